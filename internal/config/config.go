@@ -24,8 +24,11 @@ type ServerConfig struct {
 }
 
 type StorageConfig struct {
-	Type           string `yaml:"type"`
-	Path           string `yaml:"path"`
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	// DSN is the connection string of the PostgreSQL database. If it is
+	// empty, the PG* environment variables are used.
+	DSN            string `yaml:"dsn"`
 	RetentionDays  int    `yaml:"retention_days"`
 	MaxConnections int    `yaml:"max_connections"`
 }
@@ -37,6 +40,17 @@ type IngestionConfig struct {
 	HTTPEnabled   bool          `yaml:"http_enabled"`
 	BatchSize     int           `yaml:"batch_size"`
 	FlushInterval time.Duration `yaml:"flush_interval"`
+	QueueSize     int           `yaml:"queue_size"`
+	Spool         SpoolConfig   `yaml:"spool"`
+}
+
+// SpoolConfig configures the on-disk spool that accepted telemetry is
+// written to before it is stored
+type SpoolConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Path          string `yaml:"path"`
+	MaxSizeMB     int    `yaml:"max_size_mb"`
+	SegmentSizeMB int    `yaml:"segment_size_mb"`
 }
 
 type WebConfig struct {
@@ -137,6 +151,18 @@ func (c *Config) setDefaults() {
 	if c.Ingestion.FlushInterval == 0 {
 		c.Ingestion.FlushInterval = 5 * time.Second
 	}
+	if c.Ingestion.QueueSize == 0 {
+		c.Ingestion.QueueSize = 10 * c.Ingestion.BatchSize
+	}
+	if c.Ingestion.Spool.Path == "" {
+		c.Ingestion.Spool.Path = "./data/spool"
+	}
+	if c.Ingestion.Spool.MaxSizeMB == 0 {
+		c.Ingestion.Spool.MaxSizeMB = 512
+	}
+	if c.Ingestion.Spool.SegmentSizeMB == 0 {
+		c.Ingestion.Spool.SegmentSizeMB = 16
+	}
 
 	if c.Web.Title == "" {
 		c.Web.Title = "Open-Telemorph-Prime"
@@ -174,6 +200,13 @@ func DefaultConfig() *Config {
 			HTTPEnabled:   true,
 			BatchSize:     1000,
 			FlushInterval: 5 * time.Second,
+			QueueSize:     10000,
+			Spool: SpoolConfig{
+				Enabled:       false,
+				Path:          "./data/spool",
+				MaxSizeMB:     512,
+				SegmentSizeMB: 16,
+			},
 		},
 		Web: WebConfig{
 			Enabled: true,
@@ -1,39 +1,53 @@
 package dogfood
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+	"crypto/rand"
 	"log"
-	"net/http"
+	"os"
 	"runtime"
 	"time"
 
 	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/otlp"
 	"open-telemorph-prime/internal/storage"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+const (
+	serviceName    = "open-telemorph-prime"
+	serviceVersion = "0.2.1"
 )
 
+// scope identifies the instrumentation producing the dogfood telemetry
+var scope = &commonpb.InstrumentationScope{Name: serviceName, Version: serviceVersion}
+
 type Service struct {
-	config     config.WebConfig
-	storage    storage.Storage
-	client     *http.Client
-	enabled    bool
-	serverPort int
-	ctx        context.Context
-	cancel     context.CancelFunc
+	config  config.WebConfig
+	storage storage.Storage
+	writer  *otlp.Writer
+	enabled bool
+	ctx     context.Context
+	cancel  context.CancelFunc
 }
 
-func NewService(config config.WebConfig, storage storage.Storage, serverPort int) *Service {
+func NewService(config config.WebConfig, storage storage.Storage) *Service {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Service{
-		config:     config,
-		storage:    storage,
-		client:     &http.Client{Timeout: 5 * time.Second},
-		enabled:    config.Dogfood,
-		serverPort: serverPort,
-		ctx:        ctx,
-		cancel:     cancel,
+		config:  config,
+		storage: storage,
+		writer:  otlp.NewWriter(storage),
+		enabled: config.Dogfood,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
@@ -78,216 +92,126 @@ func (s *Service) collectAndSendTelemetry() {
 
 	log.Println("Dogfood: Collecting telemetry data...")
 
-	// Collect metrics
-	metrics := s.collectMetrics()
-	traces := s.collectTraces()
-	logs := s.collectLogs()
-
-	// Send to internal endpoints
-	s.sendMetrics(metrics)
-	s.sendTraces(traces)
-	s.sendLogs(logs)
+	// Store through the same translation as the OTLP receivers
+	if _, err := s.writer.WriteMetrics(s.collectMetrics()); err != nil {
+		log.Printf("Failed to store dogfood metrics: %v", err)
+	}
+	if _, err := s.writer.WriteTraces(s.collectTraces()); err != nil {
+		log.Printf("Failed to store dogfood traces: %v", err)
+	}
+	if _, err := s.writer.WriteLogs(s.collectLogs()); err != nil {
+		log.Printf("Failed to store dogfood logs: %v", err)
+	}
 
 	log.Println("Dogfood: Telemetry collection completed")
 }
 
-func (s *Service) collectMetrics() []map[string]interface{} {
+// resource describes this instance as the source of its own telemetry
+func resource() *resourcepb.Resource {
+	attrs := []*commonpb.KeyValue{
+		stringAttribute("service.name", serviceName),
+		stringAttribute("service.version", serviceVersion),
+		stringAttribute("service.instance.id", "telemorph-1"),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attrs = append(attrs, stringAttribute("host.name", hostname))
+	}
+	return &resourcepb.Resource{Attributes: attrs}
+}
+
+func (s *Service) collectMetrics() *colmetricspb.ExportMetricsServiceRequest {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	now := time.Now()
-	serviceName := "open-telemorph-prime"
-
-	metrics := []map[string]interface{}{
-		{
-			"resource": map[string]interface{}{
-				"attributes": []map[string]interface{}{
-					{"key": "service.name", "value": map[string]interface{}{"stringValue": serviceName}},
-					{"key": "service.version", "value": map[string]interface{}{"stringValue": "0.2.1"}},
-					{"key": "service.instance.id", "value": map[string]interface{}{"stringValue": "telemorph-1"}},
-				},
-			},
-			"scopeMetrics": []map[string]interface{}{
-				{
-					"scope": map[string]interface{}{
-						"name":    "open-telemorph-prime",
-						"version": "0.2.1",
-					},
-					"metrics": []map[string]interface{}{
-						{
-							"name": "memory.usage",
-							"data": map[string]interface{}{
-								"gauge": map[string]interface{}{
-									"dataPoints": []map[string]interface{}{
-										{
-											"timeUnixNano": fmt.Sprintf("%d", now.UnixNano()),
-											"asDouble":     float64(m.Alloc),
-										},
-									},
-								},
-							},
-						},
-						{
-							"name": "memory.heap.size",
-							"data": map[string]interface{}{
-								"gauge": map[string]interface{}{
-									"dataPoints": []map[string]interface{}{
-										{
-											"timeUnixNano": fmt.Sprintf("%d", now.UnixNano()),
-											"asDouble":     float64(m.HeapSys),
-										},
-									},
-								},
-							},
-						},
-						{
-							"name": "gc.collections",
-							"data": map[string]interface{}{
-								"sum": map[string]interface{}{
-									"dataPoints": []map[string]interface{}{
-										{
-											"timeUnixNano": fmt.Sprintf("%d", now.UnixNano()),
-											"asDouble":     float64(m.NumGC),
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+	now := uint64(time.Now().UnixNano())
+	gauge := func(name string, value float64) *metricspb.Metric {
+		return &metricspb.Metric{
+			Name: name,
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{{
+					TimeUnixNano: now,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				}},
+			}},
+		}
 	}
 
-	return metrics
-}
-
-func (s *Service) collectTraces() []map[string]interface{} {
-	now := time.Now()
-	serviceName := "open-telemorph-prime"
-	traceID := fmt.Sprintf("%016x", now.UnixNano())
-	spanID := fmt.Sprintf("%016x", now.UnixNano()+1)
-
-	traces := []map[string]interface{}{
-		{
-			"resource": map[string]interface{}{
-				"attributes": []map[string]interface{}{
-					{"key": "service.name", "value": map[string]interface{}{"stringValue": serviceName}},
-					{"key": "service.version", "value": map[string]interface{}{"stringValue": "0.2.1"}},
-				},
-			},
-			"scopeSpans": []map[string]interface{}{
-				{
-					"scope": map[string]interface{}{
-						"name":    "open-telemorph-prime",
-						"version": "0.2.1",
-					},
-					"spans": []map[string]interface{}{
-						{
-							"traceId":           traceID,
-							"spanId":            spanID,
-							"name":              "self-monitoring.collect",
-							"kind":              1, // INTERNAL
-							"startTimeUnixNano": fmt.Sprintf("%d", now.UnixNano()),
-							"endTimeUnixNano":   fmt.Sprintf("%d", now.Add(10*time.Millisecond).UnixNano()),
-							"status": map[string]interface{}{
-								"code": "STATUS_CODE_OK",
-							},
-							"attributes": []map[string]interface{}{
-								{"key": "component", "value": map[string]interface{}{"stringValue": "dogfood"}},
-								{"key": "operation", "value": map[string]interface{}{"stringValue": "telemetry_collection"}},
-							},
-						},
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: resource(),
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope: scope,
+				Metrics: []*metricspb.Metric{
+					gauge("memory.usage", float64(m.Alloc)),
+					gauge("memory.heap.size", float64(m.HeapSys)),
+					{
+						Name: "gc.collections",
+						Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+							AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+							IsMonotonic:            true,
+							DataPoints: []*metricspb.NumberDataPoint{{
+								TimeUnixNano: now,
+								Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: float64(m.NumGC)},
+							}},
+						}},
 					},
 				},
-			},
-		},
+			}},
+		}},
 	}
-
-	return traces
 }
 
-func (s *Service) collectLogs() []map[string]interface{} {
+func (s *Service) collectTraces() *coltracepb.ExportTraceServiceRequest {
 	now := time.Now()
-	serviceName := "open-telemorph-prime"
-
-	logs := []map[string]interface{}{
-		{
-			"resource": map[string]interface{}{
-				"attributes": []map[string]interface{}{
-					{"key": "service.name", "value": map[string]interface{}{"stringValue": serviceName}},
-					{"key": "service.version", "value": map[string]interface{}{"stringValue": "0.2.1"}},
-				},
-			},
-			"scopeLogs": []map[string]interface{}{
-				{
-					"scope": map[string]interface{}{
-						"name":    "open-telemorph-prime",
-						"version": "0.2.1",
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	rand.Read(traceID)
+	rand.Read(spanID)
+
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: resource(),
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: scope,
+				Spans: []*tracepb.Span{{
+					TraceId:           traceID,
+					SpanId:            spanID,
+					Name:              "self-monitoring.collect",
+					Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+					StartTimeUnixNano: uint64(now.UnixNano()),
+					EndTimeUnixNano:   uint64(now.Add(10 * time.Millisecond).UnixNano()),
+					Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+					Attributes: []*commonpb.KeyValue{
+						stringAttribute("component", "dogfood"),
+						stringAttribute("operation", "telemetry_collection"),
 					},
-					"logRecords": []map[string]interface{}{
-						{
-							"timeUnixNano": fmt.Sprintf("%d", now.UnixNano()),
-							"severityText": "INFO",
-							"body": map[string]interface{}{
-								"stringValue": "Dogfood telemetry collection completed",
-							},
-							"attributes": []map[string]interface{}{
-								{"key": "component", "value": map[string]interface{}{"stringValue": "dogfood"}},
-								{"key": "operation", "value": map[string]interface{}{"stringValue": "telemetry_collection"}},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	return logs
-}
-
-func (s *Service) sendMetrics(metrics []map[string]interface{}) {
-	payload := map[string]interface{}{
-		"resourceMetrics": metrics,
-	}
-
-	s.sendToEndpoint("/v1/metrics", payload)
-}
-
-func (s *Service) sendTraces(traces []map[string]interface{}) {
-	payload := map[string]interface{}{
-		"resourceSpans": traces,
+				}},
+			}},
+		}},
 	}
-
-	s.sendToEndpoint("/v1/traces", payload)
 }
 
-func (s *Service) sendLogs(logs []map[string]interface{}) {
-	payload := map[string]interface{}{
-		"resourceLogs": logs,
+func (s *Service) collectLogs() *collogspb.ExportLogsServiceRequest {
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: resource(),
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: scope,
+				LogRecords: []*logspb.LogRecord{{
+					TimeUnixNano:   uint64(time.Now().UnixNano()),
+					SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+					SeverityText:   "INFO",
+					Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Dogfood telemetry collection completed"}},
+					Attributes: []*commonpb.KeyValue{
+						stringAttribute("component", "dogfood"),
+						stringAttribute("operation", "telemetry_collection"),
+					},
+				}},
+			}},
+		}},
 	}
-
-	s.sendToEndpoint("/v1/logs", payload)
 }
 
-func (s *Service) sendToEndpoint(endpoint string, payload interface{}) {
-	// Send to the OTLP HTTP ingestion endpoint on port 4318
-	url := fmt.Sprintf("http://localhost:4318%s", endpoint)
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal dogfood payload: %v", err)
-		return
-	}
-
-	resp, err := s.client.Post(url, "application/json", bytes.NewReader(jsonData))
-	if err != nil {
-		log.Printf("Failed to send dogfood telemetry to %s: %v", endpoint, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Dogfood telemetry endpoint %s returned status %d", endpoint, resp.StatusCode)
-	}
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
 }
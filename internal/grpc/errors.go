@@ -0,0 +1,40 @@
+package grpc
+
+import (
+	"errors"
+
+	"open-telemorph-prime/internal/otlp"
+	"open-telemorph-prime/internal/storage"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// exportError converts a Writer error that applies to a whole export request
+// into the status exporters retry on: UNAVAILABLE while storage cannot be
+// written or the service is stopping, and RESOURCE_EXHAUSTED while the
+// ingestion queue is full. It returns nil for errors that only some records
+// were rejected for, which are reported as partial success.
+func exportError(writer *otlp.Writer, err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, otlp.ErrClosed):
+		code = codes.Unavailable
+	case errors.Is(err, otlp.ErrQueueFull):
+		code = codes.ResourceExhausted
+	default:
+		return nil
+	}
+
+	st := status.New(code, err.Error())
+	if delay := writer.RetryAfter(); delay > 0 {
+		if detailed, detailErr := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(delay),
+		}); detailErr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
@@ -5,7 +5,7 @@ import (
 	"log"
 	"net"
 
-	"open-telemorph-prime/internal/storage"
+	"open-telemorph-prime/internal/otlp"
 
 	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
 	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
@@ -22,7 +22,7 @@ type Server struct {
 	port           int
 }
 
-func NewServer(storage storage.Storage, port int) *Server {
+func NewServer(writer *otlp.Writer, port int) *Server {
 	// Create gRPC server with options
 	grpcServer := grpc.NewServer(
 		grpc.MaxRecvMsgSize(4*1024*1024), // 4MB max message size
@@ -30,9 +30,9 @@ func NewServer(storage storage.Storage, port int) *Server {
 	)
 
 	// Create service instances
-	traceService := NewTraceService(storage)
-	metricsService := NewMetricsService(storage)
-	logsService := NewLogsService(storage)
+	traceService := NewTraceService(writer)
+	metricsService := NewMetricsService(writer)
+	logsService := NewLogsService(writer)
 
 	// Register services with gRPC server
 	coltracepb.RegisterTraceServiceServer(grpcServer, traceService)
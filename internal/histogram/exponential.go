@@ -0,0 +1,290 @@
+package histogram
+
+import (
+	"math"
+	"sort"
+)
+
+// Exponential is an OpenTelemetry exponential histogram. Bucket boundaries
+// are powers of base = 2^(2^-scale): positive bucket i counts observations in
+// (base^i, base^(i+1)], negative bucket i counts observations in
+// [-base^(i+1), -base^i). Observations within [-ZeroThreshold, ZeroThreshold]
+// are counted in the zero bucket.
+//
+// Counts are floats so that histograms can be scaled, as rate() does.
+type Exponential struct {
+	Scale         int32   `json:"scale"`
+	ZeroThreshold float64 `json:"zero_threshold"`
+	ZeroCount     float64 `json:"zero_count"`
+	Count         float64 `json:"count"`
+	Sum           float64 `json:"sum"`
+	Positive      Buckets `json:"positive"`
+	Negative      Buckets `json:"negative"`
+}
+
+// Buckets is a dense run of bucket counts starting at bucket index Offset
+type Buckets struct {
+	Offset int32     `json:"offset"`
+	Counts []float64 `json:"counts"`
+}
+
+// Bucket is a single bucket of a histogram with its boundaries
+type Bucket struct {
+	Lower          float64
+	Upper          float64
+	LowerInclusive bool
+	UpperInclusive bool
+	Count          float64
+}
+
+// isZero reports whether the bucket is the zero bucket
+func (b Bucket) isZero() bool {
+	return b.Lower <= 0 && b.Upper >= 0
+}
+
+// valueAt returns the value at the given fraction of the way through the
+// bucket. Observations are assumed to be spread exponentially within regular
+// buckets, matching their boundaries, and linearly within the zero bucket.
+func (b Bucket) valueAt(fraction float64) float64 {
+	if b.isZero() {
+		return b.Lower + (b.Upper-b.Lower)*fraction
+	}
+	if b.Lower < 0 {
+		return -math.Abs(b.Lower) * math.Pow(math.Abs(b.Upper)/math.Abs(b.Lower), fraction)
+	}
+	return b.Lower * math.Pow(b.Upper/b.Lower, fraction)
+}
+
+// fractionBelow returns the share of the bucket's observations assumed to be
+// below v, the inverse of valueAt
+func (b Bucket) fractionBelow(v float64) float64 {
+	switch {
+	case v <= b.Lower:
+		return 0
+	case v >= b.Upper:
+		return 1
+	case b.isZero():
+		if b.Upper == b.Lower {
+			return 1
+		}
+		return (v - b.Lower) / (b.Upper - b.Lower)
+	case b.Lower < 0:
+		return math.Log(math.Abs(v)/math.Abs(b.Lower)) / math.Log(math.Abs(b.Upper)/math.Abs(b.Lower))
+	}
+	return math.Log(v/b.Lower) / math.Log(b.Upper/b.Lower)
+}
+
+// bucketBound returns the lower boundary of the positive bucket with the given
+// index at the given scale
+func bucketBound(index int32, scale int32) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(scale)))
+}
+
+// Buckets returns all non-empty buckets in ascending order of their bounds
+func (h *Exponential) Buckets() []Bucket {
+	var buckets []Bucket
+	for i := len(h.Negative.Counts) - 1; i >= 0; i-- {
+		count := h.Negative.Counts[i]
+		if count == 0 {
+			continue
+		}
+		index := h.Negative.Offset + int32(i)
+		buckets = append(buckets, Bucket{
+			Lower:          -bucketBound(index+1, h.Scale),
+			Upper:          -bucketBound(index, h.Scale),
+			LowerInclusive: true,
+			Count:          count,
+		})
+	}
+	if h.ZeroCount > 0 {
+		buckets = append(buckets, Bucket{
+			Lower:          -h.ZeroThreshold,
+			Upper:          h.ZeroThreshold,
+			LowerInclusive: true,
+			UpperInclusive: true,
+			Count:          h.ZeroCount,
+		})
+	}
+	for i, count := range h.Positive.Counts {
+		if count == 0 {
+			continue
+		}
+		index := h.Positive.Offset + int32(i)
+		buckets = append(buckets, Bucket{
+			Lower:          bucketBound(index, h.Scale),
+			Upper:          bucketBound(index+1, h.Scale),
+			UpperInclusive: true,
+			Count:          count,
+		})
+	}
+	return buckets
+}
+
+// Quantile estimates the q-quantile of the observations
+func (h *Exponential) Quantile(q float64) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	buckets := h.Buckets()
+	var total float64
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	var cumulative float64
+	for _, b := range buckets {
+		if cumulative+b.Count >= rank {
+			return b.valueAt((rank - cumulative) / b.Count)
+		}
+		cumulative += b.Count
+	}
+	return buckets[len(buckets)-1].Upper
+}
+
+// Fraction estimates the share of observations between lower and upper
+func (h *Exponential) Fraction(lower, upper float64) float64 {
+	if math.IsNaN(lower) || math.IsNaN(upper) || upper <= lower {
+		if upper == lower && !math.IsNaN(upper) {
+			return 0
+		}
+		return math.NaN()
+	}
+
+	var total, within float64
+	for _, b := range h.Buckets() {
+		total += b.Count
+		if b.Lower == b.Upper {
+			// A zero bucket without width holds observations of exactly zero
+			if lower < 0 && upper >= 0 {
+				within += b.Count
+			}
+			continue
+		}
+		within += b.Count * (b.fractionBelow(upper) - b.fractionBelow(lower))
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	return within / total
+}
+
+// Copy returns a deep copy of the histogram
+func (h *Exponential) Copy() *Exponential {
+	c := *h
+	c.Positive.Counts = append([]float64(nil), h.Positive.Counts...)
+	c.Negative.Counts = append([]float64(nil), h.Negative.Counts...)
+	return &c
+}
+
+// Mul scales all counts and the sum by factor
+func (h *Exponential) Mul(factor float64) *Exponential {
+	c := h.Copy()
+	c.ZeroCount *= factor
+	c.Count *= factor
+	c.Sum *= factor
+	for i := range c.Positive.Counts {
+		c.Positive.Counts[i] *= factor
+	}
+	for i := range c.Negative.Counts {
+		c.Negative.Counts[i] *= factor
+	}
+	return c
+}
+
+// Merge returns the combination of h and other as if all their observations
+// had been recorded in one histogram. The result uses the coarser of the two
+// scales and the wider zero bucket.
+func (h *Exponential) Merge(other *Exponential) *Exponential {
+	return combine(h, other, 1)
+}
+
+// Sub returns the observations recorded in h but not in other, which is the
+// change between two cumulative snapshots of the same histogram
+func (h *Exponential) Sub(other *Exponential) *Exponential {
+	return combine(h, other, -1)
+}
+
+// combine adds sign times the buckets of b to those of a
+func combine(a, b *Exponential, sign float64) *Exponential {
+	scale := a.Scale
+	if b.Scale < scale {
+		scale = b.Scale
+	}
+	zeroThreshold := math.Max(a.ZeroThreshold, b.ZeroThreshold)
+
+	result := &Exponential{
+		Scale:         scale,
+		ZeroThreshold: zeroThreshold,
+		ZeroCount:     a.ZeroCount + sign*b.ZeroCount,
+		Count:         a.Count + sign*b.Count,
+		Sum:           a.Sum + sign*b.Sum,
+	}
+
+	positive := map[int32]float64{}
+	negative := map[int32]float64{}
+	for _, part := range []struct {
+		h    *Exponential
+		sign float64
+	}{{a, 1}, {b, sign}} {
+		shift := part.h.Scale - scale
+		for _, spans := range []struct {
+			buckets Buckets
+			into    map[int32]float64
+		}{{part.h.Positive, positive}, {part.h.Negative, negative}} {
+			for i, count := range spans.buckets.Counts {
+				// Shifting right floors negative indexes too, so each
+				// bucket lands in the coarser bucket containing it
+				index := (spans.buckets.Offset + int32(i)) >> shift
+				spans.into[index] += part.sign * count
+			}
+		}
+	}
+
+	// Buckets that now lie entirely within the zero bucket are folded into it
+	for index, count := range positive {
+		if bucketBound(index+1, scale) <= zeroThreshold {
+			result.ZeroCount += count
+			delete(positive, index)
+		}
+	}
+	for index, count := range negative {
+		if bucketBound(index+1, scale) <= zeroThreshold {
+			result.ZeroCount += count
+			delete(negative, index)
+		}
+	}
+
+	result.Positive = denseBuckets(positive)
+	result.Negative = denseBuckets(negative)
+	return result
+}
+
+// denseBuckets converts sparse bucket counts into a dense run
+func denseBuckets(sparse map[int32]float64) Buckets {
+	if len(sparse) == 0 {
+		return Buckets{}
+	}
+
+	indexes := make([]int32, 0, len(sparse))
+	for index := range sparse {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	offset := indexes[0]
+	counts := make([]float64, indexes[len(indexes)-1]-offset+1)
+	for index, count := range sparse {
+		counts[index-offset] = count
+	}
+	return Buckets{Offset: offset, Counts: counts}
+}
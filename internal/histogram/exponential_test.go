@@ -0,0 +1,192 @@
+package histogram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// approxEqual reports whether two estimates agree up to rounding, treating
+// NaNs as equal
+func approxEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return a == b || math.Abs(a-b) < 1e-12
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *Exponential
+		want *Exponential
+	}{
+		{
+			name: "same scale",
+			a:    &Exponential{Count: 3, Sum: 4, Positive: Buckets{Offset: 0, Counts: []float64{1, 2}}},
+			b:    &Exponential{Count: 7, Sum: 20, Positive: Buckets{Offset: 1, Counts: []float64{3, 4}}},
+			want: &Exponential{Count: 10, Sum: 24, Positive: Buckets{Offset: 0, Counts: []float64{1, 5, 4}}},
+		},
+		{
+			// Pairs of buckets at scale 1 make up one bucket at scale 0
+			name: "scale reduction",
+			a:    &Exponential{Scale: 1, Count: 4, Positive: Buckets{Offset: 0, Counts: []float64{1, 1, 1, 1}}},
+			b:    &Exponential{Scale: 0, Count: 1, Positive: Buckets{Offset: 0, Counts: []float64{1}}},
+			want: &Exponential{Scale: 0, Count: 5, Positive: Buckets{Offset: 0, Counts: []float64{3, 2}}},
+		},
+		{
+			// Bucket -3 at scale 1, (2^-1.5, 2^-1], lies within bucket -2
+			// at scale 0, (2^-2, 2^-1]
+			name: "scale reduction of negative indexes",
+			a:    &Exponential{Scale: 1, Count: 3, Positive: Buckets{Offset: -3, Counts: []float64{1, 1, 1}}},
+			b:    &Exponential{Scale: 0},
+			want: &Exponential{Scale: 0, Count: 3, Positive: Buckets{Offset: -2, Counts: []float64{1, 2}}},
+		},
+		{
+			name: "negative buckets",
+			a:    &Exponential{Scale: 2, Count: 2, Negative: Buckets{Offset: 4, Counts: []float64{1, 1}}},
+			b:    &Exponential{Scale: 1, Count: 1, Negative: Buckets{Offset: 2, Counts: []float64{1}}},
+			want: &Exponential{Scale: 1, Count: 3, Negative: Buckets{Offset: 2, Counts: []float64{3}}},
+		},
+		{
+			// Buckets with an upper bound within the wider zero threshold
+			// are counted in the zero bucket; (0.5, 1] straddles it and
+			// is kept
+			name: "zero threshold folding",
+			a: &Exponential{
+				Count:    4,
+				Positive: Buckets{Offset: -2, Counts: []float64{1, 1, 1}},
+				Negative: Buckets{Offset: -2, Counts: []float64{1}},
+			},
+			b: &Exponential{ZeroThreshold: 0.7, ZeroCount: 2, Count: 2},
+			want: &Exponential{
+				ZeroThreshold: 0.7,
+				ZeroCount:     4,
+				Count:         6,
+				Positive:      Buckets{Offset: -1, Counts: []float64{1, 1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Merge(tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("a.Merge(b) = %+v, want %+v", got, tt.want)
+			}
+			if got := tt.b.Merge(tt.a); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("b.Merge(a) = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSub(t *testing.T) {
+	// A later snapshot of a histogram whose scale was reduced after the
+	// earlier one
+	earlier := &Exponential{
+		Scale:     1,
+		ZeroCount: 1,
+		Count:     3,
+		Sum:       5,
+		Positive:  Buckets{Offset: 0, Counts: []float64{1, 1}},
+	}
+	later := &Exponential{
+		Scale:     0,
+		ZeroCount: 1,
+		Count:     9,
+		Sum:       20,
+		Positive:  Buckets{Offset: 0, Counts: []float64{3, 5}},
+	}
+	want := &Exponential{
+		Scale:    0,
+		Count:    6,
+		Sum:      15,
+		Positive: Buckets{Offset: 0, Counts: []float64{1, 5}},
+	}
+	if got := later.Sub(earlier); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sub = %+v, want %+v", got, want)
+	}
+
+	// Adding the difference to the earlier snapshot restores the later one
+	if got := earlier.Merge(want); !reflect.DeepEqual(got, later) {
+		t.Errorf("Merge(Sub) = %+v, want %+v", got, later)
+	}
+}
+
+// testHistogram has two observations in each of [-2, -1), the zero bucket
+// [-0.5, 0.5], (1, 2] and (2, 4]
+var testHistogram = &Exponential{
+	ZeroThreshold: 0.5,
+	ZeroCount:     2,
+	Count:         8,
+	Positive:      Buckets{Offset: 0, Counts: []float64{2, 2}},
+	Negative:      Buckets{Offset: 0, Counts: []float64{2}},
+}
+
+func TestQuantile(t *testing.T) {
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, -2},
+		// Within regular buckets observations are spread exponentially
+		{0.125, -math.Sqrt2},
+		{0.25, -1},
+		// Within the zero bucket they are spread linearly
+		{0.3125, -0.25},
+		{0.375, 0},
+		{0.5, 0.5},
+		{0.625, math.Sqrt2},
+		{0.875, 2 * math.Sqrt2},
+		{1, 4},
+		{-0.1, math.Inf(-1)},
+		{1.1, math.Inf(1)},
+		{math.NaN(), math.NaN()},
+	}
+	for _, tt := range tests {
+		if got := testHistogram.Quantile(tt.q); !approxEqual(got, tt.want) {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	if got := (&Exponential{}).Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile of an empty histogram = %v, want NaN", got)
+	}
+}
+
+func TestFraction(t *testing.T) {
+	tests := []struct {
+		lower, upper float64
+		want         float64
+	}{
+		{math.Inf(-1), math.Inf(1), 1},
+		{0, 4, 5.0 / 8},
+		{1, math.Sqrt2, 1.0 / 8},
+		{-1.5, -1, 2 * (1 - math.Log(0.75)/math.Log(0.5)) / 8},
+		{-0.25, 0.25, 1.0 / 8},
+		{4, 8, 0},
+		{2, 2, 0},
+		{3, 2, math.NaN()},
+		{math.NaN(), 1, math.NaN()},
+	}
+	for _, tt := range tests {
+		if got := testHistogram.Fraction(tt.lower, tt.upper); !approxEqual(got, tt.want) {
+			t.Errorf("Fraction(%v, %v) = %v, want %v", tt.lower, tt.upper, got, tt.want)
+		}
+	}
+
+	// A zero bucket without width holds observations of exactly zero
+	h := &Exponential{ZeroCount: 1, Count: 2, Positive: Buckets{Offset: 0, Counts: []float64{1}}}
+	for _, tt := range []struct {
+		lower, upper float64
+		want         float64
+	}{
+		{-1, 0, 0.5},
+		{0, 2, 0.5},
+		{-1, 2, 1},
+	} {
+		if got := h.Fraction(tt.lower, tt.upper); !approxEqual(got, tt.want) {
+			t.Errorf("Fraction(%v, %v) with a zero-width zero bucket = %v, want %v", tt.lower, tt.upper, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ingestion
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+
+	// maxRequestBodySize limits the decompressed size of an export request,
+	// matching the maximum message size of the gRPC receiver
+	maxRequestBodySize = 4 * 1024 * 1024
+)
+
+// idFields are the OTLP/JSON fields holding trace and span IDs. OTLP/JSON
+// encodes them as hex strings rather than the base64 protojson expects.
+var idFields = map[string]bool{
+	"traceId":        true,
+	"spanId":         true,
+	"parentSpanId":   true,
+	"trace_id":       true,
+	"span_id":        true,
+	"parent_span_id": true,
+}
+
+// decodeRequest decodes an OTLP/HTTP export request body into msg according
+// to its Content-Type and Content-Encoding. It returns the content type
+// responses must be encoded in, and false if an error response was written.
+func decodeRequest(c *gin.Context, msg proto.Message) (string, bool) {
+	format := contentTypeJSON
+	mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch {
+	case err != nil:
+		writeError(c, format, http.StatusUnsupportedMediaType, codes.InvalidArgument, "invalid Content-Type header")
+		return "", false
+	case mediaType == contentTypeProtobuf:
+		format = contentTypeProtobuf
+	case mediaType != contentTypeJSON:
+		writeError(c, format, http.StatusUnsupportedMediaType, codes.InvalidArgument,
+			fmt.Sprintf("unsupported content type %q, expected %s or %s", mediaType, contentTypeProtobuf, contentTypeJSON))
+		return "", false
+	}
+
+	body, code, err := readBody(c.Request)
+	if err != nil {
+		writeError(c, format, code, codes.InvalidArgument, err.Error())
+		return "", false
+	}
+
+	if format == contentTypeProtobuf {
+		err = proto.Unmarshal(body, msg)
+	} else {
+		err = unmarshalJSON(body, msg)
+	}
+	if err != nil {
+		writeError(c, format, http.StatusBadRequest, codes.InvalidArgument, fmt.Sprintf("failed to decode request: %v", err))
+		return "", false
+	}
+	return format, true
+}
+
+// readBody reads the decompressed request body. On failure it also returns
+// the HTTP status code to respond with.
+func readBody(r *http.Request) ([]byte, int, error) {
+	var reader io.Reader = r.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxRequestBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(body) > maxRequestBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxRequestBodySize)
+	}
+	return body, 0, nil
+}
+
+// unmarshalJSON decodes an OTLP/JSON message. Hex trace and span IDs are
+// converted to base64 first, and unknown fields are ignored as the
+// specification requires.
+func unmarshalJSON(data []byte, msg proto.Message) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+	if err := convertIDs(doc); err != nil {
+		return err
+	}
+
+	converted, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(converted, msg)
+}
+
+// convertIDs rewrites hex-encoded ID fields anywhere in a decoded JSON
+// document to base64
+func convertIDs(doc interface{}) error {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if id, ok := value.(string); ok && idFields[key] {
+				raw, err := hex.DecodeString(id)
+				if err != nil {
+					return fmt.Errorf("invalid %s %q: must be hex encoded", key, id)
+				}
+				v[key] = base64.StdEncoding.EncodeToString(raw)
+				continue
+			}
+			if err := convertIDs(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := convertIDs(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeResponse encodes msg in the given content type
+func writeResponse(c *gin.Context, format string, code int, msg proto.Message) {
+	var data []byte
+	var err error
+	if format == contentTypeProtobuf {
+		data, err = proto.Marshal(msg)
+	} else {
+		data, err = protojson.Marshal(msg)
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to encode response: %v", err)
+		return
+	}
+	c.Data(code, format, data)
+}
+
+// writeError responds with a google.rpc.Status message, as OTLP/HTTP
+// requires for failed requests
+func writeError(c *gin.Context, format string, httpCode int, code codes.Code, message string) {
+	writeResponse(c, format, httpCode, status.New(code, message).Proto())
+}
+
+// writeStatus responds with the HTTP equivalent of a gRPC status error. The
+// retry delay of retryable errors is sent as Retry-After.
+func writeStatus(c *gin.Context, format string, err error) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := math.Ceil(info.GetRetryDelay().AsDuration().Seconds())
+			c.Header("Retry-After", strconv.Itoa(int(math.Max(seconds, 1))))
+		}
+	}
+
+	httpCode := http.StatusInternalServerError
+	switch st.Code() {
+	case codes.InvalidArgument:
+		httpCode = http.StatusBadRequest
+	case codes.ResourceExhausted:
+		httpCode = http.StatusTooManyRequests
+	case codes.Unavailable:
+		httpCode = http.StatusServiceUnavailable
+	}
+	writeResponse(c, format, httpCode, st.Proto())
+}
@@ -0,0 +1,320 @@
+package ingestion
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testTraceID = "5b8efff798038103d269b633813fc60c"
+	testSpanID  = "eee19b7ec3c1b174"
+)
+
+// newTestService returns an ingestion service over an in-memory storage and
+// a router serving its OTLP/HTTP endpoints
+func newTestService(t *testing.T, cfg config.IngestionConfig) (*Service, storage.Storage, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30})
+	t.Cleanup(func() { store.Close() })
+
+	service, err := NewService(store, cfg)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	router := gin.New()
+	router.POST("/v1/traces", service.HandleTraces)
+	return service, store, router
+}
+
+// post sends an export request to the router
+func post(router *gin.Engine, path, contentType, contentEncoding string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// traceRequest returns an encoded export request holding one span
+func traceRequest(t *testing.T) []byte {
+	t.Helper()
+	traceID, spanID := make([]byte, 16), make([]byte, 8)
+	for i := range traceID {
+		traceID[i] = byte(i + 1)
+	}
+	for i := range spanID {
+		spanID[i] = byte(i + 1)
+	}
+	body, err := proto.Marshal(&coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+				Key:   "service.name",
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "checkout"}},
+			}}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{
+					TraceId:           traceID,
+					SpanId:            spanID,
+					Name:              "GET /",
+					StartTimeUnixNano: uint64(time.Now().UnixNano()),
+					EndTimeUnixNano:   uint64(time.Now().Add(time.Millisecond).UnixNano()),
+				}},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// storedTraces stops the service, which stores the queued records, and
+// returns the stored spans
+func storedTraces(t *testing.T, service *Service, store storage.Storage) []*storage.Trace {
+	t.Helper()
+	if err := service.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	traces, err := store.GetTraces(10, 0)
+	if err != nil {
+		t.Fatalf("GetTraces: %v", err)
+	}
+	return traces
+}
+
+// decodeStatus decodes a google.rpc.Status error response
+func decodeStatus(t *testing.T, w *httptest.ResponseRecorder) *spb.Status {
+	t.Helper()
+	st := &spb.Status{}
+	var err error
+	if w.Header().Get("Content-Type") == contentTypeProtobuf {
+		err = proto.Unmarshal(w.Body.Bytes(), st)
+	} else {
+		err = protojson.Unmarshal(w.Body.Bytes(), st)
+	}
+	if err != nil {
+		t.Fatalf("response %q is not a google.rpc.Status: %v", w.Body.String(), err)
+	}
+	return st
+}
+
+func TestContentEncodings(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+	zstded := func(data []byte) []byte {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil)
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		compress func([]byte) []byte
+	}{
+		{"", func(data []byte) []byte { return data }},
+		{"identity", func(data []byte) []byte { return data }},
+		{"gzip", gzipped},
+		{"GZIP", gzipped},
+		{"zstd", zstded},
+	} {
+		t.Run(tt.encoding, func(t *testing.T) {
+			service, store, router := newTestService(t, config.DefaultConfig().Ingestion)
+			w := post(router, "/v1/traces", contentTypeProtobuf, tt.encoding, tt.compress(traceRequest(t)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("POST = %d %q, want 200", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != contentTypeProtobuf {
+				t.Errorf("response Content-Type = %q, want %s", ct, contentTypeProtobuf)
+			}
+			traces := storedTraces(t, service, store)
+			if len(traces) != 1 || traces[0].TraceID != "0102030405060708090a0b0c0d0e0f10" {
+				t.Errorf("stored %+v, want the exported span", traces)
+			}
+		})
+	}
+}
+
+func TestJSONIDs(t *testing.T) {
+	service, store, router := newTestService(t, config.DefaultConfig().Ingestion)
+	start := strconv.FormatInt(time.Now().UnixNano(), 10)
+	body := `{"resourceSpans": [{"scopeSpans": [{"spans": [{
+		"traceId": "` + testTraceID + `",
+		"spanId": "` + testSpanID + `",
+		"parentSpanId": "0af7651916cd43dd",
+		"name": "GET /",
+		"startTimeUnixNano": "` + start + `",
+		"endTimeUnixNano": "` + start + `",
+		"unknownField": true
+	}]}]}]}`
+	w := post(router, "/v1/traces", "application/json; charset=utf-8", "", []byte(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %q, want 200", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != contentTypeJSON {
+		t.Errorf("response Content-Type = %q, want %s", ct, contentTypeJSON)
+	}
+
+	traces := storedTraces(t, service, store)
+	if len(traces) != 1 {
+		t.Fatalf("stored %d spans, want 1", len(traces))
+	}
+	if got := traces[0]; got.TraceID != testTraceID || got.SpanID != testSpanID || got.ParentSpanID == nil || *got.ParentSpanID != "0af7651916cd43dd" {
+		t.Errorf("stored IDs %s, %s, %v, want the hex IDs of the request", got.TraceID, got.SpanID, got.ParentSpanID)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	var oversized bytes.Buffer
+	gz := gzip.NewWriter(&oversized)
+	gz.Write(make([]byte, maxRequestBodySize+1))
+	gz.Close()
+
+	tests := []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		code            int
+		message         string
+	}{
+		{
+			name:    "missing content type",
+			body:    []byte("{}"),
+			code:    http.StatusUnsupportedMediaType,
+			message: "invalid Content-Type header",
+		},
+		{
+			name:        "unknown content type",
+			contentType: "text/plain",
+			body:        []byte("{}"),
+			code:        http.StatusUnsupportedMediaType,
+			message:     `unsupported content type "text/plain"`,
+		},
+		{
+			name:            "unknown content encoding",
+			contentType:     contentTypeJSON,
+			contentEncoding: "br",
+			body:            []byte("{}"),
+			code:            http.StatusUnsupportedMediaType,
+			message:         `unsupported content encoding "br"`,
+		},
+		{
+			name:            "invalid gzip body",
+			contentType:     contentTypeProtobuf,
+			contentEncoding: "gzip",
+			body:            []byte("not gzip"),
+			code:            http.StatusBadRequest,
+			message:         "invalid gzip body",
+		},
+		{
+			// The limit applies to the decompressed body
+			name:            "body over the size limit",
+			contentType:     contentTypeProtobuf,
+			contentEncoding: "gzip",
+			body:            oversized.Bytes(),
+			code:            http.StatusRequestEntityTooLarge,
+			message:         "request body exceeds 4194304 bytes",
+		},
+		{
+			name:        "invalid protobuf",
+			contentType: contentTypeProtobuf,
+			body:        []byte{0xff, 0xff, 0xff},
+			code:        http.StatusBadRequest,
+			message:     "failed to decode request",
+		},
+		{
+			name:        "invalid hex ID",
+			contentType: contentTypeJSON,
+			body:        []byte(`{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "not hex"}]}]}]}`),
+			code:        http.StatusBadRequest,
+			message:     `failed to decode request: invalid traceId "not hex": must be hex encoded`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, router := newTestService(t, config.DefaultConfig().Ingestion)
+			w := post(router, "/v1/traces", tt.contentType, tt.contentEncoding, tt.body)
+			if w.Code != tt.code {
+				t.Errorf("POST = %d, want %d", w.Code, tt.code)
+			}
+			st := decodeStatus(t, w)
+			if codes.Code(st.Code) != codes.InvalidArgument || !strings.HasPrefix(st.Message, tt.message) {
+				t.Errorf("status %v %q, want InvalidArgument %q", codes.Code(st.Code), st.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	// The queue holds a single span and is flushed once an hour, so the
+	// second request finds it full
+	cfg := config.DefaultConfig().Ingestion
+	cfg.QueueSize = 1
+	cfg.FlushInterval = time.Hour
+	service, _, router := newTestService(t, cfg)
+
+	if w := post(router, "/v1/traces", contentTypeProtobuf, "", traceRequest(t)); w.Code != http.StatusOK {
+		t.Fatalf("first POST = %d %q, want 200", w.Code, w.Body.String())
+	}
+
+	w := post(router, "/v1/traces", contentTypeProtobuf, "", traceRequest(t))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("POST to a full queue = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", got)
+	}
+	if st := decodeStatus(t, w); codes.Code(st.Code) != codes.ResourceExhausted {
+		t.Errorf("status %v, want ResourceExhausted", codes.Code(st.Code))
+	}
+
+	if err := service.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	w = post(router, "/v1/traces", contentTypeProtobuf, "", traceRequest(t))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST after Stop = %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", got)
+	}
+	if st := decodeStatus(t, w); codes.Code(st.Code) != codes.Unavailable {
+		t.Errorf("status %v, want Unavailable", codes.Code(st.Code))
+	}
+}
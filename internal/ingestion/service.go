@@ -2,31 +2,58 @@ package ingestion
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
 	"open-telemorph-prime/internal/config"
 	otlpgrpc "open-telemorph-prime/internal/grpc"
+	"open-telemorph-prime/internal/otlp"
+	"open-telemorph-prime/internal/spool"
 	"open-telemorph-prime/internal/storage"
 
 	"github.com/gin-gonic/gin"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 )
 
 type Service struct {
-	storage    storage.Storage
-	config     config.IngestionConfig
-	httpServer *http.Server
-	grpcServer *otlpgrpc.Server
+	storage        storage.Storage
+	config         config.IngestionConfig
+	httpServer     *http.Server
+	grpcServer     *otlpgrpc.Server
+	writer         *otlp.Writer
+	traceService   *otlpgrpc.TraceService
+	metricsService *otlpgrpc.MetricsService
+	logsService    *otlpgrpc.LogsService
 }
 
-func NewService(storage storage.Storage, config config.IngestionConfig) *Service {
-	return &Service{
-		storage: storage,
-		config:  config,
+func NewService(storage storage.Storage, config config.IngestionConfig) (*Service, error) {
+	// Both receivers share one pipeline, which batches writes to storage or
+	// spools them on disk first
+	var writer *otlp.Writer
+	if config.Spool.Enabled {
+		sp, err := spool.Open(config.Spool.Path, int64(config.Spool.MaxSizeMB)<<20, int64(config.Spool.SegmentSizeMB)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
+		if stats := sp.Stats(); stats.PendingBytes > 0 {
+			log.Printf("Replaying %d bytes of spooled telemetry", stats.PendingBytes)
+		}
+		writer = otlp.NewSpoolWriter(storage, config, sp)
+	} else {
+		writer = otlp.NewBatchWriter(storage, config)
 	}
+
+	return &Service{
+		storage:        storage,
+		config:         config,
+		writer:         writer,
+		traceService:   otlpgrpc.NewTraceService(writer),
+		metricsService: otlpgrpc.NewMetricsService(writer),
+		logsService:    otlpgrpc.NewLogsService(writer),
+	}, nil
 }
 
 func (s *Service) Start() error {
@@ -77,7 +104,7 @@ func (s *Service) startHTTPServer() {
 
 func (s *Service) startGRPCServer() {
 	// Create our custom gRPC server with all OTLP services registered
-	s.grpcServer = otlpgrpc.NewServer(s.storage, s.config.GRPCPort)
+	s.grpcServer = otlpgrpc.NewServer(s.writer, s.config.GRPCPort)
 
 	// Start the server
 	if err := s.grpcServer.Start(); err != nil {
@@ -100,282 +127,68 @@ func (s *Service) Stop(ctx context.Context) error {
 		s.grpcServer.Stop()
 	}
 
+	// Store the telemetry that was accepted but not yet written
+	if err := s.writer.Close(ctx); err != nil {
+		return fmt.Errorf("failed to drain ingestion queues: %w", err)
+	}
+
 	return nil
 }
 
-// HTTP handlers for OTLP endpoints
-func (s *Service) HandleTraces(c *gin.Context) {
-	var req struct {
-		ResourceSpans []struct {
-			Resource struct {
-				Attributes []struct {
-					Key   string `json:"key"`
-					Value struct {
-						StringValue string `json:"stringValue"`
-					} `json:"value"`
-				} `json:"attributes"`
-			} `json:"resource"`
-			ScopeSpans []struct {
-				Spans []struct {
-					TraceId           string `json:"traceId"`
-					SpanId            string `json:"spanId"`
-					ParentSpanId      string `json:"parentSpanId"`
-					Name              string `json:"name"`
-					StartTimeUnixNano string `json:"startTimeUnixNano"`
-					EndTimeUnixNano   string `json:"endTimeUnixNano"`
-					Status            struct {
-						Code string `json:"code"`
-					} `json:"status"`
-					Attributes []struct {
-						Key   string `json:"key"`
-						Value struct {
-							StringValue string `json:"stringValue"`
-						} `json:"value"`
-					} `json:"attributes"`
-				} `json:"spans"`
-			} `json:"scopeSpans"`
-		} `json:"resourceSpans"`
+// GetSpoolStats reports the contents of the ingestion spool and how replay
+// into storage is progressing
+func (s *Service) GetSpoolStats(c *gin.Context) {
+	stats, ok := s.writer.SpoolStats()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "spool": stats})
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// HTTP handlers for OTLP endpoints. Requests are decoded into the OTLP
+// protobuf messages and stored by the same services as gRPC exports.
+func (s *Service) HandleTraces(c *gin.Context) {
+	req := &coltracepb.ExportTraceServiceRequest{}
+	format, ok := decodeRequest(c, req)
+	if !ok {
 		return
 	}
 
-	// Process traces
-	for _, resourceSpan := range req.ResourceSpans {
-		serviceName := extractServiceNameFromResource(resourceSpan.Resource)
-
-		for _, scopeSpan := range resourceSpan.ScopeSpans {
-			for _, span := range scopeSpan.Spans {
-				startTime, _ := time.Parse(time.RFC3339Nano, span.StartTimeUnixNano)
-				endTime, _ := time.Parse(time.RFC3339Nano, span.EndTimeUnixNano)
-
-				trace := &storage.Trace{
-					TraceID:       span.TraceId,
-					SpanID:        span.SpanId,
-					ServiceName:   serviceName,
-					OperationName: span.Name,
-					StartTime:     startTime,
-					DurationNanos: endTime.Sub(startTime).Nanoseconds(),
-					StatusCode:    span.Status.Code,
-					Attributes:    convertAttributesToJSON(span.Attributes),
-				}
-
-				if span.ParentSpanId != "" {
-					trace.ParentSpanID = &span.ParentSpanId
-				}
-
-				if err := s.storage.InsertTrace(trace); err != nil {
-					log.Printf("Failed to insert trace: %v", err)
-				}
-			}
-		}
+	resp, err := s.traceService.Export(c.Request.Context(), req)
+	if err != nil {
+		writeStatus(c, format, err)
+		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
+	writeResponse(c, format, http.StatusOK, resp)
 }
 
 func (s *Service) HandleMetrics(c *gin.Context) {
-	var req struct {
-		ResourceMetrics []struct {
-			Resource struct {
-				Attributes []struct {
-					Key   string `json:"key"`
-					Value struct {
-						StringValue string `json:"stringValue"`
-					} `json:"value"`
-				} `json:"attributes"`
-			} `json:"resource"`
-			ScopeMetrics []struct {
-				Metrics []struct {
-					Name string `json:"name"`
-					Data struct {
-						Gauge struct {
-							DataPoints []struct {
-								TimeUnixNano string  `json:"timeUnixNano"`
-								AsDouble     float64 `json:"asDouble"`
-								Attributes   []struct {
-									Key   string `json:"key"`
-									Value struct {
-										StringValue string `json:"stringValue"`
-									} `json:"value"`
-								} `json:"attributes"`
-							} `json:"dataPoints"`
-						} `json:"gauge"`
-						Sum struct {
-							DataPoints []struct {
-								TimeUnixNano string  `json:"timeUnixNano"`
-								AsDouble     float64 `json:"asDouble"`
-								Attributes   []struct {
-									Key   string `json:"key"`
-									Value struct {
-										StringValue string `json:"stringValue"`
-									} `json:"value"`
-								} `json:"attributes"`
-							} `json:"dataPoints"`
-						} `json:"sum"`
-					} `json:"data"`
-				} `json:"metrics"`
-			} `json:"scopeMetrics"`
-		} `json:"resourceMetrics"`
-	}
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	format, ok := decodeRequest(c, req)
+	if !ok {
 		return
 	}
 
-	// Process metrics
-	for _, resourceMetric := range req.ResourceMetrics {
-		serviceName := extractServiceNameFromResource(resourceMetric.Resource)
-
-		for _, scopeMetric := range resourceMetric.ScopeMetrics {
-			for _, metric := range scopeMetric.Metrics {
-				// Handle gauge metrics
-				for _, dataPoint := range metric.Data.Gauge.DataPoints {
-					timestamp, _ := time.Parse(time.RFC3339Nano, dataPoint.TimeUnixNano)
-					metricData := &storage.Metric{
-						MetricName:  metric.Name,
-						Value:       dataPoint.AsDouble,
-						Timestamp:   timestamp,
-						ServiceName: serviceName,
-						Labels:      convertAttributesToJSON(dataPoint.Attributes),
-					}
-
-					if err := s.storage.InsertMetric(metricData); err != nil {
-						log.Printf("Failed to insert metric: %v", err)
-					}
-				}
-
-				// Handle sum metrics
-				for _, dataPoint := range metric.Data.Sum.DataPoints {
-					timestamp, _ := time.Parse(time.RFC3339Nano, dataPoint.TimeUnixNano)
-					metricData := &storage.Metric{
-						MetricName:  metric.Name,
-						Value:       dataPoint.AsDouble,
-						Timestamp:   timestamp,
-						ServiceName: serviceName,
-						Labels:      convertAttributesToJSON(dataPoint.Attributes),
-					}
-
-					if err := s.storage.InsertMetric(metricData); err != nil {
-						log.Printf("Failed to insert metric: %v", err)
-					}
-				}
-			}
-		}
+	resp, err := s.metricsService.Export(c.Request.Context(), req)
+	if err != nil {
+		writeStatus(c, format, err)
+		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
+	writeResponse(c, format, http.StatusOK, resp)
 }
 
 func (s *Service) HandleLogs(c *gin.Context) {
-	var req struct {
-		ResourceLogs []struct {
-			Resource struct {
-				Attributes []struct {
-					Key   string `json:"key"`
-					Value struct {
-						StringValue string `json:"stringValue"`
-					} `json:"value"`
-				} `json:"attributes"`
-			} `json:"resource"`
-			ScopeLogs []struct {
-				LogRecords []struct {
-					TimeUnixNano string `json:"timeUnixNano"`
-					SeverityText string `json:"severityText"`
-					Body         struct {
-						StringValue string `json:"stringValue"`
-					} `json:"body"`
-					Attributes []struct {
-						Key   string `json:"key"`
-						Value struct {
-							StringValue string `json:"stringValue"`
-						} `json:"value"`
-					} `json:"attributes"`
-					TraceId string `json:"traceId"`
-					SpanId  string `json:"spanId"`
-				} `json:"logRecords"`
-			} `json:"scopeLogs"`
-		} `json:"resourceLogs"`
-	}
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	req := &collogspb.ExportLogsServiceRequest{}
+	format, ok := decodeRequest(c, req)
+	if !ok {
 		return
 	}
 
-	// Process logs
-	for _, resourceLog := range req.ResourceLogs {
-		serviceName := extractServiceNameFromResource(resourceLog.Resource)
-
-		for _, scopeLog := range resourceLog.ScopeLogs {
-			for _, logRecord := range scopeLog.LogRecords {
-				timestamp, _ := time.Parse(time.RFC3339Nano, logRecord.TimeUnixNano)
-
-				logData := &storage.Log{
-					Timestamp:   timestamp,
-					ServiceName: serviceName,
-					Level:       logRecord.SeverityText,
-					Message:     logRecord.Body.StringValue,
-					Attributes:  convertAttributesToJSON(logRecord.Attributes),
-				}
-
-				if logRecord.TraceId != "" {
-					logData.TraceID = &logRecord.TraceId
-				}
-				if logRecord.SpanId != "" {
-					logData.SpanID = &logRecord.SpanId
-				}
-
-				if err := s.storage.InsertLog(logData); err != nil {
-					log.Printf("Failed to insert log: %v", err)
-				}
-			}
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
-}
-
-// Helper functions
-func extractServiceNameFromResource(resource struct {
-	Attributes []struct {
-		Key   string `json:"key"`
-		Value struct {
-			StringValue string `json:"stringValue"`
-		} `json:"value"`
-	} `json:"attributes"`
-}) string {
-	for _, attr := range resource.Attributes {
-		if attr.Key == "service.name" {
-			return attr.Value.StringValue
-		}
-	}
-
-	return "unknown"
-}
-
-func convertAttributesToJSON(attributes []struct {
-	Key   string `json:"key"`
-	Value struct {
-		StringValue string `json:"stringValue"`
-	} `json:"value"`
-}) string {
-	if len(attributes) == 0 {
-		return "{}"
-	}
-
-	attrs := make(map[string]interface{})
-	for _, attr := range attributes {
-		attrs[attr.Key] = attr.Value.StringValue
-	}
-
-	jsonData, err := json.Marshal(attrs)
+	resp, err := s.logsService.Export(c.Request.Context(), req)
 	if err != nil {
-		return "{}"
+		writeStatus(c, format, err)
+		return
 	}
-
-	return string(jsonData)
+	writeResponse(c, format, http.StatusOK, resp)
 }
@@ -0,0 +1,145 @@
+package otlp
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+
+	"open-telemorph-prime/internal/storage"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// UnknownService is the service name of telemetry whose resource has no
+// service.name attribute
+const UnknownService = "unknown"
+
+// ServiceName returns the service.name attribute of a resource
+func ServiceName(resource *resourcepb.Resource) string {
+	if resource == nil {
+		return UnknownService
+	}
+
+	for _, attr := range resource.Attributes {
+		if attr.Key == "service.name" {
+			if strVal := attr.Value.GetStringValue(); strVal != "" {
+				return strVal
+			}
+		}
+	}
+
+	return UnknownService
+}
+
+// Resource converts a resource into the record stored for it
+func Resource(resource *resourcepb.Resource) *storage.Resource {
+	return storage.NewResource(attributeMap(resource.GetAttributes()))
+}
+
+// ConvertAttributes converts attributes into the JSON object stored in the
+// labels and attributes columns. Values keep their types; arrays and key-value
+// lists become JSON arrays and objects, and NaN and infinite doubles the
+// strings "NaN", "+Inf" and "-Inf".
+func ConvertAttributes(attributes []*commonpb.KeyValue) string {
+	if len(attributes) == 0 {
+		return "{}"
+	}
+
+	return marshalJSON(attributeMap(attributes), "{}")
+}
+
+// marshalJSON encodes v as JSON, falling back to def if it cannot be encoded
+func marshalJSON(v interface{}, def string) string {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to marshal %T to JSON: %v", v, err)
+		return def
+	}
+
+	return string(jsonData)
+}
+
+// attributeMap converts attributes into a map, dropping empty values
+func attributeMap(attributes []*commonpb.KeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, attr := range attributes {
+		if attr == nil {
+			continue
+		}
+
+		if value := AttributeValue(attr.Value); value != nil {
+			attrs[attr.Key] = value
+		}
+	}
+	return attrs
+}
+
+// AttributeValue converts an attribute value into its Go equivalent
+func AttributeValue(value *commonpb.AnyValue) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch v := value.Value.(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		// JSON has no NaN or infinities; they are kept in their Prometheus
+		// form rather than failing the whole attribute set
+		if math.IsNaN(v.DoubleValue) || math.IsInf(v.DoubleValue, 0) {
+			return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+		}
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return v.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		if v.ArrayValue != nil {
+			items := make([]interface{}, len(v.ArrayValue.Values))
+			for i, item := range v.ArrayValue.Values {
+				items[i] = AttributeValue(item)
+			}
+			return items
+		}
+	case *commonpb.AnyValue_KvlistValue:
+		if v.KvlistValue != nil {
+			return attributeMap(v.KvlistValue.Values)
+		}
+	}
+
+	return nil
+}
+
+// BodyString renders a log body as text. Strings are used as is, other
+// scalars in their literal form and arrays and maps as JSON.
+func BodyString(body *commonpb.AnyValue) string {
+	if body == nil {
+		return ""
+	}
+
+	switch v := body.Value.(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	}
+
+	value := AttributeValue(body)
+	if value == nil {
+		return ""
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(jsonData)
+}
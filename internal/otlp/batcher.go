@@ -0,0 +1,213 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned when a batching Writer has no room for the
+// records of an export request. Exporters should retry later.
+var ErrQueueFull = errors.New("ingestion queue is full")
+
+// ErrClosed is returned when records are written to a Writer that has been
+// closed
+var ErrClosed = errors.New("ingestion pipeline is closed")
+
+// batchQueue is a bounded queue of records of one signal. A worker goroutine
+// stores the queued records in batches, as soon as a batch fills and at
+// least once per flush interval. A batch that cannot be stored because
+// storage is unavailable stays queued and is retried on the next flush.
+type batchQueue[T any] struct {
+	name          string
+	capacity      int
+	batchSize     int
+	flushInterval time.Duration
+	store         func([]T) error
+
+	mu      sync.Mutex
+	items   []T
+	closed  bool
+	failure error // why the last batch could not be stored, nil once one is
+
+	full    chan struct{}
+	stop    chan struct{}
+	abort   chan struct{}
+	stopped chan struct{}
+}
+
+func newBatchQueue[T any](name string, capacity, batchSize int, flushInterval time.Duration, store func([]T) error) *batchQueue[T] {
+	q := &batchQueue[T]{
+		name:          name,
+		capacity:      capacity,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		store:         store,
+		full:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		abort:         make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues the records of one export request. Either all of them are
+// queued or, if they do not fit, none are. A request larger than the whole
+// queue is accepted when the queue is empty.
+func (q *batchQueue[T]) push(items []T) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if len(q.items) > 0 && len(q.items)+len(items) > q.capacity {
+		if q.failure != nil {
+			return fmt.Errorf("%w: %w", ErrQueueFull, q.failure)
+		}
+		return ErrQueueFull
+	}
+
+	q.items = append(q.items, items...)
+	if len(q.items) >= q.batchSize {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// take removes up to one batch of records from the queue. Unless all is set,
+// it only returns a batch if a full one is queued.
+func (q *batchQueue[T]) take(all bool) []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.items)
+	if n > q.batchSize {
+		n = q.batchSize
+	}
+	if n == 0 || (!all && n < q.batchSize) {
+		return nil
+	}
+
+	batch := make([]T, n)
+	copy(batch, q.items)
+	q.items = q.items[n:]
+	if len(q.items) == 0 {
+		// Release the backing array rather than keep it growing
+		q.items = nil
+	}
+	return batch
+}
+
+// requeue puts a batch that could not be stored back at the front of the
+// queue
+func (q *batchQueue[T]) requeue(batch []T, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.failure == nil {
+		log.Printf("Storage unavailable, keeping %d queued %s for retry: %v", len(q.items)+len(batch), q.name, err)
+	}
+	q.failure = err
+	q.items = append(batch, q.items...)
+}
+
+// flush stores queued records batch by batch, stopping at the first
+// partial batch unless all is set. It reports false if storage was
+// unavailable.
+func (q *batchQueue[T]) flush(all bool) bool {
+	for {
+		batch := q.take(all)
+		if batch == nil {
+			return true
+		}
+
+		if err := q.store(batch); err != nil {
+			q.requeue(batch, err)
+			return false
+		}
+
+		q.mu.Lock()
+		if q.failure != nil {
+			log.Printf("Storage available again, storing queued %s", q.name)
+			q.failure = nil
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *batchQueue[T]) run() {
+	defer close(q.stopped)
+
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.full:
+			// While storage is unavailable, retries wait for the ticker
+			q.mu.Lock()
+			failing := q.failure != nil
+			q.mu.Unlock()
+			if !failing {
+				q.flush(false)
+			}
+		case <-ticker.C:
+			q.flush(true)
+		case <-q.stop:
+			// Retry until everything is stored or the caller gives up
+			for !q.flush(true) {
+				select {
+				case <-ticker.C:
+				case <-q.abort:
+					log.Printf("Dropping %d queued %s that could not be stored", q.pending(), q.name)
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+// pending returns the number of queued records
+func (q *batchQueue[T]) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// close stops accepting records and waits until the queued ones are stored
+// or the context is done
+func (q *batchQueue[T]) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	pending := len(q.items)
+	q.mu.Unlock()
+
+	if pending > 0 {
+		log.Printf("Draining %d queued %s", pending, q.name)
+	}
+
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		close(q.abort)
+		<-q.stopped
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,217 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// switchStorage stores log records while up. It is unavailable while down
+// and for the next outages batches.
+type switchStorage struct {
+	storage.Storage
+
+	mu       sync.Mutex
+	down     bool
+	outages  int
+	attempts int      // batches of log records it was asked to store
+	messages []string // messages of the stored log records, in order
+}
+
+func newSwitchStorage(down bool) *switchStorage {
+	return &switchStorage{
+		Storage: storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30}),
+		down:    down,
+	}
+}
+
+func (s *switchStorage) InsertLogs(logs []*storage.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.down || s.outages > 0 {
+		if s.outages > 0 {
+			s.outages--
+		}
+		return fmt.Errorf("%w: database is locked", storage.ErrUnavailable)
+	}
+	for _, l := range logs {
+		s.messages = append(s.messages, l.Message)
+	}
+	return nil
+}
+
+func (s *switchStorage) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// stored returns the number of attempts to store a batch and the messages
+// stored
+func (s *switchStorage) stored() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts, append([]string(nil), s.messages...)
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// logsRequest returns an export request holding log records with the given
+// messages
+func logsRequest(messages ...string) *collogspb.ExportLogsServiceRequest {
+	ts := uint64(time.Now().UnixNano())
+	var records []*logspb.LogRecord
+	for _, message := range messages {
+		records = append(records, &logspb.LogRecord{
+			TimeUnixNano: ts,
+			Body:         &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: message}},
+		})
+	}
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{ScopeLogs: []*logspb.ScopeLogs{{LogRecords: records}}}},
+	}
+}
+
+// messages returns the messages "<prefix>0" to "<prefix>n-1"
+func messages(prefix string, n int) []string {
+	var result []string
+	for i := 0; i < n; i++ {
+		result = append(result, prefix+strconv.Itoa(i))
+	}
+	return result
+}
+
+func TestBatchWriterQueueFull(t *testing.T) {
+	store := newSwitchStorage(true)
+	w := NewBatchWriter(store, config.IngestionConfig{BatchSize: 2, QueueSize: 4, FlushInterval: time.Hour})
+
+	// A full batch is stored at once, and requeued when storage is down
+	if rejected, err := w.WriteLogs(logsRequest("a", "b")); rejected != 0 || err != nil {
+		t.Fatalf("WriteLogs = %d, %v; want 0, nil", rejected, err)
+	}
+	waitFor(t, "an attempt to store the batch", func() bool {
+		attempts, _ := store.stored()
+		return attempts > 0
+	})
+
+	if rejected, err := w.WriteLogs(logsRequest("c", "d")); rejected != 0 || err != nil {
+		t.Fatalf("WriteLogs filling the queue = %d, %v; want 0, nil", rejected, err)
+	}
+	// The request is rejected whole, with the reason the queue is not
+	// draining
+	rejected, err := w.WriteLogs(logsRequest("e", "f"))
+	if rejected != 2 || !errors.Is(err, ErrQueueFull) || !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("WriteLogs to a full queue = %d, %v; want 2, ErrQueueFull wrapping ErrUnavailable", rejected, err)
+	}
+
+	// Once storage is back, closing stores the queued records in order
+	store.setDown(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, got := store.stored(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("stored %q, want a to d", got)
+	}
+	if _, err := w.WriteLogs(logsRequest("g")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteLogs after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestBatchWriterRequeue(t *testing.T) {
+	store := newSwitchStorage(false)
+	store.outages = 1
+	w := NewBatchWriter(store, config.IngestionConfig{BatchSize: 2, QueueSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer w.Close(context.Background())
+
+	want := messages("m", 5)
+	if _, err := w.WriteLogs(logsRequest(want[:3]...)); err != nil {
+		t.Fatalf("WriteLogs: %v", err)
+	}
+	if _, err := w.WriteLogs(logsRequest(want[3:]...)); err != nil {
+		t.Fatalf("WriteLogs: %v", err)
+	}
+
+	// The batch that failed is retried by the next flush, ahead of the
+	// records queued after it
+	waitFor(t, "the queued records to be stored", func() bool {
+		_, got := store.stored()
+		return len(got) >= len(want)
+	})
+	attempts, got := store.stored()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+	if attempts < 2 {
+		t.Errorf("stored the records in %d attempts, want a retry", attempts)
+	}
+}
+
+func TestBatchWriterClose(t *testing.T) {
+	tests := []struct {
+		name          string
+		flushInterval time.Duration
+		// recoverAfter is how long storage is down after Close is called,
+		// or negative if it stays down
+		recoverAfter time.Duration
+		wantErr      error
+		wantStored   int
+	}{
+		// The partial batch is only stored by the flush on Close
+		{name: "available", flushInterval: time.Hour, wantStored: 5},
+		// Close retries once per flush interval
+		{name: "recovering", flushInterval: 10 * time.Millisecond, recoverAfter: 50 * time.Millisecond, wantStored: 5},
+		// Close gives up at its deadline, dropping the queued records
+		{name: "unavailable", flushInterval: 10 * time.Millisecond, recoverAfter: -1, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newSwitchStorage(tt.recoverAfter != 0)
+			w := NewBatchWriter(store, config.IngestionConfig{BatchSize: 100, QueueSize: 100, FlushInterval: tt.flushInterval})
+			if _, err := w.WriteLogs(logsRequest(messages("m", 5)...)); err != nil {
+				t.Fatalf("WriteLogs: %v", err)
+			}
+			if tt.recoverAfter > 0 {
+				time.AfterFunc(tt.recoverAfter, func() { store.setDown(false) })
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := w.Close(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Close = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Close took %v, past its deadline", elapsed)
+			}
+			if _, got := store.stored(); len(got) != tt.wantStored {
+				t.Errorf("stored %d records, want %d", len(got), tt.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package otlp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"open-telemorph-prime/internal/config"
+	otlpgrpc "open-telemorph-prime/internal/grpc"
+	"open-telemorph-prime/internal/ingestion"
+	"open-telemorph-prime/internal/otlp"
+	"open-telemorph-prime/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// recorder is a storage that keeps the records it is asked to insert
+type recorder struct {
+	storage.Storage
+
+	mu         sync.Mutex
+	traces     []*storage.Trace
+	metrics    []*storage.Metric
+	histograms []*storage.ExponentialHistogram
+	logs       []*storage.Log
+}
+
+func newRecorder() *recorder {
+	return &recorder{Storage: storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30})}
+}
+
+func (r *recorder) InsertTraces(traces []*storage.Trace) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, trace := range traces {
+		copied := *trace
+		copied.StartTime = copied.StartTime.UTC()
+		r.traces = append(r.traces, &copied)
+	}
+	return nil
+}
+
+func (r *recorder) InsertMetrics(metrics []*storage.Metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, metric := range metrics {
+		copied := *metric
+		copied.Timestamp = copied.Timestamp.UTC()
+		r.metrics = append(r.metrics, &copied)
+	}
+	return nil
+}
+
+func (r *recorder) InsertExponentialHistograms(histograms []*storage.ExponentialHistogram) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range histograms {
+		copied := *h
+		copied.Timestamp = copied.Timestamp.UTC()
+		r.histograms = append(r.histograms, &copied)
+	}
+	return nil
+}
+
+func (r *recorder) InsertLogs(logs []*storage.Log) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range logs {
+		copied := *l
+		copied.Timestamp = copied.Timestamp.UTC()
+		copied.ObservedTimestamp = copied.ObservedTimestamp.UTC()
+		r.logs = append(r.logs, &copied)
+	}
+	return nil
+}
+
+// records renders the recorded records as indented JSON, with times in UTC
+// so that golden files do not depend on the local time zone
+func (r *recorder) records(t *testing.T) []byte {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(struct {
+		Traces     []*storage.Trace                `json:"traces,omitempty"`
+		Metrics    []*storage.Metric               `json:"metrics,omitempty"`
+		Histograms []*storage.ExponentialHistogram `json:"histograms,omitempty"`
+		Logs       []*storage.Log                  `json:"logs,omitempty"`
+	}{r.traces, r.metrics, r.histograms, r.logs}, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to encode records: %v", err)
+	}
+	return append(data, '\n')
+}
+
+// signal describes how each receiver exports one kind of telemetry
+type signal struct {
+	name       string
+	newRequest func() proto.Message
+	exportGRPC func(ctx context.Context, writer *otlp.Writer, req proto.Message) error
+	handleHTTP func(s *ingestion.Service) gin.HandlerFunc
+}
+
+var signals = []signal{
+	{
+		name:       "traces",
+		newRequest: func() proto.Message { return &coltracepb.ExportTraceServiceRequest{} },
+		exportGRPC: func(ctx context.Context, writer *otlp.Writer, req proto.Message) error {
+			_, err := otlpgrpc.NewTraceService(writer).Export(ctx, req.(*coltracepb.ExportTraceServiceRequest))
+			return err
+		},
+		handleHTTP: func(s *ingestion.Service) gin.HandlerFunc { return s.HandleTraces },
+	},
+	{
+		name:       "metrics",
+		newRequest: func() proto.Message { return &colmetricspb.ExportMetricsServiceRequest{} },
+		exportGRPC: func(ctx context.Context, writer *otlp.Writer, req proto.Message) error {
+			_, err := otlpgrpc.NewMetricsService(writer).Export(ctx, req.(*colmetricspb.ExportMetricsServiceRequest))
+			return err
+		},
+		handleHTTP: func(s *ingestion.Service) gin.HandlerFunc { return s.HandleMetrics },
+	},
+	{
+		name:       "logs",
+		newRequest: func() proto.Message { return &collogspb.ExportLogsServiceRequest{} },
+		exportGRPC: func(ctx context.Context, writer *otlp.Writer, req proto.Message) error {
+			_, err := otlpgrpc.NewLogsService(writer).Export(ctx, req.(*collogspb.ExportLogsServiceRequest))
+			return err
+		},
+		handleHTTP: func(s *ingestion.Service) gin.HandlerFunc { return s.HandleLogs },
+	},
+}
+
+// exportGRPC stores a protobuf-encoded export request through the gRPC
+// service
+func exportGRPC(t *testing.T, sig signal, body []byte) []byte {
+	t.Helper()
+	req := sig.newRequest()
+	if err := proto.Unmarshal(body, req); err != nil {
+		t.Fatalf("failed to decode %s fixture: %v", sig.name, err)
+	}
+
+	rec := newRecorder()
+	if err := sig.exportGRPC(context.Background(), otlp.NewWriter(rec), req); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	return rec.records(t)
+}
+
+// exportHTTP stores an export request through the OTLP/HTTP receiver, which
+// queues records and stores them once the service stops
+func exportHTTP(t *testing.T, sig signal, contentType string, body []byte) []byte {
+	t.Helper()
+	rec := newRecorder()
+	service, err := ingestion.NewService(rec, config.DefaultConfig().Ingestion)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	router := gin.New()
+	router.POST("/v1/"+sig.name, sig.handleHTTP(service))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/"+sig.name, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /v1/%s = %d %s", sig.name, w.Code, w.Body.String())
+	}
+
+	if err := service.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	return rec.records(t)
+}
+
+// TestGolden exports the requests in testdata through the gRPC receiver and
+// through the OTLP/HTTP receiver in both encodings, and checks that each
+// stores the records in the signal's golden file. Run with -update to
+// rewrite the golden files from the gRPC receiver's output.
+func TestGolden(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, sig := range signals {
+		t.Run(sig.name, func(t *testing.T) {
+			protobuf, err := os.ReadFile(filepath.Join("testdata", sig.name+".pb"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			jsonBody, err := os.ReadFile(filepath.Join("testdata", sig.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			goldenPath := filepath.Join("testdata", sig.name+".golden.json")
+			grpcRecords := exportGRPC(t, sig, protobuf)
+			if *update {
+				if err := os.WriteFile(goldenPath, grpcRecords, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []struct {
+				name    string
+				records []byte
+			}{
+				{"gRPC", grpcRecords},
+				{"OTLP/HTTP protobuf", exportHTTP(t, sig, "application/x-protobuf", protobuf)},
+				{"OTLP/HTTP JSON", exportHTTP(t, sig, "application/json", jsonBody)},
+			} {
+				if !bytes.Equal(path.records, golden) {
+					t.Errorf("%s stored records differing from %s:\n%s", path.name, goldenPath, path.records)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"open-telemorph-prime/internal/storage"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// severityLevels are the severity texts of the six severity number ranges,
+// in ascending order. Each range spans four severity numbers, starting at 1.
+var severityLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// severityAliases maps common severity texts that are not range names to
+// their range
+var severityAliases = map[string]string{
+	"WARNING":  "WARN",
+	"CRITICAL": "FATAL",
+}
+
+// TranslateLogs converts the log records of an export request into log
+// records for storage, one per record. Records with invalid trace or span
+// IDs are rejected; it returns their number and the reason the first was
+// rejected.
+func TranslateLogs(req *collogspb.ExportLogsServiceRequest) ([]*storage.Log, int64, error) {
+	var logs []*storage.Log
+	var rejected int64
+	var firstErr error
+	for _, resourceLog := range req.GetResourceLogs() {
+		serviceName := ServiceName(resourceLog.Resource)
+		resource := Resource(resourceLog.Resource)
+		for _, scopeLog := range resourceLog.ScopeLogs {
+			for _, logRecord := range scopeLog.LogRecords {
+				err := validateID("trace ID", logRecord.TraceId, traceIDSize, false)
+				if err == nil {
+					err = validateID("span ID", logRecord.SpanId, spanIDSize, false)
+				}
+				if err != nil {
+					rejected++
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+
+				logData := translateLogRecord(logRecord, serviceName)
+				logData.ScopeName = scopeLog.Scope.GetName()
+				logData.ScopeVersion = scopeLog.Scope.GetVersion()
+				logData.ScopeAttributes = ConvertAttributes(scopeLog.Scope.GetAttributes())
+				logData.Resource = resource
+				logs = append(logs, logData)
+			}
+		}
+	}
+	return logs, rejected, firstErr
+}
+
+func translateLogRecord(logRecord *logspb.LogRecord, serviceName string) *storage.Log {
+	level, severityNumber := severity(logRecord.SeverityText, logRecord.SeverityNumber)
+
+	// Records without an event time are timestamped when they were observed
+	timestamp := logRecord.TimeUnixNano
+	if timestamp == 0 {
+		timestamp = logRecord.ObservedTimeUnixNano
+	}
+
+	logData := &storage.Log{
+		Timestamp:      time.Unix(0, int64(timestamp)),
+		ServiceName:    serviceName,
+		Level:          level,
+		SeverityNumber: severityNumber,
+		EventName:      logRecord.EventName,
+		Message:        BodyString(logRecord.Body),
+		Body:           marshalJSON(AttributeValue(logRecord.Body), "null"),
+		Attributes:     ConvertAttributes(logRecord.Attributes),
+		Flags:          logRecord.Flags,
+	}
+	if logRecord.ObservedTimeUnixNano != 0 {
+		logData.ObservedTimestamp = time.Unix(0, int64(logRecord.ObservedTimeUnixNano))
+	}
+
+	// Set trace and span IDs if present
+	if len(logRecord.TraceId) > 0 {
+		traceID := hex.EncodeToString(logRecord.TraceId)
+		logData.TraceID = &traceID
+	}
+
+	if len(logRecord.SpanId) > 0 {
+		spanID := hex.EncodeToString(logRecord.SpanId)
+		logData.SpanID = &spanID
+	}
+
+	return logData
+}
+
+// severity returns the level and severity number of a log record, each
+// derived from the other when missing. The level is the severity text as
+// sent, or the name of the severity number's range such as WARN. Records
+// with neither are UNSPECIFIED.
+func severity(text string, number logspb.SeverityNumber) (string, int32) {
+	n := int32(number)
+	if n < 1 || n > 24 {
+		n = 0
+	}
+
+	if text == "" {
+		if n == 0 {
+			return "UNSPECIFIED", 0
+		}
+		return severityLevels[(n-1)/4], n
+	}
+
+	if n == 0 {
+		level := strings.ToUpper(text)
+		if alias, ok := severityAliases[level]; ok {
+			level = alias
+		}
+		for i, name := range severityLevels {
+			if level == name {
+				n = int32(i*4 + 1)
+				break
+			}
+		}
+	}
+	return text, n
+}
@@ -0,0 +1,285 @@
+package otlp
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"open-telemorph-prime/internal/histogram"
+	"open-telemorph-prime/internal/storage"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// DataPoint holds the records stored for a single OTLP data point. Gauges and
+// sums produce one sample; histograms and summaries produce a sample per
+// component series, and exponential histograms are also stored in full.
+type DataPoint struct {
+	Metrics              []*storage.Metric
+	ExponentialHistogram *storage.ExponentialHistogram
+}
+
+// TranslateMetrics converts the data points of an export request into the
+// records to store. Data points of metrics without a name are rejected; it
+// returns their number and the reason the first was rejected.
+func TranslateMetrics(req *colmetricspb.ExportMetricsServiceRequest) ([]DataPoint, int64, error) {
+	var points []DataPoint
+	var rejected int64
+	var firstErr error
+	for _, resourceMetric := range req.GetResourceMetrics() {
+		serviceName := ServiceName(resourceMetric.Resource)
+		resource := Resource(resourceMetric.Resource)
+		for _, scopeMetric := range resourceMetric.ScopeMetrics {
+			for _, metric := range scopeMetric.Metrics {
+				translated := translateMetric(metric, serviceName)
+				if metric.Name == "" {
+					rejected += int64(len(translated))
+					if firstErr == nil && len(translated) > 0 {
+						firstErr = errors.New("invalid metric: name must not be empty")
+					}
+					continue
+				}
+
+				for _, point := range translated {
+					for _, m := range point.Metrics {
+						m.Resource = resource
+					}
+					if point.ExponentialHistogram != nil {
+						point.ExponentialHistogram.Resource = resource
+					}
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points, rejected, firstErr
+}
+
+func translateMetric(metric *metricspb.Metric, serviceName string) []DataPoint {
+	// Process different metric types
+	switch data := metric.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		return translateNumberDataPoints(metric.Name, data.Gauge.DataPoints, serviceName)
+	case *metricspb.Metric_Sum:
+		return translateNumberDataPoints(metric.Name, data.Sum.DataPoints, serviceName)
+	case *metricspb.Metric_Histogram:
+		return translateHistogram(metric.Name, data.Histogram, serviceName)
+	case *metricspb.Metric_ExponentialHistogram:
+		return translateExponentialHistogram(metric.Name, data.ExponentialHistogram, serviceName)
+	case *metricspb.Metric_Summary:
+		return translateSummary(metric.Name, data.Summary, serviceName)
+	default:
+		log.Printf("Unknown metric type for metric: %s", metric.Name)
+		return nil
+	}
+}
+
+func translateNumberDataPoints(name string, dataPoints []*metricspb.NumberDataPoint, serviceName string) []DataPoint {
+	points := make([]DataPoint, 0, len(dataPoints))
+	for _, dataPoint := range dataPoints {
+		points = append(points, DataPoint{Metrics: []*storage.Metric{{
+			MetricName:  name,
+			Value:       numericValue(dataPoint),
+			Timestamp:   time.Unix(0, int64(dataPoint.TimeUnixNano)),
+			ServiceName: serviceName,
+			Labels:      ConvertAttributes(dataPoint.Attributes),
+		}}})
+	}
+	return points
+}
+
+func translateHistogram(name string, h *metricspb.Histogram, serviceName string) []DataPoint {
+	points := make([]DataPoint, 0, len(h.DataPoints))
+	for _, dataPoint := range h.DataPoints {
+		timestamp := time.Unix(0, int64(dataPoint.TimeUnixNano))
+		labels := ConvertAttributes(dataPoint.Attributes)
+
+		// Store count as a metric
+		metrics := []*storage.Metric{{
+			MetricName:  name + "_count",
+			Value:       float64(dataPoint.Count),
+			Timestamp:   timestamp,
+			ServiceName: serviceName,
+			Labels:      labels,
+		}}
+
+		// Store sum as a metric
+		if dataPoint.Sum != nil {
+			metrics = append(metrics, &storage.Metric{
+				MetricName:  name + "_sum",
+				Value:       *dataPoint.Sum,
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labels,
+			})
+		}
+
+		// Store cumulative bucket counts. OTLP carries one more bucket count
+		// than explicit bounds; the last bucket is the +Inf bucket.
+		var cumulative uint64
+		for i, bucketCount := range dataPoint.BucketCounts {
+			cumulative += bucketCount
+
+			le := "+Inf"
+			if i < len(dataPoint.ExplicitBounds) {
+				le = formatBucketBound(dataPoint.ExplicitBounds[i])
+			}
+
+			metrics = append(metrics, &storage.Metric{
+				MetricName:  name + "_bucket",
+				Value:       float64(cumulative),
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labelsWith(dataPoint.Attributes, "le", le),
+			})
+		}
+
+		points = append(points, DataPoint{Metrics: metrics})
+	}
+	return points
+}
+
+func translateExponentialHistogram(name string, h *metricspb.ExponentialHistogram, serviceName string) []DataPoint {
+	points := make([]DataPoint, 0, len(h.DataPoints))
+	for _, dataPoint := range h.DataPoints {
+		timestamp := time.Unix(0, int64(dataPoint.TimeUnixNano))
+		labels := ConvertAttributes(dataPoint.Attributes)
+
+		// Store count as a metric
+		metrics := []*storage.Metric{{
+			MetricName:  name + "_count",
+			Value:       float64(dataPoint.Count),
+			Timestamp:   timestamp,
+			ServiceName: serviceName,
+			Labels:      labels,
+		}}
+
+		// Store sum as a metric
+		if dataPoint.Sum != nil {
+			metrics = append(metrics, &storage.Metric{
+				MetricName:  name + "_sum",
+				Value:       *dataPoint.Sum,
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labels,
+			})
+		}
+
+		// Store the full histogram so that quantiles can be recovered
+		points = append(points, DataPoint{
+			Metrics: metrics,
+			ExponentialHistogram: &storage.ExponentialHistogram{
+				MetricName:  name,
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labels,
+				Histogram:   exponentialHistogram(dataPoint),
+			},
+		})
+	}
+	return points
+}
+
+// exponentialHistogram converts an OTLP exponential histogram data point into
+// its stored representation
+func exponentialHistogram(dataPoint *metricspb.ExponentialHistogramDataPoint) *histogram.Exponential {
+	h := &histogram.Exponential{
+		Scale:         dataPoint.Scale,
+		ZeroThreshold: dataPoint.ZeroThreshold,
+		ZeroCount:     float64(dataPoint.ZeroCount),
+		Count:         float64(dataPoint.Count),
+		Sum:           dataPoint.GetSum(),
+	}
+	if positive := dataPoint.Positive; positive != nil {
+		h.Positive = histogram.Buckets{Offset: positive.Offset, Counts: bucketCounts(positive.BucketCounts)}
+	}
+	if negative := dataPoint.Negative; negative != nil {
+		h.Negative = histogram.Buckets{Offset: negative.Offset, Counts: bucketCounts(negative.BucketCounts)}
+	}
+	return h
+}
+
+func bucketCounts(counts []uint64) []float64 {
+	result := make([]float64, len(counts))
+	for i, c := range counts {
+		result[i] = float64(c)
+	}
+	return result
+}
+
+func translateSummary(name string, summary *metricspb.Summary, serviceName string) []DataPoint {
+	points := make([]DataPoint, 0, len(summary.DataPoints))
+	for _, dataPoint := range summary.DataPoints {
+		timestamp := time.Unix(0, int64(dataPoint.TimeUnixNano))
+		labels := ConvertAttributes(dataPoint.Attributes)
+
+		// Store count as a metric
+		metrics := []*storage.Metric{{
+			MetricName:  name + "_count",
+			Value:       float64(dataPoint.Count),
+			Timestamp:   timestamp,
+			ServiceName: serviceName,
+			Labels:      labels,
+		}}
+
+		// Store sum as a metric
+		if dataPoint.Sum != 0 {
+			metrics = append(metrics, &storage.Metric{
+				MetricName:  name + "_sum",
+				Value:       dataPoint.Sum,
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labels,
+			})
+		}
+
+		// Store quantile values
+		for _, quantile := range dataPoint.QuantileValues {
+			metrics = append(metrics, &storage.Metric{
+				MetricName:  name + "_quantile",
+				Value:       quantile.Value,
+				Timestamp:   timestamp,
+				ServiceName: serviceName,
+				Labels:      labelsWith(dataPoint.Attributes, "quantile", quantile.Quantile),
+			})
+		}
+
+		points = append(points, DataPoint{Metrics: metrics})
+	}
+	return points
+}
+
+func numericValue(dataPoint *metricspb.NumberDataPoint) float64 {
+	if dataPoint == nil {
+		return 0.0
+	}
+
+	switch v := dataPoint.Value.(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(v.AsInt)
+	default:
+		return 0.0
+	}
+}
+
+// formatBucketBound renders a bucket upper bound the way Prometheus writes le
+// label values
+func formatBucketBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
+
+// labelsWith converts attributes into labels JSON with one additional label
+func labelsWith(attributes []*commonpb.KeyValue, key string, value interface{}) string {
+	attrs := attributeMap(attributes)
+	attrs[key] = value
+	return marshalJSON(attrs, "{}")
+}
@@ -0,0 +1,318 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/spool"
+	"open-telemorph-prime/internal/storage"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Kinds of spool entries, each holding one export request
+const (
+	spoolTraces byte = iota + 1
+	spoolMetrics
+	spoolLogs
+)
+
+// SpoolStats describes the spool of a Writer and the replay of its entries
+// into storage
+type SpoolStats struct {
+	spool.Stats
+	ReplayFailures int64      `json:"replay_failures"`
+	LastReplay     *time.Time `json:"last_replay,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// spooler appends export requests to a spool and replays them into storage
+// from a background goroutine. Requests are replayed at least once: while
+// storage is unavailable, the records of a batch that were not stored yet
+// are retried, and a batch that was not committed before a restart is
+// replayed again as a whole.
+type spooler struct {
+	writer        *Writer
+	spool         *spool.Spool
+	batchSize     int
+	flushInterval time.Duration
+
+	// batch is the batch being replayed, nil between batches. It is only
+	// used by the replay goroutine.
+	batch *replayBatch
+
+	mu     sync.Mutex
+	closed bool
+	stats  SpoolStats
+
+	stop    chan struct{}
+	abort   chan struct{}
+	stopped chan struct{}
+}
+
+// NewSpoolWriter returns a Writer that appends export requests to sp and
+// acknowledges them once they are on disk. They are stored in batches of
+// about cfg.BatchSize records; while storage is unavailable, replay is
+// retried every cfg.FlushInterval. Writes fail with ErrQueueFull once the
+// spool is full.
+func NewSpoolWriter(store storage.Storage, cfg config.IngestionConfig, sp *spool.Spool) *Writer {
+	w := &Writer{
+		storage:       store,
+		flushInterval: cfg.FlushInterval,
+	}
+	w.spooler = &spooler{
+		writer:        w,
+		spool:         sp,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		stop:          make(chan struct{}),
+		abort:         make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go w.spooler.run()
+	return w
+}
+
+// SpoolStats returns statistics about the spool of the Writer, and false if
+// it does not spool
+func (w *Writer) SpoolStats() (SpoolStats, bool) {
+	if w.spooler == nil {
+		return SpoolStats{}, false
+	}
+
+	s := w.spooler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Stats = s.spool.Stats()
+	return stats, true
+}
+
+// append writes an export request to the spool
+func (s *spooler) append(kind byte, req proto.Message) error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request for the spool: %w", err)
+	}
+
+	err = s.spool.Append(kind, payload)
+	if errors.Is(err, spool.ErrFull) {
+		return fmt.Errorf("%w: %w", ErrQueueFull, err)
+	}
+	if err != nil {
+		// Exporters keep the request and retry, as for a storage outage
+		log.Printf("Failed to spool export request: %v", err)
+		return fmt.Errorf("%w: %v", storage.ErrUnavailable, err)
+	}
+	return nil
+}
+
+func (s *spooler) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	// stop is cleared once received, replay then ends when the spool is
+	// drained or the caller gives up
+	stop := s.stop
+	for {
+		replayed, err := s.replay()
+		if err != nil {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				stop = nil
+			case <-s.abort:
+				return
+			}
+			continue
+		}
+		if replayed {
+			continue
+		}
+		if stop == nil {
+			return
+		}
+
+		select {
+		case <-s.spool.Appended():
+		case <-ticker.C:
+		case <-stop:
+			stop = nil
+		}
+	}
+}
+
+// replayBatch holds the records of spooled requests until they are stored
+// and the requests committed. Records are removed as they are stored.
+type replayBatch struct {
+	traces  []*storage.Trace
+	points  []DataPoint
+	logs    []*storage.Log
+	next    spool.Position
+	entries int
+}
+
+// replay stores the next batch of spooled requests. It reports whether any
+// were replayed, and returns an error if storage was unavailable.
+func (s *spooler) replay() (bool, error) {
+	if s.batch == nil {
+		batch, err := s.read()
+		if err != nil {
+			s.failed(err)
+			return false, err
+		}
+		if batch == nil {
+			return false, nil
+		}
+		s.batch = batch
+	}
+
+	if err := s.store(s.batch); err != nil {
+		s.failed(err)
+		return false, err
+	}
+	if err := s.spool.Commit(s.batch.next, s.batch.entries); err != nil {
+		s.failed(err)
+		return false, err
+	}
+	s.batch = nil
+
+	now := time.Now()
+	s.mu.Lock()
+	if s.stats.LastError != "" {
+		log.Printf("Storage available again, replaying spooled telemetry")
+		s.stats.LastError = ""
+	}
+	s.stats.LastReplay = &now
+	s.mu.Unlock()
+	return true, nil
+}
+
+// read translates the next batch of spooled requests, or returns nil if
+// there are none
+func (s *spooler) read() (*replayBatch, error) {
+	from := s.spool.Committed()
+	batch := &replayBatch{next: from}
+	for len(batch.traces)+len(batch.points)+len(batch.logs) < s.batchSize {
+		read, next, err := s.spool.Read(batch.next, 1)
+		if err != nil {
+			return nil, err
+		}
+		batch.next = next
+		if len(read) == 0 {
+			break
+		}
+		batch.entries++
+
+		entry := read[0]
+		switch entry.Kind {
+		case spoolTraces:
+			req := &coltracepb.ExportTraceServiceRequest{}
+			if err := proto.Unmarshal(entry.Payload, req); err != nil {
+				log.Printf("Skipping undecodable spooled trace export: %v", err)
+				continue
+			}
+			translated, _, _ := TranslateTraces(req)
+			batch.traces = append(batch.traces, translated...)
+		case spoolMetrics:
+			req := &colmetricspb.ExportMetricsServiceRequest{}
+			if err := proto.Unmarshal(entry.Payload, req); err != nil {
+				log.Printf("Skipping undecodable spooled metrics export: %v", err)
+				continue
+			}
+			translated, _, _ := TranslateMetrics(req)
+			batch.points = append(batch.points, translated...)
+		case spoolLogs:
+			req := &collogspb.ExportLogsServiceRequest{}
+			if err := proto.Unmarshal(entry.Payload, req); err != nil {
+				log.Printf("Skipping undecodable spooled logs export: %v", err)
+				continue
+			}
+			translated, _, _ := TranslateLogs(req)
+			batch.logs = append(batch.logs, translated...)
+		default:
+			log.Printf("Skipping spool entry of unknown kind %d", entry.Kind)
+		}
+	}
+
+	if batch.next == from {
+		return nil, nil
+	}
+	return batch, nil
+}
+
+// store stores the records of a batch signal by signal. Signals that were
+// stored are removed from the batch, so that a retry after storage was
+// unavailable does not store them twice. Records that storage rejected are
+// logged and not retried.
+func (s *spooler) store(batch *replayBatch) error {
+	if len(batch.traces) > 0 {
+		if err := retryable(s.writer.storeTraces(batch.traces)); err != nil {
+			return err
+		}
+		batch.traces = nil
+	}
+	if len(batch.points) > 0 {
+		if err := retryable(s.writer.storeDataPoints(batch.points)); err != nil {
+			return err
+		}
+		batch.points = nil
+	}
+	if len(batch.logs) > 0 {
+		if err := retryable(s.writer.storeLogs(batch.logs)); err != nil {
+			return err
+		}
+		batch.logs = nil
+	}
+	return nil
+}
+
+// failed records a replay that has to be retried
+func (s *spooler) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.LastError == "" {
+		log.Printf("Failed to replay spooled telemetry, retrying every %v: %v", s.flushInterval, err)
+	}
+	s.stats.ReplayFailures++
+	s.stats.LastError = err.Error()
+}
+
+// close stops accepting requests and replays the spooled ones until the
+// spool is drained or the context is done. Requests that are not replayed
+// stay on disk for the next start.
+func (s *spooler) close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		close(s.abort)
+		<-s.stopped
+		log.Printf("Leaving %d bytes of telemetry spooled until the next start", s.spool.Stats().PendingBytes)
+	}
+	return s.spool.Close()
+}
@@ -0,0 +1,61 @@
+package otlp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/spool"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func TestSpoolReplayRetry(t *testing.T) {
+	sp, err := spool.Open(t.TempDir(), 1<<20, 64<<10)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Logs fail twice, after the spans of the same batch were stored
+	store := newFlakyStorage(0, 2)
+	w := NewSpoolWriter(store, config.IngestionConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond}, sp)
+
+	ts := uint64(time.Now().UnixNano())
+	if _, err := w.WriteTraces(&coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+			TraceId:           []byte("0123456789abcdef"),
+			SpanId:            []byte("01234567"),
+			Name:              "GET /",
+			StartTimeUnixNano: ts,
+			EndTimeUnixNano:   ts + 1000,
+		}}}}}},
+	}); err != nil {
+		t.Fatalf("WriteTraces: %v", err)
+	}
+	if _, err := w.WriteLogs(&collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{ScopeLogs: []*logspb.ScopeLogs{{LogRecords: []*logspb.LogRecord{{
+			TimeUnixNano: ts,
+		}}}}}},
+	}); err != nil {
+		t.Fatalf("WriteLogs: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.traces != 1 || store.logs != 1 {
+		t.Errorf("stored %d spans and %d log records, want 1 and 1", store.traces, store.logs)
+	}
+	stats, _ := w.SpoolStats()
+	if stats.ReplayFailures != 2 || stats.PendingBytes != 0 {
+		t.Errorf("spool stats = %+v, want 2 replay failures and nothing pending", stats)
+	}
+}
@@ -0,0 +1,168 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"open-telemorph-prime/internal/storage"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// TranslateTraces converts the spans of an export request into trace
+// records, one per span. Spans with invalid IDs are rejected; it returns
+// their number and the reason the first was rejected.
+func TranslateTraces(req *coltracepb.ExportTraceServiceRequest) ([]*storage.Trace, int64, error) {
+	var traces []*storage.Trace
+	var rejected int64
+	var firstErr error
+	for _, resourceSpan := range req.GetResourceSpans() {
+		serviceName := ServiceName(resourceSpan.Resource)
+		resource := Resource(resourceSpan.Resource)
+		for _, scopeSpan := range resourceSpan.ScopeSpans {
+			for _, span := range scopeSpan.Spans {
+				if err := validateSpan(span); err != nil {
+					rejected++
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+
+				trace := translateSpan(span, serviceName)
+				trace.ScopeName = scopeSpan.Scope.GetName()
+				trace.ScopeVersion = scopeSpan.Scope.GetVersion()
+				trace.Resource = resource
+				traces = append(traces, trace)
+			}
+		}
+	}
+	return traces, rejected, firstErr
+}
+
+const (
+	traceIDSize = 16
+	spanIDSize  = 8
+)
+
+// validateSpan checks the IDs of a span
+func validateSpan(span *tracepb.Span) error {
+	if err := validateID("trace ID", span.TraceId, traceIDSize, true); err != nil {
+		return err
+	}
+	if err := validateID("span ID", span.SpanId, spanIDSize, true); err != nil {
+		return err
+	}
+	return validateID("parent span ID", span.ParentSpanId, spanIDSize, false)
+}
+
+// validateID checks that an ID has its fixed size and is not all zeros.
+// Optional IDs may also be empty.
+func validateID(name string, id []byte, size int, required bool) error {
+	if len(id) == 0 && !required {
+		return nil
+	}
+	if len(id) != size {
+		return fmt.Errorf("invalid %s %q: must be %d bytes", name, hex.EncodeToString(id), size)
+	}
+	for _, b := range id {
+		if b != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s: must not be all zeros", name)
+}
+
+// spanEvent is the stored form of a span event
+type spanEvent struct {
+	Timestamp  int64                  `json:"timestamp"`
+	Name       string                 `json:"name"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// spanLink is the stored form of a span link
+type spanLink struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	TraceState string                 `json:"trace_state,omitempty"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func translateSpan(span *tracepb.Span, serviceName string) *storage.Trace {
+	trace := &storage.Trace{
+		TraceID:       hex.EncodeToString(span.TraceId),
+		SpanID:        hex.EncodeToString(span.SpanId),
+		TraceState:    span.TraceState,
+		ServiceName:   serviceName,
+		OperationName: span.Name,
+		Kind:          spanKind(span.Kind),
+		StartTime:     time.Unix(0, int64(span.StartTimeUnixNano)),
+		DurationNanos: int64(span.EndTimeUnixNano - span.StartTimeUnixNano),
+		StatusCode:    statusCode(span.Status),
+		StatusMessage: span.Status.GetMessage(),
+		Attributes:    ConvertAttributes(span.Attributes),
+		Events:        spanEvents(span.Events),
+		Links:         spanLinks(span.Links),
+	}
+
+	// Set parent span ID if present
+	if len(span.ParentSpanId) > 0 {
+		parentSpanID := hex.EncodeToString(span.ParentSpanId)
+		trace.ParentSpanID = &parentSpanID
+	}
+
+	return trace
+}
+
+// spanKind returns the kind of a span without the SPAN_KIND_ prefix, such as
+// SERVER or CLIENT
+func spanKind(kind tracepb.Span_SpanKind) string {
+	return strings.TrimPrefix(kind.String(), "SPAN_KIND_")
+}
+
+// spanEvents converts span events, such as exceptions, into a JSON array
+func spanEvents(events []*tracepb.Span_Event) string {
+	stored := make([]spanEvent, 0, len(events))
+	for _, event := range events {
+		stored = append(stored, spanEvent{
+			Timestamp:  int64(event.TimeUnixNano),
+			Name:       event.Name,
+			Attributes: attributeMap(event.Attributes),
+		})
+	}
+	return marshalJSON(stored, "[]")
+}
+
+// spanLinks converts span links into a JSON array
+func spanLinks(links []*tracepb.Span_Link) string {
+	stored := make([]spanLink, 0, len(links))
+	for _, link := range links {
+		stored = append(stored, spanLink{
+			TraceID:    hex.EncodeToString(link.TraceId),
+			SpanID:     hex.EncodeToString(link.SpanId),
+			TraceState: link.TraceState,
+			Attributes: attributeMap(link.Attributes),
+		})
+	}
+	return marshalJSON(stored, "[]")
+}
+
+func statusCode(status *tracepb.Status) string {
+	if status == nil {
+		return "UNSET"
+	}
+
+	switch status.Code {
+	case tracepb.Status_STATUS_CODE_UNSET:
+		return "UNSET"
+	case tracepb.Status_STATUS_CODE_OK:
+		return "OK"
+	case tracepb.Status_STATUS_CODE_ERROR:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,252 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+// Writer translates OTLP export requests and stores the resulting records.
+// Every receiver stores telemetry through a Writer so that the same payload
+// is stored the same way regardless of transport.
+type Writer struct {
+	storage storage.Storage
+
+	// Queues of a batching Writer, nil if records are stored as they are
+	// written
+	traces        *batchQueue[*storage.Trace]
+	metrics       *batchQueue[DataPoint]
+	logs          *batchQueue[*storage.Log]
+	flushInterval time.Duration
+
+	// spooler of a spooling Writer, nil otherwise
+	spooler *spooler
+}
+
+// NewWriter returns a Writer that stores records before returning
+func NewWriter(storage storage.Storage) *Writer {
+	return &Writer{
+		storage: storage,
+	}
+}
+
+// NewBatchWriter returns a Writer that queues records and stores them in
+// batches of cfg.BatchSize from background workers, at least once every
+// cfg.FlushInterval. Writes fail with ErrQueueFull once cfg.QueueSize
+// records of a signal are waiting to be stored.
+func NewBatchWriter(store storage.Storage, cfg config.IngestionConfig) *Writer {
+	w := &Writer{
+		storage:       store,
+		flushInterval: cfg.FlushInterval,
+	}
+	w.traces = newBatchQueue("spans", cfg.QueueSize, cfg.BatchSize, cfg.FlushInterval, func(batch []*storage.Trace) error {
+		return retryable(w.storeTraces(batch))
+	})
+	w.metrics = newBatchQueue("data points", cfg.QueueSize, cfg.BatchSize, cfg.FlushInterval, func(batch []DataPoint) error {
+		return retryable(w.storeDataPoints(batch))
+	})
+	w.logs = newBatchQueue("log records", cfg.QueueSize, cfg.BatchSize, cfg.FlushInterval, func(batch []*storage.Log) error {
+		return retryable(w.storeLogs(batch))
+	})
+	return w
+}
+
+// retryable returns the error of a batch that was not stored because
+// storage was unavailable. Batches whose records were stored or rejected
+// are done with.
+func retryable(_ int64, err error) error {
+	if errors.Is(err, storage.ErrUnavailable) {
+		return err
+	}
+	return nil
+}
+
+// RetryAfter is how long exporters should wait before retrying a write that
+// failed with ErrQueueFull. Queues are flushed, and spooled requests
+// replayed, at least this often.
+func (w *Writer) RetryAfter() time.Duration {
+	return w.flushInterval
+}
+
+// Close stops a batching or spooling Writer from accepting records and waits
+// until the queued or spooled ones are stored or the context is done
+func (w *Writer) Close(ctx context.Context) error {
+	if w.spooler != nil {
+		return w.spooler.close(ctx)
+	}
+	if w.traces == nil {
+		return nil
+	}
+	return errors.Join(w.traces.close(ctx), w.metrics.close(ctx), w.logs.close(ctx))
+}
+
+// WriteTraces stores, queues or spools the spans of an export request. It
+// returns the number of spans that were not accepted and the error of the
+// first one.
+func (w *Writer) WriteTraces(req *coltracepb.ExportTraceServiceRequest) (int64, error) {
+	traces, invalid, invalidErr := TranslateTraces(req)
+	if w.spooler != nil {
+		// Requests without valid records are not spooled
+		if len(traces) > 0 {
+			if err := w.spooler.append(spoolTraces, req); err != nil {
+				return invalid + int64(len(traces)), err
+			}
+		}
+		return invalid, invalidErr
+	}
+	if w.traces != nil {
+		if err := w.traces.push(traces); err != nil {
+			return invalid + int64(len(traces)), err
+		}
+		return invalid, invalidErr
+	}
+	stored, err := w.storeTraces(traces)
+	return addRejected(invalid, invalidErr, stored, err)
+}
+
+func (w *Writer) storeTraces(traces []*storage.Trace) (int64, error) {
+	return rejected("spans", storage.BatchFailures(w.storage.InsertTraces(traces), len(traces)))
+}
+
+// WriteMetrics stores, queues or spools the data points of an export
+// request. It returns the number of data points that were not accepted, even
+// partially, and the error of the first one.
+func (w *Writer) WriteMetrics(req *colmetricspb.ExportMetricsServiceRequest) (int64, error) {
+	points, invalid, invalidErr := TranslateMetrics(req)
+	if w.spooler != nil {
+		// Requests without valid records are not spooled
+		if len(points) > 0 {
+			if err := w.spooler.append(spoolMetrics, req); err != nil {
+				return invalid + int64(len(points)), err
+			}
+		}
+		return invalid, invalidErr
+	}
+	if w.metrics != nil {
+		if err := w.metrics.push(points); err != nil {
+			return invalid + int64(len(points)), err
+		}
+		return invalid, invalidErr
+	}
+	stored, err := w.storeDataPoints(points)
+	return addRejected(invalid, invalidErr, stored, err)
+}
+
+// storeDataPoints stores the records of data points in one batch per table.
+// A data point is rejected if any of its records could not be stored. The
+// samples are removed from points once stored, so that retrying points
+// after storage was unavailable for the histograms does not store them
+// twice.
+func (w *Writer) storeDataPoints(points []DataPoint) (int64, error) {
+	var metrics []*storage.Metric
+	var metricPoints []int
+	var histograms []*storage.ExponentialHistogram
+	var histogramPoints []int
+	for i, point := range points {
+		for _, metric := range point.Metrics {
+			metrics = append(metrics, metric)
+			metricPoints = append(metricPoints, i)
+		}
+		if point.ExponentialHistogram != nil {
+			histograms = append(histograms, point.ExponentialHistogram)
+			histogramPoints = append(histogramPoints, i)
+		}
+	}
+
+	// A batch storage is unavailable for is not stored at all
+	failures := make(map[int]error)
+	if len(metrics) > 0 {
+		err := w.storage.InsertMetrics(metrics)
+		if errors.Is(err, storage.ErrUnavailable) {
+			return int64(len(points)), err
+		}
+		for i, err := range storage.BatchFailures(err, len(metrics)) {
+			failures[metricPoints[i]] = fmt.Errorf("failed to insert metric %s: %w", metrics[i].MetricName, err)
+		}
+		for i := range points {
+			points[i].Metrics = nil
+		}
+	}
+
+	if len(histograms) > 0 {
+		err := w.storage.InsertExponentialHistograms(histograms)
+		if errors.Is(err, storage.ErrUnavailable) {
+			// Rejected samples are not retried, only reported now
+			if len(failures) > 0 {
+				rejected("data points", failures)
+			}
+			return int64(len(histograms)), err
+		}
+		for i, err := range storage.BatchFailures(err, len(histograms)) {
+			failures[histogramPoints[i]] = fmt.Errorf("failed to insert histogram %s: %w", histograms[i].MetricName, err)
+		}
+	}
+	return rejected("data points", failures)
+}
+
+// WriteLogs stores, queues or spools the log records of an export request.
+// It returns the number of records that were not accepted and the error of
+// the first one.
+func (w *Writer) WriteLogs(req *collogspb.ExportLogsServiceRequest) (int64, error) {
+	logs, invalid, invalidErr := TranslateLogs(req)
+	if w.spooler != nil {
+		// Requests without valid records are not spooled
+		if len(logs) > 0 {
+			if err := w.spooler.append(spoolLogs, req); err != nil {
+				return invalid + int64(len(logs)), err
+			}
+		}
+		return invalid, invalidErr
+	}
+	if w.logs != nil {
+		if err := w.logs.push(logs); err != nil {
+			return invalid + int64(len(logs)), err
+		}
+		return invalid, invalidErr
+	}
+	stored, err := w.storeLogs(logs)
+	return addRejected(invalid, invalidErr, stored, err)
+}
+
+func (w *Writer) storeLogs(logs []*storage.Log) (int64, error) {
+	return rejected("log records", storage.BatchFailures(w.storage.InsertLogs(logs), len(logs)))
+}
+
+// rejected counts the records of a batch that failed to store and returns
+// the error of the first one. Batches storage was unavailable for are
+// retried or reported to the exporter rather than logged.
+func rejected(kind string, failures map[int]error) (int64, error) {
+	if len(failures) == 0 {
+		return 0, nil
+	}
+
+	first := -1
+	for i := range failures {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	if !errors.Is(failures[first], storage.ErrUnavailable) {
+		log.Printf("Failed to store %d %s: %v", len(failures), kind, failures[first])
+	}
+	return int64(len(failures)), failures[first]
+}
+
+// addRejected adds the records rejected before they reached storage to the
+// result of storing the others. Storage errors take precedence, as they
+// decide whether the export can be retried.
+func addRejected(invalid int64, invalidErr error, rejected int64, err error) (int64, error) {
+	if err == nil {
+		err = invalidErr
+	}
+	return invalid + rejected, err
+}
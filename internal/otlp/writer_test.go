@@ -0,0 +1,100 @@
+package otlp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/histogram"
+	"open-telemorph-prime/internal/storage"
+)
+
+// flakyStorage counts the records it stores. It is unavailable for the
+// first histogramOutages histogram batches and the first logOutages log
+// batches.
+type flakyStorage struct {
+	storage.Storage
+
+	mu               sync.Mutex
+	histogramOutages int
+	logOutages       int
+	traces           int
+	metrics          int
+	histograms       int
+	logs             int
+}
+
+func newFlakyStorage(histogramOutages, logOutages int) *flakyStorage {
+	return &flakyStorage{
+		Storage:          storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30}),
+		histogramOutages: histogramOutages,
+		logOutages:       logOutages,
+	}
+}
+
+func (s *flakyStorage) InsertTraces(traces []*storage.Trace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traces += len(traces)
+	return nil
+}
+
+func (s *flakyStorage) InsertMetrics(metrics []*storage.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics += len(metrics)
+	return nil
+}
+
+func (s *flakyStorage) InsertExponentialHistograms(histograms []*storage.ExponentialHistogram) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.histogramOutages > 0 {
+		s.histogramOutages--
+		return fmt.Errorf("%w: database is locked", storage.ErrUnavailable)
+	}
+	s.histograms += len(histograms)
+	return nil
+}
+
+func (s *flakyStorage) InsertLogs(logs []*storage.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logOutages > 0 {
+		s.logOutages--
+		return fmt.Errorf("%w: database is locked", storage.ErrUnavailable)
+	}
+	s.logs += len(logs)
+	return nil
+}
+
+func TestStoreDataPointsRetry(t *testing.T) {
+	store := newFlakyStorage(1, 0)
+	w := NewWriter(store)
+
+	now := time.Now()
+	points := []DataPoint{
+		{Metrics: []*storage.Metric{{Timestamp: now, MetricName: "up", Value: 1}}},
+		{
+			Metrics: []*storage.Metric{
+				{Timestamp: now, MetricName: "latency_count", Value: 3},
+				{Timestamp: now, MetricName: "latency_sum", Value: 1.5},
+			},
+			ExponentialHistogram: &storage.ExponentialHistogram{Timestamp: now, MetricName: "latency",
+				Histogram: &histogram.Exponential{Count: 3, Sum: 1.5}},
+		},
+	}
+
+	if _, err := w.storeDataPoints(points); !errors.Is(err, storage.ErrUnavailable) {
+		t.Fatalf("storeDataPoints = %v, want ErrUnavailable", err)
+	}
+	if rejected, err := w.storeDataPoints(points); rejected != 0 || err != nil {
+		t.Fatalf("retried storeDataPoints = %d, %v; want 0, nil", rejected, err)
+	}
+	if store.metrics != 3 || store.histograms != 1 {
+		t.Errorf("stored %d samples and %d histograms, want 3 and 1", store.metrics, store.histograms)
+	}
+}
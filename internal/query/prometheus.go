@@ -0,0 +1,577 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"open-telemorph-prime/internal/query/promql"
+	"open-telemorph-prime/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus HTTP API error types
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+	errorTimeout   = "timeout"
+	errorCanceled  = "canceled"
+	errorInternal  = "internal"
+)
+
+var (
+	// minTime and maxTime are used when a request leaves a time bound open.
+	// Both stay representable as Unix nanoseconds.
+	minTime = time.Unix(0, 0).UTC()
+	maxTime = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// apiResponse is the envelope of every Prometheus HTTP API response
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+// queryData is the data of a query or query_range response
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+// metricMetadata describes a metric family in a metadata response
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// RegisterPrometheusRoutes registers the Prometheus-compatible HTTP API.
+// POST /query is not registered here because the web UI already owns it;
+// callers route form-encoded requests to HandleInstantQuery themselves.
+func (s *Service) RegisterPrometheusRoutes(router *gin.RouterGroup) {
+	router.GET("/query", s.HandleInstantQuery)
+	router.GET("/query_range", s.HandleRangeQuery)
+	router.POST("/query_range", s.HandleRangeQuery)
+	router.GET("/series", s.HandleSeries)
+	router.POST("/series", s.HandleSeries)
+	router.GET("/labels", s.HandleLabels)
+	router.POST("/labels", s.HandleLabels)
+	router.GET("/label/:name/values", s.HandleLabelValues)
+	router.GET("/metadata", s.HandleMetadata)
+}
+
+// HandleInstantQuery evaluates a PromQL expression at a single point in time
+func (s *Service) HandleInstantQuery(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		respondError(c, errorBadData, fmt.Errorf("error parsing form values: %w", err))
+		return
+	}
+
+	ts, err := parseTimeParam(c, "time", time.Now())
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+
+	ctx, cancel, err := queryContext(c)
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+	defer cancel()
+
+	expr, err := s.promqlParser.Parse(c.Request.Form.Get("query"))
+	if err != nil {
+		respondError(c, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+
+	result, err := s.promqlEval.EvaluateInstant(ctx, expr, ts)
+	if err != nil {
+		respondError(c, evaluationErrorType(err), err)
+		return
+	}
+
+	respond(c, s.convertToPrometheusFormat(result))
+}
+
+// HandleRangeQuery evaluates a PromQL expression over a range of time
+func (s *Service) HandleRangeQuery(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		respondError(c, errorBadData, fmt.Errorf("error parsing form values: %w", err))
+		return
+	}
+
+	start, err := parseTimeParam(c, "start", time.Time{})
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+	end, err := parseTimeParam(c, "end", time.Time{})
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+	if end.Before(start) {
+		respondError(c, errorBadData, errors.New("end timestamp must not be before start time"))
+		return
+	}
+
+	step, err := parseDurationParam(c.Request.Form.Get("step"))
+	if err != nil {
+		respondError(c, errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err))
+		return
+	}
+	if step <= 0 {
+		respondError(c, errorBadData, errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer"))
+		return
+	}
+	if end.Sub(start)/step > promql.MaxPointsPerSeries {
+		respondError(c, errorBadData, fmt.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", promql.MaxPointsPerSeries))
+		return
+	}
+
+	ctx, cancel, err := queryContext(c)
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+	defer cancel()
+
+	expr, err := s.promqlParser.Parse(c.Request.Form.Get("query"))
+	if err != nil {
+		respondError(c, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+	switch expr.Type() {
+	case promql.ValueTypeMatrix:
+		respondError(c, errorBadData, errors.New(`invalid expression type "range vector" for range query, must be Scalar or instant Vector`))
+		return
+	case promql.ValueTypeString:
+		respondError(c, errorBadData, errors.New(`invalid expression type "string" for range query, must be Scalar or instant Vector`))
+		return
+	}
+
+	result, err := s.promqlEval.EvaluateRange(ctx, expr, start, end, step)
+	if err != nil {
+		respondError(c, evaluationErrorType(err), err)
+		return
+	}
+
+	respond(c, s.convertToPrometheusFormat(result))
+}
+
+// HandleSeries returns the label sets of the series matching match[]
+func (s *Service) HandleSeries(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		respondError(c, errorBadData, fmt.Errorf("error parsing form values: %w", err))
+		return
+	}
+	if len(c.Request.Form["match[]"]) == 0 {
+		respondError(c, errorBadData, errors.New("no match[] parameter provided"))
+		return
+	}
+
+	start, end, err := parseTimeRangeParams(c)
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+
+	selectors, err := s.parseMatchers(c.Request.Form["match[]"])
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+
+	series, err := s.promqlEval.Series(c.Request.Context(), selectors, start, end)
+	if err != nil {
+		respondError(c, errorExecution, err)
+		return
+	}
+	if series == nil {
+		series = []map[string]string{}
+	}
+
+	respond(c, series)
+}
+
+// HandleLabels returns the label names in use, optionally restricted to the
+// series matching match[]
+func (s *Service) HandleLabels(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		respondError(c, errorBadData, fmt.Errorf("error parsing form values: %w", err))
+		return
+	}
+
+	sets, start, end, err := s.labelMatchers(c)
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+
+	names, err := unionLabels(sets, func(matchers []*storage.LabelMatcher) ([]string, error) {
+		return s.storage.LabelNames(c.Request.Context(), matchers, start, end)
+	})
+	if err != nil {
+		respondError(c, errorExecution, err)
+		return
+	}
+
+	respond(c, names)
+}
+
+// HandleLabelValues returns the values of a label, optionally restricted to
+// the series matching match[]
+func (s *Service) HandleLabelValues(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		respondError(c, errorBadData, fmt.Errorf("error parsing form values: %w", err))
+		return
+	}
+
+	name := c.Param("name")
+	if name == "" || !utf8.ValidString(name) {
+		respondError(c, errorBadData, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+
+	sets, start, end, err := s.labelMatchers(c)
+	if err != nil {
+		respondError(c, errorBadData, err)
+		return
+	}
+
+	values, err := unionLabels(sets, func(matchers []*storage.LabelMatcher) ([]string, error) {
+		return s.storage.LabelValues(c.Request.Context(), name, matchers, start, end)
+	})
+	if err != nil {
+		respondError(c, errorExecution, err)
+		return
+	}
+
+	respond(c, values)
+}
+
+// HandleMetadata returns metadata about metric families. Types are inferred
+// from the series stored for each family since OTLP metadata is not kept.
+func (s *Service) HandleMetadata(c *gin.Context) {
+	metrics, err := s.GetAvailableMetrics(c.Request.Context())
+	if err != nil {
+		respondError(c, errorInternal, err)
+		return
+	}
+
+	limit := -1
+	if l := c.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			respondError(c, errorBadData, errors.New("limit must be a number"))
+			return
+		}
+	}
+
+	families := inferMetadata(metrics)
+	if metric := c.Query("metric"); metric != "" {
+		filtered := map[string][]metricMetadata{}
+		if md, ok := families[metric]; ok {
+			filtered[metric] = md
+		}
+		families = filtered
+	}
+
+	if limit >= 0 && len(families) > limit {
+		names := make([]string, 0, len(families))
+		for name := range families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[limit:] {
+			delete(families, name)
+		}
+	}
+
+	respond(c, families)
+}
+
+// labelMatchers resolves the match[] and start/end parameters of a labels
+// request into the label matchers of each selector. Without match[] every
+// series is considered.
+func (s *Service) labelMatchers(c *gin.Context) ([][]*storage.LabelMatcher, time.Time, time.Time, error) {
+	start, end, err := parseTimeRangeParams(c)
+	if err != nil {
+		return nil, start, end, err
+	}
+
+	matchers := c.Request.Form["match[]"]
+	if len(matchers) == 0 {
+		return [][]*storage.LabelMatcher{nil}, start, end, nil
+	}
+
+	selectors, err := s.parseMatchers(matchers)
+	if err != nil {
+		return nil, start, end, err
+	}
+	sets := make([][]*storage.LabelMatcher, len(selectors))
+	for i, selector := range selectors {
+		if sets[i], err = promql.StorageMatchers(selector.LabelMatchers); err != nil {
+			return nil, start, end, fmt.Errorf("invalid parameter \"match[]\": %w", err)
+		}
+	}
+	return sets, start, end, nil
+}
+
+// unionLabels looks up label names or values for every set of matchers and
+// returns them sorted and deduplicated
+func unionLabels(sets [][]*storage.LabelMatcher, lookup func(matchers []*storage.LabelMatcher) ([]string, error)) ([]string, error) {
+	seen := map[string]bool{}
+	for _, matchers := range sets {
+		values, err := lookup(matchers)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			seen[value] = true
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+// parseMatchers parses series selectors given as match[] parameters
+func (s *Service) parseMatchers(matchers []string) ([]*promql.VectorSelector, error) {
+	selectors := make([]*promql.VectorSelector, 0, len(matchers))
+	for _, m := range matchers {
+		expr, err := s.promqlParser.Parse(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter \"match[]\": %w", err)
+		}
+		selector, ok := expr.(*promql.VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter \"match[]\": %s is not a series selector", m)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// inferMetadata derives metric family types from the metric names written by
+// the OTLP receivers, which flatten histograms and summaries into suffixed
+// series
+func inferMetadata(metrics []string) map[string][]metricMetadata {
+	names := map[string]bool{}
+	for _, m := range metrics {
+		names[m] = true
+	}
+
+	families := map[string][]metricMetadata{}
+	for _, m := range metrics {
+		family, typ := m, "unknown"
+		for _, suffix := range []string{"_bucket", "_count", "_sum", "_quantile"} {
+			base := strings.TrimSuffix(m, suffix)
+			if base == m {
+				continue
+			}
+			if names[base+"_bucket"] {
+				family, typ = base, "histogram"
+			} else if names[base+"_quantile"] {
+				family, typ = base, "summary"
+			}
+			break
+		}
+		if typ == "unknown" && strings.HasSuffix(m, "_total") {
+			typ = "counter"
+		}
+		families[family] = []metricMetadata{{Type: typ}}
+	}
+	return families
+}
+
+// respond writes a successful API response
+func respond(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusOK, apiResponse{
+		Status: "success",
+		Data:   data,
+	})
+}
+
+// respondError writes an API error with the status code Prometheus uses for
+// the error type
+func respondError(c *gin.Context, errorType string, err error) {
+	var code int
+	switch errorType {
+	case errorBadData:
+		code = http.StatusBadRequest
+	case errorExecution:
+		code = http.StatusUnprocessableEntity
+	case errorCanceled:
+		code = 499
+	case errorTimeout:
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusInternalServerError
+	}
+
+	c.JSON(code, apiResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+// evaluationErrorType classifies an error returned by the evaluator
+func evaluationErrorType(err error) string {
+	var queryErr *promql.QueryError
+	switch {
+	case errors.As(err, &queryErr):
+		return errorBadData
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTimeout
+	case errors.Is(err, context.Canceled):
+		return errorCanceled
+	}
+	return errorExecution
+}
+
+// queryContext derives the evaluation context, honouring the timeout parameter
+func queryContext(c *gin.Context) (context.Context, context.CancelFunc, error) {
+	ctx := c.Request.Context()
+	if to := c.Request.Form.Get("timeout"); to != "" {
+		timeout, err := parseDurationParam(to)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid parameter \"timeout\": %w", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
+}
+
+// parseTimeRangeParams parses the optional start and end parameters
+func parseTimeRangeParams(c *gin.Context) (time.Time, time.Time, error) {
+	start, err := parseTimeParam(c, "start", minTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := parseTimeParam(c, "end", maxTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, end, nil
+}
+
+// parseTimeParam parses a time parameter given as a Unix timestamp or
+// RFC 3339 string. A zero defaultValue makes the parameter required.
+func parseTimeParam(c *gin.Context, name string, defaultValue time.Time) (time.Time, error) {
+	val := c.Request.Form.Get(name)
+	if val == "" {
+		if defaultValue.IsZero() {
+			return time.Time{}, fmt.Errorf("invalid parameter %q: missing value", name)
+		}
+		return defaultValue, nil
+	}
+	t, err := parseTime(val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid parameter %q: %w", name, err)
+	}
+	return t, nil
+}
+
+// parseTime parses a Unix timestamp with optional fractional seconds or an
+// RFC 3339 time
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(math.Round(frac*1000))*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDurationParam parses a duration given in seconds or as a PromQL
+// duration string
+func parseDurationParam(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := promql.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// formatSample renders a point as a [timestamp, "value"] pair, the way the
+// Prometheus API encodes samples
+func formatSample(point promql.MetricPoint) []interface{} {
+	return []interface{}{
+		float64(point.Timestamp.UnixMilli()) / 1000,
+		formatValue(point.Value),
+	}
+}
+
+// formatHistogramSample renders a native histogram point as a [timestamp,
+// histogram] pair. Each bucket is [boundary rule, lower, upper, count], where
+// the rule is 0 for buckets open on the left, 1 for buckets open on the right
+// and 3 for the zero bucket, which is closed on both sides.
+func formatHistogramSample(point promql.MetricPoint) []interface{} {
+	h := point.Histogram
+	buckets := [][]interface{}{}
+	for _, b := range h.Buckets() {
+		rule := 0
+		switch {
+		case b.LowerInclusive && b.UpperInclusive:
+			rule = 3
+		case b.LowerInclusive:
+			rule = 1
+		}
+		buckets = append(buckets, []interface{}{rule, formatValue(b.Lower), formatValue(b.Upper), formatValue(b.Count)})
+	}
+
+	return []interface{}{
+		float64(point.Timestamp.UnixMilli()) / 1000,
+		map[string]interface{}{
+			"count":   formatValue(h.Count),
+			"sum":     formatValue(h.Sum),
+			"buckets": buckets,
+		},
+	}
+}
+
+// formatValue renders a sample value, spelling out special values as
+// Prometheus does
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// sortedKeys returns the keys of a set in ascending order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
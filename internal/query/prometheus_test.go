@@ -0,0 +1,412 @@
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testBase is the time of the first sample stored by newTestRouter
+var testBase = time.Unix(1700000000, 0).UTC()
+
+// newTestRouter serves the Prometheus API over an in-memory storage holding
+// requests{method="get"} and requests{method="put"} every 30 seconds for a
+// minute from testBase, and a single limits series
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30})
+	t.Cleanup(func() { store.Close() })
+
+	var metrics []*storage.Metric
+	for i := 0; i <= 2; i++ {
+		ts := testBase.Add(time.Duration(i) * 30 * time.Second)
+		metrics = append(metrics,
+			&storage.Metric{Timestamp: ts, MetricName: "requests", Value: float64(i), Labels: `{"method":"get"}`, ServiceName: "api"},
+			&storage.Metric{Timestamp: ts, MetricName: "requests", Value: float64(10 + i), Labels: `{"method":"put"}`, ServiceName: "api"},
+		)
+	}
+	metrics = append(metrics, &storage.Metric{Timestamp: testBase, MetricName: "limits", Value: 100, ServiceName: "api"})
+	if err := store.InsertMetrics(metrics); err != nil {
+		t.Fatalf("InsertMetrics: %v", err)
+	}
+
+	router := gin.New()
+	NewService(store).RegisterPrometheusRoutes(router.Group("/api/v1"))
+	return router
+}
+
+// testResponse is a decoded API response envelope
+type testResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+// serve sends a request to the router and decodes the response envelope. A
+// non-nil form is sent form-encoded in a POST body.
+func serve(t *testing.T, router *gin.Engine, path string, params, form url.Values) (int, testResponse) {
+	t.Helper()
+	target := "/api/v1" + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if form != nil {
+		req = httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s returned invalid JSON %q: %v", target, w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+func TestPrometheusErrors(t *testing.T) {
+	router := newTestRouter(t)
+	start, end := "1700000000", "1700000060"
+
+	tests := []struct {
+		name      string
+		path      string
+		params    url.Values
+		code      int
+		errorType string
+		err       string
+	}{
+		{
+			name:      "invalid query",
+			path:      "/query",
+			params:    url.Values{"query": {"sum("}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "query": `,
+		},
+		{
+			name:      "invalid time",
+			path:      "/query",
+			params:    url.Values{"query": {"requests"}, "time": {"yesterday"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "time": cannot parse "yesterday" to a valid timestamp`,
+		},
+		{
+			name:      "invalid timeout",
+			path:      "/query",
+			params:    url.Values{"query": {"requests"}, "timeout": {"soon"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "timeout": cannot parse "soon" to a valid duration`,
+		},
+		{
+			name:      "evaluation failure",
+			path:      "/query",
+			params:    url.Values{"query": {"requests / ignoring(method) limits"}, "time": {start}},
+			code:      http.StatusUnprocessableEntity,
+			errorType: "execution",
+			err:       "multiple matches for labels",
+		},
+		{
+			name:      "missing start",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests"}, "end": {end}, "step": {"15"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "start": missing value`,
+		},
+		{
+			name:      "end before start",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests"}, "start": {end}, "end": {start}, "step": {"15"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       "end timestamp must not be before start time",
+		},
+		{
+			name:      "invalid step",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests"}, "start": {start}, "end": {end}, "step": {"often"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "step": cannot parse "often" to a valid duration`,
+		},
+		{
+			name:      "zero step",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests"}, "start": {start}, "end": {end}, "step": {"0"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       "zero or negative query resolution step widths are not accepted",
+		},
+		{
+			name:      "too many points",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests"}, "start": {start}, "end": {"1800000000"}, "step": {"1"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       "exceeded maximum resolution",
+		},
+		{
+			name:      "range vector",
+			path:      "/query_range",
+			params:    url.Values{"query": {"requests[1m]"}, "start": {start}, "end": {end}, "step": {"15"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid expression type "range vector" for range query`,
+		},
+		{
+			name:      "series without match[]",
+			path:      "/series",
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       "no match[] parameter provided",
+		},
+		{
+			name:      "series with an expression",
+			path:      "/series",
+			params:    url.Values{"match[]": {"sum(requests)"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       `invalid parameter "match[]": sum(requests) is not a series selector`,
+		},
+		{
+			name:      "invalid metadata limit",
+			path:      "/metadata",
+			params:    url.Values{"limit": {"ten"}},
+			code:      http.StatusBadRequest,
+			errorType: "bad_data",
+			err:       "limit must be a number",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := serve(t, router, tt.path, tt.params, nil)
+			if code != tt.code {
+				t.Errorf("status code = %d, want %d", code, tt.code)
+			}
+			if resp.Status != "error" || resp.ErrorType != tt.errorType {
+				t.Errorf("status %q, errorType %q, want error, %s", resp.Status, resp.ErrorType, tt.errorType)
+			}
+			if !strings.HasPrefix(resp.Error, tt.err) {
+				t.Errorf("error = %q, want prefix %q", resp.Error, tt.err)
+			}
+			if resp.Data != nil {
+				t.Errorf("error response has data %s", resp.Data)
+			}
+		})
+	}
+}
+
+// vectorData is the data of an instant query returning a vector
+type vectorData struct {
+	ResultType string `json:"resultType"`
+	Result     []struct {
+		Metric map[string]string `json:"metric"`
+		Value  [2]interface{}    `json:"value"`
+	} `json:"result"`
+}
+
+func TestPrometheusTimeParam(t *testing.T) {
+	router := newTestRouter(t)
+
+	tests := []struct {
+		time string
+		// want is the evaluation time in Unix seconds
+		want  float64
+		value string
+	}{
+		{"1700000030", 1700000030, "1"},
+		{"1700000045.25", 1700000045.25, "1"},
+		{"1700000060.001", 1700000060.001, "2"},
+		{"2023-11-14T22:13:50Z", 1700000030, "1"},
+		{"2023-11-14T23:14:20.5+01:00", 1700000060.5, "2"},
+		{"2023-11-14T22:13:49.999999999Z", 1700000029.999, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.time, func(t *testing.T) {
+			code, resp := serve(t, router, "/query", url.Values{"query": {`requests{method="get"}`}, "time": {tt.time}}, nil)
+			if code != http.StatusOK || resp.Status != "success" || resp.ErrorType != "" || resp.Error != "" {
+				t.Fatalf("got %d %+v, want success", code, resp)
+			}
+			var data vectorData
+			if err := json.Unmarshal(resp.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+			if data.ResultType != "vector" || len(data.Result) != 1 {
+				t.Fatalf("got %s with %d series, want one series", data.ResultType, len(data.Result))
+			}
+			if ts := data.Result[0].Value[0]; ts != tt.want {
+				t.Errorf("timestamp = %v, want %v", ts, tt.want)
+			}
+			if value := data.Result[0].Value[1]; value != tt.value {
+				t.Errorf("value = %v, want %s", value, tt.value)
+			}
+		})
+	}
+}
+
+// matrixData is the data of a range query
+type matrixData struct {
+	ResultType string `json:"resultType"`
+	Result     []struct {
+		Metric map[string]string `json:"metric"`
+		Values [][2]interface{}  `json:"values"`
+	} `json:"result"`
+}
+
+func TestPrometheusStepParam(t *testing.T) {
+	router := newTestRouter(t)
+
+	tests := []struct {
+		step string
+		// want is the timestamps of the points, in seconds after testBase
+		want []float64
+	}{
+		{"30", []float64{0, 30, 60}},
+		{"30s", []float64{0, 30, 60}},
+		{"1m", []float64{0, 60}},
+		{"22.5", []float64{0, 22.5, 45}},
+		{"1m30s", []float64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			// A POST with a form body takes the same parameters
+			for _, post := range []bool{false, true} {
+				params := url.Values{
+					"query": {`requests{method="get"}`},
+					"start": {"1700000000"},
+					"end":   {"2023-11-14T22:14:20Z"},
+					"step":  {tt.step},
+				}
+				var code int
+				var resp testResponse
+				if post {
+					code, resp = serve(t, router, "/query_range", nil, params)
+				} else {
+					code, resp = serve(t, router, "/query_range", params, nil)
+				}
+				if code != http.StatusOK || resp.Status != "success" {
+					t.Fatalf("got %d %+v, want success", code, resp)
+				}
+				var data matrixData
+				if err := json.Unmarshal(resp.Data, &data); err != nil {
+					t.Fatal(err)
+				}
+				if data.ResultType != "matrix" || len(data.Result) != 1 {
+					t.Fatalf("got %s with %d series, want one series", data.ResultType, len(data.Result))
+				}
+				var got []float64
+				for _, v := range data.Result[0].Values {
+					got = append(got, v[0].(float64)-float64(testBase.Unix()))
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("post %t: timestamps = %v, want %v", post, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrometheusMatchParam(t *testing.T) {
+	router := newTestRouter(t)
+	get := map[string]string{"__name__": "requests", "method": "get", "service_name": "api"}
+	put := map[string]string{"__name__": "requests", "method": "put", "service_name": "api"}
+	limits := map[string]string{"__name__": "limits", "service_name": "api"}
+
+	tests := []struct {
+		name   string
+		path   string
+		params url.Values
+		post   bool
+		want   interface{}
+	}{
+		{
+			name:   "series of one selector",
+			path:   "/series",
+			params: url.Values{"match[]": {`requests{method="put"}`}},
+			want:   []map[string]string{put},
+		},
+		{
+			name:   "series of several selectors",
+			path:   "/series",
+			params: url.Values{"match[]": {`requests{method=~"g.*"}`, "limits"}},
+			want:   []map[string]string{limits, get},
+		},
+		{
+			name:   "series by POST",
+			path:   "/series",
+			params: url.Values{"match[]": {`{service_name="api", method!="get"}`}},
+			post:   true,
+			want:   []map[string]string{limits, put},
+		},
+		{
+			name:   "series outside the time range",
+			path:   "/series",
+			params: url.Values{"match[]": {"requests"}, "start": {"1600000000"}, "end": {"1600000060"}},
+			want:   []map[string]string{},
+		},
+		{
+			name: "all label names",
+			path: "/labels",
+			want: []string{"__name__", "method", "service_name"},
+		},
+		{
+			name:   "label names of a selector",
+			path:   "/labels",
+			params: url.Values{"match[]": {"limits"}},
+			want:   []string{"__name__", "service_name"},
+		},
+		{
+			name:   "label values of several selectors",
+			path:   "/label/__name__/values",
+			params: url.Values{"match[]": {`requests{method="get"}`, "limits"}},
+			want:   []string{"limits", "requests"},
+		},
+		{
+			name:   "label values of a selector",
+			path:   "/label/method/values",
+			params: url.Values{"match[]": {`requests{method!="get"}`}},
+			want:   []string{"put"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var code int
+			var resp testResponse
+			if tt.post {
+				code, resp = serve(t, router, tt.path, nil, tt.params)
+			} else {
+				code, resp = serve(t, router, tt.path, tt.params, nil)
+			}
+			if code != http.StatusOK || resp.Status != "success" {
+				t.Fatalf("got %d %+v, want success", code, resp)
+			}
+			got := reflect.New(reflect.TypeOf(tt.want))
+			if err := json.Unmarshal(resp.Data, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), tt.want) {
+				t.Errorf("data = %s, want %v", resp.Data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"open-telemorph-prime/internal/histogram"
+)
+
+// aggregationGroup collects the samples that share a grouping label set
+type aggregationGroup struct {
+	metricName string
+	labels     map[string]string
+	series     []MetricSeries
+	values     []float64
+	histograms []*histogram.Exponential
+}
+
+// applyAggregation aggregates the samples of a vector per group. Groups are
+// formed from the labels listed in by, or from all labels except those listed
+// in without. param is the evaluated parameter of topk, bottomk, quantile and
+// count_values.
+func (ev *evaluation) applyAggregation(vector Vector, agg *AggregateExpr, param Value, ts time.Time) (Vector, error) {
+	var k int
+	var phi float64
+	var valueLabel string
+	switch agg.Op {
+	case "topk", "bottomk":
+		f := param.(Scalar).Value
+		if math.IsNaN(f) {
+			return nil, fmt.Errorf("parameter value is NaN for %s", agg.Op)
+		}
+		if f >= math.MaxInt64 {
+			k = math.MaxInt
+		} else {
+			k = int(f)
+		}
+		if k < 1 {
+			return Vector{}, nil
+		}
+	case "quantile":
+		phi = param.(Scalar).Value
+	case "count_values":
+		valueLabel = param.(String).Value
+		if valueLabel == "" || !utf8.ValidString(valueLabel) {
+			return nil, fmt.Errorf("invalid label name %q", valueLabel)
+		}
+	}
+
+	index := make(map[string]*aggregationGroup)
+	var groups []*aggregationGroup
+	for _, s := range vector {
+		metricName, labels := groupLabels(s, agg.Grouping, agg.Without)
+		if agg.Op == "count_values" {
+			// Every distinct value forms its own group
+			labels[valueLabel] = strconv.FormatFloat(s.Points[0].Value, 'f', -1, 64)
+		}
+
+		key := seriesKey(metricName, labels)
+		group, ok := index[key]
+		if !ok {
+			group = &aggregationGroup{metricName: metricName, labels: labels}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.series = append(group.series, s)
+		group.values = append(group.values, s.Points[0].Value)
+		if h := s.Points[0].Histogram; h != nil {
+			group.histograms = append(group.histograms, h)
+		}
+	}
+
+	result := Vector{}
+	for _, group := range groups {
+		var value float64
+		switch agg.Op {
+		case "sum":
+			if len(group.histograms) > 0 {
+				// Native histograms are merged; groups that mix them with
+				// float samples have no meaningful sum
+				if len(group.histograms) != len(group.series) {
+					continue
+				}
+				merged := group.histograms[0]
+				for _, h := range group.histograms[1:] {
+					merged = merged.Merge(h)
+				}
+				result = append(result, MetricSeries{
+					MetricName: group.metricName,
+					Labels:     group.labels,
+					Points:     []MetricPoint{{Timestamp: ts, Value: merged.Count, Histogram: merged}},
+				})
+				continue
+			}
+			value = sumValues(group.values)
+		case "avg":
+			value = sumValues(group.values) / float64(len(group.values))
+		case "count", "count_values":
+			value = float64(len(group.values))
+		case "group":
+			value = 1
+		case "min":
+			value = extremum(group.values, func(a, b float64) bool { return a < b })
+		case "max":
+			value = extremum(group.values, func(a, b float64) bool { return a > b })
+		case "stddev":
+			value = math.Sqrt(variance(group.values))
+		case "stdvar":
+			value = variance(group.values)
+		case "quantile":
+			value = quantile(phi, group.values)
+		case "topk", "bottomk":
+			result = append(result, selectK(group.series, k, agg.Op == "topk")...)
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported aggregation: %s", agg.Op)
+		}
+
+		result = append(result, MetricSeries{
+			MetricName: group.metricName,
+			Labels:     group.labels,
+			Points:     []MetricPoint{{Timestamp: ts, Value: value}},
+		})
+	}
+	return result, nil
+}
+
+// groupLabels returns the metric name and labels identifying the group a
+// series belongs to. The metric name only survives when grouping by __name__.
+func groupLabels(s MetricSeries, grouping []string, without bool) (string, map[string]string) {
+	labels := make(map[string]string)
+	if without {
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		for _, name := range grouping {
+			delete(labels, name)
+		}
+		return "", labels
+	}
+
+	var metricName string
+	for _, name := range grouping {
+		if name == MetricNameLabel {
+			metricName = s.MetricName
+			continue
+		}
+		if v, ok := s.Labels[name]; ok && v != "" {
+			labels[name] = v
+		}
+	}
+	return metricName, labels
+}
+
+// sumValues adds up values using Kahan summation to limit rounding error
+func sumValues(values []float64) float64 {
+	var sum, c float64
+	for _, v := range values {
+		if math.IsInf(v, 0) || math.IsInf(sum, 0) {
+			sum += v
+			continue
+		}
+		y := v - c
+		t := sum + y
+		c = (t - sum) - y
+		sum = t
+	}
+	return sum
+}
+
+// extremum returns the value preferred by better, ignoring NaN unless every
+// value is NaN
+func extremum(values []float64, better func(a, b float64) bool) float64 {
+	result := math.NaN()
+	for _, v := range values {
+		if math.IsNaN(result) || better(v, result) {
+			result = v
+		}
+	}
+	return result
+}
+
+// variance returns the population variance of values
+func variance(values []float64) float64 {
+	var mean, m2 float64
+	for i, v := range values {
+		delta := v - mean
+		mean += delta / float64(i+1)
+		m2 += delta * (v - mean)
+	}
+	return m2 / float64(len(values))
+}
+
+// quantile returns the phi-quantile of values, interpolating linearly between
+// the two nearest ranks
+func quantile(phi float64, values []float64) float64 {
+	switch {
+	case len(values) == 0 || math.IsNaN(phi):
+		return math.NaN()
+	case phi < 0:
+		return math.Inf(-1)
+	case phi > 1:
+		return math.Inf(1)
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := float64(len(sorted))
+	rank := phi * (n - 1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+// selectK returns the k largest (top) or smallest series, ordering NaN last
+func selectK(series []MetricSeries, k int, top bool) []MetricSeries {
+	sorted := append([]MetricSeries(nil), series...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Points[0].Value, sorted[j].Points[0].Value
+		if math.IsNaN(a) {
+			return false
+		}
+		if math.IsNaN(b) {
+			return true
+		}
+		if top {
+			return a > b
+		}
+		return a < b
+	})
+	if k < len(sorted) {
+		sorted = sorted[:k]
+	}
+	return sorted
+}
@@ -0,0 +1,154 @@
+package promql
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/storage"
+)
+
+func TestAggregations(t *testing.T) {
+	ts := time.Now().Truncate(time.Minute)
+	sample := func(labels string, value float64) *storage.Metric {
+		return &storage.Metric{
+			Timestamp:   ts.Add(-30 * time.Second),
+			MetricName:  "requests",
+			Value:       value,
+			Labels:      labels,
+			ServiceName: "api",
+		}
+	}
+	e := newTestEvaluator(t,
+		sample(`{"job":"api","instance":"a","method":"get"}`, 10),
+		sample(`{"job":"api","instance":"b","method":"get"}`, 20),
+		sample(`{"job":"api","instance":"a","method":"put"}`, 30),
+		sample(`{"job":"db","instance":"c","method":"get"}`, 10),
+		sample(`{"job":"db","instance":"d","method":"get"}`, 7),
+	)
+
+	apiGetA := `requests{instance="a", job="api", method="get", service_name="api"}`
+	apiGetB := `requests{instance="b", job="api", method="get", service_name="api"}`
+	apiPut := `requests{instance="a", job="api", method="put", service_name="api"}`
+	dbGetC := `requests{instance="c", job="db", method="get", service_name="api"}`
+	dbGetD := `requests{instance="d", job="db", method="get", service_name="api"}`
+
+	tests := []struct {
+		query string
+		// want maps each result series, as formatted by formatSeries, to
+		// its value
+		want map[string]float64
+		err  string
+	}{
+		{query: "sum(requests)", want: map[string]float64{`{}`: 77}},
+		{query: "sum by (job) (requests)", want: map[string]float64{`{job="api"}`: 60, `{job="db"}`: 17}},
+		{query: "sum(requests) by (job)", want: map[string]float64{`{job="api"}`: 60, `{job="db"}`: 17}},
+		{
+			query: "sum without (instance, method, service_name) (requests)",
+			want:  map[string]float64{`{job="api"}`: 60, `{job="db"}`: 17},
+		},
+		{
+			// Grouping by a label no series has forms a single group
+			query: "sum by (missing) (requests)",
+			want:  map[string]float64{`{}`: 77},
+		},
+		{
+			// The metric name only survives when grouped by
+			query: "sum by (__name__) (requests)",
+			want:  map[string]float64{`requests{}`: 77},
+		},
+		{query: "avg by (method) (requests)", want: map[string]float64{`{method="get"}`: 11.75, `{method="put"}`: 30}},
+		{query: "min by (job) (requests)", want: map[string]float64{`{job="api"}`: 10, `{job="db"}`: 7}},
+		{query: "max by (job) (requests)", want: map[string]float64{`{job="api"}`: 30, `{job="db"}`: 10}},
+		{query: "stddev by (job) (requests{job=\"db\"})", want: map[string]float64{`{job="db"}`: 1.5}},
+		{query: "stdvar by (job) (requests{job=\"db\"})", want: map[string]float64{`{job="db"}`: 2.25}},
+		{query: "group by (job) (requests)", want: map[string]float64{`{job="api"}`: 1, `{job="db"}`: 1}},
+		{
+			query: "count without (instance) (requests)",
+			want: map[string]float64{
+				`{job="api", method="get", service_name="api"}`: 2,
+				`{job="api", method="put", service_name="api"}`: 1,
+				`{job="db", method="get", service_name="api"}`:  2,
+			},
+		},
+		{
+			// topk and bottomk keep the labels of the series they select
+			query: "topk(1, requests)",
+			want:  map[string]float64{apiPut: 30},
+		},
+		{query: "topk by (job) (1, requests)", want: map[string]float64{apiPut: 30, dbGetC: 10}},
+		{query: "topk(2, requests{job=\"db\"})", want: map[string]float64{dbGetC: 10, dbGetD: 7}},
+		{query: "bottomk(2, requests{job=\"api\"})", want: map[string]float64{apiGetA: 10, apiGetB: 20}},
+		{query: "bottomk without (instance, method) (1, requests)", want: map[string]float64{apiGetA: 10, dbGetD: 7}},
+		{query: "topk(0, requests)", want: map[string]float64{}},
+		{query: "quantile(0.5, requests)", want: map[string]float64{`{}`: 10}},
+		{query: "quantile by (job) (0.5, requests)", want: map[string]float64{`{job="api"}`: 20, `{job="db"}`: 8.5}},
+		{query: "quantile(0.75, requests{job=\"api\"})", want: map[string]float64{`{}`: 25}},
+		{query: "quantile(2, requests)", want: map[string]float64{`{}`: math.Inf(1)}},
+		{query: "quantile(-1, requests)", want: map[string]float64{`{}`: math.Inf(-1)}},
+		{
+			query: `count_values("value", requests)`,
+			want: map[string]float64{
+				`{value="10"}`: 2,
+				`{value="20"}`: 1,
+				`{value="30"}`: 1,
+				`{value="7"}`:  1,
+			},
+		},
+		{
+			query: `count_values by (job) ("value", requests)`,
+			want: map[string]float64{
+				`{job="api", value="10"}`: 1,
+				`{job="api", value="20"}`: 1,
+				`{job="api", value="30"}`: 1,
+				`{job="db", value="10"}`:  1,
+				`{job="db", value="7"}`:   1,
+			},
+		},
+		{
+			// The value label replaces a label of the same name
+			query: `count_values without (instance, service_name) ("method", requests)`,
+			want: map[string]float64{
+				`{job="api", method="10"}`: 1,
+				`{job="api", method="20"}`: 1,
+				`{job="api", method="30"}`: 1,
+				`{job="db", method="10"}`:  1,
+				`{job="db", method="7"}`:   1,
+			},
+		},
+		{query: `count_values("", requests)`, err: `invalid label name ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evaluateInstant(t, e, tt.query, ts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+
+			got := make(map[string]float64)
+			for _, s := range result.Series {
+				key := formatSeries(s)
+				if _, dup := got[key]; dup {
+					t.Errorf("series %s returned twice", key)
+				}
+				got[key] = s.Points[0].Value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got series %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if v, ok := got[key]; !ok || v != value {
+					t.Errorf("%s = %v (present %t), want %v", key, v, ok, value)
+				}
+			}
+		})
+	}
+}
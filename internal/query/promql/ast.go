@@ -0,0 +1,523 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValueType describes the type a PromQL expression evaluates to
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// describe returns the type name used in error messages
+func (t ValueType) describe() string {
+	switch t {
+	case ValueTypeVector:
+		return "instant vector"
+	case ValueTypeMatrix:
+		return "range vector"
+	}
+	return string(t)
+}
+
+// PositionRange describes the byte offsets of a node within the query string.
+// End is exclusive.
+type PositionRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Node is a generic node of the PromQL abstract syntax tree
+type Node interface {
+	// String returns the canonical PromQL representation of the node
+	String() string
+	// PositionRange returns where the node appears in the original query
+	PositionRange() PositionRange
+}
+
+// Expr is a node that evaluates to a value
+type Expr interface {
+	Node
+	Type() ValueType
+}
+
+// MatchType is the operator of a label matcher
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (m MatchType) String() string {
+	switch m {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "?"
+}
+
+// LabelMatcher selects series by comparing a label value
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewLabelMatcher creates a label matcher, compiling the value for regex matchers.
+// Regular expressions are fully anchored as in Prometheus.
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether the label value satisfies the matcher.
+// A missing label is treated as the empty string.
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *LabelMatcher) String() string {
+	return fmt.Sprintf("%s%s%q", formatLabelName(m.Name), m.Type, m.Value)
+}
+
+// NumberLiteral is a floating point constant
+type NumberLiteral struct {
+	Val      float64
+	PosRange PositionRange
+}
+
+// StringLiteral is a quoted string constant
+type StringLiteral struct {
+	Val      string
+	PosRange PositionRange
+}
+
+// VectorSelector selects the latest sample of every matching series
+type VectorSelector struct {
+	Name          string
+	LabelMatchers []*LabelMatcher
+
+	// Offset shifts the evaluation time into the past
+	Offset time.Duration
+	// Timestamp pins evaluation to a fixed time set through the @ modifier
+	Timestamp *time.Time
+	// StartOrEnd is "start" or "end" when the @ modifier uses start() or end()
+	StartOrEnd string
+
+	PosRange PositionRange
+}
+
+// MatrixSelector selects a range of samples for every matching series
+type MatrixSelector struct {
+	// VectorSelector is always a *VectorSelector, possibly wrapped in parentheses
+	VectorSelector Expr
+	Range          time.Duration
+
+	EndPos int
+}
+
+// SubqueryExpr evaluates an instant vector expression over a range
+type SubqueryExpr struct {
+	Expr       Expr
+	Range      time.Duration
+	Step       time.Duration
+	Offset     time.Duration
+	Timestamp  *time.Time
+	StartOrEnd string
+
+	EndPos int
+}
+
+// Call is a function call such as rate(x[5m])
+type Call struct {
+	Func     Function
+	Args     []Expr
+	PosRange PositionRange
+}
+
+// AggregateExpr is an aggregation such as sum by (job) (x)
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+	PosRange PositionRange
+}
+
+// VectorMatchCardinality describes how samples are paired in a binary operation
+type VectorMatchCardinality string
+
+const (
+	CardOneToOne   VectorMatchCardinality = "one-to-one"
+	CardManyToOne  VectorMatchCardinality = "many-to-one"
+	CardOneToMany  VectorMatchCardinality = "one-to-many"
+	CardManyToMany VectorMatchCardinality = "many-to-many"
+)
+
+// VectorMatching describes the label matching rules of a binary operation
+type VectorMatching struct {
+	Card VectorMatchCardinality
+	// MatchingLabels are the labels listed in on() or ignoring()
+	MatchingLabels []string
+	// On is true for on(), false for ignoring()
+	On bool
+	// Include lists the extra labels of group_left/group_right
+	Include []string
+}
+
+// BinaryExpr is a binary operation such as a / b
+type BinaryExpr struct {
+	Op  string
+	LHS Expr
+	RHS Expr
+
+	VectorMatching *VectorMatching
+	// ReturnBool is set by the bool modifier on comparison operators
+	ReturnBool bool
+}
+
+// ParenExpr is an expression wrapped in parentheses
+type ParenExpr struct {
+	Expr     Expr
+	PosRange PositionRange
+}
+
+// UnaryExpr is a unary minus or plus
+type UnaryExpr struct {
+	Op       string
+	Expr     Expr
+	StartPos int
+}
+
+func (n *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (n *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (n *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (n *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (n *SubqueryExpr) Type() ValueType   { return ValueTypeMatrix }
+func (n *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (n *ParenExpr) Type() ValueType      { return n.Expr.Type() }
+func (n *UnaryExpr) Type() ValueType      { return n.Expr.Type() }
+
+func (n *Call) Type() ValueType {
+	switch n.Func.ReturnType {
+	case ReturnTypeScalar:
+		return ValueTypeScalar
+	case ReturnTypeRangeVector:
+		return ValueTypeMatrix
+	case ReturnTypeString:
+		return ValueTypeString
+	default:
+		return ValueTypeVector
+	}
+}
+
+func (n *BinaryExpr) Type() ValueType {
+	if n.LHS.Type() == ValueTypeScalar && n.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (n *NumberLiteral) PositionRange() PositionRange  { return n.PosRange }
+func (n *StringLiteral) PositionRange() PositionRange  { return n.PosRange }
+func (n *VectorSelector) PositionRange() PositionRange { return n.PosRange }
+func (n *Call) PositionRange() PositionRange           { return n.PosRange }
+func (n *AggregateExpr) PositionRange() PositionRange  { return n.PosRange }
+func (n *ParenExpr) PositionRange() PositionRange      { return n.PosRange }
+
+func (n *MatrixSelector) PositionRange() PositionRange {
+	return PositionRange{Start: n.VectorSelector.PositionRange().Start, End: n.EndPos}
+}
+
+func (n *SubqueryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: n.Expr.PositionRange().Start, End: n.EndPos}
+}
+
+func (n *BinaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: n.LHS.PositionRange().Start, End: n.RHS.PositionRange().End}
+}
+
+func (n *UnaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: n.StartPos, End: n.Expr.PositionRange().End}
+}
+
+func (n *NumberLiteral) String() string {
+	return formatFloat(n.Val)
+}
+
+func (n *StringLiteral) String() string {
+	return strconv.Quote(n.Val)
+}
+
+func (n *VectorSelector) String() string {
+	return n.selectorString() + formatModifiers(n.Offset, n.Timestamp, n.StartOrEnd)
+}
+
+// selectorString prints the metric name and matchers without modifiers
+func (n *VectorSelector) selectorString() string {
+	var matchers []string
+	for _, m := range n.LabelMatchers {
+		// The metric name is printed in front of the braces
+		if n.Name != "" && m.Name == MetricNameLabel && m.Type == MatchEqual {
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+
+	var b strings.Builder
+	switch {
+	case n.Name == "":
+	case isValidMetricName(n.Name):
+		b.WriteString(n.Name)
+	default:
+		matchers = append([]string{strconv.Quote(n.Name)}, matchers...)
+	}
+	if len(matchers) > 0 || b.Len() == 0 {
+		b.WriteString("{" + strings.Join(matchers, ", ") + "}")
+	}
+	return b.String()
+}
+
+func (n *MatrixSelector) String() string {
+	// Modifiers are printed after the range
+	vs, ok := unwrapParens(n.VectorSelector).(*VectorSelector)
+	if !ok {
+		return n.VectorSelector.String() + "[" + formatDuration(n.Range) + "]"
+	}
+	return vs.selectorString() + "[" + formatDuration(n.Range) + "]" +
+		formatModifiers(vs.Offset, vs.Timestamp, vs.StartOrEnd)
+}
+
+func (n *SubqueryExpr) String() string {
+	step := ""
+	if n.Step != 0 {
+		step = formatDuration(n.Step)
+	}
+	return n.Expr.String() + "[" + formatDuration(n.Range) + ":" + step + "]" +
+		formatModifiers(n.Offset, n.Timestamp, n.StartOrEnd)
+}
+
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+	return n.Func.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (n *AggregateExpr) String() string {
+	var b strings.Builder
+	b.WriteString(n.Op)
+	if n.Without || len(n.Grouping) > 0 {
+		if n.Without {
+			b.WriteString(" without ")
+		} else {
+			b.WriteString(" by ")
+		}
+		b.WriteString("(" + formatLabelList(n.Grouping) + ") ")
+	}
+	b.WriteString("(")
+	if n.Param != nil {
+		b.WriteString(n.Param.String() + ", ")
+	}
+	b.WriteString(n.Expr.String() + ")")
+	return b.String()
+}
+
+func (n *BinaryExpr) String() string {
+	var b strings.Builder
+	b.WriteString(n.LHS.String() + " " + n.Op)
+	if n.ReturnBool {
+		b.WriteString(" bool")
+	}
+	if vm := n.VectorMatching; vm != nil {
+		if vm.On || len(vm.MatchingLabels) > 0 {
+			if vm.On {
+				b.WriteString(" on")
+			} else {
+				b.WriteString(" ignoring")
+			}
+			b.WriteString("(" + formatLabelList(vm.MatchingLabels) + ")")
+		}
+		switch vm.Card {
+		case CardManyToOne:
+			b.WriteString(" group_left(" + formatLabelList(vm.Include) + ")")
+		case CardOneToMany:
+			b.WriteString(" group_right(" + formatLabelList(vm.Include) + ")")
+		}
+	}
+	b.WriteString(" " + n.RHS.String())
+	return b.String()
+}
+
+func (n *ParenExpr) String() string {
+	return "(" + n.Expr.String() + ")"
+}
+
+func (n *UnaryExpr) String() string {
+	return n.Op + n.Expr.String()
+}
+
+// MetricNameLabel is the reserved label holding the metric name
+const MetricNameLabel = "__name__"
+
+// Inspect walks the tree depth-first, calling f for every node until f
+// returns false for a subtree
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	for _, child := range children(node) {
+		Inspect(child, f)
+	}
+}
+
+func children(node Node) []Node {
+	switch n := node.(type) {
+	case *MatrixSelector:
+		return []Node{n.VectorSelector}
+	case *SubqueryExpr:
+		return []Node{n.Expr}
+	case *Call:
+		nodes := make([]Node, len(n.Args))
+		for i, arg := range n.Args {
+			nodes[i] = arg
+		}
+		return nodes
+	case *AggregateExpr:
+		if n.Param != nil {
+			return []Node{n.Param, n.Expr}
+		}
+		return []Node{n.Expr}
+	case *BinaryExpr:
+		return []Node{n.LHS, n.RHS}
+	case *ParenExpr:
+		return []Node{n.Expr}
+	case *UnaryExpr:
+		return []Node{n.Expr}
+	}
+	return nil
+}
+
+// unwrapParens strips any number of enclosing parentheses
+func unwrapParens(expr Expr) Expr {
+	for {
+		p, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+func formatModifiers(offset time.Duration, ts *time.Time, startOrEnd string) string {
+	var b strings.Builder
+	switch {
+	case startOrEnd != "":
+		b.WriteString(" @ " + startOrEnd + "()")
+	case ts != nil:
+		b.WriteString(" @ " + formatFloat(float64(ts.UnixMilli())/1000))
+	}
+	switch {
+	case offset > 0:
+		b.WriteString(" offset " + formatDuration(offset))
+	case offset < 0:
+		b.WriteString(" offset -" + formatDuration(-offset))
+	}
+	return b.String()
+}
+
+func formatLabelName(name string) string {
+	if isValidLabelName(name) {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+func formatLabelList(labels []string) string {
+	formatted := make([]string, len(labels))
+	for i, l := range labels {
+		formatted[i] = formatLabelName(l)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatDuration prints a duration using the PromQL units (1h30m, 5m, 500ms)
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	ms := int64(d / time.Millisecond)
+	units := []struct {
+		suffix string
+		ms     int64
+	}{
+		{"y", 365 * 24 * 60 * 60 * 1000},
+		{"w", 7 * 24 * 60 * 60 * 1000},
+		{"d", 24 * 60 * 60 * 1000},
+		{"h", 60 * 60 * 1000},
+		{"m", 60 * 1000},
+		{"s", 1000},
+		{"ms", 1},
+	}
+	var b strings.Builder
+	for _, u := range units {
+		if ms >= u.ms {
+			b.WriteString(strconv.FormatInt(ms/u.ms, 10) + u.suffix)
+			ms %= u.ms
+		}
+	}
+	return b.String()
+}
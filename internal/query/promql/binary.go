@@ -0,0 +1,374 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// evalBinary evaluates a binary operation between scalars and instant vectors
+func (ev *evaluation) evalBinary(n *BinaryExpr, ts time.Time) (Value, error) {
+	lhs, err := ev.eval(n.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(n.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			value, keep := scalarBinop(n.Op, l.Value, r.Value)
+			if isComparisonOperator(n.Op) {
+				value = boolValue(keep)
+			}
+			return Scalar{Timestamp: ts, Value: value}, nil
+		case Vector:
+			return vectorScalarBinop(n, r, l.Value, true), nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			return vectorScalarBinop(n, l, r.Value, false), nil
+		case Vector:
+			switch n.Op {
+			case "and":
+				return vectorAnd(l, r, n.VectorMatching), nil
+			case "or":
+				return vectorOr(l, r, n.VectorMatching), nil
+			case "unless":
+				return vectorUnless(l, r, n.VectorMatching), nil
+			}
+			return vectorBinop(n, l, r)
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported operand types %s and %s for %s", lhs.Type(), rhs.Type(), n.Op)
+}
+
+// evalUnary evaluates unary plus and minus
+func (ev *evaluation) evalUnary(n *UnaryExpr, ts time.Time) (Value, error) {
+	val, err := ev.eval(n.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op != "-" {
+		return val, nil
+	}
+
+	switch v := val.(type) {
+	case Scalar:
+		return Scalar{Timestamp: v.Timestamp, Value: -v.Value}, nil
+	case Vector:
+		return mapVector(v, func(f float64) float64 { return -f }), nil
+	}
+	return nil, fmt.Errorf("unary minus not supported on %s", val.Type())
+}
+
+// scalarBinop applies an arithmetic or comparison operator. For comparisons
+// the result is the left operand and keep reports whether the comparison held.
+func scalarBinop(op string, lhs, rhs float64) (value float64, keep bool) {
+	switch op {
+	case "+":
+		return lhs + rhs, true
+	case "-":
+		return lhs - rhs, true
+	case "*":
+		return lhs * rhs, true
+	case "/":
+		return lhs / rhs, true
+	case "%":
+		return math.Mod(lhs, rhs), true
+	case "^":
+		return math.Pow(lhs, rhs), true
+	case "atan2":
+		return math.Atan2(lhs, rhs), true
+	case "==":
+		return lhs, lhs == rhs
+	case "!=":
+		return lhs, lhs != rhs
+	case ">":
+		return lhs, lhs > rhs
+	case "<":
+		return lhs, lhs < rhs
+	case ">=":
+		return lhs, lhs >= rhs
+	case "<=":
+		return lhs, lhs <= rhs
+	}
+	panic(fmt.Sprintf("promql: unknown binary operator %q", op))
+}
+
+// compareBinop applies op to a pair of samples, returning the resulting value
+// and whether the sample is part of the result. Comparisons without bool
+// filter and keep the value of the left operand.
+func compareBinop(n *BinaryExpr, lhs, rhs float64) (float64, bool) {
+	value, keep := scalarBinop(n.Op, lhs, rhs)
+	if isComparisonOperator(n.Op) && n.ReturnBool {
+		return boolValue(keep), true
+	}
+	return value, keep
+}
+
+// boolValue converts a comparison outcome into 1 or 0
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// dropsMetricName reports whether the result of the operation loses the
+// metric name. Only filtering comparisons leave samples unchanged.
+func dropsMetricName(n *BinaryExpr) bool {
+	return !isComparisonOperator(n.Op) || n.ReturnBool
+}
+
+// vectorScalarBinop applies op between every sample of a vector and a scalar.
+// swap is set when the scalar is the left operand.
+func vectorScalarBinop(n *BinaryExpr, vector Vector, scalar float64, swap bool) Vector {
+	result := Vector{}
+	for _, s := range vector {
+		lhs, rhs := s.Points[0].Value, scalar
+		if swap {
+			lhs, rhs = rhs, lhs
+		}
+		value, keep := compareBinop(n, lhs, rhs)
+		if !keep {
+			continue
+		}
+		if isComparisonOperator(n.Op) && !n.ReturnBool {
+			// A filtering comparison always keeps the vector sample
+			value = s.Points[0].Value
+		}
+
+		metricName := s.MetricName
+		if dropsMetricName(n) {
+			metricName = ""
+		}
+		result = append(result, MetricSeries{
+			MetricName: metricName,
+			Labels:     s.Labels,
+			Points:     []MetricPoint{{Timestamp: s.Points[0].Timestamp, Value: value}},
+		})
+	}
+	return result
+}
+
+// vectorBinop applies an arithmetic or comparison operator between two
+// vectors, pairing samples according to the vector matching
+func vectorBinop(n *BinaryExpr, lhs, rhs Vector) (Vector, error) {
+	vm := n.VectorMatching
+	if vm.Card == CardManyToMany {
+		return nil, fmt.Errorf("many-to-many only allowed for set operators")
+	}
+
+	// The "one" side of the match is always indexed; for group_right the
+	// operands are swapped so that the "many" side is iterated
+	many, one := lhs, rhs
+	if vm.Card == CardOneToMany {
+		many, one = rhs, lhs
+	}
+
+	oneSide := make(map[string]MetricSeries, len(one))
+	for _, s := range one {
+		sig := matchingSignature(s, vm)
+		if _, dup := oneSide[sig]; dup {
+			side := "right"
+			if vm.Card == CardOneToMany {
+				side = "left"
+			}
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", formatMatchGroup(matchGroup(s, vm)), side)
+		}
+		oneSide[sig] = s
+	}
+
+	matched := make(map[string]bool)
+	inserted := make(map[string]bool)
+	result := Vector{}
+	for _, ms := range many {
+		sig := matchingSignature(ms, vm)
+		os, ok := oneSide[sig]
+		if !ok {
+			continue
+		}
+
+		if vm.Card == CardOneToOne {
+			if matched[sig] {
+				return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matched[sig] = true
+		}
+
+		l, r := ms.Points[0].Value, os.Points[0].Value
+		if vm.Card == CardOneToMany {
+			l, r = r, l
+		}
+		value, keep := compareBinop(n, l, r)
+		if !keep {
+			continue
+		}
+
+		metricName, labels := resultLabels(n, ms, os)
+		if vm.Card != CardOneToOne {
+			key := seriesKey(metricName, labels)
+			if inserted[key] {
+				return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			inserted[key] = true
+		}
+
+		result = append(result, MetricSeries{
+			MetricName: metricName,
+			Labels:     labels,
+			Points:     []MetricPoint{{Timestamp: ms.Points[0].Timestamp, Value: value}},
+		})
+	}
+	return result, nil
+}
+
+// resultLabels computes the labels of a vector binop result from the sample
+// on the "many" side and its match on the "one" side
+func resultLabels(n *BinaryExpr, many, one MetricSeries) (string, map[string]string) {
+	vm := n.VectorMatching
+	metricName := many.MetricName
+	if dropsMetricName(n) {
+		metricName = ""
+	}
+
+	labels := make(map[string]string, len(many.Labels))
+	if vm.Card == CardOneToOne {
+		if vm.On {
+			for _, name := range vm.MatchingLabels {
+				if v, ok := many.Labels[name]; ok {
+					labels[name] = v
+				}
+			}
+			if !containsString(vm.MatchingLabels, MetricNameLabel) {
+				metricName = ""
+			}
+		} else {
+			for k, v := range many.Labels {
+				labels[k] = v
+			}
+			for _, name := range vm.MatchingLabels {
+				delete(labels, name)
+			}
+		}
+		return metricName, labels
+	}
+
+	for k, v := range many.Labels {
+		labels[k] = v
+	}
+	for _, name := range vm.Include {
+		if v, ok := one.Labels[name]; ok && v != "" {
+			labels[name] = v
+		} else {
+			delete(labels, name)
+		}
+	}
+	return metricName, labels
+}
+
+// matchingSignature identifies the match group of a sample: the labels listed
+// in on(), or every label except those listed in ignoring() and the metric name
+func matchingSignature(s MetricSeries, vm *VectorMatching) string {
+	return seriesKey(matchGroup(s, vm))
+}
+
+// matchGroup returns the metric name and labels a sample is matched on
+func matchGroup(s MetricSeries, vm *VectorMatching) (string, map[string]string) {
+	labels := make(map[string]string)
+	var metricName string
+	if vm.On {
+		for _, name := range vm.MatchingLabels {
+			if name == MetricNameLabel {
+				metricName = s.MetricName
+			} else if v, ok := s.Labels[name]; ok && v != "" {
+				labels[name] = v
+			}
+		}
+	} else {
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		for _, name := range vm.MatchingLabels {
+			delete(labels, name)
+		}
+	}
+	return metricName, labels
+}
+
+// formatMatchGroup renders a match group the way a selector is written
+func formatMatchGroup(metricName string, labels map[string]string) string {
+	parts := make([]string, 0, len(labels)+1)
+	if metricName != "" {
+		parts = append(parts, fmt.Sprintf("%s=%q", MetricNameLabel, metricName))
+	}
+	for k, v := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%q", formatLabelName(k), v))
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// vectorAnd keeps the left samples that have a match on the right
+func vectorAnd(lhs, rhs Vector, vm *VectorMatching) Vector {
+	rightSigs := signatures(rhs, vm)
+	result := Vector{}
+	for _, s := range lhs {
+		if rightSigs[matchingSignature(s, vm)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// vectorOr keeps all left samples plus the right samples without a match on
+// the left
+func vectorOr(lhs, rhs Vector, vm *VectorMatching) Vector {
+	leftSigs := signatures(lhs, vm)
+	result := append(Vector{}, lhs...)
+	for _, s := range rhs {
+		if !leftSigs[matchingSignature(s, vm)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// vectorUnless keeps the left samples that have no match on the right
+func vectorUnless(lhs, rhs Vector, vm *VectorMatching) Vector {
+	rightSigs := signatures(rhs, vm)
+	result := Vector{}
+	for _, s := range lhs {
+		if !rightSigs[matchingSignature(s, vm)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// signatures returns the set of match groups present in a vector
+func signatures(vector Vector, vm *VectorMatching) map[string]bool {
+	sigs := make(map[string]bool, len(vector))
+	for _, s := range vector {
+		sigs[matchingSignature(s, vm)] = true
+	}
+	return sigs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package promql
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/storage"
+)
+
+func TestVectorMatching(t *testing.T) {
+	ts := time.Now().Truncate(time.Minute)
+	sample := func(name, labels string, value float64) *storage.Metric {
+		return &storage.Metric{
+			Timestamp:   ts.Add(-30 * time.Second),
+			MetricName:  name,
+			Value:       value,
+			Labels:      labels,
+			ServiceName: "api",
+		}
+	}
+	e := newTestEvaluator(t,
+		sample("requests", `{"method":"get","code":"200"}`, 90),
+		sample("requests", `{"method":"get","code":"500"}`, 10),
+		sample("requests", `{"method":"put","code":"200"}`, 20),
+		sample("errors", `{"method":"get","code":"200"}`, 1),
+		sample("limits", `{"method":"get"}`, 100),
+		sample("limits", `{"method":"put"}`, 50),
+	)
+
+	tests := []struct {
+		query string
+		// want maps the labels of each result series, as formatted by
+		// formatMatchGroup, to its value
+		want map[string]float64
+		err  string
+	}{
+		{
+			query: "requests / ignoring(code) limits",
+			err:   "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)",
+		},
+		{
+			query: "requests / on(method) limits",
+			err:   "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)",
+		},
+		{
+			// One-to-one matching keeps only the matching labels
+			query: `requests{code="200"} / on(method) limits`,
+			want: map[string]float64{
+				`{method="get"}`: 0.9,
+				`{method="put"}`: 0.4,
+			},
+		},
+		{
+			query: "requests / on(method) group_left limits",
+			want: map[string]float64{
+				`{code="200", method="get", service_name="api"}`: 0.9,
+				`{code="200", method="put", service_name="api"}`: 0.4,
+				`{code="500", method="get", service_name="api"}`: 0.1,
+			},
+		},
+		{
+			query: "limits / on(method) group_left requests",
+			err:   `found duplicate series for the match group {method="get"} on the right hand-side of the operation`,
+		},
+		{
+			query: "limits / on(method) group_right requests",
+			want: map[string]float64{
+				`{code="200", method="get", service_name="api"}`: 100.0 / 90,
+				`{code="200", method="put", service_name="api"}`: 2.5,
+				`{code="500", method="get", service_name="api"}`: 10,
+			},
+		},
+		{
+			query: "requests / on(method) group_right limits",
+			err:   `found duplicate series for the match group {method="get"} on the left hand-side of the operation`,
+		},
+		{
+			// Dropping the metric name leaves two results with the same labels
+			query: `{__name__=~"requests|errors", code="200"} / on(method) group_left limits`,
+			err:   "multiple matches for labels: grouping labels must ensure unique matches",
+		},
+		{
+			query: "requests + on(method) requests",
+			err:   `found duplicate series for the match group {method="get"} on the right hand-side of the operation`,
+		},
+		{
+			query: "requests * 10 > bool on(method) group_left limits",
+			want: map[string]float64{
+				`{code="200", method="get", service_name="api"}`: 1,
+				`{code="200", method="put", service_name="api"}`: 1,
+				`{code="500", method="get", service_name="api"}`: 0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evaluateInstant(t, e, tt.query, ts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EvaluateInstant: %v", err)
+			}
+
+			got := make(map[string]float64)
+			for _, s := range result.Series {
+				got[formatMatchGroup(s.MetricName, s.Labels)] = s.Points[0].Value
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for labels, want := range tt.want {
+				if value, ok := got[labels]; !ok || math.Abs(value-want) > 1e-9 {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestScalarBinaryOperators(t *testing.T) {
+	e := newTestEvaluator(t)
+	ts := time.Now()
+
+	tests := []struct {
+		query string
+		want  float64
+	}{
+		{"-1 ^ 2", -1},
+		{"(-1) ^ 2", 1},
+		{"2 ^ 3 ^ 2", 512},
+		{"1 - 2 - 3", -4},
+		{"1 + 2 * 3", 7},
+		{"7 % 4 * 2", 6},
+		{"-7 % 4", -3},
+		{"2 * 3 > bool 5", 1},
+		{"1 + 1 == bool 2", 1},
+		{"1 / 0", math.Inf(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evaluateInstant(t, e, tt.query, ts)
+			if err != nil {
+				t.Fatalf("EvaluateInstant: %v", err)
+			}
+			if result.Type != string(ValueTypeScalar) {
+				t.Fatalf("result type = %s, want scalar", result.Type)
+			}
+			if got := result.Series[0].Points[0].Value; got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
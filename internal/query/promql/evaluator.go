@@ -2,18 +2,50 @@ package promql
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"math"
 	"sort"
 	"time"
+
+	"open-telemorph-prime/internal/histogram"
+	"open-telemorph-prime/internal/storage"
+)
+
+const (
+	// DefaultLookbackDelta is how far back an instant vector selector looks
+	// for the most recent sample of a series
+	DefaultLookbackDelta = 5 * time.Minute
+
+	// DefaultSubqueryStep is the subquery resolution used for instant
+	// queries when the subquery does not specify one
+	DefaultSubqueryStep = time.Minute
+
+	// MaxPointsPerSeries bounds the number of steps of a range query
+	MaxPointsPerSeries = 11000
 )
 
-// MetricPoint represents a single data point
+// QueryError is returned for a query that cannot be evaluated as requested,
+// such as a range query for a range vector or one exceeding
+// MaxPointsPerSeries. It is a mistake in the request rather than a failure
+// to evaluate.
+type QueryError struct {
+	Err string
+}
+
+func (e *QueryError) Error() string {
+	return e.Err
+}
+
+func queryErrorf(format string, args ...interface{}) error {
+	return &QueryError{Err: fmt.Sprintf(format, args...)}
+}
+
+// MetricPoint represents a single data point. Native histogram samples carry
+// the histogram and its observation count as Value.
 type MetricPoint struct {
 	Timestamp time.Time
 	Value     float64
 	Labels    map[string]string
+	Histogram *histogram.Exponential
 }
 
 // MetricSeries represents a time series of metric points
@@ -26,415 +58,673 @@ type MetricSeries struct {
 // QueryResult represents the result of a PromQL query
 type QueryResult struct {
 	Series []MetricSeries
-	Type   string // "vector", "matrix", "scalar"
+	Type   string // "vector", "matrix", "scalar", "string"
+	// String holds the value of a string result
+	String string
 }
 
+// Value is the result of evaluating an expression at a single timestamp
+type Value interface {
+	Type() ValueType
+}
+
+// Scalar is a single floating point value
+type Scalar struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// String is a string value
+type String struct {
+	Timestamp time.Time
+	Value     string
+}
+
+// Vector is a set of series holding exactly one point each, all at the
+// evaluation timestamp
+type Vector []MetricSeries
+
+// Matrix is a set of series holding a range of points each
+type Matrix []MetricSeries
+
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+
 // Evaluator handles PromQL query evaluation
 type Evaluator struct {
-	db *sql.DB
+	storage       storage.Storage
+	lookbackDelta time.Duration
 }
 
-// NewEvaluator creates a new PromQL evaluator
-func NewEvaluator(db *sql.DB) *Evaluator {
-	return &Evaluator{db: db}
+// NewEvaluator creates a new PromQL evaluator reading the series in store
+func NewEvaluator(store storage.Storage) *Evaluator {
+	return &Evaluator{
+		storage:       store,
+		lookbackDelta: DefaultLookbackDelta,
+	}
+}
+
+// EvaluateInstant evaluates an expression at a single timestamp
+func (e *Evaluator) EvaluateInstant(ctx context.Context, expr Expr, ts time.Time) (*QueryResult, error) {
+	ev, err := e.newEvaluation(ctx, expr, ts, ts, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := ev.eval(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case Vector:
+		if call, ok := unwrapParens(expr).(*Call); !ok || !sortFunctions[call.Func.Name] {
+			sortSeries(v)
+		}
+		return &QueryResult{Series: v, Type: string(ValueTypeVector)}, nil
+	case Matrix:
+		sortSeries(v)
+		return &QueryResult{Series: v, Type: string(ValueTypeMatrix)}, nil
+	case Scalar:
+		return &QueryResult{
+			Series: []MetricSeries{{
+				Labels: map[string]string{},
+				Points: []MetricPoint{{Timestamp: ts, Value: v.Value}},
+			}},
+			Type: string(ValueTypeScalar),
+		}, nil
+	case String:
+		return &QueryResult{
+			Series: []MetricSeries{{
+				Labels: map[string]string{},
+				Points: []MetricPoint{{Timestamp: ts}},
+			}},
+			Type:   string(ValueTypeString),
+			String: v.Value,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported result type %s", val.Type())
 }
 
-// Evaluate executes a parsed PromQL query
-func (e *Evaluator) Evaluate(ctx context.Context, query *Query, startTime, endTime time.Time) (*QueryResult, error) {
-	// Get base metric data
-	series, err := e.getMetricSeries(ctx, query, startTime, endTime)
+// EvaluateRange evaluates an expression at every step between start and end,
+// returning one series per distinct label set
+func (e *Evaluator) EvaluateRange(ctx context.Context, expr Expr, start, end time.Time, step time.Duration) (*QueryResult, error) {
+	if step <= 0 {
+		return nil, queryErrorf("zero or negative query resolution step widths are not accepted")
+	}
+	if end.Before(start) {
+		return nil, queryErrorf("end timestamp must not be before start time")
+	}
+	if end.Sub(start)/step > MaxPointsPerSeries {
+		return nil, queryErrorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution (?step=XX)", MaxPointsPerSeries)
+	}
+	if t := expr.Type(); t != ValueTypeVector && t != ValueTypeScalar {
+		return nil, queryErrorf("invalid expression type %q for range query, must be scalar or instant vector", t.describe())
+	}
+
+	ev, err := e.newEvaluation(ctx, expr, start, end, step)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metric series: %w", err)
+		return nil, err
 	}
 
-	// Apply function if specified
-	if query.Function != "" {
-		series, err = e.applyFunction(series, query.Function, query.Range)
+	matrix := newSeriesBuilder()
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		val, err := ev.eval(expr, ts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to apply function %s: %w", query.Function, err)
+			return nil, err
+		}
+
+		switch v := val.(type) {
+		case Vector:
+			for _, s := range v {
+				matrix.add(s.MetricName, s.Labels, s.Points...)
+			}
+		case Scalar:
+			matrix.add("", map[string]string{}, MetricPoint{Timestamp: ts, Value: v.Value})
+		default:
+			return nil, fmt.Errorf("unexpected %s value in range query", val.Type())
 		}
 	}
 
-	// Apply aggregation if specified
-	if query.Aggregation != nil {
-		series, err = e.applyAggregation(series, query.Aggregation)
+	return &QueryResult{Series: matrix.series(), Type: string(ValueTypeMatrix)}, nil
+}
+
+// Series returns the label sets of all series matching any of the selectors
+// that have samples between start and end. The metric name is reported
+// under the __name__ label.
+func (e *Evaluator) Series(ctx context.Context, selectors []*VectorSelector, start, end time.Time) ([]map[string]string, error) {
+	seen := make(map[string]bool)
+	var result []map[string]string
+	for _, selector := range selectors {
+		series, err := e.getMetricSeries(ctx, selector, start, end)
 		if err != nil {
-			return nil, fmt.Errorf("failed to apply aggregation: %w", err)
+			return nil, fmt.Errorf("failed to get metric series: %w", err)
+		}
+		for _, s := range series {
+			key := seriesKey(s.MetricName, s.Labels)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			labels := make(map[string]string, len(s.Labels)+1)
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			labels[MetricNameLabel] = s.MetricName
+			result = append(result, labels)
 		}
 	}
 
-	return &QueryResult{
-		Series: series,
-		Type:   "vector",
-	}, nil
+	sort.Slice(result, func(i, j int) bool {
+		return seriesKey("", result[i]) < seriesKey("", result[j])
+	})
+	return result, nil
 }
 
-// getMetricSeries retrieves metric data from the database
-func (e *Evaluator) getMetricSeries(ctx context.Context, query *Query, startTime, endTime time.Time) ([]MetricSeries, error) {
-	// Build SQL query
-	sqlQuery := `
-		SELECT timestamp, value, labels, service_name
-		FROM metrics 
-		WHERE metric_name = ? 
-		AND timestamp >= ? 
-		AND timestamp <= ?
-	`
+// evaluation holds the state of a single query execution
+type evaluation struct {
+	ctx      context.Context
+	e        *Evaluator
+	start    time.Time
+	end      time.Time
+	interval time.Duration
 
-	args := []interface{}{query.MetricName, startTime.Unix(), endTime.Unix()}
+	// selected holds the raw samples fetched for every selector of the query
+	selected map[*VectorSelector][]MetricSeries
+}
 
-	// Add label filters
-	for key, value := range query.Labels {
-		sqlQuery += fmt.Sprintf(" AND JSON_EXTRACT(labels, '$.%s') = ?", key)
-		args = append(args, value)
+// newEvaluation prepares an evaluation, loading the samples every selector
+// of the expression needs for the whole query range up front
+func (e *Evaluator) newEvaluation(ctx context.Context, expr Expr, start, end time.Time, interval time.Duration) (*evaluation, error) {
+	ev := &evaluation{
+		ctx:      ctx,
+		e:        e,
+		start:    start,
+		end:      end,
+		interval: interval,
+		selected: make(map[*VectorSelector][]MetricSeries),
 	}
 
-	sqlQuery += " ORDER BY timestamp ASC"
+	ranges := make(map[*VectorSelector]timeRange)
+	ev.collectSelectorRanges(expr, timeRange{start, end}, ranges)
 
-	rows, err := e.db.QueryContext(ctx, sqlQuery, args...)
-	if err != nil {
-		return nil, fmt.Errorf("database query failed: %w", err)
+	for selector, r := range ranges {
+		series, err := e.getMetricSeries(ctx, selector, r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get metric series: %w", err)
+		}
+		ev.selected[selector] = series
 	}
-	defer rows.Close()
+	return ev, nil
+}
 
-	// Group by labels to create series
-	seriesMap := make(map[string]*MetricSeries)
+// timeRange is an inclusive time interval
+type timeRange struct {
+	min time.Time
+	max time.Time
+}
 
-	for rows.Next() {
-		var timestamp int64
-		var value float64
-		var labelsJSON string
-		var serviceName string
+func (r timeRange) union(other timeRange) timeRange {
+	if other.min.Before(r.min) {
+		r.min = other.min
+	}
+	if other.max.After(r.max) {
+		r.max = other.max
+	}
+	return r
+}
 
-		if err := rows.Scan(&timestamp, &value, &labelsJSON, &serviceName); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+// collectSelectorRanges computes the sample range each selector reads when the
+// enclosing expression is evaluated at every time within evalRange
+func (ev *evaluation) collectSelectorRanges(node Node, evalRange timeRange, ranges map[*VectorSelector]timeRange) {
+	add := func(vs *VectorSelector, r timeRange) {
+		if existing, ok := ranges[vs]; ok {
+			r = r.union(existing)
 		}
+		ranges[vs] = r
+	}
 
-		// Parse labels JSON (simplified - in real implementation, use proper JSON parsing)
-		labels := map[string]string{
-			"service": serviceName,
-		}
+	switch n := node.(type) {
+	case *VectorSelector:
+		r := ev.shiftRange(evalRange, n.Timestamp, n.StartOrEnd, n.Offset)
+		r.min = r.min.Add(-ev.e.lookbackDelta)
+		add(n, r)
+		return
+
+	case *MatrixSelector:
+		vs := unwrapParens(n.VectorSelector).(*VectorSelector)
+		r := ev.shiftRange(evalRange, vs.Timestamp, vs.StartOrEnd, vs.Offset)
+		r.min = r.min.Add(-n.Range)
+		add(vs, r)
+		return
+
+	case *SubqueryExpr:
+		r := ev.shiftRange(evalRange, n.Timestamp, n.StartOrEnd, n.Offset)
+		r.min = r.min.Add(-n.Range)
+		ev.collectSelectorRanges(n.Expr, r, ranges)
+		return
+	}
 
-		// Create series key for grouping
-		seriesKey := e.createSeriesKey(labels)
+	for _, child := range children(node) {
+		ev.collectSelectorRanges(child, evalRange, ranges)
+	}
+}
 
-		// Get or create series
-		series, exists := seriesMap[seriesKey]
-		if !exists {
-			series = &MetricSeries{
-				MetricName: query.MetricName,
-				Labels:     labels,
-				Points:     []MetricPoint{},
-			}
-			seriesMap[seriesKey] = series
-		}
+// shiftRange applies @ and offset modifiers to an evaluation range
+func (ev *evaluation) shiftRange(r timeRange, at *time.Time, startOrEnd string, offset time.Duration) timeRange {
+	if at != nil || startOrEnd != "" {
+		t := ev.modifierTime(r.max, at, startOrEnd, 0)
+		r = timeRange{t, t}
+	}
+	return timeRange{r.min.Add(-offset), r.max.Add(-offset)}
+}
 
-		// Add point to series
-		series.Points = append(series.Points, MetricPoint{
-			Timestamp: time.Unix(timestamp, 0),
-			Value:     value,
-			Labels:    labels,
-		})
+// modifierTime returns the time a selector reads at when the query is
+// evaluated at ts, honouring the @ and offset modifiers
+func (ev *evaluation) modifierTime(ts time.Time, at *time.Time, startOrEnd string, offset time.Duration) time.Time {
+	switch {
+	case startOrEnd == "start":
+		ts = ev.start
+	case startOrEnd == "end":
+		ts = ev.end
+	case at != nil:
+		ts = *at
 	}
+	return ts.Add(-offset)
+}
 
-	// Convert map to slice
-	var result []MetricSeries
-	for _, series := range seriesMap {
-		result = append(result, *series)
+// eval evaluates an expression at a single timestamp
+func (ev *evaluation) eval(expr Expr, ts time.Time) (Value, error) {
+	if err := ev.ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return result, nil
-}
+	switch n := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{Timestamp: ts, Value: n.Val}, nil
 
-// createSeriesKey creates a unique key for grouping series by labels
-func (e *Evaluator) createSeriesKey(labels map[string]string) string {
-	var keys []string
-	for k, v := range labels {
-		keys = append(keys, fmt.Sprintf("%s=%s", k, v))
-	}
-	sort.Strings(keys)
-	return fmt.Sprintf("%v", keys)
-}
-
-// applyFunction applies PromQL functions to the series
-func (e *Evaluator) applyFunction(series []MetricSeries, function string, rangeDuration time.Duration) ([]MetricSeries, error) {
-	switch function {
-	case "rate":
-		return e.applyRate(series, rangeDuration)
-	case "increase":
-		return e.applyIncrease(series, rangeDuration)
-	case "sum":
-		return e.applySum(series)
-	case "avg":
-		return e.applyAvg(series)
-	case "count":
-		return e.applyCount(series)
-	case "min":
-		return e.applyMin(series)
-	case "max":
-		return e.applyMax(series)
-	default:
-		return nil, fmt.Errorf("unsupported function: %s", function)
-	}
-}
-
-// applyRate calculates the per-second rate of increase
-func (e *Evaluator) applyRate(series []MetricSeries, rangeDuration time.Duration) ([]MetricSeries, error) {
-	result := make([]MetricSeries, len(series))
-
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     []MetricPoint{},
-		}
+	case *StringLiteral:
+		return String{Timestamp: ts, Value: n.Val}, nil
 
-		// Calculate rate for each point
-		for j, point := range s.Points {
-			if j == 0 {
-				continue // Skip first point
-			}
+	case *ParenExpr:
+		return ev.eval(n.Expr, ts)
 
-			// Find previous point within range
-			rangeStart := point.Timestamp.Add(-rangeDuration)
-			var prevPoint *MetricPoint
+	case *UnaryExpr:
+		return ev.evalUnary(n, ts)
 
-			for k := j - 1; k >= 0; k-- {
-				if s.Points[k].Timestamp.After(rangeStart) {
-					prevPoint = &s.Points[k]
-					break
-				}
-			}
+	case *BinaryExpr:
+		return ev.evalBinary(n, ts)
 
-			if prevPoint != nil {
-				// Calculate rate
-				timeDiff := point.Timestamp.Sub(prevPoint.Timestamp).Seconds()
-				valueDiff := point.Value - prevPoint.Value
-				rate := valueDiff / timeDiff
-
-				result[i].Points = append(result[i].Points, MetricPoint{
-					Timestamp: point.Timestamp,
-					Value:     rate,
-					Labels:    point.Labels,
-				})
-			}
-		}
-	}
+	case *VectorSelector:
+		return ev.vectorSelector(n, ts), nil
 
-	return result, nil
-}
+	case *MatrixSelector:
+		return ev.matrixSelector(n, ts), nil
 
-// applyIncrease calculates the increase over the range
-func (e *Evaluator) applyIncrease(series []MetricSeries, rangeDuration time.Duration) ([]MetricSeries, error) {
-	result := make([]MetricSeries, len(series))
+	case *SubqueryExpr:
+		return ev.subquery(n, ts)
 
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     []MetricPoint{},
+	case *Call:
+		call := &FunctionCall{
+			Args:      make([]Value, len(n.Args)),
+			Exprs:     n.Args,
+			Timestamp: ts,
 		}
-
-		// Calculate increase for each point
-		for j, point := range s.Points {
-			rangeStart := point.Timestamp.Add(-rangeDuration)
-			var startPoint *MetricPoint
-
-			// Find start point within range
-			for k := j; k >= 0; k-- {
-				if s.Points[k].Timestamp.Before(rangeStart) || s.Points[k].Timestamp.Equal(rangeStart) {
-					startPoint = &s.Points[k]
-					break
-				}
+		for i, arg := range n.Args {
+			if vs, ok := unwrapParens(arg).(*VectorSelector); ok && n.Func.Name == "timestamp" {
+				// timestamp() reports when the selected samples were taken
+				call.Args[i] = ev.latestSamples(vs, ts)
+				continue
+			}
+			if arg.Type() == ValueTypeMatrix {
+				call.RangeStart, call.RangeEnd = ev.rangeWindow(arg, ts)
 			}
+			val, err := ev.eval(arg, ts)
+			if err != nil {
+				return nil, err
+			}
+			call.Args[i] = val
+		}
+		if n.Func.Handler == nil {
+			return nil, fmt.Errorf("function %s is not implemented", n.Func.Name)
+		}
+		result, err := n.Func.Handler(call)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply function %s: %w", n.Func.Name, err)
+		}
+		return result, nil
 
-			if startPoint != nil {
-				increase := point.Value - startPoint.Value
-				result[i].Points = append(result[i].Points, MetricPoint{
-					Timestamp: point.Timestamp,
-					Value:     increase,
-					Labels:    point.Labels,
-				})
+	case *AggregateExpr:
+		val, err := ev.eval(n.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		var param Value
+		if n.Param != nil {
+			if param, err = ev.eval(n.Param, ts); err != nil {
+				return nil, err
 			}
 		}
+		result, err := ev.applyAggregation(val.(Vector), n, param, ts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply aggregation: %w", err)
+		}
+		return result, nil
 	}
 
-	return result, nil
+	return nil, fmt.Errorf("unsupported expression: %s", expr)
 }
 
-// applySum sums all series values
-func (e *Evaluator) applySum(series []MetricSeries) ([]MetricSeries, error) {
-	if len(series) == 0 {
-		return series, nil
+// vectorSelector returns the latest sample of every series within the
+// lookback window, stamped with the evaluation timestamp
+func (ev *evaluation) vectorSelector(vs *VectorSelector, ts time.Time) Vector {
+	vector := ev.latestSamples(vs, ts)
+	for i := range vector {
+		vector[i].Points[0].Timestamp = ts
 	}
+	return vector
+}
 
-	// Get all unique timestamps
-	timestampMap := make(map[time.Time]bool)
-	for _, s := range series {
-		for _, point := range s.Points {
-			timestampMap[point.Timestamp] = true
+// latestSamples returns the latest sample of every series within the
+// lookback window with its original timestamp
+func (ev *evaluation) latestSamples(vs *VectorSelector, ts time.Time) Vector {
+	t := ev.modifierTime(ts, vs.Timestamp, vs.StartOrEnd, vs.Offset)
+	windowStart := t.Add(-ev.e.lookbackDelta)
+
+	var vector Vector
+	for _, s := range ev.selected[vs] {
+		// Index of the first point after t
+		i := sort.Search(len(s.Points), func(i int) bool {
+			return s.Points[i].Timestamp.After(t)
+		})
+		if i == 0 || !s.Points[i-1].Timestamp.After(windowStart) {
+			continue
 		}
+		vector = append(vector, MetricSeries{
+			MetricName: s.MetricName,
+			Labels:     s.Labels,
+			Points:     []MetricPoint{{Timestamp: s.Points[i-1].Timestamp, Value: s.Points[i-1].Value, Histogram: s.Points[i-1].Histogram}},
+		})
 	}
+	return vector
+}
 
-	var timestamps []time.Time
-	for ts := range timestampMap {
-		timestamps = append(timestamps, ts)
-	}
-	sort.Slice(timestamps, func(i, j int) bool {
-		return timestamps[i].Before(timestamps[j])
-	})
-
-	// Calculate sum for each timestamp
-	var points []MetricPoint
-	for _, ts := range timestamps {
-		sum := 0.0
-		for _, s := range series {
-			for _, point := range s.Points {
-				if point.Timestamp.Equal(ts) {
-					sum += point.Value
-					break
-				}
-			}
+// matrixSelector returns the samples of every series within the range
+// window ending at the evaluation timestamp
+func (ev *evaluation) matrixSelector(ms *MatrixSelector, ts time.Time) Matrix {
+	vs := unwrapParens(ms.VectorSelector).(*VectorSelector)
+	t := ev.modifierTime(ts, vs.Timestamp, vs.StartOrEnd, vs.Offset)
+	windowStart := t.Add(-ms.Range)
+
+	var matrix Matrix
+	for _, s := range ev.selected[vs] {
+		from := sort.Search(len(s.Points), func(i int) bool {
+			return s.Points[i].Timestamp.After(windowStart)
+		})
+		to := sort.Search(len(s.Points), func(i int) bool {
+			return s.Points[i].Timestamp.After(t)
+		})
+		if from >= to {
+			continue
 		}
-
-		points = append(points, MetricPoint{
-			Timestamp: ts,
-			Value:     sum,
-			Labels:    map[string]string{},
+		matrix = append(matrix, MetricSeries{
+			MetricName: s.MetricName,
+			Labels:     s.Labels,
+			Points:     s.Points[from:to],
 		})
 	}
-
-	return []MetricSeries{{
-		MetricName: series[0].MetricName,
-		Labels:     map[string]string{},
-		Points:     points,
-	}}, nil
+	return matrix
 }
 
-// applyAvg calculates the average of all series values
-func (e *Evaluator) applyAvg(series []MetricSeries) ([]MetricSeries, error) {
-	if len(series) == 0 {
-		return series, nil
+// subquery evaluates the inner expression at every subquery step within the
+// range window ending at the evaluation timestamp. Steps are aligned to
+// multiples of the step width so that results are stable across queries.
+func (ev *evaluation) subquery(sq *SubqueryExpr, ts time.Time) (Value, error) {
+	t := ev.modifierTime(ts, sq.Timestamp, sq.StartOrEnd, sq.Offset)
+
+	step := sq.Step
+	if step == 0 {
+		step = ev.interval
+	}
+	if step == 0 {
+		step = DefaultSubqueryStep
+	}
+
+	windowStart := t.Add(-sq.Range).UnixMilli()
+	stepMs := step.Milliseconds()
+	first := windowStart - windowStart%stepMs
+	if first <= windowStart {
+		first += stepMs
 	}
 
-	// Get all unique timestamps
-	timestampMap := make(map[time.Time]bool)
-	for _, s := range series {
-		for _, point := range s.Points {
-			timestampMap[point.Timestamp] = true
+	builder := newSeriesBuilder()
+	for s := first; s <= t.UnixMilli(); s += stepMs {
+		val, err := ev.eval(sq.Expr, time.UnixMilli(s))
+		if err != nil {
+			return nil, err
+		}
+		vector, ok := val.(Vector)
+		if !ok {
+			return nil, fmt.Errorf("subquery expression must return an instant vector, got %s", val.Type())
+		}
+		for _, series := range vector {
+			builder.add(series.MetricName, series.Labels, series.Points...)
 		}
 	}
+	return Matrix(builder.series()), nil
+}
 
-	var timestamps []time.Time
-	for ts := range timestampMap {
-		timestamps = append(timestamps, ts)
+// rangeWindow returns the bounds of the window a range vector argument
+// selects when evaluated at ts
+func (ev *evaluation) rangeWindow(expr Expr, ts time.Time) (time.Time, time.Time) {
+	switch n := unwrapParens(expr).(type) {
+	case *MatrixSelector:
+		vs := unwrapParens(n.VectorSelector).(*VectorSelector)
+		t := ev.modifierTime(ts, vs.Timestamp, vs.StartOrEnd, vs.Offset)
+		return t.Add(-n.Range), t
+	case *SubqueryExpr:
+		t := ev.modifierTime(ts, n.Timestamp, n.StartOrEnd, n.Offset)
+		return t.Add(-n.Range), t
 	}
-	sort.Slice(timestamps, func(i, j int) bool {
-		return timestamps[i].Before(timestamps[j])
-	})
+	return ts, ts
+}
 
-	// Calculate average for each timestamp
-	var points []MetricPoint
-	for _, ts := range timestamps {
-		sum := 0.0
-		count := 0
-		for _, s := range series {
-			for _, point := range s.Points {
-				if point.Timestamp.Equal(ts) {
-					sum += point.Value
-					count++
-					break
-				}
-			}
-		}
+// seriesBuilder accumulates points into series keyed by their label set
+type seriesBuilder struct {
+	index map[string]int
+	list  []MetricSeries
+}
 
-		avg := 0.0
-		if count > 0 {
-			avg = sum / float64(count)
-		}
+func newSeriesBuilder() *seriesBuilder {
+	return &seriesBuilder{index: make(map[string]int)}
+}
 
-		points = append(points, MetricPoint{
-			Timestamp: ts,
-			Value:     avg,
-			Labels:    map[string]string{},
-		})
+func (b *seriesBuilder) add(metricName string, labels map[string]string, points ...MetricPoint) {
+	key := seriesKey(metricName, labels)
+	i, ok := b.index[key]
+	if !ok {
+		i = len(b.list)
+		b.index[key] = i
+		b.list = append(b.list, MetricSeries{MetricName: metricName, Labels: labels})
 	}
+	b.list[i].Points = append(b.list[i].Points, points...)
+}
+
+func (b *seriesBuilder) series() []MetricSeries {
+	sortSeries(b.list)
+	return b.list
+}
 
-	return []MetricSeries{{
-		MetricName: series[0].MetricName,
-		Labels:     map[string]string{},
-		Points:     points,
-	}}, nil
+// seriesKey identifies a series by its metric name and labels
+func seriesKey(metricName string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels)+1)
+	keys = append(keys, MetricNameLabel+"="+metricName)
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys[1:])
+	return fmt.Sprintf("%q", keys)
 }
 
-// applyCount counts the number of series
-func (e *Evaluator) applyCount(series []MetricSeries) ([]MetricSeries, error) {
-	count := float64(len(series))
-	return []MetricSeries{{
-		MetricName: "count",
-		Labels:     map[string]string{},
-		Points:     []MetricPoint{{Timestamp: time.Now(), Value: count}},
-	}}, nil
+// sortSeries orders series by metric name and labels for stable output
+func sortSeries(series []MetricSeries) {
+	sort.SliceStable(series, func(i, j int) bool {
+		return seriesKey(series[i].MetricName, series[i].Labels) < seriesKey(series[j].MetricName, series[j].Labels)
+	})
 }
 
-// applyMin finds the minimum value across all series
-func (e *Evaluator) applyMin(series []MetricSeries) ([]MetricSeries, error) {
-	if len(series) == 0 {
-		return series, nil
+// ServiceNameLabel is the label carrying the service a series was reported by
+const ServiceNameLabel = storage.ServiceNameLabel
+
+// Labels carrying the identifying attributes of the resource a series was
+// reported by. Data point attributes of the same name take precedence.
+const (
+	ServiceNamespaceLabel      = storage.ServiceNamespaceLabel
+	ServiceVersionLabel        = storage.ServiceVersionLabel
+	DeploymentEnvironmentLabel = storage.DeploymentEnvironmentLabel
+	HostNameLabel              = storage.HostNameLabel
+	ServiceInstanceIDLabel     = storage.ServiceInstanceIDLabel
+)
+
+// getMetricSeries retrieves the samples of every series matching the selector
+// between startTime and endTime. A series is identified by its metric name,
+// its stored labels, its service name and the identity of its resource.
+func (e *Evaluator) getMetricSeries(ctx context.Context, selector *VectorSelector, startTime, endTime time.Time) ([]MetricSeries, error) {
+	matchers, err := StorageMatchers(selector.LabelMatchers)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := e.storage.SelectSeries(ctx, matchers, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select series: %w", err)
+	}
+
+	ids := make([]int64, len(stored))
+	labels := make(map[int64]map[string]string, len(stored))
+	names := make(map[int64]string, len(stored))
+	for i, series := range stored {
+		ids[i] = series.ID
+		labels[series.ID] = storage.MetricLabels(series.Labels, series.ServiceName, series.Resource)
+		names[series.ID] = series.MetricName
+	}
+
+	samples, err := e.storage.GetSamples(ctx, ids, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read samples: %w", err)
 	}
 
-	min := math.Inf(1)
-	for _, s := range series {
-		for _, point := range s.Points {
-			if point.Value < min {
-				min = point.Value
+	builder := newSeriesBuilder()
+	for _, id := range ids {
+		if len(samples[id]) == 0 {
+			continue
+		}
+		points := make([]MetricPoint, len(samples[id]))
+		for i, sample := range samples[id] {
+			points[i] = MetricPoint{
+				Timestamp: time.Unix(0, sample.Timestamp),
+				Value:     sample.Value,
+				Labels:    labels[id],
 			}
 		}
+		builder.add(names[id], labels[id], points...)
 	}
 
-	return []MetricSeries{{
-		MetricName: series[0].MetricName,
-		Labels:     map[string]string{},
-		Points:     []MetricPoint{{Timestamp: time.Now(), Value: min}},
-	}}, nil
-}
+	// Native histograms are stored point by point; their label sets are
+	// decoded once per distinct raw form
+	histograms, err := e.storage.GetExponentialHistograms(ctx, matchers, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read histograms: %w", err)
+	}
+	decoded := make(map[string]map[string]string)
+	for _, h := range histograms {
+		raw := h.MetricName + "\xff" + h.ServiceName + "\xff" + h.Labels
+		if h.Resource != nil {
+			raw += "\xff" + h.Resource.Attributes
+		}
+		setLabels, ok := decoded[raw]
+		if !ok {
+			setLabels = storage.MetricLabels(h.Labels, h.ServiceName, h.Resource)
+			decoded[raw] = setLabels
+		}
 
-// applyMax finds the maximum value across all series
-func (e *Evaluator) applyMax(series []MetricSeries) ([]MetricSeries, error) {
-	if len(series) == 0 {
-		return series, nil
+		builder.add(h.MetricName, setLabels, MetricPoint{
+			Timestamp: h.Timestamp,
+			Value:     h.Histogram.Count,
+			Labels:    setLabels,
+			Histogram: h.Histogram,
+		})
 	}
 
-	max := math.Inf(-1)
-	for _, s := range series {
-		for _, point := range s.Points {
-			if point.Value > max {
-				max = point.Value
-			}
+	// Series holding both float samples and histograms, or several stored
+	// series with the same labels, have their points merged by time
+	result := builder.series()
+	for i := range result {
+		points := result[i].Points
+		less := func(a, b int) bool { return points[a].Timestamp.Before(points[b].Timestamp) }
+		if !sort.SliceIsSorted(points, less) {
+			sort.SliceStable(points, less)
 		}
 	}
 
-	return []MetricSeries{{
-		MetricName: series[0].MetricName,
-		Labels:     map[string]string{},
-		Points:     []MetricPoint{{Timestamp: time.Now(), Value: max}},
-	}}, nil
+	return result, nil
+}
+
+// StorageMatchers converts the label matchers of a selector into those
+// storage selects series with
+func StorageMatchers(matchers []*LabelMatcher) ([]*storage.LabelMatcher, error) {
+	result := make([]*storage.LabelMatcher, len(matchers))
+	for i, m := range matchers {
+		var t storage.MatchType
+		switch m.Type {
+		case MatchEqual:
+			t = storage.MatchEqual
+		case MatchNotEqual:
+			t = storage.MatchNotEqual
+		case MatchRegexp:
+			t = storage.MatchRegexp
+		case MatchNotRegexp:
+			t = storage.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unknown match type %v", m.Type)
+		}
+		converted, err := storage.NewLabelMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", m.Value, err)
+		}
+		result[i] = converted
+	}
+	return result, nil
 }
 
-// applyAggregation applies aggregation operations
-func (e *Evaluator) applyAggregation(series []MetricSeries, agg *Aggregation) ([]MetricSeries, error) {
-	switch agg.Operation {
-	case "sum":
-		return e.applySum(series)
-	case "avg":
-		return e.applyAvg(series)
-	case "count":
-		return e.applyCount(series)
-	case "min":
-		return e.applyMin(series)
-	case "max":
-		return e.applyMax(series)
-	default:
-		return nil, fmt.Errorf("unsupported aggregation: %s", agg.Operation)
+// mapMatrix reduces the points of every series in a matrix to a single
+// sample at ts, dropping the metric name. Series for which fn reports no
+// result are left out.
+func mapMatrix(matrix Matrix, ts time.Time, fn func(points []MetricPoint) (float64, bool)) Vector {
+	vector := Vector{}
+	for _, s := range matrix {
+		value, ok := fn(s.Points)
+		if !ok {
+			continue
+		}
+		vector = append(vector, MetricSeries{
+			Labels: s.Labels,
+			Points: []MetricPoint{{Timestamp: ts, Value: value}},
+		})
 	}
+	return vector
 }
 
+// mapVector applies fn to every sample of a vector, dropping the metric name
+func mapVector(vector Vector, fn func(float64) float64) Vector {
+	result := make(Vector, len(vector))
+	for i, s := range vector {
+		result[i] = MetricSeries{
+			Labels: s.Labels,
+			Points: []MetricPoint{{Timestamp: s.Points[0].Timestamp, Value: fn(s.Points[0].Value)}},
+		}
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+)
+
+// newTestEvaluator returns an evaluator over an in-memory storage holding
+// the given samples
+func newTestEvaluator(t *testing.T, metrics ...*storage.Metric) *Evaluator {
+	t.Helper()
+	store := storage.NewMemoryStorage(config.StorageConfig{Type: "memory", RetentionDays: 30})
+	t.Cleanup(func() { store.Close() })
+	if err := store.InsertMetrics(metrics); err != nil {
+		t.Fatalf("InsertMetrics: %v", err)
+	}
+	return NewEvaluator(store)
+}
+
+// evaluateInstant parses and evaluates a query at ts
+func evaluateInstant(t *testing.T, e *Evaluator, query string, ts time.Time) (*QueryResult, error) {
+	t.Helper()
+	expr, err := NewParser().Parse(query)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", query, err)
+	}
+	return e.EvaluateInstant(context.Background(), expr, ts)
+}
+
+// formatSeries renders the metric name and labels of a series in the
+// Prometheus text form
+func formatSeries(s MetricSeries) string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, s.Labels[name])
+	}
+	return s.MetricName + "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func TestSeriesIdentity(t *testing.T) {
+	ts := time.Now().Truncate(time.Minute)
+	sample := func(age time.Duration, name, labels, service string, value float64) *storage.Metric {
+		return &storage.Metric{
+			Timestamp:   ts.Add(-age),
+			MetricName:  name,
+			Value:       value,
+			Labels:      labels,
+			ServiceName: service,
+		}
+	}
+	e := newTestEvaluator(t,
+		sample(time.Minute, "requests", `{"method":"get","code":200}`, "api", 1),
+		sample(30*time.Second, "requests", `{"code":200,"method":"get"}`, "api", 2),
+		sample(30*time.Second, "requests", `{"method":"put","code":500}`, "api", 3),
+		sample(30*time.Second, "requests", `{"method":"get","code":200}`, "web", 4),
+		sample(30*time.Second, "errors", `{"method":"get","retry":true}`, "api", 5),
+	)
+
+	apiGet := `requests{code="200", method="get", service_name="api"}`
+	apiPut := `requests{code="500", method="put", service_name="api"}`
+	webGet := `requests{code="200", method="get", service_name="web"}`
+	errors := `errors{method="get", retry="true", service_name="api"}`
+
+	tests := []struct {
+		query string
+		// want maps each result series, as formatted by formatSeries, to
+		// its value
+		want map[string]float64
+	}{
+		// Samples with the same labels in any order form one series, and
+		// the same labels of another service form another
+		{"requests", map[string]float64{apiGet: 2, apiPut: 3, webGet: 4}},
+		{`requests{code="200"}`, map[string]float64{apiGet: 2, webGet: 4}},
+		{`requests{method!="get"}`, map[string]float64{apiPut: 3}},
+		{`requests{code=~"5.."}`, map[string]float64{apiPut: 3}},
+		{`requests{service_name!~"a.*"}`, map[string]float64{webGet: 4}},
+		{`requests{missing=""}`, map[string]float64{apiGet: 2, apiPut: 3, webGet: 4}},
+		{`requests{missing!=""}`, map[string]float64{}},
+		// Selectors without an exact metric name
+		{`{method="get"}`, map[string]float64{apiGet: 2, webGet: 4, errors: 5}},
+		{`{__name__=~"err.*", retry="true"}`, map[string]float64{errors: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evaluateInstant(t, e, tt.query, ts)
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+			got := make(map[string]float64)
+			for _, s := range result.Series {
+				if len(s.Points) != 1 {
+					t.Fatalf("%s has %d points, want 1", formatSeries(s), len(s.Points))
+				}
+				key := formatSeries(s)
+				if _, dup := got[key]; dup {
+					t.Errorf("series %s returned twice", key)
+				}
+				got[key] = s.Points[0].Value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got series %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if v, ok := got[key]; !ok || v != value {
+					t.Errorf("%s = %v (present %t), want %v", key, v, ok, value)
+				}
+			}
+		})
+	}
+}
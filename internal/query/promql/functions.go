@@ -1,9 +1,16 @@
 package promql
 
 import (
+	"fmt"
 	"math"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"open-telemorph-prime/internal/histogram"
 )
 
 // FunctionRegistry holds all available PromQL functions
@@ -16,8 +23,27 @@ type Function struct {
 	Name        string
 	Description string
 	Args        []ArgType
-	ReturnType  ReturnType
-	Handler     func(args []interface{}) (interface{}, error)
+	// Variadic is the number of trailing optional arguments, -1 for unlimited
+	Variadic   int
+	ReturnType ReturnType
+	Handler    FunctionHandler
+}
+
+// FunctionHandler computes the result of a function call at a single
+// evaluation timestamp
+type FunctionHandler func(call *FunctionCall) (Value, error)
+
+// FunctionCall carries the evaluated arguments of a function call
+type FunctionCall struct {
+	Args []Value
+	// Exprs are the argument expressions as written in the query
+	Exprs []Expr
+	// Timestamp is the evaluation time
+	Timestamp time.Time
+	// RangeStart and RangeEnd bound the window selected by the range vector
+	// argument, if the function takes one
+	RangeStart time.Time
+	RangeEnd   time.Time
 }
 
 // ArgType represents function argument types
@@ -40,6 +66,15 @@ const (
 	ReturnTypeString
 )
 
+// sortFunctions return their results in a meaningful order, which instant
+// queries must preserve
+var sortFunctions = map[string]bool{
+	"sort":               true,
+	"sort_desc":          true,
+	"sort_by_label":      true,
+	"sort_by_label_desc": true,
+}
+
 // NewFunctionRegistry creates a new function registry
 func NewFunctionRegistry() *FunctionRegistry {
 	registry := &FunctionRegistry{
@@ -68,78 +103,266 @@ func (fr *FunctionRegistry) registerBuiltinFunctions() {
 		Handler:     fr.handleIncrease,
 	})
 
-	// Aggregation functions
 	fr.Register(Function{
-		Name:        "sum",
-		Description: "Sum over dimensions",
-		Args:        []ArgType{ArgTypeInstantVector},
+		Name:        "irate",
+		Description: "Calculates the per-second instant rate of increase from the last two samples",
+		Args:        []ArgType{ArgTypeRangeVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleSum,
+		Handler:     fr.handleIrate,
 	})
 
 	fr.Register(Function{
-		Name:        "avg",
-		Description: "Average over dimensions",
-		Args:        []ArgType{ArgTypeInstantVector},
+		Name:        "delta",
+		Description: "Calculates the difference between the first and last value of a gauge",
+		Args:        []ArgType{ArgTypeRangeVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleAvg,
+		Handler:     fr.handleDelta,
 	})
 
 	fr.Register(Function{
-		Name:        "count",
-		Description: "Count of elements",
-		Args:        []ArgType{ArgTypeInstantVector},
+		Name:        "idelta",
+		Description: "Calculates the difference between the last two samples of a gauge",
+		Args:        []ArgType{ArgTypeRangeVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleCount,
+		Handler:     fr.handleIdelta,
 	})
 
 	fr.Register(Function{
-		Name:        "min",
-		Description: "Minimum value",
-		Args:        []ArgType{ArgTypeInstantVector},
+		Name:        "deriv",
+		Description: "Calculates the per-second derivative of a gauge using linear regression",
+		Args:        []ArgType{ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleDeriv,
+	})
+
+	fr.Register(Function{
+		Name:        "predict_linear",
+		Description: "Predicts the value of a gauge the given number of seconds from now",
+		Args:        []ArgType{ArgTypeRangeVector, ArgTypeScalar},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handlePredictLinear,
+	})
+
+	fr.Register(Function{
+		Name:        "resets",
+		Description: "Counts the number of counter resets",
+		Args:        []ArgType{ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleResets,
+	})
+
+	fr.Register(Function{
+		Name:        "changes",
+		Description: "Counts the number of times the value changed",
+		Args:        []ArgType{ArgTypeRangeVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleMin,
+		Handler:     fr.handleChanges,
+	})
+
+	// Functions over time
+	fr.registerOverTime("avg_over_time", "Average value of each series over the range", func(points []MetricPoint) float64 {
+		return sumValues(pointValues(points)) / float64(len(points))
+	})
+	fr.registerOverTime("min_over_time", "Minimum value of each series over the range", func(points []MetricPoint) float64 {
+		return extremum(pointValues(points), func(a, b float64) bool { return a < b })
+	})
+	fr.registerOverTime("max_over_time", "Maximum value of each series over the range", func(points []MetricPoint) float64 {
+		return extremum(pointValues(points), func(a, b float64) bool { return a > b })
+	})
+	fr.registerOverTime("sum_over_time", "Sum of all values of each series over the range", func(points []MetricPoint) float64 {
+		return sumValues(pointValues(points))
+	})
+	fr.registerOverTime("count_over_time", "Number of samples of each series over the range", func(points []MetricPoint) float64 {
+		return float64(len(points))
+	})
+	fr.registerOverTime("stddev_over_time", "Population standard deviation of each series over the range", func(points []MetricPoint) float64 {
+		return math.Sqrt(variance(pointValues(points)))
+	})
+	fr.registerOverTime("stdvar_over_time", "Population variance of each series over the range", func(points []MetricPoint) float64 {
+		return variance(pointValues(points))
+	})
+	fr.registerOverTime("present_over_time", "1 for every series with a sample in the range", func(points []MetricPoint) float64 {
+		return 1
+	})
+
+	fr.Register(Function{
+		Name:        "last_over_time",
+		Description: "Most recent value of each series in the range",
+		Args:        []ArgType{ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleLastOverTime,
 	})
 
 	fr.Register(Function{
-		Name:        "max",
-		Description: "Maximum value",
+		Name:        "quantile_over_time",
+		Description: "The φ-quantile of the values of each series over the range",
+		Args:        []ArgType{ArgTypeScalar, ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleQuantileOverTime,
+	})
+
+	// Histogram functions
+	fr.Register(Function{
+		Name:        "histogram_quantile",
+		Description: "Estimates the φ-quantile from histogram buckets",
+		Args:        []ArgType{ArgTypeScalar, ArgTypeInstantVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleHistogramQuantile,
+	})
+	fr.Register(Function{
+		Name:        "histogram_fraction",
+		Description: "Estimates the fraction of observations between two values",
+		Args:        []ArgType{ArgTypeScalar, ArgTypeScalar, ArgTypeInstantVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleHistogramFraction,
+	})
+	fr.Register(Function{
+		Name:        "histogram_count",
+		Description: "Number of observations of native histograms",
 		Args:        []ArgType{ArgTypeInstantVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleMax,
+		Handler: func(call *FunctionCall) (Value, error) {
+			return mapHistograms(call.Args[0].(Vector), func(h *histogram.Exponential) float64 { return h.Count }), nil
+		},
+	})
+	fr.Register(Function{
+		Name:        "histogram_sum",
+		Description: "Sum of observations of native histograms",
+		Args:        []ArgType{ArgTypeInstantVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler: func(call *FunctionCall) (Value, error) {
+			return mapHistograms(call.Args[0].(Vector), func(h *histogram.Exponential) float64 { return h.Sum }), nil
+		},
 	})
 
 	// Math functions
+	fr.registerMath("abs", "Absolute value", math.Abs)
+	fr.registerMath("ceil", "Round up to nearest integer", math.Ceil)
+	fr.registerMath("floor", "Round down to nearest integer", math.Floor)
+	fr.registerMath("exp", "Exponential function", math.Exp)
+	fr.registerMath("ln", "Natural logarithm", math.Log)
+	fr.registerMath("log2", "Binary logarithm", math.Log2)
+	fr.registerMath("log10", "Decimal logarithm", math.Log10)
+	fr.registerMath("sqrt", "Square root", math.Sqrt)
+
 	fr.Register(Function{
-		Name:        "abs",
-		Description: "Absolute value",
-		Args:        []ArgType{ArgTypeInstantVector},
+		Name:        "round",
+		Description: "Round to nearest integer, or to the nearest multiple of to_nearest",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeScalar},
+		Variadic:    1,
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleRound,
+	})
+
+	fr.Register(Function{
+		Name:        "clamp",
+		Description: "Clamp sample values to the range [min, max]",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeScalar, ArgTypeScalar},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleAbs,
+		Handler:     fr.handleClamp,
 	})
 
 	fr.Register(Function{
-		Name:        "ceil",
-		Description: "Round up to nearest integer",
+		Name:        "clamp_min",
+		Description: "Clamp sample values to a lower bound",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeScalar},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleClampMin,
+	})
+
+	fr.Register(Function{
+		Name:        "clamp_max",
+		Description: "Clamp sample values to an upper bound",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeScalar},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleClampMax,
+	})
+
+	// Label functions
+	fr.Register(Function{
+		Name:        "label_replace",
+		Description: "Set a label to a replacement built from the regex match of a source label",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeString, ArgTypeString, ArgTypeString, ArgTypeString},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleLabelReplace,
+	})
+
+	fr.Register(Function{
+		Name:        "label_join",
+		Description: "Set a label to the values of source labels joined by a separator",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeString, ArgTypeString, ArgTypeString},
+		Variadic:    -1,
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleLabelJoin,
+	})
+
+	// Sorting functions
+	fr.Register(Function{
+		Name:        "sort",
+		Description: "Sort by sample value in ascending order",
 		Args:        []ArgType{ArgTypeInstantVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleCeil,
+		Handler:     fr.handleSort,
 	})
 
 	fr.Register(Function{
-		Name:        "floor",
-		Description: "Round down to nearest integer",
+		Name:        "sort_desc",
+		Description: "Sort by sample value in descending order",
 		Args:        []ArgType{ArgTypeInstantVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleFloor,
+		Handler:     fr.handleSortDesc,
 	})
 
 	fr.Register(Function{
-		Name:        "round",
-		Description: "Round to nearest integer",
+		Name:        "sort_by_label",
+		Description: "Sort by the values of the given labels in ascending order",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeString},
+		Variadic:    -1,
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleSortByLabel,
+	})
+
+	fr.Register(Function{
+		Name:        "sort_by_label_desc",
+		Description: "Sort by the values of the given labels in descending order",
+		Args:        []ArgType{ArgTypeInstantVector, ArgTypeString},
+		Variadic:    -1,
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleSortByLabelDesc,
+	})
+
+	// Presence functions
+	fr.Register(Function{
+		Name:        "absent",
+		Description: "1-element vector if the argument has no elements, empty otherwise",
 		Args:        []ArgType{ArgTypeInstantVector},
 		ReturnType:  ReturnTypeInstantVector,
-		Handler:     fr.handleRound,
+		Handler:     fr.handleAbsent,
+	})
+
+	fr.Register(Function{
+		Name:        "absent_over_time",
+		Description: "1-element vector if the range has no samples, empty otherwise",
+		Args:        []ArgType{ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleAbsentOverTime,
+	})
+
+	// Type conversion functions
+	fr.Register(Function{
+		Name:        "vector",
+		Description: "Convert a scalar to a vector without labels",
+		Args:        []ArgType{ArgTypeScalar},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler:     fr.handleVector,
+	})
+
+	fr.Register(Function{
+		Name:        "scalar",
+		Description: "Convert a single-element vector to a scalar, NaN otherwise",
+		Args:        []ArgType{ArgTypeInstantVector},
+		ReturnType:  ReturnTypeScalar,
+		Handler:     fr.handleScalar,
 	})
 
 	// Time functions
@@ -160,6 +383,35 @@ func (fr *FunctionRegistry) registerBuiltinFunctions() {
 	})
 }
 
+// registerMath registers a function applying fn to every sample value
+func (fr *FunctionRegistry) registerMath(name, description string, fn func(float64) float64) {
+	fr.Register(Function{
+		Name:        name,
+		Description: description,
+		Args:        []ArgType{ArgTypeInstantVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler: func(call *FunctionCall) (Value, error) {
+			return mapVector(call.Args[0].(Vector), fn), nil
+		},
+	})
+}
+
+// registerOverTime registers a function reducing the points of every series
+// of a range vector to a single value
+func (fr *FunctionRegistry) registerOverTime(name, description string, fn func(points []MetricPoint) float64) {
+	fr.Register(Function{
+		Name:        name,
+		Description: description,
+		Args:        []ArgType{ArgTypeRangeVector},
+		ReturnType:  ReturnTypeInstantVector,
+		Handler: func(call *FunctionCall) (Value, error) {
+			return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+				return fn(points), len(points) > 0
+			}), nil
+		},
+	})
+}
+
 // Register registers a new function
 func (fr *FunctionRegistry) Register(fn Function) {
 	fr.functions[fn.Name] = fn
@@ -183,169 +435,422 @@ func (fr *FunctionRegistry) List() []string {
 
 // Function handlers
 
-func (fr *FunctionRegistry) handleRate(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleRate(call *FunctionCall) (Value, error) {
+	return counterIncrease(call, true), nil
 }
 
-func (fr *FunctionRegistry) handleIncrease(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleIncrease(call *FunctionCall) (Value, error) {
+	return counterIncrease(call, false), nil
 }
 
-func (fr *FunctionRegistry) handleSum(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+// counterIncrease implements rate and increase for float counters and for
+// native histograms
+func counterIncrease(call *FunctionCall, isRate bool) Vector {
+	vector := Vector{}
+	for _, s := range call.Args[0].(Matrix) {
+		point := MetricPoint{Timestamp: call.Timestamp}
+		ok := false
+		if s.Points[len(s.Points)-1].Histogram != nil {
+			point.Histogram, ok = histogramRate(s.Points, call.RangeStart, call.RangeEnd, isRate)
+			if ok {
+				point.Value = point.Histogram.Count
+			}
+		} else {
+			point.Value, ok = extrapolatedRate(s.Points, call.RangeStart, call.RangeEnd, true, isRate)
+		}
+		if !ok {
+			continue
+		}
+		vector = append(vector, MetricSeries{
+			Labels: s.Labels,
+			Points: []MetricPoint{point},
+		})
+	}
+	return vector
 }
 
-func (fr *FunctionRegistry) handleAvg(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleDelta(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		return extrapolatedRate(points, call.RangeStart, call.RangeEnd, false, false)
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleCount(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleIrate(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		return instantValue(points, true)
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleMin(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleIdelta(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		return instantValue(points, false)
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleMax(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleDeriv(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		slope, _ := linearRegression(points, points[0].Timestamp)
+		return slope, true
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleAbs(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handlePredictLinear(call *FunctionCall) (Value, error) {
+	duration := call.Args[1].(Scalar).Value
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		slope, intercept := linearRegression(points, call.Timestamp)
+		return slope*duration + intercept, true
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleCeil(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleResets(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		return countResets(points), true
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleFloor(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleChanges(call *FunctionCall) (Value, error) {
+	return mapMatrix(call.Args[0].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		var changes float64
+		for i := 1; i < len(points); i++ {
+			prev, cur := points[i-1].Value, points[i].Value
+			if cur != prev && !(math.IsNaN(cur) && math.IsNaN(prev)) {
+				changes++
+			}
+		}
+		return changes, true
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleRound(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleLastOverTime(call *FunctionCall) (Value, error) {
+	vector := Vector{}
+	for _, s := range call.Args[0].(Matrix) {
+		if len(s.Points) == 0 {
+			continue
+		}
+		vector = append(vector, MetricSeries{
+			MetricName: s.MetricName,
+			Labels:     s.Labels,
+			Points:     []MetricPoint{{Timestamp: call.Timestamp, Value: s.Points[len(s.Points)-1].Value}},
+		})
+	}
+	return vector, nil
 }
 
-func (fr *FunctionRegistry) handleTime(args []interface{}) (interface{}, error) {
-	return float64(time.Now().Unix()), nil
+func (fr *FunctionRegistry) handleQuantileOverTime(call *FunctionCall) (Value, error) {
+	phi := call.Args[0].(Scalar).Value
+	return mapMatrix(call.Args[1].(Matrix), call.Timestamp, func(points []MetricPoint) (float64, bool) {
+		return quantile(phi, pointValues(points)), len(points) > 0
+	}), nil
 }
 
-func (fr *FunctionRegistry) handleTimestamp(args []interface{}) (interface{}, error) {
-	// This would be implemented by the evaluator
-	return nil, nil
+func (fr *FunctionRegistry) handleRound(call *FunctionCall) (Value, error) {
+	toNearest := 1.0
+	if len(call.Args) > 1 {
+		toNearest = call.Args[1].(Scalar).Value
+	}
+	// Dividing by the inverse avoids float rounding errors for fractions
+	// such as 0.1
+	inverse := 1 / toNearest
+	return mapVector(call.Args[0].(Vector), func(v float64) float64 {
+		return math.Floor(v*inverse+0.5) / inverse
+	}), nil
 }
 
-// Utility functions for mathematical operations
+func (fr *FunctionRegistry) handleClamp(call *FunctionCall) (Value, error) {
+	min, max := call.Args[1].(Scalar).Value, call.Args[2].(Scalar).Value
+	if max < min {
+		return Vector{}, nil
+	}
+	return mapVector(call.Args[0].(Vector), func(v float64) float64 {
+		return math.Max(min, math.Min(max, v))
+	}), nil
+}
 
-// ApplyAbs applies absolute value to all points in a series
-func ApplyAbs(series []MetricSeries) []MetricSeries {
-	result := make([]MetricSeries, len(series))
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     make([]MetricPoint, len(s.Points)),
-		}
-		for j, point := range s.Points {
-			result[i].Points[j] = MetricPoint{
-				Timestamp: point.Timestamp,
-				Value:     math.Abs(point.Value),
-				Labels:    point.Labels,
-			}
+func (fr *FunctionRegistry) handleClampMin(call *FunctionCall) (Value, error) {
+	min := call.Args[1].(Scalar).Value
+	return mapVector(call.Args[0].(Vector), func(v float64) float64 {
+		return math.Max(min, v)
+	}), nil
+}
+
+func (fr *FunctionRegistry) handleClampMax(call *FunctionCall) (Value, error) {
+	max := call.Args[1].(Scalar).Value
+	return mapVector(call.Args[0].(Vector), func(v float64) float64 {
+		return math.Min(max, v)
+	}), nil
+}
+
+func (fr *FunctionRegistry) handleLabelReplace(call *FunctionCall) (Value, error) {
+	dst := call.Args[1].(String).Value
+	replacement := call.Args[2].(String).Value
+	src := call.Args[3].(String).Value
+	pattern := call.Args[4].(String).Value
+
+	re, err := regexp.Compile("^(?s:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in label_replace(): %s", pattern)
+	}
+	if dst == "" || !utf8.ValidString(dst) {
+		return nil, fmt.Errorf("invalid destination label name in label_replace(): %s", dst)
+	}
+
+	result := Vector{}
+	for _, s := range call.Args[0].(Vector) {
+		value := labelValue(s, src)
+		indexes := re.FindStringSubmatchIndex(value)
+		if indexes != nil {
+			res := re.ExpandString(nil, replacement, value, indexes)
+			s = setLabel(s, dst, string(res))
 		}
+		result = append(result, s)
 	}
-	return result
+	return result, nil
 }
 
-// ApplyCeil applies ceiling function to all points in a series
-func ApplyCeil(series []MetricSeries) []MetricSeries {
-	result := make([]MetricSeries, len(series))
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     make([]MetricPoint, len(s.Points)),
+func (fr *FunctionRegistry) handleLabelJoin(call *FunctionCall) (Value, error) {
+	dst := call.Args[1].(String).Value
+	separator := call.Args[2].(String).Value
+	var srcLabels []string
+	for _, arg := range call.Args[3:] {
+		src := arg.(String).Value
+		if !utf8.ValidString(src) {
+			return nil, fmt.Errorf("invalid source label name in label_join(): %s", src)
 		}
-		for j, point := range s.Points {
-			result[i].Points[j] = MetricPoint{
-				Timestamp: point.Timestamp,
-				Value:     math.Ceil(point.Value),
-				Labels:    point.Labels,
-			}
+		srcLabels = append(srcLabels, src)
+	}
+	if dst == "" || !utf8.ValidString(dst) {
+		return nil, fmt.Errorf("invalid destination label name in label_join(): %s", dst)
+	}
+
+	result := Vector{}
+	for _, s := range call.Args[0].(Vector) {
+		values := make([]string, len(srcLabels))
+		for i, src := range srcLabels {
+			values[i] = labelValue(s, src)
 		}
+		result = append(result, setLabel(s, dst, strings.Join(values, separator)))
 	}
-	return result
+	return result, nil
 }
 
-// ApplyFloor applies floor function to all points in a series
-func ApplyFloor(series []MetricSeries) []MetricSeries {
-	result := make([]MetricSeries, len(series))
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     make([]MetricPoint, len(s.Points)),
-		}
-		for j, point := range s.Points {
-			result[i].Points[j] = MetricPoint{
-				Timestamp: point.Timestamp,
-				Value:     math.Floor(point.Value),
-				Labels:    point.Labels,
-			}
+func (fr *FunctionRegistry) handleSort(call *FunctionCall) (Value, error) {
+	return sortByValue(call.Args[0].(Vector), false), nil
+}
+
+func (fr *FunctionRegistry) handleSortDesc(call *FunctionCall) (Value, error) {
+	return sortByValue(call.Args[0].(Vector), true), nil
+}
+
+func (fr *FunctionRegistry) handleSortByLabel(call *FunctionCall) (Value, error) {
+	return sortByLabels(call.Args[0].(Vector), call.Args[1:], false), nil
+}
+
+func (fr *FunctionRegistry) handleSortByLabelDesc(call *FunctionCall) (Value, error) {
+	return sortByLabels(call.Args[0].(Vector), call.Args[1:], true), nil
+}
+
+func (fr *FunctionRegistry) handleAbsent(call *FunctionCall) (Value, error) {
+	if len(call.Args[0].(Vector)) > 0 {
+		return Vector{}, nil
+	}
+	return absentVector(call.Exprs[0], call.Timestamp), nil
+}
+
+func (fr *FunctionRegistry) handleAbsentOverTime(call *FunctionCall) (Value, error) {
+	for _, s := range call.Args[0].(Matrix) {
+		if len(s.Points) > 0 {
+			return Vector{}, nil
 		}
 	}
-	return result
+	return absentVector(call.Exprs[0], call.Timestamp), nil
 }
 
-// ApplyRound applies round function to all points in a series
-func ApplyRound(series []MetricSeries) []MetricSeries {
-	result := make([]MetricSeries, len(series))
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     make([]MetricPoint, len(s.Points)),
+func (fr *FunctionRegistry) handleVector(call *FunctionCall) (Value, error) {
+	return Vector{{
+		Labels: map[string]string{},
+		Points: []MetricPoint{{Timestamp: call.Timestamp, Value: call.Args[0].(Scalar).Value}},
+	}}, nil
+}
+
+func (fr *FunctionRegistry) handleScalar(call *FunctionCall) (Value, error) {
+	vector := call.Args[0].(Vector)
+	if len(vector) != 1 {
+		return Scalar{Timestamp: call.Timestamp, Value: math.NaN()}, nil
+	}
+	return Scalar{Timestamp: call.Timestamp, Value: vector[0].Points[0].Value}, nil
+}
+
+func (fr *FunctionRegistry) handleTime(call *FunctionCall) (Value, error) {
+	return Scalar{Timestamp: call.Timestamp, Value: float64(call.Timestamp.UnixMilli()) / 1000}, nil
+}
+
+// handleTimestamp returns the timestamp of each sample. The evaluator passes
+// the raw samples of a vector selector argument so that their own timestamps
+// are reported rather than the evaluation time.
+func (fr *FunctionRegistry) handleTimestamp(call *FunctionCall) (Value, error) {
+	vector := Vector{}
+	for _, s := range call.Args[0].(Vector) {
+		vector = append(vector, MetricSeries{
+			Labels: s.Labels,
+			Points: []MetricPoint{{
+				Timestamp: call.Timestamp,
+				Value:     float64(s.Points[0].Timestamp.UnixMilli()) / 1000,
+			}},
+		})
+	}
+	return vector, nil
+}
+
+// Utility functions
+
+// pointValues returns the values of a list of points
+func pointValues(points []MetricPoint) []float64 {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return values
+}
+
+// labelValue returns the value of a label, including the metric name
+func labelValue(s MetricSeries, name string) string {
+	if name == MetricNameLabel {
+		return s.MetricName
+	}
+	return s.Labels[name]
+}
+
+// setLabel returns a copy of the series with a label set, or removed when the
+// value is empty
+func setLabel(s MetricSeries, name, value string) MetricSeries {
+	if name == MetricNameLabel {
+		s.MetricName = value
+		return s
+	}
+
+	labels := make(map[string]string, len(s.Labels)+1)
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	if value == "" {
+		delete(labels, name)
+	} else {
+		labels[name] = value
+	}
+	s.Labels = labels
+	return s
+}
+
+// sortByValue orders a vector by sample value, NaN last
+func sortByValue(vector Vector, desc bool) Vector {
+	sorted := append(Vector{}, vector...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Points[0].Value, sorted[j].Points[0].Value
+		if math.IsNaN(a) {
+			return false
 		}
-		for j, point := range s.Points {
-			result[i].Points[j] = MetricPoint{
-				Timestamp: point.Timestamp,
-				Value:     math.Round(point.Value),
-				Labels:    point.Labels,
-			}
+		if math.IsNaN(b) {
+			return true
 		}
-	}
-	return result
+		if desc {
+			return a > b
+		}
+		return a < b
+	})
+	return sorted
 }
 
-// ApplyTimestamp extracts timestamps from all points in a series
-func ApplyTimestamp(series []MetricSeries) []MetricSeries {
-	result := make([]MetricSeries, len(series))
-	for i, s := range series {
-		result[i] = MetricSeries{
-			MetricName: s.MetricName,
-			Labels:     s.Labels,
-			Points:     make([]MetricPoint, len(s.Points)),
+// sortByLabels orders a vector by the values of the given labels, using
+// natural ordering so that "9" sorts before "10"
+func sortByLabels(vector Vector, labelArgs []Value, desc bool) Vector {
+	names := make([]string, len(labelArgs))
+	for i, arg := range labelArgs {
+		names[i] = arg.(String).Value
+	}
+
+	sorted := append(Vector{}, vector...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, name := range names {
+			a, b := labelValue(sorted[i], name), labelValue(sorted[j], name)
+			if a == b {
+				continue
+			}
+			if desc {
+				return naturalLess(b, a)
+			}
+			return naturalLess(a, b)
 		}
-		for j, point := range s.Points {
-			result[i].Points[j] = MetricPoint{
-				Timestamp: point.Timestamp,
-				Value:     float64(point.Timestamp.Unix()),
-				Labels:    point.Labels,
+		return false
+	})
+	return sorted
+}
+
+// naturalLess compares strings treating runs of digits as numbers
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, _ := strconv.ParseFloat(da, 64)
+			nb, _ := strconv.ParseFloat(db, 64)
+			if na != nb {
+				return na < nb
 			}
+			a, b = a[len(da):], b[len(db):]
+			continue
 		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
 	}
-	return result
+	return s[:i]
 }
 
+// absentVector builds the single sample returned by absent and
+// absent_over_time. Its labels are taken from the equality matchers of the
+// selector, if the argument is one.
+func absentVector(expr Expr, ts time.Time) Vector {
+	labels := map[string]string{}
+	var vs *VectorSelector
+	switch n := unwrapParens(expr).(type) {
+	case *VectorSelector:
+		vs = n
+	case *MatrixSelector:
+		vs, _ = unwrapParens(n.VectorSelector).(*VectorSelector)
+	}
+
+	if vs != nil {
+		conflicting := map[string]bool{}
+		for _, m := range vs.LabelMatchers {
+			if m.Name == MetricNameLabel || m.Type != MatchEqual || m.Value == "" {
+				continue
+			}
+			if _, seen := labels[m.Name]; seen {
+				conflicting[m.Name] = true
+			}
+			labels[m.Name] = m.Value
+		}
+		for name := range conflicting {
+			delete(labels, name)
+		}
+	}
+
+	return Vector{{
+		Labels: labels,
+		Points: []MetricPoint{{Timestamp: ts, Value: 1}},
+	}}
+}
@@ -0,0 +1,173 @@
+package promql
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/storage"
+)
+
+func TestFunctions(t *testing.T) {
+	ts := time.Now().Truncate(time.Minute)
+	sample := func(age time.Duration, instance string, value float64) *storage.Metric {
+		return &storage.Metric{
+			Timestamp:  ts.Add(-age),
+			MetricName: "gauge",
+			Value:      value,
+			Labels:     `{"instance":"` + instance + `"}`,
+		}
+	}
+	e := newTestEvaluator(t,
+		sample(3*time.Minute, "a", 3),
+		sample(2*time.Minute, "a", -1.5),
+		sample(time.Minute, "a", 4),
+		sample(0, "a", 2),
+		sample(30*time.Second, "b", -2.5),
+	)
+	seconds := func(t time.Time) float64 { return float64(t.UnixMilli()) / 1000 }
+
+	tests := []struct {
+		query string
+		// want maps each result series, as formatted by formatSeries, to
+		// its value
+		want map[string]float64
+		// order lists the result series in the order expected, if any
+		order []string
+		err   string
+	}{
+		// Functions over time drop the metric name, except last_over_time
+		{query: `avg_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 1.875}},
+		{query: `min_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: -1.5}},
+		{query: `max_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 4}},
+		{query: `sum_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 7.5}},
+		{query: `count_over_time(gauge[5m])`, want: map[string]float64{`{instance="a"}`: 4, `{instance="b"}`: 1}},
+		{query: `count_over_time(gauge[90s])`, want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: 1}},
+		{query: `stdvar_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 4.296875}},
+		{query: `stddev_over_time(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: math.Sqrt(4.296875)}},
+		{query: `present_over_time(gauge[5m])`, want: map[string]float64{`{instance="a"}`: 1, `{instance="b"}`: 1}},
+		{query: `last_over_time(gauge[5m])`, want: map[string]float64{`gauge{instance="a"}`: 2, `gauge{instance="b"}`: -2.5}},
+		{query: `quantile_over_time(0.5, gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 2.5}},
+		{query: `changes(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 3}},
+		{query: `resets(gauge{instance="a"}[5m])`, want: map[string]float64{`{instance="a"}`: 2}},
+		{query: `max_over_time(missing[5m])`, want: map[string]float64{}},
+
+		// Math functions drop the metric name
+		{query: "abs(gauge)", want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: 2.5}},
+		{query: "ceil(gauge)", want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: -2}},
+		{query: "floor(gauge)", want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: -3}},
+		{query: "round(gauge)", want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: -2}},
+		{query: "round(gauge, 0.3)", want: map[string]float64{`{instance="a"}`: 2.1, `{instance="b"}`: -2.4}},
+		{query: "clamp(gauge, -1, 1)", want: map[string]float64{`{instance="a"}`: 1, `{instance="b"}`: -1}},
+		{query: "clamp(gauge, 1, -1)", want: map[string]float64{}},
+		{query: "clamp_min(gauge, 0)", want: map[string]float64{`{instance="a"}`: 2, `{instance="b"}`: 0}},
+		{query: "clamp_max(gauge, 0)", want: map[string]float64{`{instance="a"}`: 0, `{instance="b"}`: -2.5}},
+		{query: "sqrt(gauge)", want: map[string]float64{`{instance="a"}`: math.Sqrt2, `{instance="b"}`: math.NaN()}},
+
+		// Label functions keep the metric name
+		{
+			query: `label_replace(gauge, "host", "$1-x", "instance", "(.*)")`,
+			want:  map[string]float64{`gauge{host="a-x", instance="a"}`: 2, `gauge{host="b-x", instance="b"}`: -2.5},
+		},
+		{
+			// A replacement is only made when the whole value matches
+			query: `label_replace(gauge, "host", "$1", "instance", "(a)")`,
+			want:  map[string]float64{`gauge{host="a", instance="a"}`: 2, `gauge{instance="b"}`: -2.5},
+		},
+		{
+			query: `label_replace(gauge, "host", "$1", "__name__", "(g)")`,
+			want:  map[string]float64{`gauge{instance="a"}`: 2, `gauge{instance="b"}`: -2.5},
+		},
+		{
+			// An empty replacement removes the label
+			query: `label_replace(gauge, "instance", "", "instance", "a")`,
+			want:  map[string]float64{`gauge{}`: 2, `gauge{instance="b"}`: -2.5},
+		},
+		{
+			query: `label_replace(gauge, "name", "${1}_total", "__name__", "(.+)")`,
+			want:  map[string]float64{`gauge{instance="a", name="gauge_total"}`: 2, `gauge{instance="b", name="gauge_total"}`: -2.5},
+		},
+		{query: `label_replace(gauge, "host", "$1", "instance", "(")`, err: "invalid regular expression in label_replace(): ("},
+		{query: `label_replace(gauge, "", "$1", "instance", "(.*)")`, err: "invalid destination label name in label_replace(): "},
+		{
+			query: `label_join(gauge, "id", "/", "__name__", "instance", "missing")`,
+			want:  map[string]float64{`gauge{id="gauge/a/", instance="a"}`: 2, `gauge{id="gauge/b/", instance="b"}`: -2.5},
+		},
+		{query: `label_join(gauge, "", "-", "instance")`, err: "invalid destination label name in label_join(): "},
+
+		// absent takes its labels from the equality matchers of a selector
+		{query: "absent(gauge)", want: map[string]float64{}},
+		{query: `absent(missing{job="x", env=~"p.*"})`, want: map[string]float64{`{job="x"}`: 1}},
+		{query: `absent(missing{job="x", job="y"})`, want: map[string]float64{`{}`: 1}},
+		{query: `absent(sum(missing{job="x"}))`, want: map[string]float64{`{}`: 1}},
+		{query: "absent_over_time(gauge[5m])", want: map[string]float64{}},
+		{query: `absent_over_time(missing{job="x"}[5m])`, want: map[string]float64{`{job="x"}`: 1}},
+
+		// timestamp reports the time of each sample rather than of the
+		// evaluation
+		{
+			query: "timestamp(gauge)",
+			want:  map[string]float64{`{instance="a"}`: seconds(ts), `{instance="b"}`: seconds(ts.Add(-30 * time.Second))},
+		},
+		{query: "time()", want: map[string]float64{`{}`: seconds(ts)}},
+		{query: "vector(3)", want: map[string]float64{`{}`: 3}},
+		{query: `scalar(gauge{instance="a"})`, want: map[string]float64{`{}`: 2}},
+		{query: "scalar(gauge)", want: map[string]float64{`{}`: math.NaN()}},
+
+		// Sort functions order the result
+		{
+			query: "sort(gauge)",
+			order: []string{`gauge{instance="b"}`, `gauge{instance="a"}`},
+		},
+		{
+			query: "sort_desc(gauge)",
+			order: []string{`gauge{instance="a"}`, `gauge{instance="b"}`},
+		},
+		{
+			query: `sort_by_label_desc(gauge, "instance")`,
+			order: []string{`gauge{instance="b"}`, `gauge{instance="a"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evaluateInstant(t, e, tt.query, ts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+
+			if tt.order != nil {
+				var order []string
+				for _, s := range result.Series {
+					order = append(order, formatSeries(s))
+				}
+				if !reflect.DeepEqual(order, tt.order) {
+					t.Errorf("got series %v, want %v", order, tt.order)
+				}
+				return
+			}
+
+			got := make(map[string]float64)
+			for _, s := range result.Series {
+				got[formatSeries(s)] = s.Points[0].Value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got series %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				v, ok := got[key]
+				if !ok || !(math.Abs(v-value) < 1e-9 || v == value || math.IsNaN(v) && math.IsNaN(value)) {
+					t.Errorf("%s = %v (present %t), want %v", key, v, ok, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package promql
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"open-telemorph-prime/internal/histogram"
+)
+
+// BucketLabel is the label holding the upper bound of a histogram bucket
+const BucketLabel = "le"
+
+// bucket is a classic histogram bucket with a cumulative count
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// handleHistogramQuantile estimates the φ-quantile from native histograms
+// and from classic histogram bucket series. Buckets are grouped by their
+// labels without le; series without a valid le label are ignored.
+func (fr *FunctionRegistry) handleHistogramQuantile(call *FunctionCall) (Value, error) {
+	phi := call.Args[0].(Scalar).Value
+	vector := mapHistograms(call.Args[1].(Vector), func(h *histogram.Exponential) float64 {
+		return h.Quantile(phi)
+	})
+
+	type bucketGroup struct {
+		labels  map[string]string
+		buckets []bucket
+	}
+	index := make(map[string]*bucketGroup)
+	var groups []*bucketGroup
+
+	for _, s := range call.Args[1].(Vector) {
+		if s.Points[0].Histogram != nil {
+			continue
+		}
+		upperBound, err := strconv.ParseFloat(s.Labels[BucketLabel], 64)
+		if err != nil {
+			continue
+		}
+
+		labels := make(map[string]string, len(s.Labels))
+		for k, v := range s.Labels {
+			if k != BucketLabel {
+				labels[k] = v
+			}
+		}
+
+		key := seriesKey("", labels)
+		group, ok := index[key]
+		if !ok {
+			group = &bucketGroup{labels: labels}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.buckets = append(group.buckets, bucket{upperBound: upperBound, count: s.Points[0].Value})
+	}
+
+	for _, group := range groups {
+		vector = append(vector, MetricSeries{
+			Labels: group.labels,
+			Points: []MetricPoint{{Timestamp: call.Timestamp, Value: bucketQuantile(phi, group.buckets)}},
+		})
+	}
+	return vector, nil
+}
+
+// handleHistogramFraction estimates the fraction of observations of native
+// histograms between a lower and an upper value
+func (fr *FunctionRegistry) handleHistogramFraction(call *FunctionCall) (Value, error) {
+	lower := call.Args[0].(Scalar).Value
+	upper := call.Args[1].(Scalar).Value
+	return mapHistograms(call.Args[2].(Vector), func(h *histogram.Exponential) float64 {
+		return h.Fraction(lower, upper)
+	}), nil
+}
+
+// mapHistograms applies fn to every native histogram sample of a vector,
+// dropping the metric name. Float samples are ignored.
+func mapHistograms(vector Vector, fn func(h *histogram.Exponential) float64) Vector {
+	result := Vector{}
+	for _, s := range vector {
+		point := s.Points[0]
+		if point.Histogram == nil {
+			continue
+		}
+		result = append(result, MetricSeries{
+			Labels: s.Labels,
+			Points: []MetricPoint{{Timestamp: point.Timestamp, Value: fn(point.Histogram)}},
+		})
+	}
+	return result
+}
+
+// histogramRate returns the increase of a native histogram over the range
+// window, extrapolated the way extrapolatedRate does for floats. A drop in
+// the observation count is treated as a reset.
+func histogramRate(points []MetricPoint, rangeStart, rangeEnd time.Time, isRate bool) (*histogram.Exponential, bool) {
+	if len(points) < 2 {
+		return nil, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	if first.Histogram == nil || last.Histogram == nil {
+		return nil, false
+	}
+	result := last.Histogram.Sub(first.Histogram)
+	prev := first.Histogram
+	for _, p := range points[1:] {
+		if p.Histogram == nil {
+			return nil, false
+		}
+		if p.Histogram.Count < prev.Count {
+			result = result.Merge(prev)
+		}
+		prev = p.Histogram
+	}
+
+	factor, ok := extrapolationFactor(points, rangeStart, rangeEnd, true, isRate, result.Count)
+	if !ok {
+		return nil, false
+	}
+	return result.Mul(factor), true
+}
+
+// bucketQuantile estimates the q-quantile from cumulative buckets by linear
+// interpolation within the bucket the quantile falls into. The highest bucket
+// must be +Inf; a quantile falling into it is reported as the highest finite
+// bound. Buckets that are not monotonic, as can happen when bucket series are
+// scraped at slightly different times, are smoothed out.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	buckets = coalesceBuckets(buckets)
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var bucketStart float64
+	bucketEnd := buckets[b].upperBound
+	count := buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// coalesceBuckets merges buckets with the same upper bound, which occur when
+// the same le is written in different formats such as "1" and "1.0"
+func coalesceBuckets(buckets []bucket) []bucket {
+	last := buckets[0]
+	i := 0
+	for _, b := range buckets[1:] {
+		if b.upperBound == last.upperBound {
+			last.count += b.count
+		} else {
+			buckets[i] = last
+			last = b
+			i++
+		}
+	}
+	buckets[i] = last
+	return buckets[:i+1]
+}
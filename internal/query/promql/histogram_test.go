@@ -0,0 +1,61 @@
+package promql
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	inf := math.Inf(1)
+	latency := []bucket{{0.1, 10}, {0.5, 20}, {1, 40}, {inf, 40}}
+
+	tests := []struct {
+		name    string
+		q       float64
+		buckets []bucket
+		want    float64
+	}{
+		// Interpolated linearly within the bucket the rank falls into,
+		// starting from zero in the first bucket
+		{name: "first bucket", q: 0.1, buckets: latency, want: 0.04},
+		{name: "first bucket bound", q: 0.25, buckets: latency, want: 0.1},
+		{name: "median", q: 0.5, buckets: latency, want: 0.5},
+		{name: "within bucket", q: 0.6, buckets: latency, want: 0.6},
+		{name: "upper quartile", q: 0.75, buckets: latency, want: 0.75},
+		{name: "unsorted buckets", q: 0.6, buckets: []bucket{{inf, 40}, {1, 40}, {0.1, 10}, {0.5, 20}}, want: 0.6},
+		// A rank in the +Inf bucket reports the highest finite bound
+		{name: "+Inf bucket", q: 0.9, buckets: []bucket{{1, 10}, {inf, 20}}, want: 1},
+		// The first bucket is not interpolated from zero when its bound is
+		// not positive
+		{name: "negative first bound", q: 0.2, buckets: []bucket{{-1, 5}, {0, 10}, {inf, 10}}, want: -1},
+		// Counts decreasing with le are raised to keep them monotonic
+		{name: "non-monotonic buckets", q: 0.5, buckets: []bucket{{1, 10}, {2, 8}, {inf, 12}}, want: 0.6},
+		// The same bound written as "1" and "1.0" is one bucket
+		{name: "duplicate bounds", q: 0.5, buckets: []bucket{{1, 5}, {1, 5}, {2, 20}, {inf, 20}}, want: 1},
+		{name: "q below 0", q: -0.5, buckets: latency, want: math.Inf(-1)},
+		{name: "q above 1", q: 1.5, buckets: latency, want: math.Inf(1)},
+		{name: "NaN q", q: math.NaN(), buckets: latency, want: math.NaN()},
+		{name: "no +Inf bucket", q: 0.5, buckets: []bucket{{0.1, 10}, {1, 20}}, want: math.NaN()},
+		{name: "only +Inf bucket", q: 0.5, buckets: []bucket{{inf, 10}}, want: math.NaN()},
+		{name: "no observations", q: 0.5, buckets: []bucket{{1, 0}, {inf, 0}}, want: math.NaN()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets := append([]bucket(nil), tt.buckets...)
+			got := bucketQuantile(tt.q, buckets)
+			switch {
+			case math.IsNaN(tt.want):
+				if !math.IsNaN(got) {
+					t.Errorf("got %v, want NaN", got)
+				}
+			case math.IsInf(tt.want, 0):
+				if got != tt.want {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			case math.Abs(got-tt.want) > 1e-9:
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
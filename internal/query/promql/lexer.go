@@ -0,0 +1,440 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenType identifies the kind of a lexed token
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenColon
+	tokenAt
+	tokenAssign   // =
+	tokenEQL      // ==
+	tokenNEQ      // !=
+	tokenEQLRegex // =~
+	tokenNEQRegex // !~
+	tokenLSS      // <
+	tokenLTE      // <=
+	tokenGTR      // >
+	tokenGTE      // >=
+	tokenADD      // +
+	tokenSUB      // -
+	tokenMUL      // *
+	tokenDIV      // /
+	tokenMOD      // %
+	tokenPOW      // ^
+)
+
+var tokenNames = map[tokenType]string{
+	tokenEOF:          "end of input",
+	tokenIdentifier:   "identifier",
+	tokenNumber:       "number",
+	tokenDuration:     "duration",
+	tokenString:       "string",
+	tokenLeftParen:    `"("`,
+	tokenRightParen:   `")"`,
+	tokenLeftBrace:    `"{"`,
+	tokenRightBrace:   `"}"`,
+	tokenLeftBracket:  `"["`,
+	tokenRightBracket: `"]"`,
+	tokenComma:        `","`,
+	tokenColon:        `":"`,
+	tokenAt:           `"@"`,
+	tokenAssign:       `"="`,
+	tokenEQL:          `"=="`,
+	tokenNEQ:          `"!="`,
+	tokenEQLRegex:     `"=~"`,
+	tokenNEQRegex:     `"!~"`,
+	tokenLSS:          `"<"`,
+	tokenLTE:          `"<="`,
+	tokenGTR:          `">"`,
+	tokenGTE:          `">="`,
+	tokenADD:          `"+"`,
+	tokenSUB:          `"-"`,
+	tokenMUL:          `"*"`,
+	tokenDIV:          `"/"`,
+	tokenMOD:          `"%"`,
+	tokenPOW:          `"^"`,
+}
+
+func (t tokenType) String() string {
+	if name, ok := tokenNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("token(%d)", int(t))
+}
+
+// token is a single lexical item of a PromQL query
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// desc returns a human readable description of the token for error messages
+func (t token) desc() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of input"
+	case tokenIdentifier, tokenNumber, tokenDuration:
+		return fmt.Sprintf("%s %q", t.typ, t.val)
+	case tokenString:
+		return fmt.Sprintf("string %s", t.val)
+	default:
+		return t.typ.String()
+	}
+}
+
+// end returns the position just past the token
+func (t token) end() int {
+	return t.pos + len(t.val)
+}
+
+// lexer splits a PromQL query into tokens
+type lexer struct {
+	input  string
+	pos    int
+	tokens []token
+}
+
+// lex tokenizes the whole input, returning a positional error on the first
+// invalid character sequence
+func lex(input string) ([]token, error) {
+	l := &lexer{input: input}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		l.tokens = append(l.tokens, tok)
+		if tok.typ == tokenEOF {
+			return l.tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(start, end int, format string, args ...interface{}) error {
+	return &ParseError{
+		PositionRange: PositionRange{Start: start, End: end},
+		Err:           fmt.Sprintf(format, args...),
+		Query:         l.input,
+	}
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+offset]
+}
+
+func (l *lexer) emit(typ tokenType, start int) token {
+	return token{typ: typ, val: l.input[start:l.pos], pos: start}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpaceAndComments()
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{typ: tokenEOF, pos: l.pos}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return l.emit(tokenLeftParen, start), nil
+	case c == ')':
+		l.pos++
+		return l.emit(tokenRightParen, start), nil
+	case c == '{':
+		l.pos++
+		return l.emit(tokenLeftBrace, start), nil
+	case c == '}':
+		l.pos++
+		return l.emit(tokenRightBrace, start), nil
+	case c == '[':
+		l.pos++
+		return l.emit(tokenLeftBracket, start), nil
+	case c == ']':
+		l.pos++
+		return l.emit(tokenRightBracket, start), nil
+	case c == ',':
+		l.pos++
+		return l.emit(tokenComma, start), nil
+	case c == ':':
+		l.pos++
+		return l.emit(tokenColon, start), nil
+	case c == '@':
+		l.pos++
+		return l.emit(tokenAt, start), nil
+	case c == '+':
+		l.pos++
+		return l.emit(tokenADD, start), nil
+	case c == '-':
+		l.pos++
+		return l.emit(tokenSUB, start), nil
+	case c == '*':
+		l.pos++
+		return l.emit(tokenMUL, start), nil
+	case c == '/':
+		l.pos++
+		return l.emit(tokenDIV, start), nil
+	case c == '%':
+		l.pos++
+		return l.emit(tokenMOD, start), nil
+	case c == '^':
+		l.pos++
+		return l.emit(tokenPOW, start), nil
+	case c == '=':
+		l.pos++
+		switch l.peek(0) {
+		case '=':
+			l.pos++
+			return l.emit(tokenEQL, start), nil
+		case '~':
+			l.pos++
+			return l.emit(tokenEQLRegex, start), nil
+		}
+		return l.emit(tokenAssign, start), nil
+	case c == '!':
+		l.pos++
+		switch l.peek(0) {
+		case '=':
+			l.pos++
+			return l.emit(tokenNEQ, start), nil
+		case '~':
+			l.pos++
+			return l.emit(tokenNEQRegex, start), nil
+		}
+		return token{}, l.errorf(start, l.pos, "unexpected character after '!'")
+	case c == '<':
+		l.pos++
+		if l.peek(0) == '=' {
+			l.pos++
+			return l.emit(tokenLTE, start), nil
+		}
+		return l.emit(tokenLSS, start), nil
+	case c == '>':
+		l.pos++
+		if l.peek(0) == '=' {
+			l.pos++
+			return l.emit(tokenGTE, start), nil
+		}
+		return l.emit(tokenGTR, start), nil
+	case c == '"' || c == '\'' || c == '`':
+		return l.lexString(c)
+	case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+		return l.lexNumberOrDuration()
+	case isAlpha(c):
+		return l.lexIdentifier(), nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+	return token{}, l.errorf(start, start+size, "unexpected character %q", r)
+}
+
+func (l *lexer) skipSpaceAndComments() {
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) lexString(quote byte) (token, error) {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == '\\' && quote != '`':
+			l.pos += 2
+			continue
+		case c == '\n' && quote != '`':
+			return token{}, l.errorf(start, l.pos, "unterminated quoted string")
+		case c == quote:
+			l.pos++
+			return l.emit(tokenString, start), nil
+		}
+		l.pos++
+	}
+	return token{}, l.errorf(start, len(l.input), "unterminated quoted string")
+}
+
+func (l *lexer) lexNumberOrDuration() (token, error) {
+	start := l.pos
+
+	// Hexadecimal literal
+	if l.peek(0) == '0' && (l.peek(1) == 'x' || l.peek(1) == 'X') {
+		l.pos += 2
+		for isHexDigit(l.peek(0)) {
+			l.pos++
+		}
+		if l.pos-start == 2 || isAlphaNumeric(l.peek(0)) {
+			return token{}, l.errorf(start, l.pos+1, "bad number syntax: %q", l.input[start:l.pos+1])
+		}
+		return l.emit(tokenNumber, start), nil
+	}
+
+	for isDigit(l.peek(0)) {
+		l.pos++
+	}
+
+	// A plain integer directly followed by a unit is a duration (5m, 1h30m)
+	if l.pos > start && isDurationUnitStart(l.peek(0)) && !l.looksLikeExponent() {
+		l.pos = start
+		return l.lexDuration()
+	}
+
+	if l.peek(0) == '.' {
+		l.pos++
+		for isDigit(l.peek(0)) {
+			l.pos++
+		}
+	}
+	if l.looksLikeExponent() {
+		l.pos++
+		if l.peek(0) == '+' || l.peek(0) == '-' {
+			l.pos++
+		}
+		for isDigit(l.peek(0)) {
+			l.pos++
+		}
+	}
+
+	if isAlphaNumeric(l.peek(0)) {
+		for isAlphaNumeric(l.peek(0)) || l.peek(0) == '.' {
+			l.pos++
+		}
+		return token{}, l.errorf(start, l.pos, "bad number or duration syntax: %q", l.input[start:l.pos])
+	}
+	return l.emit(tokenNumber, start), nil
+}
+
+// looksLikeExponent reports whether the lexer is positioned on the exponent of
+// a floating point literal such as 1e3 or 2E-4
+func (l *lexer) looksLikeExponent() bool {
+	c := l.peek(0)
+	if c != 'e' && c != 'E' {
+		return false
+	}
+	next := l.peek(1)
+	if next == '+' || next == '-' {
+		return isDigit(l.peek(2))
+	}
+	return isDigit(next)
+}
+
+func (l *lexer) lexDuration() (token, error) {
+	start := l.pos
+	for isDigit(l.peek(0)) {
+		for isDigit(l.peek(0)) {
+			l.pos++
+		}
+		unitStart := l.pos
+		for isAlpha(l.peek(0)) && !isDigit(l.peek(0)) {
+			l.pos++
+		}
+		if !isDurationUnit(l.input[unitStart:l.pos]) {
+			for isAlphaNumeric(l.peek(0)) {
+				l.pos++
+			}
+			return token{}, l.errorf(start, l.pos, "bad duration syntax: %q", l.input[start:l.pos])
+		}
+	}
+	if isAlphaNumeric(l.peek(0)) || l.peek(0) == '.' {
+		for isAlphaNumeric(l.peek(0)) || l.peek(0) == '.' {
+			l.pos++
+		}
+		return token{}, l.errorf(start, l.pos, "bad duration syntax: %q", l.input[start:l.pos])
+	}
+	return l.emit(tokenDuration, start), nil
+}
+
+func (l *lexer) lexIdentifier() token {
+	start := l.pos
+	for isAlphaNumeric(l.peek(0)) || l.peek(0) == ':' {
+		l.pos++
+	}
+	return l.emit(tokenIdentifier, start)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlphaNumeric(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+func isDurationUnitStart(c byte) bool {
+	return strings.IndexByte("smhdwy", c) >= 0
+}
+
+func isDurationUnit(unit string) bool {
+	switch unit {
+	case "ms", "s", "m", "h", "d", "w", "y":
+		return true
+	}
+	return false
+}
+
+// isValidLabelName reports whether name can be written unquoted as a label name
+func isValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) && r < utf8.RuneSelf || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidMetricName reports whether name can be written unquoted as a metric name
+func isValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r == ':' || unicode.IsLetter(r) && r < utf8.RuneSelf || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,286 +2,1030 @@ package promql
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Query represents a parsed PromQL query
-type Query struct {
-	MetricName  string
-	Labels      map[string]string
-	Function    string
-	Range       time.Duration
-	Offset      time.Duration
-	Aggregation *Aggregation
+// ParseError is a syntax or type error at a position of the query string
+type ParseError struct {
+	PositionRange PositionRange
+	Err           string
+	Query         string
 }
 
-// Aggregation represents aggregation operations
-type Aggregation struct {
-	Operation string   // sum, avg, count, min, max
-	By        []string // grouping labels
-	Without   []string // excluding labels
+// Error formats the error as line:column: message
+func (e *ParseError) Error() string {
+	line, col := e.LineColumn()
+	return fmt.Sprintf("%d:%d: parse error: %s", line, col, e.Err)
+}
+
+// LineColumn returns the 1-based line and column of the start of the error
+func (e *ParseError) LineColumn() (int, int) {
+	line, col := 1, 1
+	for i, r := range e.Query {
+		if i >= e.PositionRange.Start {
+			break
+		}
+		if r == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// aggregators lists the aggregation operators and whether they take a parameter
+var aggregators = map[string]ValueType{
+	"sum":          ValueTypeNone,
+	"avg":          ValueTypeNone,
+	"count":        ValueTypeNone,
+	"min":          ValueTypeNone,
+	"max":          ValueTypeNone,
+	"group":        ValueTypeNone,
+	"stddev":       ValueTypeNone,
+	"stdvar":       ValueTypeNone,
+	"topk":         ValueTypeScalar,
+	"bottomk":      ValueTypeScalar,
+	"quantile":     ValueTypeScalar,
+	"count_values": ValueTypeString,
+}
+
+// binaryPrecedence returns the precedence of binary operators, higher binds
+// tighter. The power operator is handled separately because it is right
+// associative and binds tighter than unary minus.
+var binaryPrecedence = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3,
+	"!=":     3,
+	"<=":     3,
+	"<":      3,
+	">=":     3,
+	">":      3,
+	"+":      4,
+	"-":      4,
+	"*":      5,
+	"/":      5,
+	"%":      5,
+	"atan2":  5,
+}
+
+func isComparisonOperator(op string) bool {
+	switch op {
+	case "==", "!=", "<=", "<", ">=", ">":
+		return true
+	}
+	return false
+}
+
+func isSetOperator(op string) bool {
+	switch op {
+	case "and", "or", "unless":
+		return true
+	}
+	return false
 }
 
 // Parser handles PromQL query parsing
-type Parser struct{}
+type Parser struct {
+	functions *FunctionRegistry
+}
 
 // NewParser creates a new PromQL parser
 func NewParser() *Parser {
-	return &Parser{}
+	return &Parser{functions: NewFunctionRegistry()}
 }
 
-// Parse parses a PromQL query string into a Query struct
-func (p *Parser) Parse(query string) (*Query, error) {
-	query = strings.TrimSpace(query)
-	if query == "" {
-		return nil, fmt.Errorf("empty query")
+// Parse parses a PromQL query string into an abstract syntax tree.
+// Errors are returned as *ParseError carrying the offending position.
+func (p *Parser) Parse(query string) (Expr, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, &ParseError{Err: "no expression found in input", Query: query}
 	}
 
-	// Handle function calls (e.g., rate(http_requests_total[5m]))
-	if strings.Contains(query, "(") && strings.Contains(query, ")") {
-		return p.parseFunction(query)
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
 	}
 
-	// Handle simple metric queries (e.g., http_requests_total)
-	if !strings.Contains(query, "{") {
-		return &Query{
-			MetricName: query,
-			Labels:     make(map[string]string),
-		}, nil
+	ps := &parser{query: query, tokens: tokens, functions: p.functions}
+	expr, err := ps.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := ps.peek(); tok.typ != tokenEOF {
+		return nil, ps.errorf(tok.pos, tok.end(), "unexpected %s", tok.desc())
+	}
+	if err := ps.checkAST(expr); err != nil {
+		return nil, err
 	}
+	return expr, nil
+}
+
+// parser holds the state of a single parse
+type parser struct {
+	query     string
+	tokens    []token
+	pos       int
+	functions *FunctionRegistry
+}
 
-	// Handle metric with labels (e.g., http_requests_total{service="api"})
-	return p.parseMetricWithLabels(query)
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
 }
 
-// parseFunction handles function calls like rate(http_requests_total[5m])
-func (p *Parser) parseFunction(query string) (*Query, error) {
-	// Find function name
-	openParen := strings.Index(query, "(")
-	if openParen == -1 {
-		return nil, fmt.Errorf("invalid function syntax")
+func (p *parser) peekAt(offset int) token {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
 	}
+	return p.tokens[p.pos+offset]
+}
 
-	funcName := strings.TrimSpace(query[:openParen])
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
 
-	// Find closing parenthesis
-	closeParen := strings.LastIndex(query, ")")
-	if closeParen == -1 || closeParen <= openParen {
-		return nil, fmt.Errorf("missing closing parenthesis")
+func (p *parser) errorf(start, end int, format string, args ...interface{}) error {
+	return &ParseError{
+		PositionRange: PositionRange{Start: start, End: end},
+		Err:           fmt.Sprintf(format, args...),
+		Query:         p.query,
 	}
+}
 
-	// Extract function argument
-	arg := strings.TrimSpace(query[openParen+1 : closeParen])
+func (p *parser) unexpected(tok token, context string) error {
+	return p.errorf(tok.pos, tok.end(), "unexpected %s in %s", tok.desc(), context)
+}
 
-	// Parse the argument (could be a metric with range)
-	metricQuery, rangeDuration, err := p.parseMetricWithRange(arg)
-	if err != nil {
-		return nil, fmt.Errorf("invalid function argument: %w", err)
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	tok := p.next()
+	if tok.typ != typ {
+		return tok, p.errorf(tok.pos, tok.end(), "unexpected %s in %s, expected %s", tok.desc(), context, typ)
 	}
+	return tok, nil
+}
 
-	return &Query{
-		MetricName: metricQuery.MetricName,
-		Labels:     metricQuery.Labels,
-		Function:   funcName,
-		Range:      rangeDuration,
-	}, nil
+// isKeyword reports whether tok is the identifier keyword
+func isKeyword(tok token, keyword string) bool {
+	return tok.typ == tokenIdentifier && strings.EqualFold(tok.val, keyword)
+}
+
+// peekBinaryOperator returns the binary operator at the current position, if any
+func (p *parser) peekBinaryOperator() (string, bool) {
+	tok := p.peek()
+	switch tok.typ {
+	case tokenADD, tokenSUB, tokenMUL, tokenDIV, tokenMOD,
+		tokenEQL, tokenNEQ, tokenLSS, tokenLTE, tokenGTR, tokenGTE:
+		return tok.val, true
+	case tokenIdentifier:
+		op := strings.ToLower(tok.val)
+		switch op {
+		case "and", "or", "unless", "atan2":
+			return op, true
+		}
+	}
+	return "", false
 }
 
-// parseMetricWithRange handles metrics with time ranges like http_requests_total[5m]
-func (p *Parser) parseMetricWithRange(query string) (*Query, time.Duration, error) {
-	// Check for range selector [duration]
-	rangeStart := strings.Index(query, "[")
-	if rangeStart == -1 {
-		// No range, parse as regular metric
-		q, err := p.parseMetricWithLabels(query)
-		return q, 0, err
+// parseExpr parses binary expressions using precedence climbing
+func (p *parser) parseExpr(minPrecedence int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
 	}
 
-	rangeEnd := strings.Index(query, "]")
-	if rangeEnd == -1 {
-		return nil, 0, fmt.Errorf("missing closing bracket in range selector")
+	for {
+		op, ok := p.peekBinaryOperator()
+		if !ok || binaryPrecedence[op] < minPrecedence || binaryPrecedence[op] == 0 {
+			return lhs, nil
+		}
+		p.next()
+
+		bin, err := p.parseBinaryModifiers(op)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseExpr(binaryPrecedence[op] + 1)
+		if err != nil {
+			return nil, err
+		}
+		bin.LHS, bin.RHS = lhs, rhs
+		lhs = bin
 	}
+}
 
-	metricPart := strings.TrimSpace(query[:rangeStart])
-	rangePart := strings.TrimSpace(query[rangeStart+1 : rangeEnd])
+// parseUnary parses an optionally signed operand, including the power
+// operator which binds tighter than unary minus
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.typ == tokenADD || tok.typ == tokenSUB {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if num, ok := operand.(*NumberLiteral); ok {
+			if tok.typ == tokenSUB {
+				num.Val = -num.Val
+			}
+			num.PosRange.Start = tok.pos
+			return num, nil
+		}
+		return &UnaryExpr{Op: tok.val, Expr: operand, StartPos: tok.pos}, nil
+	}
 
-	// Parse the metric part
-	metricQuery, err := p.parseMetricWithLabels(metricPart)
+	base, err := p.parsePostfix()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-
-	// Parse the range duration
-	duration, err := p.parseDuration(rangePart)
+	if p.peek().typ != tokenPOW {
+		return base, nil
+	}
+	p.next()
+	bin, err := p.parseBinaryModifiers("^")
 	if err != nil {
-		return nil, 0, fmt.Errorf("invalid range duration: %w", err)
+		return nil, err
 	}
-
-	return metricQuery, duration, nil
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	bin.LHS, bin.RHS = base, exponent
+	return bin, nil
 }
 
-// parseMetricWithLabels handles metrics with label selectors
-func (p *Parser) parseMetricWithLabels(query string) (*Query, error) {
-	// Find label selector
-	labelStart := strings.Index(query, "{")
-	if labelStart == -1 {
-		// No labels, just metric name
-		return &Query{
-			MetricName: strings.TrimSpace(query),
-			Labels:     make(map[string]string),
-		}, nil
+// parseBinaryModifiers parses bool, on/ignoring and group_left/group_right
+// following a binary operator
+func (p *parser) parseBinaryModifiers(op string) (*BinaryExpr, error) {
+	bin := &BinaryExpr{Op: op}
+
+	if isKeyword(p.peek(), "bool") {
+		tok := p.next()
+		if !isComparisonOperator(op) {
+			return nil, p.errorf(tok.pos, tok.end(), "bool modifier can only be used on comparison operators")
+		}
+		bin.ReturnBool = true
 	}
 
-	labelEnd := strings.Index(query, "}")
-	if labelEnd == -1 {
-		return nil, fmt.Errorf("missing closing brace in label selector")
+	card := CardOneToOne
+	if isSetOperator(op) {
+		card = CardManyToMany
 	}
 
-	metricName := strings.TrimSpace(query[:labelStart])
-	labelSelector := strings.TrimSpace(query[labelStart+1 : labelEnd])
+	tok := p.peek()
+	if isKeyword(tok, "on") || isKeyword(tok, "ignoring") {
+		p.next()
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return nil, err
+		}
+		bin.VectorMatching = &VectorMatching{
+			Card:           card,
+			MatchingLabels: labels,
+			On:             isKeyword(tok, "on"),
+		}
 
-	// Parse labels
-	labels, err := p.parseLabels(labelSelector)
+		groupTok := p.peek()
+		if isKeyword(groupTok, "group_left") || isKeyword(groupTok, "group_right") {
+			p.next()
+			if isSetOperator(op) {
+				return nil, p.errorf(groupTok.pos, groupTok.end(), "no grouping allowed for %q operation", op)
+			}
+			if isKeyword(groupTok, "group_left") {
+				bin.VectorMatching.Card = CardManyToOne
+			} else {
+				bin.VectorMatching.Card = CardOneToMany
+			}
+			if p.peek().typ == tokenLeftParen {
+				include, err := p.parseLabelList()
+				if err != nil {
+					return nil, err
+				}
+				bin.VectorMatching.Include = include
+			}
+		}
+	} else if isKeyword(tok, "group_left") || isKeyword(tok, "group_right") {
+		return nil, p.errorf(tok.pos, tok.end(), "%s requires on() or ignoring()", strings.ToLower(tok.val))
+	}
+
+	if bin.VectorMatching == nil {
+		bin.VectorMatching = &VectorMatching{Card: card}
+	}
+	return bin, nil
+}
+
+// parsePostfix parses a primary expression followed by range, subquery,
+// offset and @ modifiers
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Query{
-		MetricName: metricName,
-		Labels:     labels,
-	}, nil
+	for {
+		tok := p.peek()
+		switch {
+		case tok.typ == tokenLeftBracket:
+			expr, err = p.parseRangeOrSubquery(expr)
+		case isKeyword(tok, "offset"):
+			err = p.parseOffset(expr)
+		case tok.typ == tokenAt:
+			err = p.parseAt(expr)
+		default:
+			return expr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 }
 
-// parseLabels parses label selectors like service="api",method="GET"
-func (p *Parser) parseLabels(selector string) (map[string]string, error) {
-	labels := make(map[string]string)
+func (p *parser) parseRangeOrSubquery(expr Expr) (Expr, error) {
+	open := p.next()
 
-	if selector == "" {
-		return labels, nil
+	rangeTok, err := p.expect(tokenDuration, "range selector")
+	if err != nil {
+		if rangeTok.typ == tokenRightBracket {
+			return nil, p.errorf(open.pos, rangeTok.end(), "missing range duration")
+		}
+		return nil, err
+	}
+	rng, err := ParseDuration(rangeTok.val)
+	if err != nil {
+		return nil, p.errorf(rangeTok.pos, rangeTok.end(), "%v", err)
+	}
+	if rng <= 0 {
+		return nil, p.errorf(rangeTok.pos, rangeTok.end(), "range must be greater than zero")
 	}
 
-	// Split by comma
-	pairs := strings.Split(selector, ",")
-	for _, pair := range pairs {
-		pair = strings.TrimSpace(pair)
-		if pair == "" {
-			continue
+	if p.peek().typ == tokenColon {
+		p.next()
+		var step time.Duration
+		if p.peek().typ == tokenDuration {
+			stepTok := p.next()
+			if step, err = ParseDuration(stepTok.val); err != nil {
+				return nil, p.errorf(stepTok.pos, stepTok.end(), "%v", err)
+			}
 		}
-
-		// Split by equals sign
-		parts := strings.SplitN(pair, "=", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid label selector: %s", pair)
+		closeTok, err := p.expect(tokenRightBracket, "subquery selector")
+		if err != nil {
+			return nil, err
 		}
+		return &SubqueryExpr{Expr: expr, Range: rng, Step: step, EndPos: closeTok.end()}, nil
+	}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+	closeTok, err := p.expect(tokenRightBracket, "range selector")
+	if err != nil {
+		return nil, err
+	}
+
+	vs, ok := unwrapParens(expr).(*VectorSelector)
+	if !ok {
+		pr := expr.PositionRange()
+		return nil, p.errorf(pr.Start, closeTok.end(), "ranges only allowed for vector selectors")
+	}
+	if vs.Offset != 0 || vs.Timestamp != nil || vs.StartOrEnd != "" {
+		return nil, p.errorf(open.pos, closeTok.end(), "no offset or @ modifiers allowed before range")
+	}
+	return &MatrixSelector{VectorSelector: expr, Range: rng, EndPos: closeTok.end()}, nil
+}
 
-		// Remove quotes if present
-		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
-			value = value[1 : len(value)-1]
+// modifierTarget returns the fields an offset or @ modifier applies to
+func (p *parser) modifierTarget(expr Expr, tok token) (*time.Duration, **time.Time, *string, *int, error) {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return &e.Offset, &e.Timestamp, &e.StartOrEnd, &e.PosRange.End, nil
+	case *MatrixSelector:
+		if vs, ok := unwrapParens(e.VectorSelector).(*VectorSelector); ok {
+			return &vs.Offset, &vs.Timestamp, &vs.StartOrEnd, &e.EndPos, nil
 		}
+	case *SubqueryExpr:
+		return &e.Offset, &e.Timestamp, &e.StartOrEnd, &e.EndPos, nil
+	}
+	return nil, nil, nil, nil, p.errorf(tok.pos, tok.end(),
+		"%s modifier must be preceded by an instant vector selector, range vector selector or subquery", tok.val)
+}
 
-		labels[key] = value
+func (p *parser) parseOffset(expr Expr) error {
+	tok := p.next()
+	offset, _, _, end, err := p.modifierTarget(expr, tok)
+	if err != nil {
+		return err
+	}
+	if *offset != 0 {
+		return p.errorf(tok.pos, tok.end(), "offset may not be set multiple times")
 	}
 
-	return labels, nil
+	sign := time.Duration(1)
+	if p.peek().typ == tokenSUB {
+		p.next()
+		sign = -1
+	} else if p.peek().typ == tokenADD {
+		p.next()
+	}
+	durTok, err := p.expect(tokenDuration, "offset")
+	if err != nil {
+		return err
+	}
+	d, err := ParseDuration(durTok.val)
+	if err != nil {
+		return p.errorf(durTok.pos, durTok.end(), "%v", err)
+	}
+	*offset = sign * d
+	*end = durTok.end()
+	return nil
 }
 
-// parseDuration parses duration strings like "5m", "1h", "30s"
-func (p *Parser) parseDuration(duration string) (time.Duration, error) {
-	duration = strings.TrimSpace(duration)
-	if duration == "" {
-		return 0, fmt.Errorf("empty duration")
+func (p *parser) parseAt(expr Expr) error {
+	tok := p.next()
+	_, ts, startOrEnd, end, err := p.modifierTarget(expr, tok)
+	if err != nil {
+		return err
+	}
+	if *ts != nil || *startOrEnd != "" {
+		return p.errorf(tok.pos, tok.end(), "@ <timestamp> may not be set multiple times")
 	}
 
-	// Handle common duration formats
-	switch {
-	case strings.HasSuffix(duration, "s"):
-		val, err := strconv.Atoi(duration[:len(duration)-1])
+	next := p.peek()
+	if isKeyword(next, "start") || isKeyword(next, "end") {
+		p.next()
+		if _, err := p.expect(tokenLeftParen, "@ modifier"); err != nil {
+			return err
+		}
+		closeTok, err := p.expect(tokenRightParen, "@ modifier")
+		if err != nil {
+			return err
+		}
+		*startOrEnd = strings.ToLower(next.val)
+		*end = closeTok.end()
+		return nil
+	}
+
+	sign := 1.0
+	if next.typ == tokenSUB || next.typ == tokenADD {
+		p.next()
+		if next.typ == tokenSUB {
+			sign = -1
+		}
+	}
+	numTok, err := p.expect(tokenNumber, "@ modifier")
+	if err != nil {
+		return err
+	}
+	seconds, err := parseNumber(numTok.val)
+	if err != nil || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return p.errorf(numTok.pos, numTok.end(), "invalid timestamp for @ modifier: %s", numTok.val)
+	}
+	t := time.UnixMilli(int64(math.Round(sign * seconds * 1000)))
+	*ts = &t
+	*end = numTok.end()
+	return nil
+}
+
+// parsePrimary parses literals, parenthesized expressions, selectors,
+// function calls and aggregations
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.peek()
+	switch tok.typ {
+	case tokenNumber:
+		p.next()
+		v, err := parseNumber(tok.val)
 		if err != nil {
-			return 0, err
+			return nil, p.errorf(tok.pos, tok.end(), "invalid number %q", tok.val)
 		}
-		return time.Duration(val) * time.Second, nil
-	case strings.HasSuffix(duration, "m"):
-		val, err := strconv.Atoi(duration[:len(duration)-1])
+		return &NumberLiteral{Val: v, PosRange: PositionRange{Start: tok.pos, End: tok.end()}}, nil
+
+	case tokenDuration:
+		p.next()
+		// Durations are accepted as numbers of seconds, e.g. in clamp_min(x, 5m)
+		d, err := ParseDuration(tok.val)
 		if err != nil {
-			return 0, err
+			return nil, p.errorf(tok.pos, tok.end(), "%v", err)
 		}
-		return time.Duration(val) * time.Minute, nil
-	case strings.HasSuffix(duration, "h"):
-		val, err := strconv.Atoi(duration[:len(duration)-1])
+		return &NumberLiteral{Val: d.Seconds(), PosRange: PositionRange{Start: tok.pos, End: tok.end()}}, nil
+
+	case tokenString:
+		p.next()
+		s, err := unquoteString(tok.val)
 		if err != nil {
-			return 0, err
+			return nil, p.errorf(tok.pos, tok.end(), "invalid string literal: %v", err)
 		}
-		return time.Duration(val) * time.Hour, nil
-	case strings.HasSuffix(duration, "d"):
-		val, err := strconv.Atoi(duration[:len(duration)-1])
+		return &StringLiteral{Val: s, PosRange: PositionRange{Start: tok.pos, End: tok.end()}}, nil
+
+	case tokenLeftParen:
+		p.next()
+		inner, err := p.parseExpr(0)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		return time.Duration(val) * 24 * time.Hour, nil
-	default:
-		// Try parsing as Go duration
-		return time.ParseDuration(duration)
+		closeTok, err := p.expect(tokenRightParen, "parenthesized expression")
+		if err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: inner, PosRange: PositionRange{Start: tok.pos, End: closeTok.end()}}, nil
+
+	case tokenLeftBrace:
+		return p.parseVectorSelector("", tok.pos)
+
+	case tokenIdentifier:
+		lower := strings.ToLower(tok.val)
+		if lower == "inf" || lower == "nan" {
+			p.next()
+			v := math.Inf(1)
+			if lower == "nan" {
+				v = math.NaN()
+			}
+			return &NumberLiteral{Val: v, PosRange: PositionRange{Start: tok.pos, End: tok.end()}}, nil
+		}
+
+		next := p.peekAt(1)
+		if _, ok := aggregators[lower]; ok &&
+			(next.typ == tokenLeftParen || isKeyword(next, "by") || isKeyword(next, "without")) {
+			return p.parseAggregate()
+		}
+		if next.typ == tokenLeftParen {
+			return p.parseCall()
+		}
+
+		p.next()
+		if !isValidMetricName(tok.val) {
+			return nil, p.errorf(tok.pos, tok.end(), "invalid metric name %q", tok.val)
+		}
+		if p.peek().typ == tokenLeftBrace {
+			return p.parseVectorSelector(tok.val, tok.pos)
+		}
+		return newVectorSelector(tok.val, nil, PositionRange{Start: tok.pos, End: tok.end()}), nil
+
+	case tokenEOF:
+		return nil, p.errorf(tok.pos, tok.pos, "unexpected end of input")
 	}
+
+	return nil, p.errorf(tok.pos, tok.end(), "unexpected %s", tok.desc())
 }
 
-// ParseAggregation parses aggregation queries like sum(http_requests_total) by (service)
-func (p *Parser) ParseAggregation(query string) (*Query, error) {
-	query = strings.TrimSpace(query)
+// newVectorSelector builds a selector, adding the implicit __name__ matcher
+func newVectorSelector(name string, matchers []*LabelMatcher, pr PositionRange) *VectorSelector {
+	if name != "" {
+		nameMatcher, _ := NewLabelMatcher(MatchEqual, MetricNameLabel, name)
+		matchers = append([]*LabelMatcher{nameMatcher}, matchers...)
+	}
+	return &VectorSelector{Name: name, LabelMatchers: matchers, PosRange: pr}
+}
 
-	// Find aggregation function
-	openParen := strings.Index(query, "(")
-	if openParen == -1 {
-		return nil, fmt.Errorf("invalid aggregation syntax")
+// parseVectorSelector parses the {...} part of a selector. A bare quoted
+// string inside the braces names the metric, e.g. {"http.server.duration"}.
+func (p *parser) parseVectorSelector(name string, start int) (Expr, error) {
+	if _, err := p.expect(tokenLeftBrace, "vector selector"); err != nil {
+		return nil, err
 	}
 
-	funcName := strings.TrimSpace(query[:openParen])
+	var matchers []*LabelMatcher
+	for p.peek().typ != tokenRightBrace {
+		nameTok := p.next()
+		var labelName string
+		switch nameTok.typ {
+		case tokenIdentifier:
+			if strings.Contains(nameTok.val, ":") {
+				return nil, p.errorf(nameTok.pos, nameTok.end(), "invalid label name %q", nameTok.val)
+			}
+			labelName = nameTok.val
+		case tokenString:
+			s, err := unquoteString(nameTok.val)
+			if err != nil {
+				return nil, p.errorf(nameTok.pos, nameTok.end(), "invalid string literal: %v", err)
+			}
+			labelName = s
+		default:
+			return nil, p.unexpected(nameTok, "label matching")
+		}
+
+		opTok := p.peek()
+		if nameTok.typ == tokenString && (opTok.typ == tokenComma || opTok.typ == tokenRightBrace) {
+			if name != "" {
+				return nil, p.errorf(nameTok.pos, nameTok.end(), "metric name must not be set twice: %q or %q", name, labelName)
+			}
+			name = labelName
+		} else {
+			p.next()
+			var matchType MatchType
+			switch opTok.typ {
+			case tokenAssign:
+				matchType = MatchEqual
+			case tokenNEQ:
+				matchType = MatchNotEqual
+			case tokenEQLRegex:
+				matchType = MatchRegexp
+			case tokenNEQRegex:
+				matchType = MatchNotRegexp
+			default:
+				return nil, p.errorf(opTok.pos, opTok.end(), "unexpected %s in label matching, expected one of \"=\", \"!=\", \"=~\", \"!~\"", opTok.desc())
+			}
 
-	// Find closing parenthesis
-	closeParen := strings.LastIndex(query, ")")
-	if closeParen == -1 {
-		return nil, fmt.Errorf("missing closing parenthesis")
+			valueTok, err := p.expect(tokenString, "label matching")
+			if err != nil {
+				return nil, err
+			}
+			value, err := unquoteString(valueTok.val)
+			if err != nil {
+				return nil, p.errorf(valueTok.pos, valueTok.end(), "invalid string literal: %v", err)
+			}
+			m, err := NewLabelMatcher(matchType, labelName, value)
+			if err != nil {
+				return nil, p.errorf(valueTok.pos, valueTok.end(), "invalid regular expression in label matcher: %v", err)
+			}
+			if labelName == MetricNameLabel && matchType == MatchEqual && name != "" {
+				return nil, p.errorf(nameTok.pos, valueTok.end(), "metric name must not be set twice: %q or %q", name, value)
+			}
+			matchers = append(matchers, m)
+		}
+
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokenRightBrace {
+			return nil, p.unexpected(p.peek(), "label matching")
+		}
 	}
+	closeTok := p.next()
 
-	// Extract the metric query
-	metricQuery := strings.TrimSpace(query[openParen+1 : closeParen])
+	return newVectorSelector(name, matchers, PositionRange{Start: start, End: closeTok.end()}), nil
+}
 
-	// Parse the metric
-	parsedQuery, err := p.Parse(metricQuery)
-	if err != nil {
+// parseLabelList parses a parenthesized list of label names such as (job, "http.method")
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokenLeftParen, "grouping opts"); err != nil {
 		return nil, err
 	}
 
-	// Check for "by" clause
-	byClause := ""
-	if closeParen < len(query)-1 {
-		remaining := strings.TrimSpace(query[closeParen+1:])
-		if strings.HasPrefix(remaining, "by") {
-			byStart := strings.Index(remaining, "(")
-			byEnd := strings.Index(remaining, ")")
-			if byStart != -1 && byEnd != -1 {
-				byClause = strings.TrimSpace(remaining[byStart+1 : byEnd])
+	labels := []string{}
+	for p.peek().typ != tokenRightParen {
+		tok := p.next()
+		switch tok.typ {
+		case tokenIdentifier:
+			if !isValidLabelName(tok.val) {
+				return nil, p.errorf(tok.pos, tok.end(), "invalid label name %q", tok.val)
+			}
+			labels = append(labels, tok.val)
+		case tokenString:
+			s, err := unquoteString(tok.val)
+			if err != nil {
+				return nil, p.errorf(tok.pos, tok.end(), "invalid string literal: %v", err)
+			}
+			labels = append(labels, s)
+		default:
+			return nil, p.unexpected(tok, "grouping opts")
+		}
+
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokenRightParen {
+			return nil, p.unexpected(p.peek(), "grouping opts")
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+// parseAggregate parses sum by (job) (x), sum(x) without (instance) and
+// parameterized forms such as topk(5, x)
+func (p *parser) parseAggregate() (Expr, error) {
+	opTok := p.next()
+	agg := &AggregateExpr{Op: strings.ToLower(opTok.val)}
+
+	parseGrouping := func() error {
+		tok := p.peek()
+		if !isKeyword(tok, "by") && !isKeyword(tok, "without") {
+			return nil
+		}
+		if agg.Grouping != nil {
+			return p.errorf(tok.pos, tok.end(), "aggregation grouping may not be set twice")
+		}
+		p.next()
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return err
+		}
+		agg.Grouping = labels
+		agg.Without = isKeyword(tok, "without")
+		return nil
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	var args []Expr
+	for p.peek().typ != tokenRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokenRightParen {
+			return nil, p.unexpected(p.peek(), "aggregation")
+		}
+	}
+	closeTok := p.next()
+	agg.PosRange = PositionRange{Start: opTok.pos, End: closeTok.end()}
+
+	wantParam := aggregators[agg.Op] != ValueTypeNone
+	switch {
+	case wantParam && len(args) != 2:
+		return nil, p.errorf(opTok.pos, closeTok.end(), "wrong number of arguments for aggregate expression provided, expected 2, got %d", len(args))
+	case !wantParam && len(args) != 1:
+		return nil, p.errorf(opTok.pos, closeTok.end(), "wrong number of arguments for aggregate expression provided, expected 1, got %d", len(args))
+	case wantParam:
+		agg.Param, agg.Expr = args[0], args[1]
+	default:
+		agg.Expr = args[0]
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	if agg.Grouping != nil {
+		agg.PosRange.End = p.tokens[p.pos-1].end()
+	}
+	return agg, nil
+}
+
+// parseCall parses a function call, validating the name against the registry
+func (p *parser) parseCall() (Expr, error) {
+	nameTok := p.next()
+	fn, ok := p.functions.Get(nameTok.val)
+	if !ok {
+		return nil, p.errorf(nameTok.pos, nameTok.end(), "unknown function with name %q", nameTok.val)
+	}
+	p.next() // (
+
+	var args []Expr
+	for p.peek().typ != tokenRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokenRightParen {
+			return nil, p.unexpected(p.peek(), "function call")
+		}
+	}
+	closeTok := p.next()
+
+	return &Call{
+		Func:     fn,
+		Args:     args,
+		PosRange: PositionRange{Start: nameTok.pos, End: closeTok.end()},
+	}, nil
+}
+
+// checkAST validates operand types throughout the tree
+func (p *parser) checkAST(node Node) error {
+	switch n := node.(type) {
+	case *VectorSelector:
+		if n.Name == "" {
+			nonEmpty := false
+			for _, m := range n.LabelMatchers {
+				if !m.Matches("") {
+					nonEmpty = true
+					break
+				}
+			}
+			if !nonEmpty {
+				return p.errorf(n.PosRange.Start, n.PosRange.End, "vector selector must contain at least one non-empty matcher")
+			}
+		}
+
+	case *MatrixSelector:
+		return p.checkAST(n.VectorSelector)
+
+	case *SubqueryExpr:
+		if n.Expr.Type() != ValueTypeVector {
+			return p.typeErrorf(n.Expr, "subquery is only allowed on instant vector, got %s instead", n.Expr.Type().describe())
+		}
+		return p.checkAST(n.Expr)
+
+	case *ParenExpr:
+		return p.checkAST(n.Expr)
+
+	case *UnaryExpr:
+		if t := n.Expr.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+			return p.typeErrorf(n, "unary expression only allowed on expressions of type scalar or instant vector, got %s", t.describe())
+		}
+		return p.checkAST(n.Expr)
+
+	case *AggregateExpr:
+		if n.Expr.Type() != ValueTypeVector {
+			return p.typeErrorf(n.Expr, "expected type instant vector in aggregation expression, got %s", n.Expr.Type().describe())
+		}
+		if want := aggregators[n.Op]; want != ValueTypeNone && n.Param.Type() != want {
+			return p.typeErrorf(n.Param, "expected type %s in aggregation parameter, got %s", want.describe(), n.Param.Type().describe())
+		}
+		if n.Param != nil {
+			if err := p.checkAST(n.Param); err != nil {
+				return err
 			}
 		}
+		return p.checkAST(n.Expr)
+
+	case *Call:
+		if err := p.checkCall(n); err != nil {
+			return err
+		}
+		for _, arg := range n.Args {
+			if err := p.checkAST(arg); err != nil {
+				return err
+			}
+		}
+
+	case *BinaryExpr:
+		if err := p.checkBinary(n); err != nil {
+			return err
+		}
+		if err := p.checkAST(n.LHS); err != nil {
+			return err
+		}
+		return p.checkAST(n.RHS)
 	}
+	return nil
+}
+
+func (p *parser) typeErrorf(node Node, format string, args ...interface{}) error {
+	pr := node.PositionRange()
+	return p.errorf(pr.Start, pr.End, format, args...)
+}
 
-	// Parse grouping labels
-	var byLabels []string
-	if byClause != "" {
-		byLabels = strings.Split(byClause, ",")
-		for i, label := range byLabels {
-			byLabels[i] = strings.TrimSpace(label)
+func (p *parser) checkCall(n *Call) error {
+	fn := n.Func
+	minArgs := len(fn.Args) - fn.Variadic
+	if fn.Variadic < 0 {
+		minArgs = len(fn.Args) - 1
+	}
+	if len(n.Args) < minArgs || (fn.Variadic >= 0 && len(n.Args) > len(fn.Args)) {
+		expected := strconv.Itoa(len(fn.Args))
+		if fn.Variadic > 0 {
+			expected = fmt.Sprintf("%d to %d", minArgs, len(fn.Args))
 		}
+		return p.typeErrorf(n, "expected %s argument(s) in call to %q, got %d", expected, fn.Name, len(n.Args))
 	}
 
-	parsedQuery.Aggregation = &Aggregation{
-		Operation: funcName,
-		By:        byLabels,
+	for i, arg := range n.Args {
+		idx := i
+		if idx >= len(fn.Args) {
+			idx = len(fn.Args) - 1
+		}
+		want := argValueType(fn.Args[idx])
+		if arg.Type() != want {
+			return p.typeErrorf(arg, "expected type %s in call to function %q, got %s", want.describe(), fn.Name, arg.Type().describe())
+		}
+	}
+	return nil
+}
+
+func argValueType(t ArgType) ValueType {
+	switch t {
+	case ArgTypeRangeVector:
+		return ValueTypeMatrix
+	case ArgTypeScalar:
+		return ValueTypeScalar
+	case ArgTypeString:
+		return ValueTypeString
+	default:
+		return ValueTypeVector
 	}
+}
 
-	return parsedQuery, nil
+func (p *parser) checkBinary(n *BinaryExpr) error {
+	lt, rt := n.LHS.Type(), n.RHS.Type()
+	for _, side := range []Expr{n.LHS, n.RHS} {
+		if t := side.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+			return p.typeErrorf(side, "binary expression must contain only scalar and instant vector types")
+		}
+	}
+
+	bothVectors := lt == ValueTypeVector && rt == ValueTypeVector
+	vm := n.VectorMatching
+	if !bothVectors && vm != nil && (len(vm.MatchingLabels) > 0 || vm.On || vm.Card == CardManyToOne || vm.Card == CardOneToMany) {
+		return p.typeErrorf(n, "vector matching only allowed between instant vectors")
+	}
+	if isSetOperator(n.Op) && !bothVectors {
+		return p.typeErrorf(n, "set operator %q not allowed in binary scalar expression", n.Op)
+	}
+	if isComparisonOperator(n.Op) && lt == ValueTypeScalar && rt == ValueTypeScalar && !n.ReturnBool {
+		return p.typeErrorf(n, "comparisons between scalars must use BOOL modifier")
+	}
+	if !bothVectors {
+		n.VectorMatching = nil
+	}
+
+	if vm != nil && bothVectors && (vm.Card == CardManyToOne || vm.Card == CardOneToMany) && vm.On {
+		for _, include := range vm.Include {
+			for _, matching := range vm.MatchingLabels {
+				if include == matching {
+					return p.typeErrorf(n, "label %q must not occur in ON and GROUP clause at once", include)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseNumber parses decimal, hexadecimal and scientific number literals
+func parseNumber(s string) (float64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		v, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// unquoteString removes the quotes of a lexed string token, interpreting
+// escape sequences in double and single quoted strings
+func unquoteString(s string) (string, error) {
+	if len(s) < 2 {
+		return "", fmt.Errorf("invalid quoted string")
+	}
+	switch s[0] {
+	case '`':
+		return s[1 : len(s)-1], nil
+	case '\'':
+		// Convert to a double quoted string so strconv can handle the escapes
+		inner := s[1 : len(s)-1]
+		inner = strings.ReplaceAll(inner, `\'`, `'`)
+		inner = strings.ReplaceAll(inner, `"`, `\"`)
+		return strconv.Unquote(`"` + inner + `"`)
+	}
+	return strconv.Unquote(s)
+}
+
+// ParseDuration parses PromQL durations such as "5m", "1h30m", "2d" and "500ms"
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		j := 0
+		for j < len(rest) && !isDigit(rest[j]) {
+			j++
+		}
+		unit, ok := units[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q: unknown unit %q", s, rest[:j])
+		}
+		rest = rest[j:]
+
+		if n > int64(math.MaxInt64/unit) {
+			return 0, fmt.Errorf("duration %q is out of range", s)
+		}
+		total += time.Duration(n) * unit
+	}
+	return total, nil
 }
@@ -0,0 +1,176 @@
+package promql
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+		pos   PositionRange
+		line  int
+		col   int
+	}{
+		{
+			query: "",
+			err:   "1:1: parse error: no expression found in input",
+			pos:   PositionRange{Start: 0, End: 0},
+			line:  1, col: 1,
+		},
+		{
+			query: "up +",
+			err:   "1:5: parse error: unexpected end of input",
+			pos:   PositionRange{Start: 4, End: 4},
+			line:  1, col: 5,
+		},
+		{
+			query: "sum(rate(x[5m])",
+			err:   "1:16: parse error: unexpected end of input in aggregation",
+			pos:   PositionRange{Start: 15, End: 15},
+			line:  1, col: 16,
+		},
+		{
+			query: "up{a=}",
+			err:   `1:6: parse error: unexpected "}" in label matching, expected string`,
+			pos:   PositionRange{Start: 5, End: 6},
+			line:  1, col: 6,
+		},
+		{
+			query: "rate(up)",
+			err:   `1:6: parse error: expected type range vector in call to function "rate", got instant vector`,
+			pos:   PositionRange{Start: 5, End: 7},
+			line:  1, col: 6,
+		},
+		{
+			query: "foo(up)",
+			err:   `1:1: parse error: unknown function with name "foo"`,
+			pos:   PositionRange{Start: 0, End: 3},
+			line:  1, col: 1,
+		},
+		{
+			query: "up[5x]",
+			err:   `1:4: parse error: bad number or duration syntax: "5x"`,
+			pos:   PositionRange{Start: 3, End: 5},
+			line:  1, col: 4,
+		},
+		{
+			query: "up offset",
+			err:   "1:10: parse error: unexpected end of input in offset, expected duration",
+			pos:   PositionRange{Start: 9, End: 9},
+			line:  1, col: 10,
+		},
+		{
+			query: "sum by (a) (up) by (b)",
+			err:   "1:17: parse error: aggregation grouping may not be set twice",
+			pos:   PositionRange{Start: 16, End: 18},
+			line:  1, col: 17,
+		},
+		{
+			query: "up and 1",
+			err:   `1:1: parse error: set operator "and" not allowed in binary scalar expression`,
+			pos:   PositionRange{Start: 0, End: 8},
+			line:  1, col: 1,
+		},
+		{
+			query: "up[5m] + 1",
+			err:   "1:1: parse error: binary expression must contain only scalar and instant vector types",
+			pos:   PositionRange{Start: 0, End: 6},
+			line:  1, col: 1,
+		},
+		{
+			query: `up @ foo`,
+			err:   `1:6: parse error: unexpected identifier "foo" in @ modifier, expected number`,
+			pos:   PositionRange{Start: 5, End: 8},
+			line:  1, col: 6,
+		},
+		// Positions are byte offsets, columns count characters
+		{
+			query: "1 +\n  bar{",
+			err:   "2:7: parse error: unexpected end of input in label matching",
+			pos:   PositionRange{Start: 10, End: 10},
+			line:  2, col: 7,
+		},
+		{
+			query: `up{a="é"} +`,
+			err:   "1:12: parse error: unexpected end of input",
+			pos:   PositionRange{Start: 12, End: 12},
+			line:  1, col: 12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := NewParser().Parse(tt.query)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Parse(%q) error = %v, want a *ParseError", tt.query, err)
+			}
+			if err.Error() != tt.err {
+				t.Errorf("error = %q, want %q", err.Error(), tt.err)
+			}
+			if parseErr.PositionRange != tt.pos {
+				t.Errorf("position = %+v, want %+v", parseErr.PositionRange, tt.pos)
+			}
+			if line, col := parseErr.LineColumn(); line != tt.line || col != tt.col {
+				t.Errorf("line:column = %d:%d, want %d:%d", line, col, tt.line, tt.col)
+			}
+		})
+	}
+}
+
+// structure renders an expression with every binary and unary operation
+// parenthesized, showing how the parser grouped it
+func structure(expr Expr) string {
+	switch n := expr.(type) {
+	case *BinaryExpr:
+		op := n.Op
+		if n.ReturnBool {
+			op += " bool"
+		}
+		return "(" + structure(n.LHS) + " " + op + " " + structure(n.RHS) + ")"
+	case *UnaryExpr:
+		return "(" + n.Op + structure(n.Expr) + ")"
+	case *ParenExpr:
+		return structure(n.Expr)
+	}
+	return expr.String()
+}
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// Unary minus binds more loosely than ^, as in Prometheus
+		{"-1 ^ 2", "(-(1 ^ 2))"},
+		{"-a ^ -b", "(-(a ^ (-b)))"},
+		{"-a * b", "((-a) * b)"},
+		// ^ is right-associative, everything else left-associative
+		{"2 ^ 3 ^ 2", "(2 ^ (3 ^ 2))"},
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"a / b * c", "((a / b) * c)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"a + b atan2 c", "(a + (b atan2 c))"},
+		{"a % b ^ c", "(a % (b ^ c))"},
+		{"a > b + c", "(a > (b + c))"},
+		{"a == bool b or c", "((a == bool b) or c)"},
+		{"a and b unless c", "((a and b) unless c)"},
+		{"a or b and c", "(a or (b and c))"},
+		{"a or b unless c > d", "(a or (b unless (c > d)))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := NewParser().Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.query, err)
+			}
+			if got := structure(expr); got != tt.want {
+				t.Errorf("Parse(%q) = %s, want %s", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package promql
+
+import (
+	"math"
+	"time"
+)
+
+// extrapolatedRate implements rate, increase and delta. The change between the
+// first and last sample of the window is extrapolated towards the window
+// edges, unless the samples end too far from an edge, in which case the
+// series is assumed to start or end within the window. For counters, drops
+// in value are treated as resets and never extrapolated below zero.
+func extrapolatedRate(points []MetricPoint, rangeStart, rangeEnd time.Time, isCounter, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	result := last.Value - first.Value
+	if isCounter {
+		prev := first.Value
+		for _, p := range points[1:] {
+			if p.Value < prev {
+				result += prev
+			}
+			prev = p.Value
+		}
+	}
+
+	factor, ok := extrapolationFactor(points, rangeStart, rangeEnd, isCounter, isRate, result)
+	if !ok {
+		return 0, false
+	}
+	return result * factor, true
+}
+
+// extrapolationFactor returns the factor by which the change between the
+// first and last sample of a window is scaled to cover the whole window, and
+// additionally divided by its length for rates
+func extrapolationFactor(points []MetricPoint, rangeStart, rangeEnd time.Time, isCounter, isRate bool, result float64) (float64, bool) {
+	first, last := points[0], points[len(points)-1]
+	durationToStart := first.Timestamp.Sub(rangeStart).Seconds()
+	durationToEnd := rangeEnd.Sub(last.Timestamp).Seconds()
+	sampledInterval := last.Timestamp.Sub(first.Timestamp).Seconds()
+	if sampledInterval == 0 {
+		return 0, false
+	}
+	averageDurationBetweenSamples := sampledInterval / float64(len(points)-1)
+
+	// A counter cannot have been negative, so do not extrapolate further back
+	// than the point where it would have been zero
+	if isCounter && result > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * (first.Value / result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	// If the first or last sample is close enough to the window edge,
+	// extrapolate all the way to it, otherwise by half a sample interval
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	factor := extrapolateToInterval / sampledInterval
+	if isRate {
+		factor /= rangeEnd.Sub(rangeStart).Seconds()
+	}
+	return factor, true
+}
+
+// instantValue implements irate and idelta from the last two samples of the
+// window. For irate a drop in value is treated as a counter reset.
+func instantValue(points []MetricPoint, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	last, prev := points[len(points)-1], points[len(points)-2]
+	result := last.Value - prev.Value
+	if isRate && last.Value < prev.Value {
+		result = last.Value
+	}
+
+	if isRate {
+		interval := last.Timestamp.Sub(prev.Timestamp).Seconds()
+		if interval == 0 {
+			return 0, false
+		}
+		result /= interval
+	}
+	return result, true
+}
+
+// linearRegression fits a line through the samples using least squares,
+// returning its slope per second and its value at interceptTime
+func linearRegression(points []MetricPoint, interceptTime time.Time) (slope, intercept float64) {
+	var n, sumX, sumY, sumXY, sumX2 float64
+	initY := points[0].Value
+	constY := true
+	for i, p := range points {
+		if constY && i > 0 && p.Value != initY {
+			constY = false
+		}
+		x := p.Timestamp.Sub(interceptTime).Seconds()
+		n++
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumX2 += x * x
+	}
+	if constY {
+		if math.IsInf(initY, 0) {
+			return math.NaN(), math.NaN()
+		}
+		return 0, initY
+	}
+
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+	slope = covXY / varX
+	intercept = sumY/n - slope*sumX/n
+	return slope, intercept
+}
+
+// countResets returns the number of times the value decreased
+func countResets(points []MetricPoint) float64 {
+	var resets float64
+	for i := 1; i < len(points); i++ {
+		if points[i].Value < points[i-1].Value {
+			resets++
+		}
+	}
+	return resets
+}
@@ -0,0 +1,167 @@
+package promql
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// samplesAt builds points at the given offsets in seconds from base
+func samplesAt(base time.Time, offsets []float64, values []float64) []MetricPoint {
+	points := make([]MetricPoint, len(offsets))
+	for i, offset := range offsets {
+		points[i] = MetricPoint{
+			Timestamp: base.Add(time.Duration(offset * float64(time.Second))),
+			Value:     values[i],
+		}
+	}
+	return points
+}
+
+func TestExtrapolatedRate(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	every10s := []float64{5, 15, 25, 35, 45, 55}
+
+	tests := []struct {
+		name      string
+		offsets   []float64
+		values    []float64
+		isCounter bool
+		isRate    bool
+		want      float64
+		ok        bool
+	}{
+		{
+			// The samples end half an interval from both edges, so the
+			// change of 50 over 50s is extrapolated to the 60s window
+			name:      "increase extrapolated to window edges",
+			offsets:   every10s,
+			values:    []float64{10, 20, 30, 40, 50, 60},
+			isCounter: true,
+			want:      60,
+			ok:        true,
+		},
+		{
+			name:      "rate divides by the window",
+			offsets:   every10s,
+			values:    []float64{10, 20, 30, 40, 50, 60},
+			isCounter: true,
+			isRate:    true,
+			want:      1,
+			ok:        true,
+		},
+		{
+			// 10 -> 30 and 5 -> 25 with a reset in between is an increase
+			// of 45, extrapolated by 60/50
+			name:      "counter reset",
+			offsets:   every10s,
+			values:    []float64{10, 20, 30, 5, 15, 25},
+			isCounter: true,
+			want:      54,
+			ok:        true,
+		},
+		{
+			name:      "counter reset rate",
+			offsets:   every10s,
+			values:    []float64{10, 20, 30, 5, 15, 25},
+			isCounter: true,
+			isRate:    true,
+			want:      0.9,
+			ok:        true,
+		},
+		{
+			// A counter starting at zero is not extrapolated before its
+			// first sample
+			name:      "counter starting at zero",
+			offsets:   every10s,
+			values:    []float64{0, 10, 20, 30, 40, 50},
+			isCounter: true,
+			want:      55,
+			ok:        true,
+		},
+		{
+			// The samples end 20s from both edges, more than 1.1 sample
+			// intervals, so the series is assumed to end half an interval
+			// after its last sample. Towards the start it would have been
+			// zero 10s before its first sample, which is where
+			// extrapolation stops.
+			name:      "samples far from window edges",
+			offsets:   []float64{20, 30, 40},
+			values:    []float64{10, 20, 30},
+			isCounter: true,
+			want:      35,
+			ok:        true,
+		},
+		{
+			// delta does not treat drops as resets
+			name:    "delta of a decreasing gauge",
+			offsets: every10s,
+			values:  []float64{60, 50, 40, 30, 20, 10},
+			want:    -60,
+			ok:      true,
+		},
+		{
+			name:      "drop treated as reset only for counters",
+			offsets:   every10s,
+			values:    []float64{10, 20, 30, 5, 15, 25},
+			isCounter: false,
+			want:      18,
+			ok:        true,
+		},
+		{
+			name:      "single sample",
+			offsets:   []float64{30},
+			values:    []float64{10},
+			isCounter: true,
+			ok:        false,
+		},
+		{
+			name:      "samples at the same time",
+			offsets:   []float64{30, 30},
+			values:    []float64{10, 20},
+			isCounter: true,
+			ok:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := samplesAt(base, tt.offsets, tt.values)
+			got, ok := extrapolatedRate(points, base, base.Add(time.Minute), tt.isCounter, tt.isRate)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstantValue(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name   string
+		values []float64
+		isRate bool
+		want   float64
+	}{
+		{name: "irate", values: []float64{1, 5, 25}, isRate: true, want: 2},
+		{name: "irate after reset", values: []float64{1, 50, 20}, isRate: true, want: 2},
+		{name: "idelta", values: []float64{1, 50, 20}, want: -30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := samplesAt(base, []float64{0, 10, 20}, tt.values)
+			got, ok := instantValue(points, tt.isRate)
+			if !ok {
+				t.Fatalf("no value")
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,30 +2,31 @@ package query
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"open-telemorph-prime/internal/query/promql"
+	"open-telemorph-prime/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Service handles query operations
 type Service struct {
-	db           *sql.DB
+	storage      storage.Storage
 	promqlParser *promql.Parser
 	promqlEval   *promql.Evaluator
 }
 
 // NewService creates a new query service
-func NewService(db *sql.DB) *Service {
+func NewService(store storage.Storage) *Service {
 	return &Service{
-		db:           db,
+		storage:      store,
 		promqlParser: promql.NewParser(),
-		promqlEval:   promql.NewEvaluator(db),
+		promqlEval:   promql.NewEvaluator(store),
 	}
 }
 
@@ -35,6 +36,9 @@ type QueryRequest struct {
 	StartTime time.Time `json:"start_time,omitempty"`
 	EndTime   time.Time `json:"end_time,omitempty"`
 	Step      string    `json:"step,omitempty"`
+	// Time is the evaluation timestamp of an instant query. When set, the
+	// range fields are ignored.
+	Time time.Time `json:"time,omitempty"`
 }
 
 // QueryResponse represents a query response
@@ -42,6 +46,11 @@ type QueryResponse struct {
 	Status string      `json:"status"`
 	Data   interface{} `json:"data,omitempty"`
 	Error  string      `json:"error,omitempty"`
+	// ErrorType classifies errors as the Prometheus HTTP API does, such as
+	// bad_data for a query that is invalid as requested
+	ErrorType string `json:"errorType,omitempty"`
+	// Position locates a syntax error within the query string
+	Position *promql.PositionRange `json:"position,omitempty"`
 }
 
 // RegisterRoutes registers query API routes
@@ -66,27 +75,58 @@ func (s *Service) HandleMetricsQuery(c *gin.Context) {
 		return
 	}
 
-	// Set default time range if not provided
-	if req.StartTime.IsZero() {
-		req.StartTime = time.Now().Add(-1 * time.Hour)
-	}
-	if req.EndTime.IsZero() {
-		req.EndTime = time.Now()
-	}
-
 	// Parse PromQL query
-	query, err := s.promqlParser.Parse(req.Query)
+	expr, err := s.promqlParser.Parse(req.Query)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, QueryResponse{
-			Status: "error",
-			Error:  fmt.Sprintf("Invalid PromQL query: %v", err),
-		})
+		resp := QueryResponse{
+			Status:    "error",
+			Error:     fmt.Sprintf("Invalid PromQL query: %v", err),
+			ErrorType: errorBadData,
+		}
+		var parseErr *promql.ParseError
+		if errors.As(err, &parseErr) {
+			resp.Position = &parseErr.PositionRange
+		}
+		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
 
 	// Evaluate query
-	result, err := s.promqlEval.Evaluate(context.Background(), query, req.StartTime, req.EndTime)
+	var result *promql.QueryResult
+	if !req.Time.IsZero() {
+		result, err = s.promqlEval.EvaluateInstant(c.Request.Context(), expr, req.Time)
+	} else {
+		// Set default time range if not provided
+		if req.StartTime.IsZero() {
+			req.StartTime = time.Now().Add(-1 * time.Hour)
+		}
+		if req.EndTime.IsZero() {
+			req.EndTime = time.Now()
+		}
+
+		step, stepErr := parseStep(req.Step, req.StartTime, req.EndTime)
+		if stepErr != nil {
+			c.JSON(http.StatusBadRequest, QueryResponse{
+				Status:    "error",
+				Error:     fmt.Sprintf("Invalid step: %v", stepErr),
+				ErrorType: errorBadData,
+			})
+			return
+		}
+		result, err = s.promqlEval.EvaluateRange(c.Request.Context(), expr, req.StartTime, req.EndTime, step)
+	}
 	if err != nil {
+		// Queries that cannot be evaluated as requested are the client's
+		// mistake
+		var queryErr *promql.QueryError
+		if errors.As(err, &queryErr) {
+			c.JSON(http.StatusBadRequest, QueryResponse{
+				Status:    "error",
+				Error:     fmt.Sprintf("Invalid PromQL query: %v", err),
+				ErrorType: errorBadData,
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, QueryResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Query evaluation failed: %v", err),
@@ -103,9 +143,49 @@ func (s *Service) HandleMetricsQuery(c *gin.Context) {
 	})
 }
 
-// HandleLogsQuery handles log queries (placeholder)
+// LogsQueryRequest selects log records. Empty fields match any record.
+type LogsQueryRequest struct {
+	// Query is text the log messages must contain
+	Query       string            `json:"query,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	MinSeverity int32             `json:"min_severity,omitempty"`
+	TraceID     string            `json:"trace_id,omitempty"`
+	SpanID      string            `json:"span_id,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// Resource holds resource attributes such as deployment.environment
+	Resource  map[string]string `json:"resource,omitempty"`
+	StartTime time.Time         `json:"start_time,omitempty"`
+	EndTime   time.Time         `json:"end_time,omitempty"`
+	Limit     int               `json:"limit,omitempty"`
+	Offset    int               `json:"offset,omitempty"`
+}
+
+// TracesQueryRequest selects spans. Empty fields match any span.
+type TracesQueryRequest struct {
+	TraceID       string `json:"trace_id,omitempty"`
+	ServiceName   string `json:"service_name,omitempty"`
+	OperationName string `json:"operation_name,omitempty"`
+	Kind          string `json:"kind,omitempty"`
+	StatusCode    string `json:"status_code,omitempty"`
+	// MinDuration and MaxDuration bound span durations, e.g. "250ms"
+	MinDuration string            `json:"min_duration,omitempty"`
+	MaxDuration string            `json:"max_duration,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// Resource holds resource attributes such as deployment.environment
+	Resource  map[string]string `json:"resource,omitempty"`
+	StartTime time.Time         `json:"start_time,omitempty"`
+	EndTime   time.Time         `json:"end_time,omitempty"`
+	Limit     int               `json:"limit,omitempty"`
+	Offset    int               `json:"offset,omitempty"`
+}
+
+// defaultSearchLimit is the number of records a log or trace query returns
+// when the request does not set a limit
+const defaultSearchLimit = 100
+
+// HandleLogsQuery returns the log records matching the request, newest first
 func (s *Service) HandleLogsQuery(c *gin.Context) {
-	var req QueryRequest
+	var req LogsQueryRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, QueryResponse{
 			Status: "error",
@@ -114,19 +194,36 @@ func (s *Service) HandleLogsQuery(c *gin.Context) {
 		return
 	}
 
-	// TODO: Implement log query parsing and evaluation
+	query, err := req.logQuery()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, QueryResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Invalid request: %v", err),
+		})
+		return
+	}
+
+	logs, err := s.storage.SearchLogs(c.Request.Context(), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, QueryResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Log query failed: %v", err),
+		})
+		return
+	}
+	if logs == nil {
+		logs = []*storage.Log{}
+	}
+
 	c.JSON(http.StatusOK, QueryResponse{
 		Status: "success",
-		Data: map[string]interface{}{
-			"message": "Log queries not yet implemented",
-			"query":   req.Query,
-		},
+		Data:   logs,
 	})
 }
 
-// HandleTracesQuery handles trace queries (placeholder)
+// HandleTracesQuery returns the spans matching the request, newest first
 func (s *Service) HandleTracesQuery(c *gin.Context) {
-	var req QueryRequest
+	var req TracesQueryRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, QueryResponse{
 			Status: "error",
@@ -135,16 +232,125 @@ func (s *Service) HandleTracesQuery(c *gin.Context) {
 		return
 	}
 
-	// TODO: Implement trace query parsing and evaluation
+	query, err := req.traceQuery()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, QueryResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Invalid request: %v", err),
+		})
+		return
+	}
+
+	traces, err := s.storage.FindTraces(c.Request.Context(), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, QueryResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Trace query failed: %v", err),
+		})
+		return
+	}
+	if traces == nil {
+		traces = []*storage.Trace{}
+	}
+
 	c.JSON(http.StatusOK, QueryResponse{
 		Status: "success",
-		Data: map[string]interface{}{
-			"message": "Trace queries not yet implemented",
-			"query":   req.Query,
-		},
+		Data:   traces,
 	})
 }
 
+// logQuery converts the request to a storage query
+func (req LogsQueryRequest) logQuery() (storage.LogQuery, error) {
+	resource, err := resourceFilter(req.Resource)
+	if err != nil {
+		return storage.LogQuery{}, err
+	}
+	return storage.LogQuery{
+		ServiceName: req.ServiceName,
+		MinSeverity: req.MinSeverity,
+		Contains:    req.Query,
+		TraceID:     req.TraceID,
+		SpanID:      req.SpanID,
+		Attributes:  req.Attributes,
+		Resource:    resource,
+		Start:       req.StartTime,
+		End:         req.EndTime,
+		Limit:       searchLimit(req.Limit),
+		Offset:      req.Offset,
+	}, nil
+}
+
+// traceQuery converts the request to a storage query
+func (req TracesQueryRequest) traceQuery() (storage.TraceQuery, error) {
+	minDuration, err := parseSpanDuration(req.MinDuration)
+	if err != nil {
+		return storage.TraceQuery{}, err
+	}
+	maxDuration, err := parseSpanDuration(req.MaxDuration)
+	if err != nil {
+		return storage.TraceQuery{}, err
+	}
+	resource, err := resourceFilter(req.Resource)
+	if err != nil {
+		return storage.TraceQuery{}, err
+	}
+	return storage.TraceQuery{
+		TraceID:       req.TraceID,
+		ServiceName:   req.ServiceName,
+		OperationName: req.OperationName,
+		Kind:          req.Kind,
+		StatusCode:    req.StatusCode,
+		MinDuration:   minDuration,
+		MaxDuration:   maxDuration,
+		Attributes:    req.Attributes,
+		Resource:      resource,
+		Start:         req.StartTime,
+		End:           req.EndTime,
+		Limit:         searchLimit(req.Limit),
+		Offset:        req.Offset,
+	}, nil
+}
+
+// searchLimit returns the limit of a log or trace query
+func searchLimit(limit int) int {
+	if limit <= 0 {
+		return defaultSearchLimit
+	}
+	return limit
+}
+
+// parseSpanDuration parses an optional span duration bound
+func parseSpanDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return promql.ParseDuration(s)
+}
+
+// resourceFilter builds a resource filter from resource attributes
+func resourceFilter(attributes map[string]string) (storage.ResourceFilter, error) {
+	var filter storage.ResourceFilter
+	for key, value := range attributes {
+		switch key {
+		case "service.name":
+			filter.ServiceName = value
+		case "service.namespace":
+			filter.ServiceNamespace = value
+		case "service.version":
+			filter.ServiceVersion = value
+		case "deployment.environment":
+			filter.DeploymentEnvironment = value
+		case "host.name":
+			filter.HostName = value
+		case "service.instance.id":
+			filter.ServiceInstanceID = value
+		default:
+			return filter, fmt.Errorf("resources cannot be filtered by %q", key)
+		}
+	}
+	return filter, nil
+}
+
 // HandleExport handles data export requests
 func (s *Service) HandleExport(c *gin.Context) {
 	format := c.Query("format")
@@ -162,100 +368,132 @@ func (s *Service) HandleExport(c *gin.Context) {
 	})
 }
 
-// convertToPrometheusFormat converts internal result to Prometheus API format
-func (s *Service) convertToPrometheusFormat(result *promql.QueryResult) map[string]interface{} {
-	var data []map[string]interface{}
+// parseStep parses a range query resolution given either as a duration
+// ("15s", "1m") or as a number of seconds. An empty step picks a resolution
+// that yields roughly 250 points over the range.
+func parseStep(step string, start, end time.Time) (time.Duration, error) {
+	if step == "" {
+		auto := end.Sub(start) / 250
+		if auto < time.Second {
+			auto = time.Second
+		}
+		return auto.Truncate(time.Second), nil
+	}
 
-	for _, series := range result.Series {
-		// Convert points to Prometheus format
-		var values [][]interface{}
-		for _, point := range series.Points {
-			values = append(values, []interface{}{
-				float64(point.Timestamp.Unix()),
-				point.Value,
-			})
+	if seconds, err := strconv.ParseFloat(step, 64); err == nil {
+		d := time.Duration(seconds * float64(time.Second))
+		if d <= 0 {
+			return 0, fmt.Errorf("step must be positive")
 		}
+		return d, nil
+	}
+
+	d, err := promql.ParseDuration(step)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("step must be positive")
+	}
+	return d, nil
+}
 
+// convertToPrometheusFormat converts internal result to Prometheus API format
+func (s *Service) convertToPrometheusFormat(result *promql.QueryResult) queryData {
+	switch result.Type {
+	case "scalar", "string":
+		var sample []interface{}
+		if len(result.Series) > 0 && len(result.Series[0].Points) > 0 {
+			sample = formatSample(result.Series[0].Points[0])
+			if result.Type == "string" {
+				sample[1] = result.String
+			}
+		}
+		return queryData{ResultType: result.Type, Result: sample}
+	}
+
+	data := []map[string]interface{}{}
+	for _, series := range result.Series {
 		// Create metric object
-		metric := map[string]interface{}{
-			"__name__": series.MetricName,
+		metric := map[string]string{}
+		if series.MetricName != "" {
+			metric[promql.MetricNameLabel] = series.MetricName
 		}
 		for k, v := range series.Labels {
 			metric[k] = v
 		}
 
-		data = append(data, map[string]interface{}{
+		entry := map[string]interface{}{
 			"metric": metric,
-			"values": values,
-		})
-	}
+		}
+		if result.Type == "vector" {
+			if len(series.Points) > 0 {
+				if series.Points[0].Histogram != nil {
+					entry["histogram"] = formatHistogramSample(series.Points[0])
+				} else {
+					entry["value"] = formatSample(series.Points[0])
+				}
+			}
+		} else {
+			// Convert points to Prometheus format, native histograms are
+			// listed separately from float samples
+			var values, histograms [][]interface{}
+			for _, point := range series.Points {
+				if point.Histogram != nil {
+					histograms = append(histograms, formatHistogramSample(point))
+				} else {
+					values = append(values, formatSample(point))
+				}
+			}
+			if values != nil || histograms == nil {
+				if values == nil {
+					values = [][]interface{}{}
+				}
+				entry["values"] = values
+			}
+			if histograms != nil {
+				entry["histograms"] = histograms
+			}
+		}
 
-	return map[string]interface{}{
-		"resultType": result.Type,
-		"result":     data,
+		data = append(data, entry)
 	}
+
+	return queryData{ResultType: result.Type, Result: data}
 }
 
 // GetAvailableMetrics returns a list of available metrics
 func (s *Service) GetAvailableMetrics(ctx context.Context) ([]string, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT metric_name FROM metrics ORDER BY metric_name")
+	metrics, err := s.storage.LabelValues(ctx, storage.MetricNameLabel, nil, minTime, maxTime)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query metrics: %w", err)
 	}
-	defer rows.Close()
-
-	var metrics []string
-	for rows.Next() {
-		var metricName string
-		if err := rows.Scan(&metricName); err != nil {
-			return nil, fmt.Errorf("failed to scan metric name: %w", err)
-		}
-		metrics = append(metrics, metricName)
-	}
-
 	return metrics, nil
 }
 
 // GetMetricLabels returns available labels for a metric
 func (s *Service) GetMetricLabels(ctx context.Context, metricName string) (map[string][]string, error) {
-	rows, err := s.db.QueryContext(ctx,
-		"SELECT DISTINCT labels FROM metrics WHERE metric_name = ? AND labels IS NOT NULL",
-		metricName)
+	matcher, err := storage.NewLabelMatcher(storage.MatchEqual, storage.MetricNameLabel, metricName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query metric labels: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	labelValues := make(map[string]map[string]bool)
-
-	for rows.Next() {
-		var labelsJSON string
-		if err := rows.Scan(&labelsJSON); err != nil {
-			return nil, fmt.Errorf("failed to scan labels: %w", err)
-		}
+	matchers := []*storage.LabelMatcher{matcher}
 
-		// Parse labels JSON (simplified)
-		var labels map[string]string
-		if err := json.Unmarshal([]byte(labelsJSON), &labels); err != nil {
-			continue // Skip invalid JSON
-		}
-
-		for key, value := range labels {
-			if labelValues[key] == nil {
-				labelValues[key] = make(map[string]bool)
-			}
-			labelValues[key][value] = true
-		}
+	names, err := s.storage.LabelNames(ctx, matchers, minTime, maxTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metric labels: %w", err)
 	}
 
-	// Convert to slice format
 	result := make(map[string][]string)
-	for key, values := range labelValues {
-		var valueSlice []string
-		for value := range values {
-			valueSlice = append(valueSlice, value)
+	for _, name := range names {
+		if name == storage.MetricNameLabel {
+			continue
+		}
+		values, err := s.storage.LabelValues(ctx, name, matchers, minTime, maxTime)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query metric labels: %w", err)
 		}
-		result[key] = valueSlice
+		result[name] = values
 	}
 
 	return result, nil
@@ -0,0 +1,506 @@
+// Package spool implements an on-disk, append-only queue of telemetry
+// payloads. Appended entries are fsynced before Append returns, so accepted
+// telemetry survives crashes and storage outages until it is replayed.
+//
+// Entries are written to numbered segment files. A checkpoint file records
+// the position up to which entries have been replayed; segments before it
+// are deleted.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrFull is returned by Append when the entry would exceed the spool's
+// size limit
+var ErrFull = errors.New("spool is full")
+
+const (
+	segmentSuffix  = ".seg"
+	checkpointFile = "checkpoint"
+
+	// headerSize is the size of an entry header: payload length, checksum
+	// and kind
+	headerSize = 9
+)
+
+// errCorrupt is returned for an entry that is truncated or fails its checksum
+var errCorrupt = errors.New("corrupt spool entry")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Entry is a payload read from the spool
+type Entry struct {
+	Kind    byte
+	Payload []byte
+}
+
+// Position identifies an entry boundary in the spool
+type Position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Stats describes the contents of a spool
+type Stats struct {
+	Segments        int   `json:"segments"`
+	PendingBytes    int64 `json:"pending_bytes"`
+	MaxBytes        int64 `json:"max_bytes"`
+	AppendedEntries int64 `json:"appended_entries"`
+	ReplayedEntries int64 `json:"replayed_entries"`
+	RejectedEntries int64 `json:"rejected_entries"` // appends refused because the spool was full
+}
+
+// Spool is a queue of entries on disk. It is safe for concurrent use by one
+// reader and any number of writers.
+type Spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu        sync.Mutex
+	segments  []uint64         // IDs of the segment files, ascending
+	sizes     map[uint64]int64 // bytes of complete entries per segment
+	current   *os.File         // last segment, open for appending
+	committed Position         // replayed up to here
+	stats     Stats
+	appended  chan struct{}
+}
+
+// Open opens the spool in dir, creating it if necessary. An entry that was
+// only partly written when the process stopped is discarded.
+func Open(dir string, maxSize, segmentSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		sizes:       make(map[uint64]int64),
+		appended:    make(chan struct{}, 1),
+	}
+	s.stats.MaxBytes = maxSize
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the checkpoint and the existing segments and opens the last
+// segment for appending
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if err := s.readCheckpoint(); err != nil {
+		return err
+	}
+
+	// Segments before the checkpoint have been replayed already
+	for len(s.segments) > 0 && s.segments[0] < s.committed.Segment {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil {
+			return fmt.Errorf("failed to remove replayed segment: %w", err)
+		}
+		s.segments = s.segments[1:]
+	}
+
+	for _, id := range s.segments {
+		size, err := scanSegment(s.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		s.sizes[id] = size
+	}
+
+	if len(s.segments) == 0 {
+		first := s.committed.Segment
+		if first == 0 {
+			first = 1
+		}
+		s.committed = Position{Segment: first}
+		return s.createSegment(first)
+	}
+
+	// Cut off a partly written entry at the end of the last segment
+	last := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	if err := f.Truncate(s.sizes[last]); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	if _, err := f.Seek(s.sizes[last], io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	s.current = f
+
+	if s.committed.Segment < s.segments[0] {
+		s.committed = Position{Segment: s.segments[0]}
+	}
+	if s.committed.Offset > s.sizes[s.committed.Segment] {
+		s.committed.Offset = s.sizes[s.committed.Segment]
+	}
+	return nil
+}
+
+// scanSegment returns the size of the complete, intact entries at the start
+// of a segment file
+func scanSegment(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		_, n, err := readEntry(r)
+		if errors.Is(err, errCorrupt) {
+			log.Printf("Spool segment %s has an incomplete or corrupt entry at offset %d, discarding the rest of it", filepath.Base(path), size)
+			return size, nil
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+		size += n
+	}
+}
+
+// readEntry reads one entry and returns it with its size on disk. It returns
+// io.EOF at the end of the data, and another error for a truncated or
+// corrupt entry.
+func readEntry(r io.Reader) (Entry, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Entry{}, 0, fmt.Errorf("%w: truncated header", errCorrupt)
+		}
+		return Entry{}, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	entry := Entry{Kind: header[8], Payload: make([]byte, length)}
+	if _, err := io.ReadFull(r, entry.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Entry{}, 0, fmt.Errorf("%w: truncated payload", errCorrupt)
+		}
+		return Entry{}, 0, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:9], crcTable), crcTable, entry.Payload)
+	if crc != checksum {
+		return Entry{}, 0, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+	return entry, headerSize + int64(length), nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// createSegment starts a new segment and makes it the one appended to. If
+// the segment cannot be created, the current one stays current.
+func (s *Spool) createSegment(id uint64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		os.Remove(s.segmentPath(id))
+		return err
+	}
+
+	if s.current != nil {
+		// Entries are synced as they are appended, closing the previous
+		// segment cannot lose any
+		if err := s.current.Close(); err != nil {
+			log.Printf("Failed to close spool segment: %v", err)
+		}
+	}
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	s.current = f
+	return nil
+}
+
+// syncDir makes created, renamed and removed files of a directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open spool directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool directory: %w", err)
+	}
+	return nil
+}
+
+// pendingBytes returns the size of the entries not replayed yet
+func (s *Spool) pendingBytes() int64 {
+	var total int64
+	for _, id := range s.segments {
+		total += s.sizes[id]
+	}
+	return total - s.committed.Offset
+}
+
+// Append writes an entry and waits until it is on disk
+func (s *Spool) Append(kind byte, payload []byte) error {
+	record := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	record[8] = kind
+	copy(record[headerSize:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return errors.New("spool is closed")
+	}
+	// An entry larger than the whole spool is accepted when it is empty
+	if pending := s.pendingBytes(); pending > 0 && pending+int64(len(record)) > s.maxSize {
+		s.stats.RejectedEntries++
+		return ErrFull
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.sizes[last] > 0 && s.sizes[last]+int64(len(record)) > s.segmentSize {
+		if err := s.createSegment(last + 1); err != nil {
+			return err
+		}
+		last++
+	}
+
+	if _, err := s.current.Write(record); err != nil {
+		// Drop whatever part of the entry was written
+		s.current.Truncate(s.sizes[last])
+		s.current.Seek(s.sizes[last], io.SeekStart)
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := s.current.Sync(); err != nil {
+		s.current.Truncate(s.sizes[last])
+		s.current.Seek(s.sizes[last], io.SeekStart)
+		return fmt.Errorf("failed to sync spool entry: %w", err)
+	}
+
+	s.sizes[last] += int64(len(record))
+	s.stats.AppendedEntries++
+
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Appended signals when entries have been appended
+func (s *Spool) Appended() <-chan struct{} {
+	return s.appended
+}
+
+// Committed returns the position up to which entries have been replayed
+func (s *Spool) Committed() Position {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.committed
+}
+
+// Read returns up to max entries starting at from, and the position after
+// the last one. The rest of a segment holding a corrupt entry is skipped.
+func (s *Spool) Read(from Position, max int) ([]Entry, Position, error) {
+	var entries []Entry
+	pos := from
+
+	for len(entries) < max {
+		s.mu.Lock()
+		size, exists := s.sizes[pos.Segment]
+		next := uint64(0)
+		for _, id := range s.segments {
+			if id > pos.Segment {
+				next = id
+				break
+			}
+		}
+		s.mu.Unlock()
+
+		if !exists || pos.Offset >= size {
+			if next == 0 {
+				break
+			}
+			pos = Position{Segment: next}
+			continue
+		}
+
+		read, end, err := s.readSegment(pos, size, max-len(entries))
+		entries = append(entries, read...)
+		if errors.Is(err, errCorrupt) {
+			log.Printf("Skipping corrupt spool segment %d after offset %d: %v", pos.Segment, end, err)
+			end = size
+		} else if err != nil {
+			return entries, Position{Segment: pos.Segment, Offset: end}, fmt.Errorf("failed to read spool segment: %w", err)
+		}
+		pos.Offset = end
+	}
+
+	return entries, pos, nil
+}
+
+// readSegment reads up to max entries of a segment from pos until size, and
+// returns the offset after the last one
+func (s *Spool) readSegment(pos Position, size int64, max int) ([]Entry, int64, error) {
+	f, err := os.Open(s.segmentPath(pos.Segment))
+	if err != nil {
+		return nil, pos.Offset, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(f, pos.Offset, size-pos.Offset))
+	offset := pos.Offset
+	var entries []Entry
+	for len(entries) < max && offset < size {
+		entry, n, err := readEntry(r)
+		if err != nil {
+			return entries, offset, err
+		}
+		entries = append(entries, entry)
+		offset += n
+	}
+	return entries, offset, nil
+}
+
+// Commit records that the entries before pos have been replayed. Segments
+// that are replayed completely are deleted.
+func (s *Spool) Commit(pos Position, entries int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeCheckpoint(pos); err != nil {
+		return err
+	}
+	s.committed = pos
+	s.stats.ReplayedEntries += int64(entries)
+
+	// The segment appended to is kept even when it has been replayed
+	for len(s.segments) > 1 && s.segments[0] < pos.Segment {
+		id := s.segments[0]
+		if err := os.Remove(s.segmentPath(id)); err != nil {
+			return fmt.Errorf("failed to remove replayed segment: %w", err)
+		}
+		delete(s.sizes, id)
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+func (s *Spool) readCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, checkpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool checkpoint: %w", err)
+	}
+	if len(data) != 20 || crc32.Checksum(data[:16], crcTable) != binary.LittleEndian.Uint32(data[16:]) {
+		return errors.New("spool checkpoint is corrupt")
+	}
+
+	s.committed = Position{
+		Segment: binary.LittleEndian.Uint64(data[0:8]),
+		Offset:  int64(binary.LittleEndian.Uint64(data[8:16])),
+	}
+	return nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically
+func (s *Spool) writeCheckpoint(pos Position) error {
+	var data [20]byte
+	binary.LittleEndian.PutUint64(data[0:8], pos.Segment)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(pos.Offset))
+	binary.LittleEndian.PutUint32(data[16:], crc32.Checksum(data[:16], crcTable))
+
+	path := filepath.Join(s.dir, checkpointFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	if _, err := f.Write(data[:]); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync spool checkpoint: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	return syncDir(s.dir)
+}
+
+// Stats returns statistics about the spool
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Segments = len(s.segments)
+	stats.PendingBytes = s.pendingBytes()
+	return stats
+}
+
+// Close closes the spool. Entries that have not been replayed stay on disk
+// and are read again after the next Open.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
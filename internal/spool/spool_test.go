@@ -0,0 +1,44 @@
+package spool
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAppendAfterSegmentCreationFails(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, 64)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+
+	payload := make([]byte, 40)
+	if err := s.Append(1, payload); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// A directory in place of the next segment makes creating it fail
+	next := s.segmentPath(s.segments[len(s.segments)-1] + 1)
+	if err := os.Mkdir(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(2, payload); err == nil {
+		t.Fatalf("Append succeeded without a new segment")
+	}
+
+	if err := os.Remove(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(3, payload); err != nil {
+		t.Fatalf("Append after the failure: %v", err)
+	}
+
+	entries, _, err := s.Read(s.Committed(), 10)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Kind != 1 || entries[1].Kind != 3 {
+		t.Errorf("read %d entries %+v, want kinds 1 and 3", len(entries), entries)
+	}
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Chunks hold the samples of one series within one window of time,
+// compressed as described in Facebook's Gorilla paper: timestamps are
+// encoded as deltas of deltas and values as the XOR with the previous value.
+// Timestamps are nanoseconds, so the delta-of-delta buckets are wider than
+// the paper's to fit the jitter of nanosecond clocks.
+
+// chunkWindow is the span of time covered by one chunk
+const chunkWindow = int64(2 * 60 * 60 * 1e9)
+
+// chunkStart returns the start of the window of the chunk holding a sample
+// taken at ts
+func chunkStart(ts int64) int64 {
+	return ts - ((ts%chunkWindow)+chunkWindow)%chunkWindow
+}
+
+// mergeSamples sorts the samples of a chunk by timestamp. Of samples with
+// the same timestamp the one written last is kept, so that writing a sample
+// again replaces it.
+func mergeSamples(samples []Sample) []Sample {
+	// Samples arrive mostly in order; those stored first stay first
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+
+	merged := samples[:0]
+	for _, sample := range samples {
+		if n := len(merged); n > 0 && merged[n-1].Timestamp == sample.Timestamp {
+			merged[n-1] = sample
+			continue
+		}
+		merged = append(merged, sample)
+	}
+	return merged
+}
+
+// errCorruptChunk is returned when a chunk ends before its last sample
+var errCorruptChunk = errors.New("corrupt chunk")
+
+// Delta-of-delta buckets: a prefix of ones terminated by a zero, followed by
+// a signed value of the given width. Deltas of deltas that fit none of the
+// buckets follow a prefix of four ones as 64 bits.
+var dodBuckets = []struct {
+	prefix, prefixBits uint64
+	bits               int
+}{
+	{0b10, 2, 20},   // ±0.5ms
+	{0b110, 3, 30},  // ±0.5s
+	{0b1110, 4, 40}, // ±9m
+}
+
+// encodeChunk encodes samples sorted by timestamp. The chunk starts with the
+// number of samples.
+func encodeChunk(samples []Sample) []byte {
+	return newChunkAppender(samples).bytes()
+}
+
+// chunkAppender encodes the samples of a chunk as they are added. It keeps
+// the state of the encoding, so that samples later than the last can be
+// added to a stored chunk without encoding it again.
+type chunkAppender struct {
+	w       bitWriter
+	count   int
+	minTime int64
+
+	prevTimestamp, prevDelta int64
+	prevValue                uint64
+	leading, trailing        int
+}
+
+// newChunkAppender returns an appender holding samples sorted by timestamp
+func newChunkAppender(samples []Sample) *chunkAppender {
+	a := &chunkAppender{leading: -1}
+	for _, sample := range samples {
+		a.append(sample)
+	}
+	return a
+}
+
+// append adds a sample later than those added before
+func (a *chunkAppender) append(sample Sample) {
+	w := &a.w
+	a.count++
+	value := math.Float64bits(sample.Value)
+	if a.count == 1 {
+		a.minTime = sample.Timestamp
+		a.prevTimestamp, a.prevValue = sample.Timestamp, value
+		w.writeBits(uint64(sample.Timestamp), 64)
+		w.writeBits(value, 64)
+		return
+	}
+
+	delta := sample.Timestamp - a.prevTimestamp
+	writeDod(w, delta-a.prevDelta)
+	a.prevTimestamp, a.prevDelta = sample.Timestamp, delta
+
+	xor := value ^ a.prevValue
+	a.prevValue = value
+	if xor == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+
+	l, t := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+	if l > 31 {
+		// The count of leading zeros is stored in 5 bits
+		l = 31
+	}
+	if a.leading >= 0 && l >= a.leading && t >= a.trailing {
+		// The meaningful bits fit in those of the previous value
+		w.writeBit(false)
+		w.writeBits(xor>>uint(a.trailing), 64-a.leading-a.trailing)
+		return
+	}
+
+	a.leading, a.trailing = l, t
+	significant := 64 - a.leading - a.trailing
+	w.writeBit(true)
+	w.writeBits(uint64(a.leading), 5)
+	// 64 significant bits do not fit in 6 bits and are stored as 0, which
+	// is never a valid count otherwise
+	w.writeBits(uint64(significant), 6)
+	w.writeBits(xor>>uint(a.trailing), significant)
+}
+
+// bytes returns the encoded chunk
+func (a *chunkAppender) bytes() []byte {
+	return append(binary.AppendUvarint(nil, uint64(a.count)), a.w.data...)
+}
+
+// clone returns a copy of the appender that can be added to without
+// changing a
+func (a *chunkAppender) clone() *chunkAppender {
+	c := *a
+	c.w.data = append([]byte(nil), a.w.data...)
+	return &c
+}
+
+// appendable reports whether samples sorted by timestamp can be added to a
+// stored chunk holding count samples up to maxTime, of which the appender
+// was the last one written
+func (a *chunkAppender) appendable(count int, maxTime int64, samples []Sample) bool {
+	return a.count > 0 && a.count == count && a.prevTimestamp == maxTime && samples[0].Timestamp > maxTime
+}
+
+// headChunk is the appender of the latest chunk written of a series
+type headChunk struct {
+	start    int64
+	appender *chunkAppender
+}
+
+func writeDod(w *bitWriter, dod int64) {
+	if dod == 0 {
+		w.writeBit(false)
+		return
+	}
+	for _, bucket := range dodBuckets {
+		limit := int64(1) << (bucket.bits - 1)
+		if dod >= -limit && dod < limit {
+			w.writeBits(bucket.prefix, int(bucket.prefixBits))
+			w.writeBits(uint64(dod), bucket.bits)
+			return
+		}
+	}
+	w.writeBits(0b1111, 4)
+	w.writeBits(uint64(dod), 64)
+}
+
+// decodeChunk decodes the samples of a chunk
+func decodeChunk(data []byte) ([]Sample, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errCorruptChunk
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	r := &bitReader{data: data[n:]}
+	samples := make([]Sample, 0, count)
+	timestamp, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	samples = append(samples, Sample{Timestamp: int64(timestamp), Value: math.Float64frombits(value)})
+
+	prevTimestamp, prevDelta := int64(timestamp), int64(0)
+	leading, trailing := 0, 0
+	for uint64(len(samples)) < count {
+		dod, err := readDod(r)
+		if err != nil {
+			return nil, err
+		}
+		delta := prevDelta + dod
+		prevTimestamp, prevDelta = prevTimestamp+delta, delta
+
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				significant, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if significant == 0 {
+					significant = 64
+				}
+				leading, trailing = int(l), 64-int(l)-int(significant)
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			value ^= xor << uint(trailing)
+		}
+
+		samples = append(samples, Sample{Timestamp: prevTimestamp, Value: math.Float64frombits(value)})
+	}
+	return samples, nil
+}
+
+func readDod(r *bitReader) (int64, error) {
+	// Count the ones of the bucket prefix
+	ones := 0
+	for ones < 4 {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+
+	var width int
+	switch ones {
+	case 0:
+		return 0, nil
+	case 4:
+		width = 64
+	default:
+		width = dodBuckets[ones-1].bits
+	}
+
+	value, err := r.readBits(width)
+	if err != nil {
+		return 0, err
+	}
+	// Sign-extend the value to 64 bits
+	shift := uint(64 - width)
+	return int64(value<<shift) >> shift, nil
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first
+type bitWriter struct {
+	data []byte
+	free int // unused bits in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.data = append(w.data, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.data[len(w.data)-1] |= 1 << uint(w.free)
+	}
+}
+
+// writeBits writes the n least significant bits of u
+func (w *bitWriter) writeBits(u uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(u&(1<<uint(i)) != 0)
+	}
+}
+
+// bitReader reads the bits written by a bitWriter
+type bitReader struct {
+	data []byte
+	pos  int // index of the next bit
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, errCorruptChunk
+	}
+	bit := r.data[r.pos/8]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var u uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
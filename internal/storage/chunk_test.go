@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"open-telemorph-prime/internal/config"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	const second = int64(1e9)
+	start := int64(1700000000) * second
+
+	// regular returns n samples every interval starting at start with the
+	// given values, cycling through them
+	regular := func(n int, interval int64, values ...float64) []Sample {
+		samples := make([]Sample, n)
+		for i := range samples {
+			samples[i] = Sample{Timestamp: start + int64(i)*interval, Value: values[i%len(values)]}
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name    string
+		samples []Sample
+	}{
+		{"empty", nil},
+		{"single sample", []Sample{{Timestamp: start, Value: 42}}},
+		{"zero deltas of deltas and values", regular(100, 15*second, 1)},
+		{"counter", regular(100, 15*second, 1, 2, 3, 5, 8, 13, 21, 34)},
+		{
+			name: "special values",
+			samples: []Sample{
+				{Timestamp: start, Value: math.NaN()},
+				{Timestamp: start + second, Value: math.Inf(1)},
+				{Timestamp: start + 2*second, Value: math.Inf(-1)},
+				{Timestamp: start + 3*second, Value: math.Copysign(0, -1)},
+				{Timestamp: start + 4*second, Value: 0},
+				{Timestamp: start + 5*second, Value: math.NaN()},
+				{Timestamp: start + 6*second, Value: math.Float64frombits(0x7ff8000000000001)}, // NaN with a payload
+				{Timestamp: start + 7*second, Value: math.MaxFloat64},
+				{Timestamp: start + 8*second, Value: math.SmallestNonzeroFloat64},
+				{Timestamp: start + 9*second, Value: -math.MaxFloat64},
+			},
+		},
+		{
+			// XORs with no leading or trailing zeros, and with more leading
+			// zeros than the 5 bits the count is stored in hold
+			name: "value windows",
+			samples: []Sample{
+				{Timestamp: start, Value: 0},
+				{Timestamp: start + second, Value: math.Float64frombits(0x8000000000000001)},
+				{Timestamp: start + 2*second, Value: math.Float64frombits(0x8000000000000000)},
+				{Timestamp: start + 3*second, Value: math.Float64frombits(0x8000000000000003)},
+				{Timestamp: start + 4*second, Value: math.Float64frombits(0x8000000000000002)},
+			},
+		},
+		{
+			// Deltas of deltas in every bucket, both signs, and timestamp
+			// jumps beyond all of them
+			name: "timestamp jumps",
+			samples: []Sample{
+				{Timestamp: start, Value: 1},
+				{Timestamp: start + 1, Value: 1},
+				{Timestamp: start + 2, Value: 1},
+				{Timestamp: start + 2 + 400_000, Value: 1},
+				{Timestamp: start + 2 + 400_000 + second, Value: 1},
+				{Timestamp: start + 3*second, Value: 1},
+				{Timestamp: start + 3*second + 5*60*second, Value: 1},
+				{Timestamp: start + 3*second + 5*60*second + 1, Value: 1},
+				{Timestamp: start + 24*60*60*second, Value: 1},
+				{Timestamp: start + 365*24*60*60*second, Value: 1},
+				{Timestamp: start + 365*24*60*60*second + 1, Value: 1},
+			},
+		},
+		{
+			name: "extreme timestamps",
+			samples: []Sample{
+				{Timestamp: math.MinInt64, Value: 1},
+				{Timestamp: -1, Value: 2},
+				{Timestamp: 0, Value: 3},
+				{Timestamp: math.MaxInt64, Value: 4},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeChunk(tt.samples)
+			got, err := decodeChunk(data)
+			if err != nil {
+				t.Fatalf("decodeChunk: %v", err)
+			}
+			if len(got) != len(tt.samples) {
+				t.Fatalf("decoded %d samples, want %d", len(got), len(tt.samples))
+			}
+			for i, want := range tt.samples {
+				// Values are compared bit for bit, so that NaNs match
+				if got[i].Timestamp != want.Timestamp || math.Float64bits(got[i].Value) != math.Float64bits(want.Value) {
+					t.Errorf("sample %d = %d %v, want %d %v", i, got[i].Timestamp, got[i].Value, want.Timestamp, want.Value)
+				}
+			}
+
+			// Every truncation of a chunk with samples fails to decode
+			for n := 1; n < len(data) && len(tt.samples) > 0; n++ {
+				if _, err := decodeChunk(data[:n]); err == nil {
+					t.Errorf("decodeChunk of the first %d of %d bytes succeeded", n, len(data))
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestChunkCompression(t *testing.T) {
+	// Samples at a steady interval with an unchanged value take about two
+	// bits each
+	samples := make([]Sample, 1000)
+	for i := range samples {
+		samples[i] = Sample{Timestamp: int64(i) * 15e9, Value: 1}
+	}
+	if size := len(encodeChunk(samples)); size > 300 {
+		t.Errorf("encoded %d samples in %d bytes, want at most 300", len(samples), size)
+	}
+}
+
+func TestChunkAppender(t *testing.T) {
+	const second = int64(1e9)
+	var samples []Sample
+	for i := 0; i < 100; i++ {
+		samples = append(samples, Sample{Timestamp: int64(i)*15*second + int64(i%3), Value: float64(i*i) / 7})
+	}
+
+	// Appending to a copy of an appender encodes the chunk as encoding all
+	// samples at once does, and leaves the original as it was
+	head := newChunkAppender(samples[:60])
+	before := head.bytes()
+	a := head.clone()
+	for _, sample := range samples[60:] {
+		a.append(sample)
+	}
+	if !bytes.Equal(a.bytes(), encodeChunk(samples)) {
+		t.Error("appended chunk differs from the chunk encoded at once")
+	}
+	if !bytes.Equal(head.bytes(), before) {
+		t.Error("appending to a clone changed the original")
+	}
+	if a.minTime != samples[0].Timestamp || a.prevTimestamp != samples[99].Timestamp || a.count != 100 {
+		t.Errorf("appender spans %d to %d with %d samples, want %d to %d with 100",
+			a.minTime, a.prevTimestamp, a.count, samples[0].Timestamp, samples[99].Timestamp)
+	}
+}
+
+func TestAppendSamples(t *testing.T) {
+	s, err := NewSQLiteStorage(config.StorageConfig{Type: "sqlite", Path: filepath.Join(t.TempDir(), "telemorph.db"), RetentionDays: 30})
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+	defer s.Close()
+
+	const seriesID, start = 1, 0
+	stored := func() []Sample {
+		t.Helper()
+		var data []byte
+		if err := s.db.QueryRow(`SELECT data FROM chunks WHERE series_id = ? AND start_time = ?`, seriesID, start).Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		samples, err := decodeChunk(data)
+		if err != nil {
+			t.Fatalf("decodeChunk: %v", err)
+		}
+		return samples
+	}
+
+	head, err := appendSamples(s.db, seriesID, start, []Sample{{Timestamp: 20, Value: 2}, {Timestamp: 10, Value: 1}}, nil)
+	if err != nil {
+		t.Fatalf("appendSamples: %v", err)
+	}
+
+	// Later samples are appended to the head without reading the stored
+	// chunk, which is overwritten here so that reading it would fail
+	if _, err := s.db.Exec(`UPDATE chunks SET data = x'ff'`); err != nil {
+		t.Fatal(err)
+	}
+	head, err = appendSamples(s.db, seriesID, start, []Sample{{Timestamp: 30, Value: 3}}, head)
+	if err != nil {
+		t.Fatalf("appendSamples to the head: %v", err)
+	}
+	want := []Sample{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}}
+	if got := stored(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+
+	// Earlier samples are merged with the stored ones, replacing those with
+	// their timestamp
+	head, err = appendSamples(s.db, seriesID, start, []Sample{{Timestamp: 20, Value: 4}, {Timestamp: 5, Value: 0}}, head)
+	if err != nil {
+		t.Fatalf("appendSamples of earlier samples: %v", err)
+	}
+	want = []Sample{{Timestamp: 5, Value: 0}, {Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 4}, {Timestamp: 30, Value: 3}}
+	if got := stored(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+
+	// A head the stored chunk no longer matches is not appended to
+	stale := head.clone()
+	if _, err := appendSamples(s.db, seriesID, start, []Sample{{Timestamp: 40, Value: 5}}, head); err != nil {
+		t.Fatalf("appendSamples: %v", err)
+	}
+	if _, err := appendSamples(s.db, seriesID, start, []Sample{{Timestamp: 50, Value: 6}}, stale); err != nil {
+		t.Fatalf("appendSamples to a stale head: %v", err)
+	}
+	want = append(want, Sample{Timestamp: 40, Value: 5}, Sample{Timestamp: 50, Value: 6})
+	if got := stored(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
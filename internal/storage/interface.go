@@ -1,23 +1,43 @@
 package storage
 
-import "database/sql"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+)
 
 // Storage interface defines the contract for data storage
 type Storage interface {
 	// Metrics
 	InsertMetric(metric *Metric) error
+	InsertMetrics(metrics []*Metric) error
 	GetMetrics(limit int, offset int) ([]*Metric, error)
+	InsertExponentialHistogram(h *ExponentialHistogram) error
+	InsertExponentialHistograms(histograms []*ExponentialHistogram) error
+	SelectSeries(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*Series, error)
+	LabelNames(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]string, error)
+	LabelValues(ctx context.Context, name string, matchers []*LabelMatcher, start, end time.Time) ([]string, error)
+	GetSamples(ctx context.Context, seriesIDs []int64, start, end time.Time) (map[int64][]Sample, error)
+	GetExponentialHistograms(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*ExponentialHistogram, error)
 
 	// Traces
 	InsertTrace(trace *Trace) error
+	InsertTraces(traces []*Trace) error
 	GetTraces(limit int, offset int) ([]*Trace, error)
+	FindTraces(ctx context.Context, query TraceQuery) ([]*Trace, error)
 
 	// Logs
 	InsertLog(log *Log) error
+	InsertLogs(logs []*Log) error
 	GetLogs(limit int, offset int) ([]*Log, error)
+	SearchLogs(ctx context.Context, query LogQuery) ([]*Log, error)
 
 	// Services
-	GetServices() ([]string, error)
+	GetServices(filter ResourceFilter) ([]string, error)
+	GetResources(filter ResourceFilter) ([]*Resource, error)
 
 	// Cleanup
 	CleanupOldData() error
@@ -25,7 +45,69 @@ type Storage interface {
 
 	// System info
 	GetDatabasePath() string
+}
+
+// New opens the storage backend selected by cfg.Type
+func New(cfg config.StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "sqlite":
+		s, err := NewSQLiteStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "postgres", "postgresql":
+		s, err := NewPostgresStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return NewMemoryStorage(cfg), nil
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+}
+
+// ErrUnavailable is wrapped by the errors of writes that failed because
+// storage cannot be written at the moment, for example because the database
+// is locked or the disk is full. They can be retried later.
+var ErrUnavailable = errors.New("storage unavailable")
+
+// BatchError is returned by the batch insert methods when some records
+// could not be stored. The other records of the batch were stored.
+type BatchError struct {
+	// Errors holds the error of each failed record by its index in the batch
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("record %d: %v", first, e.Errors[first])
+	}
+	return fmt.Sprintf("%d records failed, first at %d: %v", len(e.Errors), first, e.Errors[first])
+}
+
+// BatchFailures returns the error of each record a batch insert of n
+// records returned err for. Errors other than a *BatchError mean no record
+// was stored.
+func BatchFailures(err error, n int) map[int]error {
+	if err == nil {
+		return nil
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Errors
+	}
 
-	// Database access for query service
-	GetDB() *sql.DB
+	failures := make(map[int]error, n)
+	for i := 0; i < n; i++ {
+		failures[i] = err
+	}
+	return failures
 }
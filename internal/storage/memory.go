@@ -0,0 +1,856 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+)
+
+// MemoryStorage keeps telemetry in memory and behaves as SQLiteStorage
+// does. Nothing is written to disk; everything is lost when the process
+// exits.
+type MemoryStorage struct {
+	mu     sync.RWMutex
+	config config.StorageConfig
+
+	resources   map[int64]*Resource
+	resourceIDs map[string]int64
+
+	series    map[int64]*memorySeries
+	seriesIDs map[string]int64
+	// index holds the IDs of the series by label name and value, sorted
+	index map[string]map[string][]int64
+
+	histograms []*memoryHistogram
+	traces     []*memoryTrace
+	logs       []*memoryLog
+
+	// Last IDs assigned; IDs are not reused
+	lastResourceID, lastSeriesID, lastRecordID int64
+}
+
+// memorySeries is a stored series with its samples, sorted by timestamp
+type memorySeries struct {
+	series     Series
+	resourceID int64
+	labels     map[string]string
+	samples    []Sample
+	createdAt  time.Time
+}
+
+// memoryTrace is a stored span and the ID of its resource
+type memoryTrace struct {
+	trace      Trace
+	resourceID int64
+}
+
+// memoryLog is a stored log record and the ID of its resource
+type memoryLog struct {
+	log        Log
+	resourceID int64
+}
+
+// memoryHistogram is a stored histogram data point, with the histogram
+// encoded as it is in SQLite
+type memoryHistogram struct {
+	histogram  ExponentialHistogram
+	data       []byte
+	resourceID int64
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage(cfg config.StorageConfig) *MemoryStorage {
+	return &MemoryStorage{
+		config:      cfg,
+		resources:   make(map[int64]*Resource),
+		resourceIDs: make(map[string]int64),
+		series:      make(map[int64]*memorySeries),
+		seriesIDs:   make(map[string]int64),
+		index:       make(map[string]map[string][]int64),
+	}
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// creationTime returns the current time at the precision creation times are
+// stored with
+func creationTime() time.Time {
+	return time.Unix(time.Now().Unix(), 0)
+}
+
+// fromUnixNano returns t as it reads back from a Unix nanosecond column
+func fromUnixNano(t time.Time) time.Time {
+	return time.Unix(0, t.UnixNano())
+}
+
+// copyString copies an optional string, so that stored records do not share
+// memory with the caller's
+func copyString(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	v := *value
+	return &v
+}
+
+// resourceID returns the ID of a record's resource, storing the resource if
+// it is new. Records without a resource have the ID 0.
+func (s *MemoryStorage) resourceID(r *Resource) int64 {
+	if r == nil {
+		return 0
+	}
+	if id, ok := s.resourceIDs[r.Attributes]; ok {
+		return id
+	}
+
+	s.lastResourceID++
+	stored := *r
+	stored.ID = s.lastResourceID
+	stored.CreatedAt = creationTime()
+	s.resources[stored.ID] = &stored
+	s.resourceIDs[r.Attributes] = stored.ID
+	return stored.ID
+}
+
+// resource returns a copy of a stored resource, or nil for ID 0
+func (s *MemoryStorage) resource(id int64) *Resource {
+	r, ok := s.resources[id]
+	if !ok {
+		return nil
+	}
+	copied := *r
+	return &copied
+}
+
+// resourceIDPointer returns the ID of a resource as it is passed to
+// seriesIdentity
+func resourceIDPointer(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// GetResources returns the stored resources matching the filter
+func (s *MemoryStorage) GetResources(filter ResourceFilter) ([]*Resource, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var resources []*Resource
+	for id, r := range s.resources {
+		if filter.matches(r) {
+			resources = append(resources, s.resource(id))
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		a, b := resources[i], resources[j]
+		switch {
+		case a.ServiceNamespace != b.ServiceNamespace:
+			return a.ServiceNamespace < b.ServiceNamespace
+		case a.ServiceName != b.ServiceName:
+			return a.ServiceName < b.ServiceName
+		case a.DeploymentEnvironment != b.DeploymentEnvironment:
+			return a.DeploymentEnvironment < b.DeploymentEnvironment
+		case a.ServiceInstanceID != b.ServiceInstanceID:
+			return a.ServiceInstanceID < b.ServiceInstanceID
+		}
+		return a.ID < b.ID
+	})
+	return resources, nil
+}
+
+// matches reports whether a resource satisfies the filter. Records without
+// a resource only satisfy the empty filter.
+func (f ResourceFilter) matches(r *Resource) bool {
+	if r == nil {
+		r = &Resource{}
+		if f != (ResourceFilter{}) {
+			return false
+		}
+	}
+	for _, field := range []struct{ value, filter string }{
+		{r.ServiceName, f.ServiceName},
+		{r.ServiceNamespace, f.ServiceNamespace},
+		{r.ServiceVersion, f.ServiceVersion},
+		{r.DeploymentEnvironment, f.DeploymentEnvironment},
+		{r.HostName, f.HostName},
+		{r.ServiceInstanceID, f.ServiceInstanceID},
+	} {
+		if field.filter != "" && field.value != field.filter {
+			return false
+		}
+	}
+	return true
+}
+
+// Metric methods
+func (s *MemoryStorage) InsertMetric(metric *Metric) error {
+	return s.InsertMetrics([]*Metric{metric})
+}
+
+// InsertMetrics adds metrics to their series
+func (s *MemoryStorage) InsertMetrics(metrics []*Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range metrics {
+		sr := s.seriesOf(m)
+		sample := Sample{Timestamp: m.Timestamp.UnixNano(), Value: m.Value}
+
+		// Samples arrive mostly in order; one written again at the same
+		// timestamp replaces the stored one
+		i := sort.Search(len(sr.samples), func(i int) bool { return sr.samples[i].Timestamp > sample.Timestamp })
+		if i > 0 && sr.samples[i-1].Timestamp == sample.Timestamp {
+			sr.samples[i-1] = sample
+			continue
+		}
+		sr.samples = append(sr.samples, Sample{})
+		copy(sr.samples[i+1:], sr.samples[i:])
+		sr.samples[i] = sample
+	}
+	return nil
+}
+
+// seriesOf returns the series of a metric, storing and indexing the series
+// if it is new
+func (s *MemoryStorage) seriesOf(m *Metric) *memorySeries {
+	resourceID := s.resourceID(m.Resource)
+	labels := jsonOrDefault(m.Labels, "{}")
+	identity := seriesIdentity(m.MetricName, labels, m.ServiceName, resourceIDPointer(resourceID))
+	if id, ok := s.seriesIDs[identity]; ok {
+		return s.series[id]
+	}
+
+	s.lastSeriesID++
+	sr := &memorySeries{
+		series: Series{
+			ID:          s.lastSeriesID,
+			MetricName:  m.MetricName,
+			Labels:      labels,
+			ServiceName: m.ServiceName,
+		},
+		resourceID: resourceID,
+		createdAt:  creationTime(),
+	}
+	sr.labels = MetricLabels(labels, m.ServiceName, s.resources[resourceID])
+	sr.labels[MetricNameLabel] = m.MetricName
+	s.series[sr.series.ID] = sr
+	s.seriesIDs[identity] = sr.series.ID
+	s.indexSeries(sr)
+	return sr
+}
+
+// indexSeries adds a series to the postings of its labels. Series are
+// indexed in the order of their IDs, so postings stay sorted.
+func (s *MemoryStorage) indexSeries(sr *memorySeries) {
+	for name, value := range sr.labels {
+		if s.index[name] == nil {
+			s.index[name] = make(map[string][]int64)
+		}
+		s.index[name][value] = append(s.index[name][value], sr.series.ID)
+	}
+}
+
+// InsertExponentialHistogram stores a native exponential histogram data point
+func (s *MemoryStorage) InsertExponentialHistogram(h *ExponentialHistogram) error {
+	return firstError(s.InsertExponentialHistograms([]*ExponentialHistogram{h}))
+}
+
+// InsertExponentialHistograms stores native exponential histogram data
+// points. Those that cannot be encoded are reported in a *BatchError.
+func (s *MemoryStorage) InsertExponentialHistograms(histograms []*ExponentialHistogram) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failed := make(map[int]error)
+	for i, h := range histograms {
+		data, err := json.Marshal(h.Histogram)
+		if err != nil {
+			failed[i] = fmt.Errorf("failed to encode histogram: %w", err)
+			continue
+		}
+
+		s.lastRecordID++
+		stored := &memoryHistogram{histogram: *h, data: data, resourceID: s.resourceID(h.Resource)}
+		stored.histogram.ID = s.lastRecordID
+		stored.histogram.Timestamp = fromUnixNano(h.Timestamp)
+		stored.histogram.CreatedAt = creationTime()
+		stored.histogram.Histogram = nil
+		stored.histogram.Resource = nil
+		s.histograms = append(s.histograms, stored)
+	}
+
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// GetMetrics returns the most recent samples of all series, newest first
+func (s *MemoryStorage) GetMetrics(limit int, offset int) ([]*Metric, error) {
+	if limit+offset <= 0 {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var metrics []*Metric
+	for _, id := range s.seriesIDsSorted() {
+		sr := s.series[id]
+		for _, sample := range sr.samples {
+			metrics = append(metrics, &Metric{
+				ID:          id,
+				Timestamp:   time.Unix(0, sample.Timestamp),
+				MetricName:  sr.series.MetricName,
+				Value:       sample.Value,
+				Labels:      sr.series.Labels,
+				ServiceName: sr.series.ServiceName,
+				Resource:    s.resource(sr.resourceID),
+				CreatedAt:   sr.createdAt,
+			})
+		}
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Timestamp.After(metrics[j].Timestamp) })
+
+	lo, hi := page(len(metrics), limit, offset)
+	if lo == hi {
+		return nil, nil
+	}
+	return metrics[lo:hi], nil
+}
+
+// page returns the bounds of the page of n rows that a LIMIT and OFFSET
+// select. A negative limit selects every row after the offset.
+func page(n, limit, offset int) (int, int) {
+	lo := offset
+	if lo < 0 {
+		lo = 0
+	}
+	if lo > n {
+		lo = n
+	}
+	hi := n
+	if limit >= 0 && lo+limit < hi {
+		hi = lo + limit
+	}
+	return lo, hi
+}
+
+// seriesIDsSorted returns the IDs of all series, sorted
+func (s *MemoryStorage) seriesIDsSorted() []int64 {
+	ids := make([]int64, 0, len(s.series))
+	for id := range s.series {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SelectSeries returns the series whose labels satisfy every matcher that
+// have samples between start and end. The metric name is matched as the
+// __name__ label.
+func (s *MemoryStorage) SelectSeries(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*Series, error) {
+	ids, err := selectSeriesIDs(ctx, s, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var series []*Series
+	for _, id := range ids {
+		sr, ok := s.series[id]
+		if !ok || len(samplesBetween(sr.samples, start.UnixNano(), end.UnixNano())) == 0 {
+			continue
+		}
+		selected := sr.series
+		selected.Resource = s.resource(sr.resourceID)
+		series = append(series, &selected)
+	}
+	return series, nil
+}
+
+// LabelNames returns the sorted names of the labels of the series
+// satisfying every matcher that have samples between start and end,
+// including __name__
+func (s *MemoryStorage) LabelNames(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]string, error) {
+	return s.labelStrings(ctx, matchers, start, end, func(labels map[string]string) []string {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		return names
+	})
+}
+
+// LabelValues returns the sorted values of a label across the series
+// satisfying every matcher that have samples between start and end. The
+// values of __name__ are the metric names.
+func (s *MemoryStorage) LabelValues(ctx context.Context, name string, matchers []*LabelMatcher, start, end time.Time) ([]string, error) {
+	return s.labelStrings(ctx, matchers, start, end, func(labels map[string]string) []string {
+		if value, ok := labels[name]; ok {
+			return []string{value}
+		}
+		return nil
+	})
+}
+
+// labelStrings returns the sorted distinct strings fn derives from the label
+// sets of the series and native histograms satisfying every matcher that
+// have samples between start and end
+func (s *MemoryStorage) labelStrings(ctx context.Context, matchers []*LabelMatcher, start, end time.Time,
+	fn func(labels map[string]string) []string) ([]string, error) {
+	ids, err := selectSeriesIDs(ctx, s, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from, to := start.UnixNano(), end.UnixNano()
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		sr, ok := s.series[id]
+		if !ok || len(samplesBetween(sr.samples, from, to)) == 0 {
+			continue
+		}
+		for _, value := range fn(sr.labels) {
+			seen[value] = true
+		}
+	}
+
+	for _, h := range s.histograms {
+		if h.histogram.Timestamp.UnixNano() < from || h.histogram.Timestamp.UnixNano() > to {
+			continue
+		}
+		labels := MetricLabels(h.histogram.Labels, h.histogram.ServiceName, s.resources[h.resourceID])
+		labels[MetricNameLabel] = h.histogram.MetricName
+		if matchesAll(matchers, labels) {
+			for _, value := range fn(labels) {
+				seen[value] = true
+			}
+		}
+	}
+
+	result := make([]string, 0, len(seen))
+	for value := range seen {
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// samplesBetween returns the samples of a sorted list between from and to
+func samplesBetween(samples []Sample, from, to int64) []Sample {
+	lo := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp >= from })
+	hi := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp > to })
+	if lo >= hi {
+		return nil
+	}
+	return samples[lo:hi]
+}
+
+// allSeries returns the IDs of all series, sorted
+func (s *MemoryStorage) allSeries(ctx context.Context) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seriesIDsSorted(), nil
+}
+
+// labelValues returns the values of a label
+func (s *MemoryStorage) labelValues(ctx context.Context, name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make([]string, 0, len(s.index[name]))
+	for value := range s.index[name] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// postings returns the IDs of the series whose label has one of the values,
+// sorted
+func (s *MemoryStorage) postings(ctx context.Context, name string, values []string) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []int64
+	for _, value := range values {
+		ids = union(ids, s.index[name][value])
+	}
+	return ids, nil
+}
+
+// seriesLabelValues returns the values of a label by the ID of the series
+// among ids that have it
+func (s *MemoryStorage) seriesLabelValues(ctx context.Context, name string, ids []int64) (map[int64]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(map[int64]string, len(ids))
+	for _, id := range ids {
+		if sr, ok := s.series[id]; ok {
+			if value, ok := sr.labels[name]; ok {
+				values[id] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// GetSamples returns the samples of series between start and end, by series
+// ID, sorted by timestamp
+func (s *MemoryStorage) GetSamples(ctx context.Context, seriesIDs []int64, start, end time.Time) (map[int64][]Sample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[int64][]Sample)
+	for _, id := range seriesIDs {
+		sr, ok := s.series[id]
+		if !ok {
+			continue
+		}
+		if samples := samplesBetween(sr.samples, start.UnixNano(), end.UnixNano()); len(samples) > 0 {
+			result[id] = append([]Sample(nil), samples...)
+		}
+	}
+	return result, nil
+}
+
+// GetExponentialHistograms returns the native histogram data points between
+// start and end whose label sets, including __name__, satisfy every matcher,
+// sorted by timestamp
+func (s *MemoryStorage) GetExponentialHistograms(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*ExponentialHistogram, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	filter := newHistogramFilter(matchers)
+	var histograms []*ExponentialHistogram
+	for _, stored := range s.histograms {
+		h := stored.histogram
+		if h.Timestamp.Before(start) || h.Timestamp.After(end) {
+			continue
+		}
+		h.Resource = s.resource(stored.resourceID)
+		if !filter.matches(&h) {
+			continue
+		}
+		if err := json.Unmarshal(stored.data, &h.Histogram); err != nil {
+			return nil, fmt.Errorf("failed to decode histogram %d: %w", h.ID, err)
+		}
+		histograms = append(histograms, &h)
+	}
+	sort.SliceStable(histograms, func(i, j int) bool { return histograms[i].Timestamp.Before(histograms[j].Timestamp) })
+	return histograms, nil
+}
+
+// Trace methods
+func (s *MemoryStorage) InsertTrace(trace *Trace) error {
+	return s.InsertTraces([]*Trace{trace})
+}
+
+// InsertTraces stores spans
+func (s *MemoryStorage) InsertTraces(traces []*Trace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, trace := range traces {
+		s.lastRecordID++
+		stored := &memoryTrace{trace: *trace, resourceID: s.resourceID(trace.Resource)}
+		t := &stored.trace
+		t.ID = s.lastRecordID
+		t.ParentSpanID = copyString(trace.ParentSpanID)
+		t.StartTime = fromUnixNano(trace.StartTime)
+		t.Events = jsonOrDefault(trace.Events, "[]")
+		t.Links = jsonOrDefault(trace.Links, "[]")
+		t.Resource = nil
+		t.CreatedAt = creationTime()
+		s.traces = append(s.traces, stored)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetTraces(limit int, offset int) ([]*Trace, error) {
+	return s.queryTraces(func(t *Trace, r *Resource) bool { return true }, limit, offset)
+}
+
+// FindTraces returns the spans matching the query, newest first
+func (s *MemoryStorage) FindTraces(ctx context.Context, query TraceQuery) ([]*Trace, error) {
+	return s.queryTraces(query.matches, searchLimit(query.Limit), query.Offset)
+}
+
+// matches reports whether a span reported by a resource satisfies the query
+func (q TraceQuery) matches(t *Trace, r *Resource) bool {
+	start := t.StartTime.UnixNano()
+	switch {
+	case q.TraceID != "" && t.TraceID != strings.ToLower(q.TraceID),
+		q.ServiceName != "" && t.ServiceName != q.ServiceName,
+		q.OperationName != "" && t.OperationName != q.OperationName,
+		q.Kind != "" && t.Kind != q.Kind,
+		q.StatusCode != "" && t.StatusCode != q.StatusCode,
+		q.MinDuration > 0 && t.DurationNanos < int64(q.MinDuration),
+		q.MaxDuration > 0 && t.DurationNanos > int64(q.MaxDuration),
+		!q.Start.IsZero() && start < q.Start.UnixNano(),
+		!q.End.IsZero() && start > q.End.UnixNano():
+		return false
+	}
+	return attributesMatch(t.Attributes, q.Attributes) && q.Resource.matches(r)
+}
+
+// attributesMatch reports whether a JSON object has the attributes with
+// non-empty values, comparing them as decodeLabels reads them
+func attributesMatch(attributesJSON string, attributes map[string]string) bool {
+	var decoded map[string]string
+	for key, value := range attributes {
+		if value == "" {
+			continue
+		}
+		if decoded == nil {
+			decoded = decodeLabels(attributesJSON)
+		}
+		if decoded[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// queryTraces returns the spans satisfying match, newest first. A negative
+// limit returns every span.
+func (s *MemoryStorage) queryTraces(match func(t *Trace, r *Resource) bool, limit, offset int) ([]*Trace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	traces := make([]*Trace, 0, len(s.traces))
+	for _, stored := range s.traces {
+		if !match(&stored.trace, s.resources[stored.resourceID]) {
+			continue
+		}
+		t := stored.trace
+		t.ParentSpanID = copyString(t.ParentSpanID)
+		t.Resource = s.resource(stored.resourceID)
+		traces = append(traces, &t)
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].StartTime.After(traces[j].StartTime) })
+
+	lo, hi := page(len(traces), limit, offset)
+	if lo == hi {
+		return nil, nil
+	}
+	return traces[lo:hi], nil
+}
+
+// Log methods
+func (s *MemoryStorage) InsertLog(log *Log) error {
+	return s.InsertLogs([]*Log{log})
+}
+
+// InsertLogs stores log records
+func (s *MemoryStorage) InsertLogs(logs []*Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, log := range logs {
+		s.lastRecordID++
+		stored := &memoryLog{log: *log, resourceID: s.resourceID(log.Resource)}
+		l := &stored.log
+		l.ID = s.lastRecordID
+		l.Timestamp = fromUnixNano(log.Timestamp)
+		if !log.ObservedTimestamp.IsZero() {
+			l.ObservedTimestamp = fromUnixNano(log.ObservedTimestamp)
+		}
+		l.Body = jsonOrDefault(log.Body, "null")
+		l.TraceID = copyString(log.TraceID)
+		l.SpanID = copyString(log.SpanID)
+		l.Resource = nil
+		l.CreatedAt = creationTime()
+		s.logs = append(s.logs, stored)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetLogs(limit int, offset int) ([]*Log, error) {
+	return s.queryLogs(func(l *Log, r *Resource) bool { return true }, limit, offset)
+}
+
+// SearchLogs returns the log records matching the query, newest first
+func (s *MemoryStorage) SearchLogs(ctx context.Context, query LogQuery) ([]*Log, error) {
+	return s.queryLogs(query.matches, searchLimit(query.Limit), query.Offset)
+}
+
+// matches reports whether a log record reported by a resource satisfies the
+// query
+func (q LogQuery) matches(l *Log, r *Resource) bool {
+	timestamp := l.Timestamp.UnixNano()
+	switch {
+	case q.ServiceName != "" && l.ServiceName != q.ServiceName,
+		q.MinSeverity > 0 && l.SeverityNumber < q.MinSeverity,
+		q.Contains != "" && !strings.Contains(l.Message, q.Contains),
+		q.TraceID != "" && (l.TraceID == nil || *l.TraceID != strings.ToLower(q.TraceID)),
+		q.SpanID != "" && (l.SpanID == nil || *l.SpanID != strings.ToLower(q.SpanID)),
+		!q.Start.IsZero() && timestamp < q.Start.UnixNano(),
+		!q.End.IsZero() && timestamp > q.End.UnixNano():
+		return false
+	}
+	return attributesMatch(l.Attributes, q.Attributes) && q.Resource.matches(r)
+}
+
+// queryLogs returns the log records satisfying match, newest first. A
+// negative limit returns every record.
+func (s *MemoryStorage) queryLogs(match func(l *Log, r *Resource) bool, limit, offset int) ([]*Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logs := make([]*Log, 0, len(s.logs))
+	for _, stored := range s.logs {
+		if !match(&stored.log, s.resources[stored.resourceID]) {
+			continue
+		}
+		l := stored.log
+		l.TraceID = copyString(l.TraceID)
+		l.SpanID = copyString(l.SpanID)
+		l.Resource = s.resource(stored.resourceID)
+		logs = append(logs, &l)
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Timestamp.After(logs[j].Timestamp) })
+
+	lo, hi := page(len(logs), limit, offset)
+	if lo == hi {
+		return nil, nil
+	}
+	return logs[lo:hi], nil
+}
+
+// Service methods
+
+// GetServices returns the names of the services that reported telemetry from
+// a resource matching the filter
+func (s *MemoryStorage) GetServices(filter ResourceFilter) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	add := func(service string, resourceID int64) {
+		if service != "" && filter.matches(s.resources[resourceID]) {
+			seen[service] = true
+		}
+	}
+	for _, sr := range s.series {
+		add(sr.series.ServiceName, sr.resourceID)
+	}
+	for _, h := range s.histograms {
+		add(h.histogram.ServiceName, h.resourceID)
+	}
+	for _, t := range s.traces {
+		add(t.trace.ServiceName, t.resourceID)
+	}
+	for _, l := range s.logs {
+		add(l.log.ServiceName, l.resourceID)
+	}
+
+	var services []string
+	for service := range seen {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// CleanupOldData deletes data older than the retention period. As in
+// SQLite, samples are deleted a chunk at a time, once the last sample of
+// their chunk is older than the retention period.
+func (s *MemoryStorage) CleanupOldData() error {
+	cutoffTime := time.Now().AddDate(0, 0, -s.config.RetentionDays)
+	cutoff := cutoffTime.UnixNano()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sr := range s.series {
+		var kept []Sample
+		for i := 0; i < len(sr.samples); {
+			// Samples are sorted, so each chunk's samples are contiguous
+			j := i
+			for j < len(sr.samples) && chunkStart(sr.samples[j].Timestamp) == chunkStart(sr.samples[i].Timestamp) {
+				j++
+			}
+			if sr.samples[j-1].Timestamp >= cutoff {
+				kept = append(kept, sr.samples[i:j]...)
+			}
+			i = j
+		}
+		sr.samples = kept
+
+		if len(sr.samples) == 0 {
+			delete(s.series, id)
+			delete(s.seriesIDs, seriesIdentity(sr.series.MetricName, sr.series.Labels, sr.series.ServiceName,
+				resourceIDPointer(sr.resourceID)))
+		}
+	}
+
+	s.index = make(map[string]map[string][]int64)
+	for _, id := range s.seriesIDsSorted() {
+		s.indexSeries(s.series[id])
+	}
+
+	referenced := make(map[int64]bool)
+	for _, sr := range s.series {
+		referenced[sr.resourceID] = true
+	}
+
+	histograms := s.histograms[:0]
+	for _, h := range s.histograms {
+		if h.histogram.Timestamp.UnixNano() >= cutoff {
+			histograms = append(histograms, h)
+			referenced[h.resourceID] = true
+		}
+	}
+	s.histograms = histograms
+
+	traces := s.traces[:0]
+	for _, t := range s.traces {
+		if t.trace.StartTime.UnixNano() >= cutoff {
+			traces = append(traces, t)
+			referenced[t.resourceID] = true
+		}
+	}
+	s.traces = traces
+
+	logs := s.logs[:0]
+	for _, l := range s.logs {
+		if l.log.Timestamp.UnixNano() >= cutoff {
+			logs = append(logs, l)
+			referenced[l.resourceID] = true
+		}
+	}
+	s.logs = logs
+
+	// Resources that have not reported within the retention period are no
+	// longer referenced by any record
+	for id, r := range s.resources {
+		if r.CreatedAt.Unix() < cutoffTime.Unix() && !referenced[id] {
+			delete(s.resources, id)
+			delete(s.resourceIDs, r.Attributes)
+		}
+	}
+
+	return nil
+}
+
+// GetDatabasePath returns the empty string, as there is no database file
+func (s *MemoryStorage) GetDatabasePath() string {
+	return ""
+}
@@ -0,0 +1,1363 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStorage stores telemetry in PostgreSQL. Attributes and labels are
+// JSONB, and samples, histograms, spans and logs are kept in tables
+// partitioned by day, so that expired data is dropped a partition at a time.
+type PostgresStorage struct {
+	sqlStore
+	config config.StorageConfig
+
+	// writeMu is held for reading by batch inserts and for writing by
+	// retention cleanup, so that cleanup never deletes a series or resource
+	// a batch has looked up or cached
+	writeMu sync.RWMutex
+
+	// resourceIDs caches the IDs of stored resources by their attributes
+	resourceMu  sync.Mutex
+	resourceIDs map[string]int64
+
+	// seriesIDs caches the IDs of stored series by their identity
+	seriesMu  sync.Mutex
+	seriesIDs map[string]int64
+
+	// heads caches the latest chunk written of each series by series ID
+	headMu sync.Mutex
+	heads  map[int64]*headChunk
+
+	// partitions caches the names of the partitions known to exist
+	partitionMu sync.Mutex
+	partitions  map[string]bool
+}
+
+// Advisory locks serializing schema changes across instances sharing a
+// database
+const (
+	pgMigrationLock = int64(0x74656c656d6f7201)
+	pgPartitionLock = int64(0x74656c656d6f7202)
+)
+
+// partitionWindow is the span of time covered by one partition
+const partitionWindow = int64(24 * 60 * 60 * 1e9)
+
+// NewPostgresStorage connects to the database named by cfg.DSN, or by the
+// PG* environment variables if it is empty, and brings its schema up to
+// date. The pool holds at most cfg.MaxConnections connections.
+func NewPostgresStorage(cfg config.StorageConfig) (*PostgresStorage, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if cfg.MaxConnections > 0 {
+		db.SetMaxOpenConns(cfg.MaxConnections)
+		db.SetMaxIdleConns(cfg.MaxConnections)
+	}
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	storage := &PostgresStorage{
+		sqlStore:    sqlStore{db: db, dialect: postgresDialect},
+		config:      cfg,
+		resourceIDs: make(map[string]int64),
+		seriesIDs:   make(map[string]int64),
+		heads:       make(map[int64]*headChunk),
+		partitions:  make(map[string]bool),
+	}
+
+	if err := storage.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return storage, nil
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+// postgresMigrations create and update the schema. Each runs once; the
+// versions applied are recorded in the schema_version table.
+var postgresMigrations = []func(tx *sql.Tx) error{
+	createPostgresSchema,
+	addPostgresLogScopeAttributes,
+}
+
+// createPostgresSchema creates the schema the SQLite migrations arrive at.
+// Timestamps are Unix nanoseconds and creation times Unix seconds, as in
+// SQLite.
+func createPostgresSchema(tx *sql.Tx) error {
+	const createdAt = `created_at BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())::BIGINT)`
+
+	queries := []string{
+		`CREATE TABLE resources (
+			id BIGSERIAL PRIMARY KEY,
+			attributes JSONB NOT NULL,
+			service_name TEXT NOT NULL DEFAULT '',
+			service_namespace TEXT NOT NULL DEFAULT '',
+			service_version TEXT NOT NULL DEFAULT '',
+			deployment_environment TEXT NOT NULL DEFAULT '',
+			host_name TEXT NOT NULL DEFAULT '',
+			service_instance_id TEXT NOT NULL DEFAULT '',
+			` + createdAt + `
+		)`,
+		`CREATE UNIQUE INDEX idx_resources_attributes ON resources ((md5(attributes::text)))`,
+		`CREATE INDEX idx_resources_attributes_gin ON resources USING GIN (attributes)`,
+
+		`CREATE TABLE series (
+			id BIGSERIAL PRIMARY KEY,
+			fingerprint BIGINT NOT NULL,
+			metric_name TEXT NOT NULL,
+			labels JSONB NOT NULL DEFAULT '{}',
+			service_name TEXT NOT NULL DEFAULT '',
+			resource_id BIGINT REFERENCES resources(id),
+			` + createdAt + `
+		)`,
+		`CREATE UNIQUE INDEX idx_series_identity
+			ON series (fingerprint, metric_name, service_name, (COALESCE(resource_id, 0)), (md5(labels::text)))`,
+		`CREATE INDEX idx_series_name ON series(metric_name)`,
+		`CREATE INDEX idx_series_resource ON series(resource_id)`,
+		`CREATE INDEX idx_series_labels ON series USING GIN (labels)`,
+
+		// Label names and values sort bytewise, as in SQLite
+		`CREATE TABLE postings (
+			name TEXT COLLATE "C" NOT NULL,
+			value TEXT COLLATE "C" NOT NULL,
+			series_id BIGINT NOT NULL REFERENCES series(id),
+			PRIMARY KEY (name, value, series_id)
+		)`,
+		`CREATE INDEX idx_postings_series ON postings(series_id, name)`,
+
+		`CREATE TABLE chunks (
+			series_id BIGINT NOT NULL REFERENCES series(id),
+			start_time BIGINT NOT NULL,
+			min_time BIGINT NOT NULL,
+			max_time BIGINT NOT NULL,
+			samples INTEGER NOT NULL,
+			data BYTEA NOT NULL,
+			PRIMARY KEY (series_id, start_time)
+		) PARTITION BY RANGE (start_time)`,
+		`CREATE INDEX idx_chunks_max_time ON chunks(max_time)`,
+
+		`CREATE TABLE exp_histograms (
+			id BIGSERIAL,
+			timestamp BIGINT NOT NULL,
+			metric_name TEXT NOT NULL,
+			labels JSONB NOT NULL DEFAULT '{}',
+			service_name TEXT NOT NULL DEFAULT '',
+			histogram JSONB NOT NULL,
+			resource_id BIGINT REFERENCES resources(id),
+			` + createdAt + `,
+			PRIMARY KEY (id, timestamp)
+		) PARTITION BY RANGE (timestamp)`,
+		`CREATE INDEX idx_exp_histograms_timestamp ON exp_histograms(timestamp)`,
+		`CREATE INDEX idx_exp_histograms_name ON exp_histograms(metric_name)`,
+		`CREATE INDEX idx_exp_histograms_resource ON exp_histograms(resource_id)`,
+
+		`CREATE TABLE traces (
+			id BIGSERIAL,
+			trace_id TEXT NOT NULL,
+			span_id TEXT NOT NULL,
+			parent_span_id TEXT,
+			trace_state TEXT NOT NULL DEFAULT '',
+			service_name TEXT NOT NULL DEFAULT '',
+			operation_name TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL DEFAULT '',
+			start_time BIGINT NOT NULL,
+			duration_nanos BIGINT NOT NULL,
+			attributes JSONB NOT NULL DEFAULT '{}',
+			events JSONB NOT NULL DEFAULT '[]',
+			links JSONB NOT NULL DEFAULT '[]',
+			status_code TEXT NOT NULL DEFAULT '',
+			status_message TEXT NOT NULL DEFAULT '',
+			scope_name TEXT NOT NULL DEFAULT '',
+			scope_version TEXT NOT NULL DEFAULT '',
+			resource_id BIGINT REFERENCES resources(id),
+			` + createdAt + `,
+			PRIMARY KEY (id, start_time)
+		) PARTITION BY RANGE (start_time)`,
+		`CREATE INDEX idx_traces_trace_id ON traces(trace_id)`,
+		`CREATE INDEX idx_traces_service ON traces(service_name)`,
+		`CREATE INDEX idx_traces_start_time ON traces(start_time)`,
+		`CREATE INDEX idx_traces_resource ON traces(resource_id)`,
+		`CREATE INDEX idx_traces_attributes ON traces USING GIN (attributes)`,
+
+		`CREATE TABLE logs (
+			id BIGSERIAL,
+			timestamp BIGINT NOT NULL,
+			observed_timestamp BIGINT NOT NULL DEFAULT 0,
+			service_name TEXT NOT NULL DEFAULT '',
+			level TEXT NOT NULL DEFAULT '',
+			severity_number INTEGER NOT NULL DEFAULT 0,
+			event_name TEXT NOT NULL DEFAULT '',
+			message TEXT NOT NULL DEFAULT '',
+			body JSONB NOT NULL DEFAULT 'null',
+			attributes JSONB NOT NULL DEFAULT '{}',
+			trace_id TEXT,
+			span_id TEXT,
+			flags BIGINT NOT NULL DEFAULT 0,
+			scope_name TEXT NOT NULL DEFAULT '',
+			scope_version TEXT NOT NULL DEFAULT '',
+			resource_id BIGINT REFERENCES resources(id),
+			` + createdAt + `,
+			PRIMARY KEY (id, timestamp)
+		) PARTITION BY RANGE (timestamp)`,
+		`CREATE INDEX idx_logs_timestamp ON logs(timestamp)`,
+		`CREATE INDEX idx_logs_service ON logs(service_name)`,
+		`CREATE INDEX idx_logs_level ON logs(level)`,
+		`CREATE INDEX idx_logs_severity_number ON logs(severity_number)`,
+		`CREATE INDEX idx_logs_trace_id ON logs(trace_id)`,
+		`CREATE INDEX idx_logs_resource ON logs(resource_id)`,
+		`CREATE INDEX idx_logs_attributes ON logs USING GIN (attributes)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPostgresLogScopeAttributes adds the attributes of the instrumentation
+// scope of log records
+func addPostgresLogScopeAttributes(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE logs ADD COLUMN scope_attributes JSONB NOT NULL DEFAULT '{}'`)
+	return err
+}
+
+// migrate applies the migrations the database has not seen yet, each in its
+// own transaction. Instances starting together take turns.
+func (s *PostgresStorage) migrate() error {
+	for {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		version, err := lockSchema(tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if version >= len(postgresMigrations) {
+			return tx.Commit()
+		}
+
+		if err := postgresMigrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, version+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+	}
+}
+
+// lockSchema takes the migration lock for the rest of the transaction and
+// returns the number of migrations applied
+func lockSchema(tx *sql.Tx) (int, error) {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, pgMigrationLock); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return 0, err
+	}
+	var version int
+	err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// partitionStart returns the start of the partition holding a record
+// timestamped ts
+func partitionStart(ts int64) int64 {
+	return ts - ((ts%partitionWindow)+partitionWindow)%partitionWindow
+}
+
+// partitionName returns the name of the partition of a table starting at
+// start
+func partitionName(table string, start int64) string {
+	return table + "_p" + time.Unix(0, start).UTC().Format("20060102")
+}
+
+// ensurePartitions creates the partitions of a table that records
+// timestamped times go in, unless they exist. Partitions are created in a
+// transaction of their own, as creating one locks the whole table.
+func (s *PostgresStorage) ensurePartitions(table string, times []int64) error {
+	s.partitionMu.Lock()
+	defer s.partitionMu.Unlock()
+
+	var starts []int64
+	seen := make(map[int64]bool)
+	for _, ts := range times {
+		start := partitionStart(ts)
+		if !seen[start] && !s.partitions[partitionName(table, start)] {
+			starts = append(starts, start)
+		}
+		seen[start] = true
+	}
+	if len(starts) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", pgUnavailable(err))
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, pgPartitionLock); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to lock partitions: %w", pgUnavailable(err))
+	}
+	for _, start := range starts {
+		query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)`,
+			pq.QuoteIdentifier(partitionName(table, start)), table, start, start+partitionWindow)
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create partition: %w", pgUnavailable(err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create partition: %w", pgUnavailable(err))
+	}
+
+	for _, start := range starts {
+		s.partitions[partitionName(table, start)] = true
+	}
+	return nil
+}
+
+// dropPartitions drops the partitions of a table that only hold records
+// older than cutoff
+func (s *PostgresStorage) dropPartitions(table string, cutoff int64) error {
+	s.partitionMu.Lock()
+	defer s.partitionMu.Unlock()
+
+	names, err := s.queryStrings(context.Background(), `SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = ?::regclass`, table)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, table+"_p"))
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		if day.UnixNano()+partitionWindow > cutoff {
+			continue
+		}
+		if _, err := s.db.Exec(`DROP TABLE IF EXISTS ` + pq.QuoteIdentifier(name)); err != nil {
+			return err
+		}
+		delete(s.partitions, name)
+	}
+	return nil
+}
+
+// rebind numbers the ? placeholders of a query the way PostgreSQL expects
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// pgUnavailable wraps errors meaning that the database cannot be written at
+// the moment, rather than that a record is invalid, in ErrUnavailable
+func pgUnavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// Connection exceptions, insufficient resources and operator
+		// intervention such as a shutdown
+		case "08", "53", "57":
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		switch pqErr.Code {
+		// Read-only transactions, serialization failures and deadlocks
+		case "25006", "40001", "40P01":
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+// errBatchAborted is the error of the records of a batch that follow a
+// failed one outside of isolated mode. The batch is retried.
+var errBatchAborted = errors.New("batch aborted by an earlier record")
+
+// pgBatch is the transaction of a batch insert. IDs of the resources and
+// series it stores are cached once it commits.
+//
+// A failed statement aborts a PostgreSQL transaction, so a batch is first
+// run as is and, if a record fails, run again in isolated mode, where each
+// step runs within a savepoint that is rolled back if it fails.
+type pgBatch struct {
+	storage     *PostgresStorage
+	tx          *sql.Tx
+	isolated    bool
+	aborted     bool
+	resourceIDs map[string]int64
+	seriesIDs   map[string]int64
+	heads       map[int64]*headChunk
+}
+
+// do runs one step of the batch
+func (b *pgBatch) do(fn func() error) error {
+	if b.aborted {
+		return errBatchAborted
+	}
+	if !b.isolated {
+		err := fn()
+		b.aborted = err != nil
+		return err
+	}
+
+	if _, err := b.tx.Exec(`SAVEPOINT record`); err != nil {
+		return pgUnavailable(err)
+	}
+	if err := fn(); err != nil {
+		if _, rollbackErr := b.tx.Exec(`ROLLBACK TO SAVEPOINT record`); rollbackErr != nil {
+			return fmt.Errorf("%w: %v", ErrUnavailable, rollbackErr)
+		}
+		return err
+	}
+	if _, err := b.tx.Exec(`RELEASE SAVEPOINT record`); err != nil {
+		return pgUnavailable(err)
+	}
+	return nil
+}
+
+// batch runs a batch insert of n records. fn stores the records, recording
+// those that fail in failed; errors it returns abort the batch. Records
+// that fail do not prevent the others from being stored; they are reported
+// in a *BatchError.
+func (s *PostgresStorage) batch(n int, fn func(b *pgBatch, failed map[int]error) error) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	for _, isolated := range []bool{false, true} {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", pgUnavailable(err))
+		}
+		b := &pgBatch{
+			storage:     s,
+			tx:          tx,
+			isolated:    isolated,
+			resourceIDs: make(map[string]int64),
+			seriesIDs:   make(map[string]int64),
+			heads:       make(map[int64]*headChunk),
+		}
+
+		failed := make(map[int]error)
+		if err := fn(b, failed); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(failed) > 0 && !isolated {
+			tx.Rollback()
+			continue
+		}
+		return b.finish(failed, n)
+	}
+	return nil
+}
+
+// failRecord records the error of a record, or returns it if the rest of
+// the batch would fail the same way
+func failRecord(failed map[int]error, i int, err error) error {
+	if err = pgUnavailable(err); errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	failed[i] = err
+	return nil
+}
+
+// finish commits a batch of n records unless all of them failed, and
+// reports the failed ones in a *BatchError
+func (b *pgBatch) finish(failed map[int]error, n int) error {
+	if len(failed) == n {
+		b.tx.Rollback()
+		return &BatchError{Errors: failed}
+	}
+	if err := b.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", pgUnavailable(err))
+	}
+
+	b.storage.resourceMu.Lock()
+	for attributes, id := range b.resourceIDs {
+		b.storage.resourceIDs[attributes] = id
+	}
+	b.storage.resourceMu.Unlock()
+
+	b.storage.seriesMu.Lock()
+	for identity, id := range b.seriesIDs {
+		b.storage.seriesIDs[identity] = id
+	}
+	b.storage.seriesMu.Unlock()
+
+	b.storage.headMu.Lock()
+	for id, head := range b.heads {
+		b.storage.heads[id] = head
+	}
+	b.storage.headMu.Unlock()
+
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// resourceID returns the ID of a record's resource, storing the resource if
+// it is new. Records without a resource have a NULL resource ID.
+func (b *pgBatch) resourceID(r *Resource) (*int64, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	b.storage.resourceMu.Lock()
+	id, ok := b.storage.resourceIDs[r.Attributes]
+	b.storage.resourceMu.Unlock()
+	if !ok {
+		if id, ok = b.resourceIDs[r.Attributes]; !ok {
+			err := b.do(func() error {
+				var err error
+				id, err = insertPostgresResource(b.tx, r)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			b.resourceIDs[r.Attributes] = id
+		}
+	}
+	return &id, nil
+}
+
+// insertPostgresResource stores a resource unless one with the same
+// attributes exists, and returns its ID
+func insertPostgresResource(tx *sql.Tx, r *Resource) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`INSERT INTO resources (attributes, service_name, service_namespace, service_version,
+			deployment_environment, host_name, service_instance_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT ((md5(attributes::text))) DO NOTHING
+			RETURNING id`,
+		jsonOrDefault(r.Attributes, "{}"),
+		r.ServiceName,
+		r.ServiceNamespace,
+		r.ServiceVersion,
+		r.DeploymentEnvironment,
+		r.HostName,
+		r.ServiceInstanceID,
+	).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to store resource: %w", err)
+	}
+
+	err = tx.QueryRow(`SELECT id FROM resources WHERE md5(attributes::text) = md5($1::jsonb::text)`,
+		jsonOrDefault(r.Attributes, "{}")).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up resource: %w", err)
+	}
+	return id, nil
+}
+
+// head returns the appender of the chunk of a series starting at start as
+// last written, or nil if it is not cached
+func (b *pgBatch) head(seriesID, start int64) *chunkAppender {
+	head, ok := b.heads[seriesID]
+	if !ok {
+		b.storage.headMu.Lock()
+		head, ok = b.storage.heads[seriesID]
+		b.storage.headMu.Unlock()
+	}
+	if !ok || head.start != start {
+		return nil
+	}
+	return head.appender
+}
+
+// seriesID returns the ID of the series of a metric, storing and indexing
+// the series if it is new
+func (b *pgBatch) seriesID(m *Metric) (int64, error) {
+	resourceID, err := b.resourceID(m.Resource)
+	if err != nil {
+		return 0, err
+	}
+	labels := jsonOrDefault(m.Labels, "{}")
+	identity := seriesIdentity(m.MetricName, labels, m.ServiceName, resourceID)
+
+	b.storage.seriesMu.Lock()
+	id, ok := b.storage.seriesIDs[identity]
+	b.storage.seriesMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if id, ok = b.seriesIDs[identity]; ok {
+		return id, nil
+	}
+
+	err = b.do(func() error {
+		var created bool
+		var err error
+		id, created, err = insertPostgresSeries(b.tx, m.MetricName, labels, m.ServiceName, resourceID)
+		if err != nil || !created {
+			return err
+		}
+		sr := &Series{ID: id, MetricName: m.MetricName, Labels: labels, ServiceName: m.ServiceName, Resource: m.Resource}
+		return indexPostgresSeries(b.tx, sr)
+	})
+	if err != nil {
+		return 0, err
+	}
+	b.seriesIDs[identity] = id
+	return id, nil
+}
+
+// insertPostgresSeries stores a series unless it exists, and returns its ID
+// and whether it is new
+func insertPostgresSeries(tx *sql.Tx, metricName, labels, serviceName string, resourceID *int64) (int64, bool, error) {
+	fingerprint := seriesFingerprint(metricName, labels, serviceName, resourceID)
+	lookup := func() (int64, error) {
+		var id int64
+		err := tx.QueryRow(`SELECT id FROM series
+			WHERE fingerprint = $1 AND metric_name = $2 AND service_name = $3
+			AND COALESCE(resource_id, 0) = COALESCE($4::BIGINT, 0) AND md5(labels::text) = md5($5::jsonb::text)`,
+			fingerprint, metricName, serviceName, resourceID, labels).Scan(&id)
+		return id, err
+	}
+
+	id, err := lookup()
+	if err == nil {
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("failed to look up series: %w", err)
+	}
+
+	err = tx.QueryRow(`INSERT INTO series (fingerprint, metric_name, labels, service_name, resource_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (fingerprint, metric_name, service_name, (COALESCE(resource_id, 0)), (md5(labels::text))) DO NOTHING
+		RETURNING id`, fingerprint, metricName, labels, serviceName, resourceID).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("failed to store series: %w", err)
+	}
+
+	// Another transaction stored the series first
+	if id, err = lookup(); err != nil {
+		return 0, false, fmt.Errorf("failed to look up series: %w", err)
+	}
+	return id, false, nil
+}
+
+// indexPostgresSeries adds a series to the postings of its labels and of its
+// metric name
+func indexPostgresSeries(tx *sql.Tx, sr *Series) error {
+	labels := MetricLabels(sr.Labels, sr.ServiceName, sr.Resource)
+	labels[MetricNameLabel] = sr.MetricName
+
+	names := make([]string, 0, len(labels))
+	values := make([]string, 0, len(labels))
+	for name, value := range labels {
+		names = append(names, name)
+		values = append(values, value)
+	}
+	_, err := tx.Exec(`INSERT INTO postings (name, value, series_id)
+		SELECT unnest($1::text[]), unnest($2::text[]), $3
+		ON CONFLICT DO NOTHING`, pq.Array(names), pq.Array(values), sr.ID)
+	if err != nil {
+		return fmt.Errorf("failed to index series: %w", err)
+	}
+	return nil
+}
+
+// appendPostgresSamples adds samples to the chunk of a series starting at
+// start, replacing stored samples with the timestamp of a new one. The
+// series is locked first, so that concurrent writers of the same chunk take
+// turns. head is the appender of the chunk as last written, or nil if
+// unknown; samples later than those it holds are appended to the encoded
+// chunk rather than merged with the decoded one. It returns the appender of
+// the chunk as written.
+func appendPostgresSamples(tx *sql.Tx, seriesID, start int64, samples []Sample, head *chunkAppender) (*chunkAppender, error) {
+	if _, err := tx.Exec(`SELECT 1 FROM series WHERE id = $1 FOR NO KEY UPDATE`, seriesID); err != nil {
+		return nil, fmt.Errorf("failed to lock series: %w", err)
+	}
+	samples = mergeSamples(samples)
+
+	if head != nil {
+		// The chunk must not have changed since head was written
+		var count int
+		var maxTime int64
+		err := tx.QueryRow(`SELECT samples, max_time FROM chunks WHERE series_id = $1 AND start_time = $2`,
+			seriesID, start).Scan(&count, &maxTime)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		if err == nil && head.appendable(count, maxTime, samples) {
+			a := head.clone()
+			for _, sample := range samples {
+				a.append(sample)
+			}
+			_, err := tx.Exec(`UPDATE chunks SET max_time = $1, samples = $2, data = $3 WHERE series_id = $4 AND start_time = $5`,
+				a.prevTimestamp, a.count, a.bytes(), seriesID, start)
+			if err != nil {
+				return nil, fmt.Errorf("failed to store chunk: %w", err)
+			}
+			return a, nil
+		}
+	}
+
+	var data []byte
+	err := tx.QueryRow(`SELECT data FROM chunks WHERE series_id = $1 AND start_time = $2`, seriesID, start).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if err == nil {
+		existing, err := decodeChunk(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		samples = mergeSamples(append(existing, samples...))
+	}
+
+	a := newChunkAppender(samples)
+	_, err = tx.Exec(`INSERT INTO chunks (series_id, start_time, min_time, max_time, samples, data)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (series_id, start_time) DO UPDATE SET
+		min_time = excluded.min_time, max_time = excluded.max_time, samples = excluded.samples, data = excluded.data`,
+		seriesID, start, a.minTime, a.prevTimestamp, a.count, a.bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store chunk: %w", err)
+	}
+	return a, nil
+}
+
+// insertBatch inserts n records in one transaction using a prepared
+// statement. args returns the statement arguments for the record at index
+// i. The partitions of the records timestamped times must exist.
+func (s *PostgresStorage) insertBatch(query string, n int, args func(b *pgBatch, i int) ([]interface{}, error)) error {
+	return s.batch(n, func(b *pgBatch, failed map[int]error) error {
+		stmt, err := b.tx.Prepare(query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", pgUnavailable(err))
+		}
+		defer stmt.Close()
+
+		for i := 0; i < n; i++ {
+			values, err := args(b, i)
+			if err == nil {
+				err = b.do(func() error {
+					_, err := stmt.Exec(values...)
+					return err
+				})
+			}
+			if err != nil {
+				if err := failRecord(failed, i, err); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetResources returns the stored resources matching the filter
+func (s *PostgresStorage) GetResources(filter ResourceFilter) ([]*Resource, error) {
+	where, args := filter.where()
+	query := rebind(`SELECT ` + resourceColumns + `
+			  FROM resources r
+			  WHERE ` + where + `
+			  ORDER BY r.service_namespace, r.service_name, r.deployment_environment, r.service_instance_id, r.id`)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resources []*Resource
+	for rows.Next() {
+		var rs resourceScanner
+		if err := rows.Scan(rs.targets()...); err != nil {
+			return nil, err
+		}
+		resources = append(resources, rs.result())
+	}
+
+	return resources, rows.Err()
+}
+
+// Metric methods
+func (s *PostgresStorage) InsertMetric(metric *Metric) error {
+	return firstError(s.InsertMetrics([]*Metric{metric}))
+}
+
+// InsertMetrics adds metrics to the chunks of their series in one
+// transaction
+func (s *PostgresStorage) InsertMetrics(metrics []*Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	starts := make([]int64, len(metrics))
+	for i, metric := range metrics {
+		starts[i] = chunkStart(metric.Timestamp.UnixNano())
+	}
+	if err := s.ensurePartitions("chunks", starts); err != nil {
+		return err
+	}
+
+	return s.batch(len(metrics), func(b *pgBatch, failed map[int]error) error {
+		// Indexes of the metrics added to each chunk
+		type chunkKey struct{ seriesID, start int64 }
+		chunks := make(map[chunkKey][]int)
+		var keys []chunkKey
+
+		for i, metric := range metrics {
+			id, err := b.seriesID(metric)
+			if err != nil {
+				if err := failRecord(failed, i, err); err != nil {
+					return err
+				}
+				continue
+			}
+
+			key := chunkKey{id, starts[i]}
+			if _, ok := chunks[key]; !ok {
+				keys = append(keys, key)
+			}
+			chunks[key] = append(chunks[key], i)
+		}
+
+		// Every batch locks series in the same order
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].seriesID != keys[j].seriesID {
+				return keys[i].seriesID < keys[j].seriesID
+			}
+			return keys[i].start < keys[j].start
+		})
+
+		for _, key := range keys {
+			samples := make([]Sample, len(chunks[key]))
+			for j, i := range chunks[key] {
+				samples[j] = Sample{Timestamp: metrics[i].Timestamp.UnixNano(), Value: metrics[i].Value}
+			}
+
+			var head *chunkAppender
+			err := b.do(func() error {
+				var err error
+				head, err = appendPostgresSamples(b.tx, key.seriesID, key.start, samples, b.head(key.seriesID, key.start))
+				return err
+			})
+			if err != nil {
+				for _, i := range chunks[key] {
+					if err := failRecord(failed, i, err); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			b.heads[key.seriesID] = &headChunk{start: key.start, appender: head}
+		}
+		return nil
+	})
+}
+
+// InsertExponentialHistogram stores a native exponential histogram data point
+func (s *PostgresStorage) InsertExponentialHistogram(h *ExponentialHistogram) error {
+	return firstError(s.InsertExponentialHistograms([]*ExponentialHistogram{h}))
+}
+
+// InsertExponentialHistograms stores native exponential histogram data
+// points in one transaction
+func (s *PostgresStorage) InsertExponentialHistograms(histograms []*ExponentialHistogram) error {
+	times := make([]int64, len(histograms))
+	for i, h := range histograms {
+		times[i] = h.Timestamp.UnixNano()
+	}
+	if err := s.ensurePartitions("exp_histograms", times); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO exp_histograms (timestamp, metric_name, labels, service_name, histogram, resource_id)
+			  VALUES ($1, $2, $3, $4, $5, $6)`
+
+	return s.insertBatch(query, len(histograms), func(b *pgBatch, i int) ([]interface{}, error) {
+		h := histograms[i]
+		data, err := json.Marshal(h.Histogram)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode histogram: %w", err)
+		}
+
+		resourceID, err := b.resourceID(h.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			times[i],
+			h.MetricName,
+			jsonOrDefault(h.Labels, "{}"),
+			h.ServiceName,
+			string(data),
+			resourceID,
+		}, nil
+	})
+}
+
+// GetExponentialHistograms returns the native histogram data points between
+// start and end whose label sets, including __name__, satisfy every matcher,
+// sorted by timestamp
+func (s *PostgresStorage) GetExponentialHistograms(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*ExponentialHistogram, error) {
+	filter := newHistogramFilter(matchers)
+	stored, err := s.queryStrings(ctx, `SELECT DISTINCT metric_name FROM exp_histograms`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read histogram metric names: %w", err)
+	}
+	names := filter.metricNames(stored)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT h.id, h.timestamp, h.metric_name, h.labels, h.service_name,
+			  h.histogram, h.created_at, `+resourceColumns+`
+			  FROM exp_histograms h
+			  LEFT JOIN resources r ON r.id = h.resource_id
+			  WHERE h.timestamp >= $1 AND h.timestamp <= $2 AND h.metric_name = ANY($3)
+			  ORDER BY h.timestamp ASC, h.id ASC`, start.UnixNano(), end.UnixNano(), pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var histograms []*ExponentialHistogram
+	for rows.Next() {
+		var h ExponentialHistogram
+		var timestamp, createdAt int64
+		var data string
+		var resource resourceScanner
+
+		err := rows.Scan(append([]interface{}{&h.ID, &timestamp, &h.MetricName, &h.Labels, &h.ServiceName,
+			&data, &createdAt}, resource.targets()...)...)
+		if err != nil {
+			return nil, err
+		}
+		h.Resource = resource.result()
+		if !filter.matches(&h) {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &h.Histogram); err != nil {
+			return nil, fmt.Errorf("failed to decode histogram %d: %w", h.ID, err)
+		}
+
+		h.Timestamp = time.Unix(0, timestamp)
+		h.CreatedAt = time.Unix(createdAt, 0)
+		histograms = append(histograms, &h)
+	}
+
+	return histograms, rows.Err()
+}
+
+// Trace methods
+func (s *PostgresStorage) InsertTrace(trace *Trace) error {
+	return firstError(s.InsertTraces([]*Trace{trace}))
+}
+
+// InsertTraces stores spans in one transaction
+func (s *PostgresStorage) InsertTraces(traces []*Trace) error {
+	times := make([]int64, len(traces))
+	for i, trace := range traces {
+		times[i] = trace.StartTime.UnixNano()
+	}
+	if err := s.ensurePartitions("traces", times); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO traces (trace_id, span_id, parent_span_id, trace_state, service_name, operation_name,
+			  kind, start_time, duration_nanos, attributes, events, links, status_code, status_message,
+			  scope_name, scope_version, resource_id)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
+
+	return s.insertBatch(query, len(traces), func(b *pgBatch, i int) ([]interface{}, error) {
+		trace := traces[i]
+		resourceID, err := b.resourceID(trace.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			trace.TraceID,
+			trace.SpanID,
+			trace.ParentSpanID,
+			trace.TraceState,
+			trace.ServiceName,
+			trace.OperationName,
+			trace.Kind,
+			times[i],
+			trace.DurationNanos,
+			jsonOrDefault(trace.Attributes, "{}"),
+			jsonOrDefault(trace.Events, "[]"),
+			jsonOrDefault(trace.Links, "[]"),
+			trace.StatusCode,
+			trace.StatusMessage,
+			trace.ScopeName,
+			trace.ScopeVersion,
+			resourceID,
+		}, nil
+	})
+}
+
+func (s *PostgresStorage) GetTraces(limit int, offset int) ([]*Trace, error) {
+	return s.queryTraces(context.Background(), `1 = 1`, nil, limit, offset)
+}
+
+// FindTraces returns the spans matching the query, newest first
+func (s *PostgresStorage) FindTraces(ctx context.Context, query TraceQuery) ([]*Trace, error) {
+	where, args := query.where(postgresDialect)
+	return s.queryTraces(ctx, where, args, searchLimit(query.Limit), query.Offset)
+}
+
+// postgresDialect matches attributes by their text in JSONB, and text
+// case-sensitively
+var postgresDialect = sqlDialect{
+	bind: rebind,
+	in: func(column string, values []interface{}) (string, []interface{}) {
+		return column + ` = ANY(?)`, []interface{}{pq.Array(values)}
+	},
+	attribute: func(column string) string {
+		return column + ` ->> CAST(? AS TEXT) = ?`
+	},
+	contains: func(column string) string {
+		return `strpos(` + column + `, ?) > 0`
+	},
+}
+
+// pgLimit returns a LIMIT argument; negative limits are no limit
+func pgLimit(limit int) interface{} {
+	if limit < 0 {
+		return nil
+	}
+	return limit
+}
+
+// queryTraces returns the spans satisfying a condition on the traces joined
+// as t and their resources joined as r, newest first. A negative limit
+// returns every span.
+func (s *PostgresStorage) queryTraces(ctx context.Context, where string, args []interface{}, limit, offset int) ([]*Trace, error) {
+	query := rebind(`SELECT t.id, t.trace_id, t.span_id, t.parent_span_id, t.trace_state, t.service_name, t.operation_name,
+			  t.kind, t.start_time, t.duration_nanos, t.attributes, t.events, t.links, t.status_code, t.status_message,
+			  t.scope_name, t.scope_version, t.created_at, ` + resourceColumns + `
+			  FROM traces t
+			  LEFT JOIN resources r ON r.id = t.resource_id
+			  WHERE ` + where + `
+			  ORDER BY t.start_time DESC
+			  LIMIT ? OFFSET ?`)
+
+	rows, err := s.db.QueryContext(ctx, query, append(args, pgLimit(limit), offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var traces []*Trace
+	for rows.Next() {
+		var t Trace
+		var startTime, createdAt int64
+		var resource resourceScanner
+
+		err := rows.Scan(append([]interface{}{&t.ID, &t.TraceID, &t.SpanID, &t.ParentSpanID, &t.TraceState,
+			&t.ServiceName, &t.OperationName, &t.Kind, &startTime, &t.DurationNanos, &t.Attributes, &t.Events,
+			&t.Links, &t.StatusCode, &t.StatusMessage, &t.ScopeName, &t.ScopeVersion, &createdAt},
+			resource.targets()...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		t.StartTime = time.Unix(0, startTime)
+		t.CreatedAt = time.Unix(createdAt, 0)
+		t.Resource = resource.result()
+		traces = append(traces, &t)
+	}
+
+	return traces, rows.Err()
+}
+
+// Log methods
+func (s *PostgresStorage) InsertLog(log *Log) error {
+	return firstError(s.InsertLogs([]*Log{log}))
+}
+
+// InsertLogs stores log records in one transaction
+func (s *PostgresStorage) InsertLogs(logs []*Log) error {
+	times := make([]int64, len(logs))
+	for i, log := range logs {
+		times[i] = log.Timestamp.UnixNano()
+	}
+	if err := s.ensurePartitions("logs", times); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO logs (timestamp, observed_timestamp, service_name, level, severity_number, event_name,
+			  message, body, attributes, trace_id, span_id, flags, scope_name, scope_version, scope_attributes, resource_id)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+
+	return s.insertBatch(query, len(logs), func(b *pgBatch, i int) ([]interface{}, error) {
+		log := logs[i]
+		resourceID, err := b.resourceID(log.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			times[i],
+			unixNanoOrZero(log.ObservedTimestamp),
+			log.ServiceName,
+			log.Level,
+			log.SeverityNumber,
+			log.EventName,
+			log.Message,
+			jsonOrDefault(log.Body, "null"),
+			jsonOrDefault(log.Attributes, "{}"),
+			log.TraceID,
+			log.SpanID,
+			int64(log.Flags),
+			log.ScopeName,
+			log.ScopeVersion,
+			jsonOrDefault(log.ScopeAttributes, "{}"),
+			resourceID,
+		}, nil
+	})
+}
+
+func (s *PostgresStorage) GetLogs(limit int, offset int) ([]*Log, error) {
+	return s.queryLogs(context.Background(), `1 = 1`, nil, limit, offset)
+}
+
+// SearchLogs returns the log records matching the query, newest first
+func (s *PostgresStorage) SearchLogs(ctx context.Context, query LogQuery) ([]*Log, error) {
+	where, args := query.where(postgresDialect)
+	return s.queryLogs(ctx, where, args, searchLimit(query.Limit), query.Offset)
+}
+
+// queryLogs returns the log records satisfying a condition on the logs
+// joined as l and their resources joined as r, newest first. A negative
+// limit returns every record.
+func (s *PostgresStorage) queryLogs(ctx context.Context, where string, args []interface{}, limit, offset int) ([]*Log, error) {
+	query := rebind(`SELECT l.id, l.timestamp, l.observed_timestamp, l.service_name, l.level, l.severity_number, l.event_name,
+			  l.message, l.body, l.attributes, l.trace_id, l.span_id, l.flags, l.scope_name, l.scope_version, l.scope_attributes, l.created_at,
+			  ` + resourceColumns + `
+			  FROM logs l
+			  LEFT JOIN resources r ON r.id = l.resource_id
+			  WHERE ` + where + `
+			  ORDER BY l.timestamp DESC
+			  LIMIT ? OFFSET ?`)
+
+	rows, err := s.db.QueryContext(ctx, query, append(args, pgLimit(limit), offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []*Log
+	for rows.Next() {
+		var l Log
+		var timestamp, observedTimestamp, createdAt int64
+		var resource resourceScanner
+
+		err := rows.Scan(append([]interface{}{&l.ID, &timestamp, &observedTimestamp, &l.ServiceName, &l.Level,
+			&l.SeverityNumber, &l.EventName, &l.Message, &l.Body, &l.Attributes, &l.TraceID, &l.SpanID, &l.Flags,
+			&l.ScopeName, &l.ScopeVersion, &l.ScopeAttributes, &createdAt}, resource.targets()...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		l.Timestamp = time.Unix(0, timestamp)
+		if observedTimestamp != 0 {
+			l.ObservedTimestamp = time.Unix(0, observedTimestamp)
+		}
+		l.CreatedAt = time.Unix(createdAt, 0)
+		l.Resource = resource.result()
+		logs = append(logs, &l)
+	}
+
+	return logs, rows.Err()
+}
+
+// Service methods
+
+// GetServices returns the names of the services that reported telemetry from
+// a resource matching the filter
+func (s *PostgresStorage) GetServices(filter ResourceFilter) ([]string, error) {
+	where, args := filter.where()
+	query := rebind(`SELECT DISTINCT t.service_name FROM (
+		SELECT service_name, resource_id FROM series WHERE service_name != ''
+		UNION
+		SELECT service_name, resource_id FROM exp_histograms WHERE service_name != ''
+		UNION
+		SELECT service_name, resource_id FROM traces WHERE service_name != ''
+		UNION
+		SELECT service_name, resource_id FROM logs WHERE service_name != ''
+	) t
+	LEFT JOIN resources r ON r.id = t.resource_id
+	WHERE ` + where + `
+	ORDER BY t.service_name`)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []string
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+
+	return services, rows.Err()
+}
+
+// CleanupOldData drops the partitions that only hold data older than the
+// retention period, then deletes the older records of the partitions that
+// remain
+func (s *PostgresStorage) CleanupOldData() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	cutoffTime := time.Now().AddDate(0, 0, -s.config.RetentionDays)
+	cutoff := cutoffTime.UnixNano()
+
+	// A chunk's samples all precede the end of the day it starts in, as
+	// chunk windows divide days
+	for _, table := range []string{"chunks", "exp_histograms", "traces", "logs"} {
+		if err := s.dropPartitions(table, cutoff); err != nil {
+			return fmt.Errorf("failed to drop old partitions of %s: %w", table, err)
+		}
+	}
+
+	queries := []string{
+		`DELETE FROM chunks WHERE max_time < $1`,
+		`DELETE FROM exp_histograms WHERE timestamp < $1`,
+		`DELETE FROM traces WHERE start_time < $1`,
+		`DELETE FROM logs WHERE timestamp < $1`,
+	}
+
+	for _, query := range queries {
+		if _, err := s.db.Exec(query, cutoff); err != nil {
+			return fmt.Errorf("failed to cleanup old data: %w", err)
+		}
+	}
+
+	// Series without samples within the retention period are dropped along
+	// with their postings
+	s.seriesMu.Lock()
+	err := s.deleteEmptySeries()
+	s.seriesIDs = make(map[string]int64)
+	s.seriesMu.Unlock()
+	s.headMu.Lock()
+	s.heads = make(map[int64]*headChunk)
+	s.headMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to cleanup old series: %w", err)
+	}
+
+	// Resources that have not reported within the retention period are no
+	// longer referenced by any record
+	s.resourceMu.Lock()
+	defer s.resourceMu.Unlock()
+
+	query := `DELETE FROM resources r WHERE created_at < $1
+		AND NOT EXISTS (SELECT 1 FROM series WHERE resource_id = r.id)
+		AND NOT EXISTS (SELECT 1 FROM exp_histograms WHERE resource_id = r.id)
+		AND NOT EXISTS (SELECT 1 FROM traces WHERE resource_id = r.id)
+		AND NOT EXISTS (SELECT 1 FROM logs WHERE resource_id = r.id)`
+	if _, err := s.db.Exec(query, cutoffTime.Unix()); err != nil {
+		return fmt.Errorf("failed to cleanup old resources: %w", err)
+	}
+	s.resourceIDs = make(map[string]int64)
+
+	return nil
+}
+
+// deleteEmptySeries deletes the series that have no chunks, and their
+// postings
+func (s *PostgresStorage) deleteEmptySeries() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	queries := []string{
+		`DELETE FROM postings p WHERE NOT EXISTS (SELECT 1 FROM chunks c WHERE c.series_id = p.series_id)`,
+		`DELETE FROM series sr WHERE NOT EXISTS (SELECT 1 FROM chunks c WHERE c.series_id = sr.id)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDatabasePath returns the empty string, as the database is not a file
+func (s *PostgresStorage) GetDatabasePath() string {
+	return ""
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricNameLabel is the label carrying the metric name of a series
+const MetricNameLabel = "__name__"
+
+// ServiceNameLabel is the label carrying the service a series was reported by
+const ServiceNameLabel = "service_name"
+
+// Labels carrying the identifying attributes of the resource a series was
+// reported by. Data point attributes of the same name take precedence.
+const (
+	ServiceNamespaceLabel      = "service_namespace"
+	ServiceVersionLabel        = "service_version"
+	DeploymentEnvironmentLabel = "deployment_environment"
+	HostNameLabel              = "host_name"
+	ServiceInstanceIDLabel     = "service_instance_id"
+)
+
+// MetricLabels returns the labels of a metric: its data point labels along
+// with its service name and the identity of its resource. Attribute values
+// that are not strings are rendered the way they were ingested: numbers and
+// booleans in their literal form, arrays and maps as JSON. The metric name
+// is not included.
+func MetricLabels(labelsJSON, serviceName string, resource *Resource) map[string]string {
+	labels := decodeLabels(labelsJSON)
+	if serviceName != "" {
+		labels[ServiceNameLabel] = serviceName
+	}
+	if resource == nil {
+		return labels
+	}
+
+	for _, identity := range []struct{ name, value string }{
+		{ServiceNamespaceLabel, resource.ServiceNamespace},
+		{ServiceVersionLabel, resource.ServiceVersion},
+		{DeploymentEnvironmentLabel, resource.DeploymentEnvironment},
+		{HostNameLabel, resource.HostName},
+		{ServiceInstanceIDLabel, resource.ServiceInstanceID},
+	} {
+		if _, exists := labels[identity.name]; !exists && identity.value != "" {
+			labels[identity.name] = identity.value
+		}
+	}
+	return labels
+}
+
+// decodeLabels decodes a labels JSON column into label values
+func decodeLabels(labelsJSON string) map[string]string {
+	labels := make(map[string]string)
+	if labelsJSON == "" {
+		return labels
+	}
+
+	var attrs map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(labelsJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&attrs); err != nil {
+		return labels
+	}
+
+	for k, v := range attrs {
+		switch val := v.(type) {
+		case nil:
+			continue
+		case string:
+			labels[k] = val
+		case json.Number:
+			labels[k] = val.String()
+		case bool:
+			labels[k] = strconv.FormatBool(val)
+		default:
+			encoded, err := json.Marshal(val)
+			if err != nil {
+				continue
+			}
+			labels[k] = string(encoded)
+		}
+		if labels[k] == "" {
+			// An empty label is the same as a missing one
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+// MatchType is the kind of comparison a LabelMatcher makes
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher selects series by the value of one of their labels. A series
+// without the label has the empty string as its value.
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewLabelMatcher creates a label matcher. Regular expressions are fully
+// anchored as in Prometheus.
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether a label value satisfies the matcher
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// matchesAll reports whether a label set satisfies every matcher
+func matchesAll(matchers []*LabelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// histogramFilter selects native histograms by label matchers. Native
+// histograms are not indexed: the __name__ matchers narrow the metrics to
+// read, and each distinct label set is decoded and matched once.
+type histogramFilter struct {
+	matchers []*LabelMatcher
+	sets     map[histogramLabelSet]map[string]string
+}
+
+// histogramLabelSet is the raw form of a native histogram's label set
+type histogramLabelSet struct {
+	metricName  string
+	labels      string
+	serviceName string
+	resourceID  int64
+}
+
+func newHistogramFilter(matchers []*LabelMatcher) *histogramFilter {
+	return &histogramFilter{matchers: matchers, sets: make(map[histogramLabelSet]map[string]string)}
+}
+
+// metricNames returns the names satisfying the matchers on __name__
+func (f *histogramFilter) metricNames(names []string) []string {
+	var result []string
+	for _, name := range names {
+		matches := true
+		for _, m := range f.matchers {
+			if m.Name == MetricNameLabel && !m.Matches(name) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// matches reports whether the label set of a native histogram, including
+// __name__, satisfies every matcher
+func (f *histogramFilter) matches(h *ExponentialHistogram) bool {
+	set := histogramLabelSet{metricName: h.MetricName, labels: h.Labels, serviceName: h.ServiceName}
+	if h.Resource != nil {
+		set.resourceID = h.Resource.ID
+	}
+	labels, ok := f.sets[set]
+	if !ok {
+		labels = MetricLabels(h.Labels, h.ServiceName, h.Resource)
+		labels[MetricNameLabel] = h.MetricName
+		if !matchesAll(f.matchers, labels) {
+			labels = nil
+		}
+		f.sets[set] = labels
+	}
+	return labels != nil
+}
+
+// postingsIndex reads the inverted index of series labels: for every label
+// name and value, the IDs of the series that have it
+type postingsIndex interface {
+	// allSeries returns the IDs of all series, sorted
+	allSeries(ctx context.Context) ([]int64, error)
+	// labelValues returns the values of a label
+	labelValues(ctx context.Context, name string) ([]string, error)
+	// postings returns the IDs of the series whose label has one of the
+	// values, sorted
+	postings(ctx context.Context, name string, values []string) ([]int64, error)
+	// seriesLabelValues returns the values of a label by the ID of the
+	// series among ids that have it
+	seriesLabelValues(ctx context.Context, name string, ids []int64) (map[int64]string, error)
+}
+
+// candidateLimit is the number of candidate series below which the
+// remaining matchers are checked against the labels of each candidate
+// rather than resolved through postings
+const candidateLimit = 1000
+
+// selectSeriesIDs returns the IDs of the series satisfying every matcher,
+// sorted. Matchers that reject series without the label narrow down the
+// series by intersecting the postings of the values they accept. The others
+// remove the postings of the values they reject.
+func selectSeriesIDs(ctx context.Context, index postingsIndex, matchers []*LabelMatcher) ([]int64, error) {
+	// Equality matchers usually select the fewest series and go first;
+	// matchers that only remove series go last
+	sorted := append([]*LabelMatcher(nil), matchers...)
+	rank := func(m *LabelMatcher) int {
+		switch {
+		case m.Matches(""):
+			return 2
+		case m.Type == MatchEqual:
+			return 0
+		}
+		return 1
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+
+	var ids, exclude []int64
+	selected := false // whether ids holds the candidates
+	for _, m := range sorted {
+		if selected && len(ids) <= candidateLimit {
+			values, err := index.seriesLabelValues(ctx, m.Name, ids)
+			if err != nil {
+				return nil, err
+			}
+			var kept []int64
+			for _, id := range ids {
+				if m.Matches(values[id]) {
+					kept = append(kept, id)
+				}
+			}
+			ids = kept
+		} else {
+			matchesEmpty := m.Matches("")
+
+			// Values of the label that the matcher decides on: those it
+			// accepts, or those it rejects if it accepts series without
+			// the label
+			var values []string
+			if (m.Type == MatchEqual && !matchesEmpty) || (m.Type == MatchNotEqual && matchesEmpty) {
+				values = []string{m.Value}
+			} else {
+				all, err := index.labelValues(ctx, m.Name)
+				if err != nil {
+					return nil, err
+				}
+				for _, value := range all {
+					if m.Matches(value) != matchesEmpty {
+						values = append(values, value)
+					}
+				}
+			}
+
+			postings, err := index.postings(ctx, m.Name, values)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case matchesEmpty:
+				exclude = union(exclude, postings)
+				continue
+			case selected:
+				ids = intersect(ids, postings)
+			default:
+				ids, selected = postings, true
+			}
+		}
+
+		if len(ids) == 0 {
+			return nil, nil
+		}
+	}
+
+	if !selected {
+		var err error
+		if ids, err = index.allSeries(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return subtract(ids, exclude), nil
+}
+
+// intersect returns the IDs in both sorted lists
+func intersect(a, b []int64) []int64 {
+	var result []int64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// union returns the IDs in either sorted list
+func union(a, b []int64) []int64 {
+	result := make([]int64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// subtract returns the IDs of the sorted list a that are not in b
+func subtract(a, b []int64) []int64 {
+	if len(b) == 0 {
+		return a
+	}
+	var result []int64
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		result = append(result, id)
+	}
+	return result
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeIndex is a postings index over series held in memory. It counts the
+// lookups made through postings and through the labels of candidates.
+type fakeIndex struct {
+	series map[int64]map[string]string
+
+	postingsCalls     int
+	seriesLabelsCalls int
+}
+
+func (f *fakeIndex) allSeries(ctx context.Context) ([]int64, error) {
+	var ids []int64
+	for id := range f.series {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (f *fakeIndex) labelValues(ctx context.Context, name string) ([]string, error) {
+	seen := make(map[string]bool)
+	var values []string
+	for _, labels := range f.series {
+		if value, ok := labels[name]; ok && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (f *fakeIndex) postings(ctx context.Context, name string, values []string) ([]int64, error) {
+	f.postingsCalls++
+	var ids []int64
+	for id, labels := range f.series {
+		value, ok := labels[name]
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			if v == value {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (f *fakeIndex) seriesLabelValues(ctx context.Context, name string, ids []int64) (map[int64]string, error) {
+	f.seriesLabelsCalls++
+	values := make(map[int64]string)
+	for _, id := range ids {
+		if value, ok := f.series[id][name]; ok {
+			values[id] = value
+		}
+	}
+	return values, nil
+}
+
+// bruteForce returns the IDs of the series satisfying every matcher by
+// checking the labels of each
+func (f *fakeIndex) bruteForce(matchers []*LabelMatcher) []int64 {
+	var ids []int64
+	for id, labels := range f.series {
+		if matchesAll(matchers, labels) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// testMatcher is the type, label name and value of a label matcher
+type testMatcher struct {
+	t           MatchType
+	name, value string
+}
+
+func newMatchers(t *testing.T, specs []testMatcher) []*LabelMatcher {
+	t.Helper()
+	var matchers []*LabelMatcher
+	for _, spec := range specs {
+		m, err := NewLabelMatcher(spec.t, spec.name, spec.value)
+		if err != nil {
+			t.Fatalf("NewLabelMatcher: %v", err)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers
+}
+
+func TestSelectSeriesIDs(t *testing.T) {
+	index := &fakeIndex{series: map[int64]map[string]string{
+		1: {MetricNameLabel: "up", "job": "api", "env": "prod"},
+		2: {MetricNameLabel: "up", "job": "api", "env": "dev"},
+		3: {MetricNameLabel: "up", "job": "db"},
+		4: {MetricNameLabel: "requests", "job": "api", "env": "prod"},
+		5: {MetricNameLabel: "requests", "job": "worker", "env": "staging"},
+	}}
+
+	tests := []struct {
+		name     string
+		matchers []testMatcher
+		want     []int64
+	}{
+		{
+			name:     "equality",
+			matchers: []testMatcher{{MatchEqual, MetricNameLabel, "up"}},
+			want:     []int64{1, 2, 3},
+		},
+		{
+			name:     "intersection",
+			matchers: []testMatcher{{MatchEqual, "job", "api"}, {MatchEqual, MetricNameLabel, "up"}},
+			want:     []int64{1, 2},
+		},
+		{
+			// The postings of every value the regexp accepts are united
+			name:     "union",
+			matchers: []testMatcher{{MatchRegexp, "job", "api|db"}},
+			want:     []int64{1, 2, 3, 4},
+		},
+		{
+			name:     "non-empty regexp",
+			matchers: []testMatcher{{MatchRegexp, "env", ".+"}},
+			want:     []int64{1, 2, 4, 5},
+		},
+		{
+			// Series without the label satisfy a negative matcher
+			name:     "subtraction",
+			matchers: []testMatcher{{MatchNotEqual, "env", "prod"}, {MatchEqual, MetricNameLabel, "up"}},
+			want:     []int64{2, 3},
+		},
+		{
+			name:     "negative equality only",
+			matchers: []testMatcher{{MatchNotEqual, "env", "prod"}},
+			want:     []int64{2, 3, 5},
+		},
+		{
+			name:     "negative regexp only",
+			matchers: []testMatcher{{MatchNotRegexp, "env", "prod|dev"}},
+			want:     []int64{3, 5},
+		},
+		{
+			name:     "several negative matchers",
+			matchers: []testMatcher{{MatchNotEqual, "job", "api"}, {MatchNotRegexp, "env", "staging"}},
+			want:     []int64{3},
+		},
+		{
+			// Matching the empty value selects series without the label
+			name:     "missing label",
+			matchers: []testMatcher{{MatchEqual, "env", ""}},
+			want:     []int64{3},
+		},
+		{
+			name:     "empty-matching regexp",
+			matchers: []testMatcher{{MatchRegexp, "env", "dev|"}},
+			want:     []int64{2, 3},
+		},
+		{
+			name:     "negative matcher rejecting missing labels",
+			matchers: []testMatcher{{MatchNotEqual, "env", ""}, {MatchNotEqual, "job", "api"}},
+			want:     []int64{5},
+		},
+		{
+			name:     "unknown value",
+			matchers: []testMatcher{{MatchEqual, MetricNameLabel, "missing"}},
+			want:     nil,
+		},
+		{
+			name:     "disjoint matchers",
+			matchers: []testMatcher{{MatchEqual, MetricNameLabel, "up"}, {MatchEqual, "job", "worker"}},
+			want:     nil,
+		},
+		{
+			name:     "no matchers",
+			matchers: nil,
+			want:     []int64{1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matchers := newMatchers(t, tt.matchers)
+			got, err := selectSeriesIDs(context.Background(), index, matchers)
+			if err != nil {
+				t.Fatalf("selectSeriesIDs: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectSeriesIDs = %v, want %v", got, tt.want)
+			}
+			if want := index.bruteForce(matchers); !reflect.DeepEqual(got, want) {
+				t.Errorf("selectSeriesIDs = %v, but the series satisfying the matchers are %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSelectSeriesIDsCandidateLimit(t *testing.T) {
+	// Twice the candidate limit of series of metric big, half of them of
+	// job a and a third of them in env x, and more series of job a
+	index := &fakeIndex{series: make(map[int64]map[string]string)}
+	for id := int64(1); id <= 2*candidateLimit; id++ {
+		labels := map[string]string{MetricNameLabel: "big", "job": "b"}
+		if id%2 == 0 {
+			labels["job"] = "a"
+		}
+		if id%3 == 0 {
+			labels["env"] = "x"
+		}
+		index.series[id] = labels
+	}
+	for id := int64(2*candidateLimit + 1); id <= 3*candidateLimit; id++ {
+		index.series[id] = map[string]string{MetricNameLabel: "other", "job": "a"}
+	}
+
+	tests := []struct {
+		name     string
+		matchers []testMatcher
+		// postings and seriesLabels are the number of lookups expected
+		// through postings and through the labels of candidates
+		postings, seriesLabels int
+	}{
+		{
+			// The second matcher leaves exactly candidateLimit candidates,
+			// whose labels the third is checked against
+			name: "below the limit",
+			matchers: []testMatcher{
+				{MatchEqual, MetricNameLabel, "big"},
+				{MatchEqual, "job", "a"},
+				{MatchNotEqual, "env", "x"},
+			},
+			postings:     2,
+			seriesLabels: 1,
+		},
+		{
+			// Candidates above the limit are narrowed down through
+			// postings
+			name: "above the limit",
+			matchers: []testMatcher{
+				{MatchEqual, MetricNameLabel, "big"},
+				{MatchRegexp, "job", "a|b"},
+				{MatchNotEqual, "env", "x"},
+			},
+			postings:     3,
+			seriesLabels: 0,
+		},
+		{
+			name: "regexp below the limit",
+			matchers: []testMatcher{
+				{MatchEqual, "env", "x"},
+				{MatchRegexp, "job", "b|"},
+			},
+			postings:     1,
+			seriesLabels: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index.postingsCalls, index.seriesLabelsCalls = 0, 0
+			matchers := newMatchers(t, tt.matchers)
+			got, err := selectSeriesIDs(context.Background(), index, matchers)
+			if err != nil {
+				t.Fatalf("selectSeriesIDs: %v", err)
+			}
+			if want := index.bruteForce(matchers); !reflect.DeepEqual(got, want) {
+				t.Errorf("selectSeriesIDs returned %d series, want %d", len(got), len(want))
+			}
+			if index.postingsCalls != tt.postings || index.seriesLabelsCalls != tt.seriesLabels {
+				t.Errorf("looked up %d postings and %d candidate labels, want %d and %d",
+					index.postingsCalls, index.seriesLabelsCalls, tt.postings, tt.seriesLabels)
+			}
+		})
+	}
+}
+
+// TestSetOperations checks the operations on sorted ID lists
+func TestSetOperations(t *testing.T) {
+	a, b := []int64{1, 3, 5, 7}, []int64{2, 3, 4, 7, 9}
+	if got, want := intersect(a, b), []int64{3, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("intersect = %v, want %v", got, want)
+	}
+	if got, want := union(a, b), []int64{1, 2, 3, 4, 5, 7, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("union = %v, want %v", got, want)
+	}
+	if got, want := subtract(a, b), []int64{1, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subtract = %v, want %v", got, want)
+	}
+	if got := intersect(a, nil); got != nil {
+		t.Errorf("intersect with nothing = %v, want nil", got)
+	}
+	if got := subtract(a, nil); !reflect.DeepEqual(got, a) {
+		t.Errorf("subtract nothing = %v, want %v", got, a)
+	}
+	if got := union(nil, b); !reflect.DeepEqual(got, b) {
+		t.Errorf("union with nothing = %v, want %v", got, b)
+	}
+	if got, want := union(b, a), []int64{1, 2, 3, 4, 5, 7, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("union = %v, want %v", got, want)
+	}
+	if got, want := subtract(b, []int64{3}), []int64{2, 4, 7, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subtract = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TraceQuery selects spans. Empty fields match any span.
+type TraceQuery struct {
+	TraceID       string
+	ServiceName   string
+	OperationName string
+	Kind          string
+	StatusCode    string
+	// MinDuration and MaxDuration bound the duration of the spans; a zero
+	// MaxDuration leaves it unbounded
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	// Attributes holds the values span attributes must have. Values that
+	// are not strings are compared in their JSON form; empty values are
+	// ignored.
+	Attributes map[string]string
+	Resource   ResourceFilter
+	// Start and End bound the start time of the spans, both inclusive; zero
+	// times leave the range open
+	Start time.Time
+	End   time.Time
+	// Limit caps the number of spans returned; zero means no cap
+	Limit  int
+	Offset int
+}
+
+// LogQuery selects log records. Empty fields match any record.
+type LogQuery struct {
+	ServiceName string
+	// MinSeverity is the lowest severity number of the records
+	MinSeverity int32
+	// Contains is text the message must contain, case-sensitively
+	Contains string
+	TraceID  string
+	SpanID   string
+	// Attributes holds the values log attributes must have, compared as
+	// those of TraceQuery are
+	Attributes map[string]string
+	Resource   ResourceFilter
+	// Start and End bound the timestamps of the records, both inclusive;
+	// zero times leave the range open
+	Start time.Time
+	End   time.Time
+	// Limit caps the number of records returned; zero means no cap
+	Limit  int
+	Offset int
+}
+
+// sqlDialect writes the SQL that differs between databases. Queries and
+// conditions use ? placeholders.
+type sqlDialect struct {
+	// bind rewrites the ? placeholders of a query for the database
+	bind func(query string) string
+	// in returns a condition that a column holds one of at most maxIn
+	// values, and the arguments it binds
+	in func(column string, values []interface{}) (string, []interface{})
+	// maxIn bounds the values of one in condition; zero means no bound
+	maxIn int
+	// attribute returns a condition that a JSON object column has an
+	// attribute, the first argument, with a value, the second
+	attribute func(column string) string
+	// contains returns a condition that a text column contains the argument
+	contains func(column string) string
+}
+
+// searchConditions collects the conditions of a search and their arguments
+type searchConditions struct {
+	dialect    sqlDialect
+	conditions []string
+	args       []interface{}
+}
+
+func (c *searchConditions) add(condition string, args ...interface{}) {
+	c.conditions = append(c.conditions, condition)
+	c.args = append(c.args, args...)
+}
+
+// equal adds a condition that a column has a value, unless value is empty
+func (c *searchConditions) equal(column, value string) {
+	if value != "" {
+		c.add(column+" = ?", value)
+	}
+}
+
+// between adds the conditions that a nanosecond timestamp column is within
+// an optionally open range
+func (c *searchConditions) between(column string, start, end time.Time) {
+	if !start.IsZero() {
+		c.add(column+" >= ?", start.UnixNano())
+	}
+	if !end.IsZero() {
+		c.add(column+" <= ?", end.UnixNano())
+	}
+}
+
+// attributes adds the conditions that a JSON column has attributes with the
+// given values, in a fixed order
+func (c *searchConditions) attributes(column string, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for key, value := range attributes {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.add(c.dialect.attribute(column), key, attributes[key])
+	}
+}
+
+// resource adds the conditions of a resource filter on the resources joined
+// as r
+func (c *searchConditions) resource(filter ResourceFilter) {
+	if filter == (ResourceFilter{}) {
+		return
+	}
+	where, args := filter.where()
+	c.add(where, args...)
+}
+
+func (c *searchConditions) where() (string, []interface{}) {
+	if len(c.conditions) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(c.conditions, " AND "), c.args
+}
+
+// where returns the conditions selecting the spans of the query from traces
+// joined as t with their resources joined as r
+func (q TraceQuery) where(dialect sqlDialect) (string, []interface{}) {
+	c := searchConditions{dialect: dialect}
+	if q.TraceID != "" {
+		c.add("t.trace_id = ?", strings.ToLower(q.TraceID))
+	}
+	c.equal("t.service_name", q.ServiceName)
+	c.equal("t.operation_name", q.OperationName)
+	c.equal("t.kind", q.Kind)
+	c.equal("t.status_code", q.StatusCode)
+	if q.MinDuration > 0 {
+		c.add("t.duration_nanos >= ?", int64(q.MinDuration))
+	}
+	if q.MaxDuration > 0 {
+		c.add("t.duration_nanos <= ?", int64(q.MaxDuration))
+	}
+	c.attributes("t.attributes", q.Attributes)
+	c.resource(q.Resource)
+	c.between("t.start_time", q.Start, q.End)
+	return c.where()
+}
+
+// where returns the conditions selecting the records of the query from logs
+// joined as l with their resources joined as r
+func (q LogQuery) where(dialect sqlDialect) (string, []interface{}) {
+	c := searchConditions{dialect: dialect}
+	c.equal("l.service_name", q.ServiceName)
+	if q.MinSeverity > 0 {
+		c.add("l.severity_number >= ?", q.MinSeverity)
+	}
+	if q.Contains != "" {
+		c.add(dialect.contains("l.message"), q.Contains)
+	}
+	if q.TraceID != "" {
+		c.add("l.trace_id = ?", strings.ToLower(q.TraceID))
+	}
+	if q.SpanID != "" {
+		c.add("l.span_id = ?", strings.ToLower(q.SpanID))
+	}
+	c.attributes("l.attributes", q.Attributes)
+	c.resource(q.Resource)
+	c.between("l.timestamp", q.Start, q.End)
+	return c.where()
+}
+
+// searchLimit returns the LIMIT of a search, negative for none
+func searchLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
@@ -1,21 +1,76 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/histogram"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type SQLiteStorage struct {
-	db     *sql.DB
+	sqlStore
 	config config.StorageConfig
+
+	// writeMu is held for reading by batch inserts and for writing by
+	// retention cleanup, so that cleanup never deletes a series or resource
+	// a batch has looked up or cached
+	writeMu sync.RWMutex
+
+	// resourceIDs caches the IDs of stored resources by their attributes
+	resourceMu  sync.Mutex
+	resourceIDs map[string]int64
+
+	// seriesIDs caches the IDs of stored series by their identity
+	seriesMu  sync.Mutex
+	seriesIDs map[string]int64
+
+	// heads caches the latest chunk written of each series by series ID
+	headMu sync.Mutex
+	heads  map[int64]*headChunk
 }
 
+// Resource is the entity that produced telemetry, such as a service instance.
+// Resources are stored once and referenced by the metrics, spans and logs
+// they produced.
+type Resource struct {
+	ID                    int64     `json:"id"`
+	ServiceName           string    `json:"service_name"`
+	ServiceNamespace      string    `json:"service_namespace"`
+	ServiceVersion        string    `json:"service_version"`
+	DeploymentEnvironment string    `json:"deployment_environment"`
+	HostName              string    `json:"host_name"`
+	ServiceInstanceID     string    `json:"service_instance_id"`
+	Attributes            string    `json:"attributes"` // JSON string
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// ResourceFilter selects resources by their identifying attributes. Empty
+// fields match any value.
+type ResourceFilter struct {
+	ServiceName           string
+	ServiceNamespace      string
+	ServiceVersion        string
+	DeploymentEnvironment string
+	HostName              string
+	ServiceInstanceID     string
+}
+
+// Metric is a float sample of a metric. Metrics read back are taken from
+// their series, and their ID is that of the series.
 type Metric struct {
 	ID          int64     `json:"id"`
 	Timestamp   time.Time `json:"timestamp"`
@@ -23,33 +78,79 @@ type Metric struct {
 	Value       float64   `json:"value"`
 	Labels      string    `json:"labels"` // JSON string
 	ServiceName string    `json:"service_name"`
+	Resource    *Resource `json:"resource,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// Series is a metric time series: the samples of one metric with one set of
+// labels, reported by one resource. Samples are stored in compressed chunks.
+type Series struct {
+	ID          int64     `json:"id"`
+	MetricName  string    `json:"metric_name"`
+	Labels      string    `json:"labels"` // JSON string
+	ServiceName string    `json:"service_name"`
+	Resource    *Resource `json:"resource,omitempty"`
+}
+
+// Sample is the value of a series at a point in time
+type Sample struct {
+	Timestamp int64 // Unix nanoseconds
+	Value     float64
+}
+
+// ExponentialHistogram is a native exponential histogram data point
+type ExponentialHistogram struct {
+	ID          int64                  `json:"id"`
+	Timestamp   time.Time              `json:"timestamp"`
+	MetricName  string                 `json:"metric_name"`
+	Labels      string                 `json:"labels"` // JSON string
+	ServiceName string                 `json:"service_name"`
+	Histogram   *histogram.Exponential `json:"histogram"`
+	Resource    *Resource              `json:"resource,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
 type Trace struct {
 	ID            int64     `json:"id"`
 	TraceID       string    `json:"trace_id"`
 	SpanID        string    `json:"span_id"`
 	ParentSpanID  *string   `json:"parent_span_id"`
+	TraceState    string    `json:"trace_state"`
 	ServiceName   string    `json:"service_name"`
 	OperationName string    `json:"operation_name"`
+	Kind          string    `json:"kind"`
 	StartTime     time.Time `json:"start_time"`
 	DurationNanos int64     `json:"duration_nanos"`
 	Attributes    string    `json:"attributes"` // JSON string
+	Events        string    `json:"events"`     // JSON string
+	Links         string    `json:"links"`      // JSON string
 	StatusCode    string    `json:"status_code"`
+	StatusMessage string    `json:"status_message"`
+	ScopeName     string    `json:"scope_name"`
+	ScopeVersion  string    `json:"scope_version"`
+	Resource      *Resource `json:"resource,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
 type Log struct {
-	ID          int64     `json:"id"`
-	Timestamp   time.Time `json:"timestamp"`
-	ServiceName string    `json:"service_name"`
-	Level       string    `json:"level"`
-	Message     string    `json:"message"`
-	Attributes  string    `json:"attributes"` // JSON string
-	TraceID     *string   `json:"trace_id"`
-	SpanID      *string   `json:"span_id"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                int64     `json:"id"`
+	Timestamp         time.Time `json:"timestamp"`
+	ObservedTimestamp time.Time `json:"observed_timestamp"`
+	ServiceName       string    `json:"service_name"`
+	Level             string    `json:"level"`
+	SeverityNumber    int32     `json:"severity_number"`
+	EventName         string    `json:"event_name"`
+	Message           string    `json:"message"`
+	Body              string    `json:"body"`       // JSON string
+	Attributes        string    `json:"attributes"` // JSON string
+	TraceID           *string   `json:"trace_id"`
+	SpanID            *string   `json:"span_id"`
+	Flags             uint32    `json:"flags"`
+	ScopeName         string    `json:"scope_name"`
+	ScopeVersion      string    `json:"scope_version"`
+	ScopeAttributes   string    `json:"scope_attributes"` // JSON string
+	Resource          *Resource `json:"resource,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
 }
 
 func NewSQLiteStorage(cfg config.StorageConfig) (*SQLiteStorage, error) {
@@ -58,14 +159,22 @@ func NewSQLiteStorage(cfg config.StorageConfig) (*SQLiteStorage, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite", cfg.Path+"?_journal_mode=WAL&_synchronous=NORMAL&_cache_size=1000")
+	// The driver applies _pragma parameters to every connection it opens.
+	// Transactions take the write lock when they begin, waiting up to five
+	// seconds for other writers, since a transaction that has read cannot
+	// wait for the lock once another has written.
+	db, err := sql.Open("sqlite", cfg.Path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"+
+		"&_pragma=synchronous(NORMAL)&_pragma=cache_size(1000)&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	storage := &SQLiteStorage{
-		db:     db,
-		config: cfg,
+		sqlStore:    sqlStore{db: db, dialect: sqliteDialect},
+		config:      cfg,
+		resourceIDs: make(map[string]int64),
+		seriesIDs:   make(map[string]int64),
+		heads:       make(map[int64]*headChunk),
 	}
 
 	// Create tables
@@ -74,6 +183,11 @@ func NewSQLiteStorage(cfg config.StorageConfig) (*SQLiteStorage, error) {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := storage.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return storage, nil
 }
 
@@ -81,7 +195,17 @@ func (s *SQLiteStorage) Close() error {
 	return s.db.Close()
 }
 
+// createTables creates the original schema in new databases and in those
+// that predate migrations. The migrations bring it up to date.
 func (s *SQLiteStorage) createTables() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > 0 {
+		return nil
+	}
+
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS metrics (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -92,6 +216,15 @@ func (s *SQLiteStorage) createTables() error {
 			service_name TEXT,
 			created_at INTEGER DEFAULT (strftime('%s', 'now'))
 		)`,
+		`CREATE TABLE IF NOT EXISTS exp_histograms (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INTEGER NOT NULL,
+			metric_name TEXT NOT NULL,
+			labels TEXT,
+			service_name TEXT,
+			histogram TEXT NOT NULL,
+			created_at INTEGER DEFAULT (strftime('%s', 'now'))
+		)`,
 		`CREATE TABLE IF NOT EXISTS traces (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			trace_id TEXT NOT NULL,
@@ -120,12 +253,15 @@ func (s *SQLiteStorage) createTables() error {
 		`CREATE INDEX IF NOT EXISTS idx_metrics_timestamp ON metrics(timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_metrics_service ON metrics(service_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics(metric_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_exp_histograms_timestamp ON exp_histograms(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_exp_histograms_name ON exp_histograms(metric_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_traces_trace_id ON traces(trace_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_traces_service ON traces(service_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_traces_start_time ON traces(start_time)`,
 		`CREATE INDEX IF NOT EXISTS idx_logs_timestamp ON logs(timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_logs_service ON logs(service_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level)`,
+		`CREATE INDEX IF NOT EXISTS idx_logs_trace_id ON logs(trace_id)`,
 	}
 
 	for _, query := range queries {
@@ -137,6 +273,411 @@ func (s *SQLiteStorage) createTables() error {
 	return nil
 }
 
+// migrations rewrite data stored by earlier versions. Each runs once; the
+// number applied is recorded in the database's user_version.
+var migrations = []func(tx *sql.Tx) error{
+	canonicalizeIDs,
+	addSpanDetails,
+	addLogDetails,
+	addResources,
+	addSeries,
+	addPostings,
+	addLogScopeAttributes,
+}
+
+// canonicalizeIDs rewrites trace and span IDs as lowercase hex. Earlier
+// versions stored the raw bytes of IDs received over gRPC and the IDs of
+// OTLP/JSON requests as sent, possibly in uppercase.
+func canonicalizeIDs(tx *sql.Tx) error {
+	columns := []struct {
+		table, column string
+		size          int // bytes in an ID
+	}{
+		{"traces", "trace_id", 16},
+		{"traces", "span_id", 8},
+		{"traces", "parent_span_id", 8},
+		{"logs", "trace_id", 16},
+		{"logs", "span_id", 8},
+	}
+
+	for _, c := range columns {
+		rows, err := tx.Query(fmt.Sprintf(`SELECT id, %s FROM %s WHERE %s IS NOT NULL AND %s != ''`, c.column, c.table, c.column, c.column))
+		if err != nil {
+			return err
+		}
+
+		updates := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			if canonical := canonicalID(value, c.size); canonical != value {
+				updates[id] = canonical
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, value := range updates {
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, c.table, c.column), value, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addSpanDetails adds the parts of the span model that earlier versions
+// dropped
+func addSpanDetails(tx *sql.Tx) error {
+	queries := []string{
+		`ALTER TABLE traces ADD COLUMN trace_state TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE traces ADD COLUMN kind TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE traces ADD COLUMN events TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE traces ADD COLUMN links TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE traces ADD COLUMN status_message TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE traces ADD COLUMN scope_name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE traces ADD COLUMN scope_version TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE traces ADD COLUMN resource_attributes TEXT NOT NULL DEFAULT '{}'`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLogDetails adds the parts of the log record model that earlier versions
+// dropped. The body of existing records is their message as a JSON string,
+// and their severity number is derived from their level.
+func addLogDetails(tx *sql.Tx) error {
+	queries := []string{
+		`ALTER TABLE logs ADD COLUMN observed_timestamp INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE logs ADD COLUMN severity_number INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE logs ADD COLUMN event_name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE logs ADD COLUMN body TEXT NOT NULL DEFAULT 'null'`,
+		`ALTER TABLE logs ADD COLUMN flags INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE logs ADD COLUMN scope_name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE logs ADD COLUMN scope_version TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE logs ADD COLUMN resource_attributes TEXT NOT NULL DEFAULT '{}'`,
+		`UPDATE logs SET body = json_quote(message) WHERE message IS NOT NULL`,
+		`UPDATE logs SET severity_number = CASE upper(level)
+			WHEN 'TRACE' THEN 1 WHEN 'DEBUG' THEN 5 WHEN 'INFO' THEN 9
+			WHEN 'WARN' THEN 13 WHEN 'WARNING' THEN 13
+			WHEN 'ERROR' THEN 17 WHEN 'FATAL' THEN 21 WHEN 'CRITICAL' THEN 21
+			ELSE 0 END`,
+		`CREATE INDEX IF NOT EXISTS idx_logs_severity_number ON logs(severity_number)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceResource is the SQL expression for the attributes of the resource
+// of records stored before resources were, which only kept the service name
+const serviceResource = `CASE WHEN service_name IS NULL OR service_name IN ('', 'unknown') THEN '{}'
+	ELSE json_object('service.name', service_name) END`
+
+// addResources moves resource attributes into a table of their own, which
+// records reference by ID. Existing records reference the resource their
+// attributes describe, or else the one their service name describes.
+func addResources(tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE resources (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			attributes TEXT NOT NULL UNIQUE,
+			service_name TEXT NOT NULL DEFAULT '',
+			service_namespace TEXT NOT NULL DEFAULT '',
+			service_version TEXT NOT NULL DEFAULT '',
+			deployment_environment TEXT NOT NULL DEFAULT '',
+			host_name TEXT NOT NULL DEFAULT '',
+			service_instance_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER DEFAULT (strftime('%s', 'now'))
+		)`,
+		`ALTER TABLE metrics ADD COLUMN resource_id INTEGER REFERENCES resources(id)`,
+		`ALTER TABLE exp_histograms ADD COLUMN resource_id INTEGER REFERENCES resources(id)`,
+		`ALTER TABLE traces ADD COLUMN resource_id INTEGER REFERENCES resources(id)`,
+		`ALTER TABLE logs ADD COLUMN resource_id INTEGER REFERENCES resources(id)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	storedResource := `CASE WHEN resource_attributes = '{}' THEN ` + serviceResource + ` ELSE resource_attributes END`
+	sources := []struct{ table, attributes string }{
+		{"metrics", serviceResource},
+		{"exp_histograms", serviceResource},
+		{"traces", storedResource},
+		{"logs", storedResource},
+	}
+
+	for _, source := range sources {
+		rows, err := tx.Query(fmt.Sprintf(`SELECT DISTINCT %s FROM %s`, source.attributes, source.table))
+		if err != nil {
+			return err
+		}
+
+		var stored []string
+		for rows.Next() {
+			var attributes string
+			if err := rows.Scan(&attributes); err != nil {
+				rows.Close()
+				return err
+			}
+			stored = append(stored, attributes)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, attributes := range stored {
+			decoder := json.NewDecoder(strings.NewReader(attributes))
+			decoder.UseNumber()
+			var attrs map[string]interface{}
+			if err := decoder.Decode(&attrs); err != nil {
+				return fmt.Errorf("invalid resource attributes %q in %s: %w", attributes, source.table, err)
+			}
+
+			id, err := insertResource(tx, NewResource(attrs))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET resource_id = ? WHERE %s = ?`, source.table, source.attributes), id, attributes); err != nil {
+				return err
+			}
+		}
+	}
+
+	queries = []string{
+		`ALTER TABLE traces DROP COLUMN resource_attributes`,
+		`ALTER TABLE logs DROP COLUMN resource_attributes`,
+		`CREATE INDEX IF NOT EXISTS idx_metrics_resource ON metrics(resource_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_exp_histograms_resource ON exp_histograms(resource_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_traces_resource ON traces(resource_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_logs_resource ON logs(resource_id)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSeries replaces the metrics table, which repeated the name, labels and
+// service of a metric in every sample, with a table of series and one of
+// compressed chunks of their samples
+func addSeries(tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE series (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			fingerprint INTEGER NOT NULL,
+			metric_name TEXT NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			service_name TEXT NOT NULL DEFAULT '',
+			resource_id INTEGER REFERENCES resources(id),
+			created_at INTEGER DEFAULT (strftime('%s', 'now'))
+		)`,
+		`CREATE TABLE chunks (
+			series_id INTEGER NOT NULL REFERENCES series(id),
+			start_time INTEGER NOT NULL,
+			min_time INTEGER NOT NULL,
+			max_time INTEGER NOT NULL,
+			samples INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			PRIMARY KEY (series_id, start_time)
+		) WITHOUT ROWID`,
+		`CREATE INDEX idx_series_fingerprint ON series(fingerprint)`,
+		`CREATE INDEX idx_series_name ON series(metric_name)`,
+		`CREATE INDEX idx_series_resource ON series(resource_id)`,
+		`CREATE INDEX idx_chunks_max_time ON chunks(max_time)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT metric_name, COALESCE(labels, '{}'), COALESCE(service_name, ''), resource_id
+		FROM metrics`)
+	if err != nil {
+		return err
+	}
+	var series []*Series
+	var resourceIDs []*int64
+	for rows.Next() {
+		var sr Series
+		var resourceID sql.NullInt64
+		if err := rows.Scan(&sr.MetricName, &sr.Labels, &sr.ServiceName, &resourceID); err != nil {
+			rows.Close()
+			return err
+		}
+		series = append(series, &sr)
+		if resourceID.Valid {
+			resourceIDs = append(resourceIDs, &resourceID.Int64)
+		} else {
+			resourceIDs = append(resourceIDs, nil)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, sr := range series {
+		id, _, err := insertSeries(tx, sr.MetricName, sr.Labels, sr.ServiceName, resourceIDs[i])
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT timestamp, value FROM metrics
+			WHERE metric_name = ? AND COALESCE(labels, '{}') = ? AND COALESCE(service_name, '') = ? AND resource_id IS ?
+			ORDER BY timestamp`, sr.MetricName, sr.Labels, sr.ServiceName, resourceIDs[i])
+		if err != nil {
+			return err
+		}
+		windows := make(map[int64][]Sample)
+		var starts []int64
+		for rows.Next() {
+			var sample Sample
+			if err := rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+				rows.Close()
+				return err
+			}
+			start := chunkStart(sample.Timestamp)
+			if _, ok := windows[start]; !ok {
+				starts = append(starts, start)
+			}
+			windows[start] = append(windows[start], sample)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, start := range starts {
+			if err := writeChunk(tx, id, start, newChunkAppender(windows[start])); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`DROP TABLE metrics`)
+	return err
+}
+
+// addPostings adds the inverted index of series labels and indexes the
+// series stored so far
+func addPostings(tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE postings (
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			series_id INTEGER NOT NULL REFERENCES series(id),
+			PRIMARY KEY (name, value, series_id)
+		) WITHOUT ROWID`,
+		`CREATE INDEX idx_postings_series ON postings(series_id, name)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT sr.id, sr.metric_name, sr.labels, sr.service_name, ` + resourceColumns + `
+		FROM series sr
+		LEFT JOIN resources r ON r.id = sr.resource_id`)
+	if err != nil {
+		return err
+	}
+	var series []*Series
+	for rows.Next() {
+		var sr Series
+		var resource resourceScanner
+		if err := rows.Scan(append([]interface{}{&sr.ID, &sr.MetricName, &sr.Labels, &sr.ServiceName},
+			resource.targets()...)...); err != nil {
+			rows.Close()
+			return err
+		}
+		sr.Resource = resource.result()
+		series = append(series, &sr)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sr := range series {
+		if err := indexSeries(tx, sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLogScopeAttributes adds the attributes of the instrumentation scope of
+// log records, which earlier versions dropped
+func addLogScopeAttributes(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE logs ADD COLUMN scope_attributes TEXT NOT NULL DEFAULT '{}'`)
+	return err
+}
+
+// canonicalID returns the lowercase hex form of an ID of size bytes, stored
+// either as hex or as raw bytes. A value of size bytes is raw even if its
+// bytes all happen to be hex digits.
+func canonicalID(id string, size int) string {
+	if len(id) != size {
+		if _, err := hex.DecodeString(id); err == nil {
+			return strings.ToLower(id)
+		}
+	}
+	return hex.EncodeToString([]byte(id))
+}
+
+// migrate applies the migrations the database has not seen yet, each in its
+// own transaction
+func (s *SQLiteStorage) migrate() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+	}
+
+	return nil
+}
+
 func createDataDir(path string) error {
 	// Extract directory from path
 	dir := ""
@@ -154,79 +695,713 @@ func createDataDir(path string) error {
 	return os.MkdirAll(dir, 0755)
 }
 
-// Metric methods
-func (s *SQLiteStorage) InsertMetric(metric *Metric) error {
-	query := `INSERT INTO metrics (timestamp, metric_name, value, labels, service_name) 
-			  VALUES (?, ?, ?, ?, ?)`
-
-	_, err := s.db.Exec(query,
-		metric.Timestamp.UnixNano(),
-		metric.MetricName,
-		metric.Value,
-		metric.Labels,
-		metric.ServiceName,
+// Resource methods
+
+// NewResource builds the resource described by a set of resource attributes,
+// picking out the attributes that identify it
+func NewResource(attributes map[string]interface{}) *Resource {
+	r := &Resource{Attributes: "{}"}
+	if len(attributes) > 0 {
+		// Map keys are encoded in sorted order, so equal attribute sets
+		// always encode the same
+		if data, err := json.Marshal(attributes); err == nil {
+			r.Attributes = string(data)
+		}
+	}
+
+	r.ServiceName = stringAttribute(attributes, "service.name")
+	r.ServiceNamespace = stringAttribute(attributes, "service.namespace")
+	r.ServiceVersion = stringAttribute(attributes, "service.version")
+	r.DeploymentEnvironment = stringAttribute(attributes, "deployment.environment.name")
+	if r.DeploymentEnvironment == "" {
+		r.DeploymentEnvironment = stringAttribute(attributes, "deployment.environment")
+	}
+	r.HostName = stringAttribute(attributes, "host.name")
+	r.ServiceInstanceID = stringAttribute(attributes, "service.instance.id")
+	return r
+}
+
+// stringAttribute returns an attribute if it is a string
+func stringAttribute(attributes map[string]interface{}, key string) string {
+	value, _ := attributes[key].(string)
+	return value
+}
+
+// execQuerier is implemented by both *sql.DB and *sql.Tx
+type execQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertResource stores a resource unless one with the same attributes
+// exists, and returns its ID
+func insertResource(db execQuerier, r *Resource) (int64, error) {
+	query := `INSERT INTO resources (attributes, service_name, service_namespace, service_version,
+			  deployment_environment, host_name, service_instance_id)
+			  VALUES (?, ?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(attributes) DO NOTHING`
+
+	_, err := db.Exec(query,
+		r.Attributes,
+		r.ServiceName,
+		r.ServiceNamespace,
+		r.ServiceVersion,
+		r.DeploymentEnvironment,
+		r.HostName,
+		r.ServiceInstanceID,
 	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store resource: %w", err)
+	}
+
+	var id int64
+	if err := db.QueryRow(`SELECT id FROM resources WHERE attributes = ?`, r.Attributes).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to look up resource: %w", err)
+	}
+	return id, nil
+}
+
+// seriesIdentity identifies a series by its metric name, labels, service
+// and resource
+func seriesIdentity(metricName, labels, serviceName string, resourceID *int64) string {
+	resource := ""
+	if resourceID != nil {
+		resource = strconv.FormatInt(*resourceID, 10)
+	}
+	return strings.Join([]string{metricName, labels, serviceName, resource}, "\xff")
+}
+
+// seriesFingerprint hashes the identity of a series
+func seriesFingerprint(metricName, labels, serviceName string, resourceID *int64) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(seriesIdentity(metricName, labels, serviceName, resourceID)))
+	return int64(h.Sum64())
+}
+
+// insertSeries stores a series unless it exists, and returns its ID and
+// whether it is new. Series are looked up by the fingerprint of their
+// identity.
+func insertSeries(db execQuerier, metricName, labels, serviceName string, resourceID *int64) (int64, bool, error) {
+	fingerprint := seriesFingerprint(metricName, labels, serviceName, resourceID)
+
+	// Without the index hint SQLite may pick the resource index, which
+	// every series of a resource shares
+	var id int64
+	err := db.QueryRow(`SELECT id FROM series INDEXED BY idx_series_fingerprint
+		WHERE fingerprint = ? AND metric_name = ? AND labels = ? AND service_name = ? AND resource_id IS ?`,
+		fingerprint, metricName, labels, serviceName, resourceID).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("failed to look up series: %w", err)
+	}
+
+	result, err := db.Exec(`INSERT INTO series (fingerprint, metric_name, labels, service_name, resource_id)
+		VALUES (?, ?, ?, ?, ?)`, fingerprint, metricName, labels, serviceName, resourceID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to store series: %w", err)
+	}
+	id, err = result.LastInsertId()
+	return id, true, err
+}
+
+// indexSeries adds a series to the postings of its labels and of its metric
+// name
+func indexSeries(db execQuerier, sr *Series) error {
+	labels := MetricLabels(sr.Labels, sr.ServiceName, sr.Resource)
+	labels[MetricNameLabel] = sr.MetricName
+	for name, value := range labels {
+		_, err := db.Exec(`INSERT INTO postings (name, value, series_id) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING`, name, value, sr.ID)
+		if err != nil {
+			return fmt.Errorf("failed to index series: %w", err)
+		}
+	}
+	return nil
+}
+
+// appendSamples adds samples to the chunk of a series starting at start.
+// Stored samples with the timestamp of a new one are replaced. head is the
+// appender of the chunk as last written, or nil if unknown; samples later
+// than those it holds are appended to the encoded chunk rather than merged
+// with the decoded one. It returns the appender of the chunk as written.
+func appendSamples(db execQuerier, seriesID, start int64, samples []Sample, head *chunkAppender) (*chunkAppender, error) {
+	samples = mergeSamples(samples)
+
+	if head != nil {
+		// The chunk must not have changed since head was written
+		var count int
+		var maxTime int64
+		err := db.QueryRow(`SELECT samples, max_time FROM chunks WHERE series_id = ? AND start_time = ?`,
+			seriesID, start).Scan(&count, &maxTime)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		if err == nil && head.appendable(count, maxTime, samples) {
+			a := head.clone()
+			for _, sample := range samples {
+				a.append(sample)
+			}
+			_, err := db.Exec(`UPDATE chunks SET max_time = ?, samples = ?, data = ? WHERE series_id = ? AND start_time = ?`,
+				a.prevTimestamp, a.count, a.bytes(), seriesID, start)
+			if err != nil {
+				return nil, fmt.Errorf("failed to store chunk: %w", err)
+			}
+			return a, nil
+		}
+	}
+
+	var data []byte
+	err := db.QueryRow(`SELECT data FROM chunks WHERE series_id = ? AND start_time = ?`, seriesID, start).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if err == nil {
+		existing, err := decodeChunk(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		samples = mergeSamples(append(existing, samples...))
+	}
+
+	a := newChunkAppender(samples)
+	if err := writeChunk(db, seriesID, start, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// writeChunk stores the chunk of a series starting at start, replacing the
+// one stored before
+func writeChunk(db execQuerier, seriesID, start int64, a *chunkAppender) error {
+	_, err := db.Exec(`INSERT INTO chunks (series_id, start_time, min_time, max_time, samples, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(series_id, start_time) DO UPDATE SET
+		min_time = excluded.min_time, max_time = excluded.max_time, samples = excluded.samples, data = excluded.data`,
+		seriesID, start, a.minTime, a.prevTimestamp, a.count, a.bytes())
+	if err != nil {
+		return fmt.Errorf("failed to store chunk: %w", err)
+	}
+	return nil
+}
+
+// batchTx is the transaction of a batch insert. IDs of the resources and
+// series it stores, and the chunks it writes, are cached once it commits.
+type batchTx struct {
+	storage     *SQLiteStorage
+	tx          *sql.Tx
+	resourceIDs map[string]int64
+	seriesIDs   map[string]int64
+	heads       map[int64]*headChunk
+}
+
+// beginBatch starts the transaction of a batch insert
+func (s *SQLiteStorage) beginBatch() (*batchTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", unavailable(err))
+	}
+	return &batchTx{
+		storage:     s,
+		tx:          tx,
+		resourceIDs: make(map[string]int64),
+		seriesIDs:   make(map[string]int64),
+		heads:       make(map[int64]*headChunk),
+	}, nil
+}
+
+// resourceID returns the ID of a record's resource, storing the resource if
+// it is new. Records without a resource have a NULL resource ID.
+func (b *batchTx) resourceID(r *Resource) (*int64, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	b.storage.resourceMu.Lock()
+	id, ok := b.storage.resourceIDs[r.Attributes]
+	b.storage.resourceMu.Unlock()
+	if !ok {
+		if id, ok = b.resourceIDs[r.Attributes]; !ok {
+			var err error
+			if id, err = insertResource(b.tx, r); err != nil {
+				return nil, err
+			}
+			b.resourceIDs[r.Attributes] = id
+		}
+	}
+	return &id, nil
+}
+
+// seriesID returns the ID of the series of a metric, storing and indexing
+// the series if it is new
+func (b *batchTx) seriesID(m *Metric) (int64, error) {
+	resourceID, err := b.resourceID(m.Resource)
+	if err != nil {
+		return 0, err
+	}
+	labels := jsonOrDefault(m.Labels, "{}")
+	identity := seriesIdentity(m.MetricName, labels, m.ServiceName, resourceID)
+
+	b.storage.seriesMu.Lock()
+	id, ok := b.storage.seriesIDs[identity]
+	b.storage.seriesMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if id, ok = b.seriesIDs[identity]; ok {
+		return id, nil
+	}
+
+	id, created, err := insertSeries(b.tx, m.MetricName, labels, m.ServiceName, resourceID)
+	if err != nil {
+		return 0, err
+	}
+	if created {
+		sr := &Series{ID: id, MetricName: m.MetricName, Labels: labels, ServiceName: m.ServiceName, Resource: m.Resource}
+		if err := indexSeries(b.tx, sr); err != nil {
+			return 0, err
+		}
+	}
+	b.seriesIDs[identity] = id
+	return id, nil
+}
+
+// head returns the appender of the chunk of a series starting at start as
+// last written, or nil if it is not cached
+func (b *batchTx) head(seriesID, start int64) *chunkAppender {
+	head, ok := b.heads[seriesID]
+	if !ok {
+		b.storage.headMu.Lock()
+		head, ok = b.storage.heads[seriesID]
+		b.storage.headMu.Unlock()
+	}
+	if !ok || head.start != start {
+		return nil
+	}
+	return head.appender
+}
+
+// finish commits a batch of n records unless all of them failed, and
+// reports the failed ones in a *BatchError
+func (b *batchTx) finish(failed map[int]error, n int) error {
+	if len(failed) == n {
+		b.tx.Rollback()
+		return &BatchError{Errors: failed}
+	}
+	if err := b.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", unavailable(err))
+	}
+
+	b.storage.resourceMu.Lock()
+	for attributes, id := range b.resourceIDs {
+		b.storage.resourceIDs[attributes] = id
+	}
+	b.storage.resourceMu.Unlock()
+
+	b.storage.seriesMu.Lock()
+	for identity, id := range b.seriesIDs {
+		b.storage.seriesIDs[identity] = id
+	}
+	b.storage.seriesMu.Unlock()
+
+	b.storage.headMu.Lock()
+	for id, head := range b.heads {
+		b.storage.heads[id] = head
+	}
+	b.storage.headMu.Unlock()
+
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// insertBatch inserts n records in one transaction using a prepared
+// statement. args returns the statement arguments for the record at index
+// i. Records that fail do not prevent the others from being stored; they
+// are reported in a *BatchError.
+func (s *SQLiteStorage) insertBatch(query string, n int, args func(b *batchTx, i int) ([]interface{}, error)) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	b, err := s.beginBatch()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := b.tx.Prepare(query)
+	if err != nil {
+		b.tx.Rollback()
+		return fmt.Errorf("failed to prepare statement: %w", unavailable(err))
+	}
+	defer stmt.Close()
+
+	failed := make(map[int]error)
+	for i := 0; i < n; i++ {
+		values, err := args(b, i)
+		if err == nil {
+			_, err = stmt.Exec(values...)
+		}
+		if err != nil {
+			// The rest of the batch would fail the same way
+			if err = unavailable(err); errors.Is(err, ErrUnavailable) {
+				b.tx.Rollback()
+				return err
+			}
+			failed[i] = err
+		}
+	}
+
+	return b.finish(failed, n)
+}
+
+// unavailable wraps errors meaning that the database cannot be written at
+// the moment, rather than that a record is invalid, in ErrUnavailable
+func unavailable(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_NOMEM, sqlite3.SQLITE_READONLY,
+			sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL, sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_PROTOCOL:
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
 	return err
 }
 
-func (s *SQLiteStorage) GetMetrics(limit int, offset int) ([]*Metric, error) {
-	query := `SELECT id, timestamp, metric_name, value, labels, service_name, created_at 
-			  FROM metrics 
-			  ORDER BY timestamp DESC 
-			  LIMIT ? OFFSET ?`
+// firstError unwraps the error of a single record batch insert
+func firstError(err error) error {
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Errors[0]
+	}
+	return err
+}
+
+// resourceColumns selects the resource a record references, joined as r.
+// Columns of records without one scan as zero values.
+const resourceColumns = `COALESCE(r.id, 0), COALESCE(r.service_name, ''), COALESCE(r.service_namespace, ''),
+			  COALESCE(r.service_version, ''), COALESCE(r.deployment_environment, ''), COALESCE(r.host_name, ''),
+			  COALESCE(r.service_instance_id, ''), COALESCE(r.attributes, '{}'), COALESCE(r.created_at, 0)`
+
+// resourceScanner scans resourceColumns
+type resourceScanner struct {
+	resource  Resource
+	createdAt int64
+}
+
+func (rs *resourceScanner) targets() []interface{} {
+	r := &rs.resource
+	return []interface{}{&r.ID, &r.ServiceName, &r.ServiceNamespace, &r.ServiceVersion,
+		&r.DeploymentEnvironment, &r.HostName, &r.ServiceInstanceID, &r.Attributes, &rs.createdAt}
+}
+
+// result returns the scanned resource, or nil if the record has none
+func (rs *resourceScanner) result() *Resource {
+	if rs.resource.ID == 0 {
+		return nil
+	}
+	r := rs.resource
+	r.CreatedAt = time.Unix(rs.createdAt, 0)
+	return &r
+}
+
+// where returns the SQL condition matching the filter against the resources
+// joined as r, and its arguments
+func (f ResourceFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	for _, field := range []struct{ column, value string }{
+		{"r.service_name", f.ServiceName},
+		{"r.service_namespace", f.ServiceNamespace},
+		{"r.service_version", f.ServiceVersion},
+		{"r.deployment_environment", f.DeploymentEnvironment},
+		{"r.host_name", f.HostName},
+		{"r.service_instance_id", f.ServiceInstanceID},
+	} {
+		if field.value != "" {
+			conditions = append(conditions, field.column+" = ?")
+			args = append(args, field.value)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// GetResources returns the stored resources matching the filter
+func (s *SQLiteStorage) GetResources(filter ResourceFilter) ([]*Resource, error) {
+	where, args := filter.where()
+	query := `SELECT ` + resourceColumns + `
+			  FROM resources r
+			  WHERE ` + where + `
+			  ORDER BY r.service_namespace, r.service_name, r.deployment_environment, r.service_instance_id, r.id`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resources []*Resource
+	for rows.Next() {
+		var rs resourceScanner
+		if err := rows.Scan(rs.targets()...); err != nil {
+			return nil, err
+		}
+		resources = append(resources, rs.result())
+	}
+
+	return resources, rows.Err()
+}
+
+// Metric methods
+func (s *SQLiteStorage) InsertMetric(metric *Metric) error {
+	return firstError(s.InsertMetrics([]*Metric{metric}))
+}
+
+// InsertMetrics adds metrics to the chunks of their series in one
+// transaction
+func (s *SQLiteStorage) InsertMetrics(metrics []*Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	b, err := s.beginBatch()
+	if err != nil {
+		return err
+	}
+
+	// Indexes of the metrics added to each chunk
+	type chunkKey struct{ seriesID, start int64 }
+	chunks := make(map[chunkKey][]int)
+	var order []chunkKey
+
+	failed := make(map[int]error)
+	for i, metric := range metrics {
+		id, err := b.seriesID(metric)
+		if err != nil {
+			if err = unavailable(err); errors.Is(err, ErrUnavailable) {
+				b.tx.Rollback()
+				return err
+			}
+			failed[i] = err
+			continue
+		}
+
+		key := chunkKey{id, chunkStart(metric.Timestamp.UnixNano())}
+		if _, ok := chunks[key]; !ok {
+			order = append(order, key)
+		}
+		chunks[key] = append(chunks[key], i)
+	}
+
+	for _, key := range order {
+		samples := make([]Sample, len(chunks[key]))
+		for j, i := range chunks[key] {
+			samples[j] = Sample{Timestamp: metrics[i].Timestamp.UnixNano(), Value: metrics[i].Value}
+		}
+
+		head, err := appendSamples(b.tx, key.seriesID, key.start, samples, b.head(key.seriesID, key.start))
+		if err != nil {
+			if err = unavailable(err); errors.Is(err, ErrUnavailable) {
+				b.tx.Rollback()
+				return err
+			}
+			for _, i := range chunks[key] {
+				failed[i] = err
+			}
+			continue
+		}
+		b.heads[key.seriesID] = &headChunk{start: key.start, appender: head}
+	}
+
+	return b.finish(failed, len(metrics))
+}
+
+// InsertExponentialHistogram stores a native exponential histogram data point
+func (s *SQLiteStorage) InsertExponentialHistogram(h *ExponentialHistogram) error {
+	return firstError(s.InsertExponentialHistograms([]*ExponentialHistogram{h}))
+}
+
+// InsertExponentialHistograms stores native exponential histogram data
+// points in one transaction
+func (s *SQLiteStorage) InsertExponentialHistograms(histograms []*ExponentialHistogram) error {
+	query := `INSERT INTO exp_histograms (timestamp, metric_name, labels, service_name, histogram, resource_id)
+			  VALUES (?, ?, ?, ?, ?, ?)`
+
+	return s.insertBatch(query, len(histograms), func(b *batchTx, i int) ([]interface{}, error) {
+		h := histograms[i]
+		data, err := json.Marshal(h.Histogram)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode histogram: %w", err)
+		}
+
+		resourceID, err := b.resourceID(h.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			h.Timestamp.UnixNano(),
+			h.MetricName,
+			h.Labels,
+			h.ServiceName,
+			string(data),
+			resourceID,
+		}, nil
+	})
+}
 
-	rows, err := s.db.Query(query, limit, offset)
+// maxQueryArgs bounds the number of series IDs or label values bound as
+// arguments of one query
+const maxQueryArgs = 500
+
+// GetExponentialHistograms returns the native histogram data points between
+// start and end whose label sets, including __name__, satisfy every matcher,
+// sorted by timestamp
+func (s *SQLiteStorage) GetExponentialHistograms(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*ExponentialHistogram, error) {
+	filter := newHistogramFilter(matchers)
+	stored, err := s.queryStrings(ctx, `SELECT DISTINCT metric_name FROM exp_histograms`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read histogram metric names: %w", err)
+	}
+	names := filter.metricNames(stored)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{start.UnixNano(), end.UnixNano()}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT h.id, h.timestamp, h.metric_name, COALESCE(h.labels, '{}'), COALESCE(h.service_name, ''),
+			  h.histogram, h.created_at, `+resourceColumns+`
+			  FROM exp_histograms h
+			  LEFT JOIN resources r ON r.id = h.resource_id
+			  WHERE h.timestamp >= ? AND h.timestamp <= ?
+			  AND h.metric_name IN (?`+strings.Repeat(", ?", len(names)-1)+`)
+			  ORDER BY h.timestamp ASC`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var metrics []*Metric
+	var histograms []*ExponentialHistogram
 	for rows.Next() {
-		var m Metric
+		var h ExponentialHistogram
 		var timestamp, createdAt int64
+		var data string
+		var resource resourceScanner
 
-		err := rows.Scan(&m.ID, &timestamp, &m.MetricName, &m.Value, &m.Labels, &m.ServiceName, &createdAt)
+		err := rows.Scan(append([]interface{}{&h.ID, &timestamp, &h.MetricName, &h.Labels, &h.ServiceName,
+			&data, &createdAt}, resource.targets()...)...)
 		if err != nil {
 			return nil, err
 		}
+		h.Resource = resource.result()
+		if !filter.matches(&h) {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &h.Histogram); err != nil {
+			return nil, fmt.Errorf("failed to decode histogram %d: %w", h.ID, err)
+		}
 
-		m.Timestamp = time.Unix(0, timestamp)
-		m.CreatedAt = time.Unix(createdAt, 0)
-		metrics = append(metrics, &m)
+		h.Timestamp = time.Unix(0, timestamp)
+		h.CreatedAt = time.Unix(createdAt, 0)
+		histograms = append(histograms, &h)
 	}
 
-	return metrics, nil
+	return histograms, rows.Err()
 }
 
 // Trace methods
 func (s *SQLiteStorage) InsertTrace(trace *Trace) error {
-	query := `INSERT INTO traces (trace_id, span_id, parent_span_id, service_name, operation_name, 
-			  start_time, duration_nanos, attributes, status_code) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-	_, err := s.db.Exec(query,
-		trace.TraceID,
-		trace.SpanID,
-		trace.ParentSpanID,
-		trace.ServiceName,
-		trace.OperationName,
-		trace.StartTime.UnixNano(),
-		trace.DurationNanos,
-		trace.Attributes,
-		trace.StatusCode,
-	)
-	return err
+	return firstError(s.InsertTraces([]*Trace{trace}))
+}
+
+// InsertTraces stores spans in one transaction
+func (s *SQLiteStorage) InsertTraces(traces []*Trace) error {
+	query := `INSERT INTO traces (trace_id, span_id, parent_span_id, trace_state, service_name, operation_name,
+			  kind, start_time, duration_nanos, attributes, events, links, status_code, status_message,
+			  scope_name, scope_version, resource_id)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	return s.insertBatch(query, len(traces), func(b *batchTx, i int) ([]interface{}, error) {
+		trace := traces[i]
+		resourceID, err := b.resourceID(trace.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			trace.TraceID,
+			trace.SpanID,
+			trace.ParentSpanID,
+			trace.TraceState,
+			trace.ServiceName,
+			trace.OperationName,
+			trace.Kind,
+			trace.StartTime.UnixNano(),
+			trace.DurationNanos,
+			trace.Attributes,
+			jsonOrDefault(trace.Events, "[]"),
+			jsonOrDefault(trace.Links, "[]"),
+			trace.StatusCode,
+			trace.StatusMessage,
+			trace.ScopeName,
+			trace.ScopeVersion,
+			resourceID,
+		}, nil
+	})
 }
 
 func (s *SQLiteStorage) GetTraces(limit int, offset int) ([]*Trace, error) {
-	query := `SELECT id, trace_id, span_id, parent_span_id, service_name, operation_name, 
-			  start_time, duration_nanos, attributes, status_code, created_at 
-			  FROM traces 
-			  ORDER BY start_time DESC 
+	return s.queryTraces(context.Background(), `1 = 1`, nil, limit, offset)
+}
+
+// FindTraces returns the spans matching the query, newest first
+func (s *SQLiteStorage) FindTraces(ctx context.Context, query TraceQuery) ([]*Trace, error) {
+	where, args := query.where(sqliteDialect)
+	return s.queryTraces(ctx, where, args, searchLimit(query.Limit), query.Offset)
+}
+
+// sqliteDialect matches attributes as decodeLabels reads them, and text
+// case-sensitively
+var sqliteDialect = sqlDialect{
+	bind: func(query string) string { return query },
+	in: func(column string, values []interface{}) (string, []interface{}) {
+		return column + ` IN (?` + strings.Repeat(", ?", len(values)-1) + `)`, values
+	},
+	maxIn: maxQueryArgs,
+	attribute: func(column string) string {
+		return `EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid(` + column + `) THEN ` + column + ` ELSE '{}' END)
+			WHERE key = ? AND CASE type WHEN 'text' THEN value WHEN 'true' THEN 'true' WHEN 'false' THEN 'false'
+			WHEN 'null' THEN NULL ELSE CAST(value AS TEXT) END = ?)`
+	},
+	contains: func(column string) string {
+		return `instr(` + column + `, ?) > 0`
+	},
+}
+
+// queryTraces returns the spans satisfying a condition on the traces joined
+// as t and their resources joined as r, newest first. A negative limit
+// returns every span.
+func (s *SQLiteStorage) queryTraces(ctx context.Context, where string, args []interface{}, limit, offset int) ([]*Trace, error) {
+	query := `SELECT t.id, t.trace_id, t.span_id, t.parent_span_id, t.trace_state, t.service_name, t.operation_name,
+			  t.kind, t.start_time, t.duration_nanos, t.attributes, t.events, t.links, t.status_code, t.status_message,
+			  t.scope_name, t.scope_version, t.created_at, ` + resourceColumns + `
+			  FROM traces t
+			  LEFT JOIN resources r ON r.id = t.resource_id
+			  WHERE ` + where + `
+			  ORDER BY t.start_time DESC 
 			  LIMIT ? OFFSET ?`
 
-	rows, err := s.db.Query(query, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, err
 	}
@@ -236,45 +1411,105 @@ func (s *SQLiteStorage) GetTraces(limit int, offset int) ([]*Trace, error) {
 	for rows.Next() {
 		var t Trace
 		var startTime, createdAt int64
+		var resource resourceScanner
 
-		err := rows.Scan(&t.ID, &t.TraceID, &t.SpanID, &t.ParentSpanID, &t.ServiceName,
-			&t.OperationName, &startTime, &t.DurationNanos, &t.Attributes, &t.StatusCode, &createdAt)
+		err := rows.Scan(append([]interface{}{&t.ID, &t.TraceID, &t.SpanID, &t.ParentSpanID, &t.TraceState,
+			&t.ServiceName, &t.OperationName, &t.Kind, &startTime, &t.DurationNanos, &t.Attributes, &t.Events,
+			&t.Links, &t.StatusCode, &t.StatusMessage, &t.ScopeName, &t.ScopeVersion, &createdAt},
+			resource.targets()...)...)
 		if err != nil {
 			return nil, err
 		}
 
 		t.StartTime = time.Unix(0, startTime)
 		t.CreatedAt = time.Unix(createdAt, 0)
+		t.Resource = resource.result()
 		traces = append(traces, &t)
 	}
 
 	return traces, nil
 }
 
+// jsonOrDefault returns value, or def for records that leave a JSON column
+// unset
+func jsonOrDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// unixNanoOrZero returns t in nanoseconds, or 0 if t is unset
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
 // Log methods
 func (s *SQLiteStorage) InsertLog(log *Log) error {
-	query := `INSERT INTO logs (timestamp, service_name, level, message, attributes, trace_id, span_id) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?)`
-
-	_, err := s.db.Exec(query,
-		log.Timestamp.UnixNano(),
-		log.ServiceName,
-		log.Level,
-		log.Message,
-		log.Attributes,
-		log.TraceID,
-		log.SpanID,
-	)
-	return err
+	return firstError(s.InsertLogs([]*Log{log}))
+}
+
+// InsertLogs stores log records in one transaction
+func (s *SQLiteStorage) InsertLogs(logs []*Log) error {
+	query := `INSERT INTO logs (timestamp, observed_timestamp, service_name, level, severity_number, event_name,
+			  message, body, attributes, trace_id, span_id, flags, scope_name, scope_version, scope_attributes, resource_id)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	return s.insertBatch(query, len(logs), func(b *batchTx, i int) ([]interface{}, error) {
+		log := logs[i]
+		resourceID, err := b.resourceID(log.Resource)
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{
+			log.Timestamp.UnixNano(),
+			unixNanoOrZero(log.ObservedTimestamp),
+			log.ServiceName,
+			log.Level,
+			log.SeverityNumber,
+			log.EventName,
+			log.Message,
+			jsonOrDefault(log.Body, "null"),
+			log.Attributes,
+			log.TraceID,
+			log.SpanID,
+			log.Flags,
+			log.ScopeName,
+			log.ScopeVersion,
+			jsonOrDefault(log.ScopeAttributes, "{}"),
+			resourceID,
+		}, nil
+	})
 }
 
 func (s *SQLiteStorage) GetLogs(limit int, offset int) ([]*Log, error) {
-	query := `SELECT id, timestamp, service_name, level, message, attributes, trace_id, span_id, created_at 
-			  FROM logs 
-			  ORDER BY timestamp DESC 
+	return s.queryLogs(context.Background(), `1 = 1`, nil, limit, offset)
+}
+
+// SearchLogs returns the log records matching the query, newest first
+func (s *SQLiteStorage) SearchLogs(ctx context.Context, query LogQuery) ([]*Log, error) {
+	where, args := query.where(sqliteDialect)
+	return s.queryLogs(ctx, where, args, searchLimit(query.Limit), query.Offset)
+}
+
+// queryLogs returns the log records satisfying a condition on the logs
+// joined as l and their resources joined as r, newest first. A negative
+// limit returns every record.
+func (s *SQLiteStorage) queryLogs(ctx context.Context, where string, args []interface{}, limit, offset int) ([]*Log, error) {
+	query := `SELECT l.id, l.timestamp, l.observed_timestamp, l.service_name, l.level, l.severity_number, l.event_name,
+			  l.message, l.body, l.attributes, l.trace_id, l.span_id, l.flags, l.scope_name, l.scope_version, l.scope_attributes, l.created_at,
+			  ` + resourceColumns + `
+			  FROM logs l
+			  LEFT JOIN resources r ON r.id = l.resource_id
+			  WHERE ` + where + `
+			  ORDER BY l.timestamp DESC 
 			  LIMIT ? OFFSET ?`
 
-	rows, err := s.db.Query(query, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, err
 	}
@@ -283,16 +1518,22 @@ func (s *SQLiteStorage) GetLogs(limit int, offset int) ([]*Log, error) {
 	var logs []*Log
 	for rows.Next() {
 		var l Log
-		var timestamp, createdAt int64
+		var timestamp, observedTimestamp, createdAt int64
+		var resource resourceScanner
 
-		err := rows.Scan(&l.ID, &timestamp, &l.ServiceName, &l.Level, &l.Message,
-			&l.Attributes, &l.TraceID, &l.SpanID, &createdAt)
+		err := rows.Scan(append([]interface{}{&l.ID, &timestamp, &observedTimestamp, &l.ServiceName, &l.Level,
+			&l.SeverityNumber, &l.EventName, &l.Message, &l.Body, &l.Attributes, &l.TraceID, &l.SpanID, &l.Flags,
+			&l.ScopeName, &l.ScopeVersion, &l.ScopeAttributes, &createdAt}, resource.targets()...)...)
 		if err != nil {
 			return nil, err
 		}
 
 		l.Timestamp = time.Unix(0, timestamp)
+		if observedTimestamp != 0 {
+			l.ObservedTimestamp = time.Unix(0, observedTimestamp)
+		}
 		l.CreatedAt = time.Unix(createdAt, 0)
+		l.Resource = resource.result()
 		logs = append(logs, &l)
 	}
 
@@ -300,16 +1541,25 @@ func (s *SQLiteStorage) GetLogs(limit int, offset int) ([]*Log, error) {
 }
 
 // Service methods
-func (s *SQLiteStorage) GetServices() ([]string, error) {
-	query := `SELECT DISTINCT service_name FROM (
-		SELECT service_name FROM metrics WHERE service_name IS NOT NULL AND service_name != ''
+
+// GetServices returns the names of the services that reported telemetry from
+// a resource matching the filter
+func (s *SQLiteStorage) GetServices(filter ResourceFilter) ([]string, error) {
+	where, args := filter.where()
+	query := `SELECT DISTINCT t.service_name FROM (
+		SELECT service_name, resource_id FROM series WHERE service_name != ''
+		UNION
+		SELECT service_name, resource_id FROM exp_histograms WHERE service_name IS NOT NULL AND service_name != ''
 		UNION
-		SELECT service_name FROM traces WHERE service_name IS NOT NULL AND service_name != ''
+		SELECT service_name, resource_id FROM traces WHERE service_name IS NOT NULL AND service_name != ''
 		UNION
-		SELECT service_name FROM logs WHERE service_name IS NOT NULL AND service_name != ''
-	) ORDER BY service_name`
+		SELECT service_name, resource_id FROM logs WHERE service_name IS NOT NULL AND service_name != ''
+	) t
+	LEFT JOIN resources r ON r.id = t.resource_id
+	WHERE ` + where + `
+	ORDER BY t.service_name`
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -329,10 +1579,15 @@ func (s *SQLiteStorage) GetServices() ([]string, error) {
 
 // Cleanup old data
 func (s *SQLiteStorage) CleanupOldData() error {
-	cutoff := time.Now().AddDate(0, 0, -s.config.RetentionDays).UnixNano()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	cutoffTime := time.Now().AddDate(0, 0, -s.config.RetentionDays)
+	cutoff := cutoffTime.UnixNano()
 
 	queries := []string{
-		`DELETE FROM metrics WHERE timestamp < ?`,
+		`DELETE FROM chunks WHERE max_time < ?`,
+		`DELETE FROM exp_histograms WHERE timestamp < ?`,
 		`DELETE FROM traces WHERE start_time < ?`,
 		`DELETE FROM logs WHERE timestamp < ?`,
 	}
@@ -343,14 +1598,58 @@ func (s *SQLiteStorage) CleanupOldData() error {
 		}
 	}
 
+	// Series without samples within the retention period are dropped along
+	// with their postings
+	s.seriesMu.Lock()
+	err := s.deleteEmptySeries()
+	s.seriesIDs = make(map[string]int64)
+	s.seriesMu.Unlock()
+	s.headMu.Lock()
+	s.heads = make(map[int64]*headChunk)
+	s.headMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to cleanup old series: %w", err)
+	}
+
+	// Resources that have not reported within the retention period are no
+	// longer referenced by any record
+	s.resourceMu.Lock()
+	defer s.resourceMu.Unlock()
+
+	query := `DELETE FROM resources WHERE created_at < ?
+		AND id NOT IN (SELECT resource_id FROM series WHERE resource_id IS NOT NULL)
+		AND id NOT IN (SELECT resource_id FROM exp_histograms WHERE resource_id IS NOT NULL)
+		AND id NOT IN (SELECT resource_id FROM traces WHERE resource_id IS NOT NULL)
+		AND id NOT IN (SELECT resource_id FROM logs WHERE resource_id IS NOT NULL)`
+	if _, err := s.db.Exec(query, cutoffTime.Unix()); err != nil {
+		return fmt.Errorf("failed to cleanup old resources: %w", err)
+	}
+	s.resourceIDs = make(map[string]int64)
+
 	return nil
 }
 
+// deleteEmptySeries deletes the series that have no chunks, and their
+// postings
+func (s *SQLiteStorage) deleteEmptySeries() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	queries := []string{
+		`DELETE FROM postings WHERE series_id NOT IN (SELECT series_id FROM chunks)`,
+		`DELETE FROM series WHERE id NOT IN (SELECT series_id FROM chunks)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // GetDatabasePath returns the path to the database file
 func (s *SQLiteStorage) GetDatabasePath() string {
 	return s.config.Path
 }
-
-func (s *SQLiteStorage) GetDB() *sql.DB {
-	return s.db
-}
@@ -0,0 +1,286 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+)
+
+// baselineSchema is the schema of the first released version, before the
+// schema was versioned
+var baselineSchema = []string{
+	`CREATE TABLE metrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		metric_name TEXT NOT NULL,
+		value REAL NOT NULL,
+		labels TEXT,
+		service_name TEXT,
+		created_at INTEGER DEFAULT (strftime('%s', 'now'))
+	)`,
+	`CREATE TABLE traces (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		trace_id TEXT NOT NULL,
+		span_id TEXT NOT NULL,
+		parent_span_id TEXT,
+		service_name TEXT,
+		operation_name TEXT,
+		start_time INTEGER NOT NULL,
+		duration_nanos INTEGER NOT NULL,
+		attributes TEXT,
+		status_code TEXT,
+		created_at INTEGER DEFAULT (strftime('%s', 'now'))
+	)`,
+	`CREATE TABLE logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		service_name TEXT,
+		level TEXT,
+		message TEXT,
+		attributes TEXT,
+		trace_id TEXT,
+		span_id TEXT,
+		created_at INTEGER DEFAULT (strftime('%s', 'now'))
+	)`,
+}
+
+// TestMigrateBaselineIDs opens a database written by the baseline version,
+// which stored IDs as sent in OTLP/JSON or as the raw bytes received over
+// gRPC, and checks that the IDs read back are lowercase hex
+func TestMigrateBaselineIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telemorph.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range baselineSchema {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	spans := []struct {
+		name                    string
+		traceID, spanID, parent interface{}
+		// want are the canonical trace, span and parent span IDs
+		want [3]string
+	}{
+		{
+			name:    "hex",
+			traceID: "5B8EFFF798038103D269B633813FC60C",
+			spanID:  "EEE19B7EC3C1B174",
+			parent:  "0af7651916cd43dd",
+			want:    [3]string{"5b8efff798038103d269b633813fc60c", "eee19b7ec3c1b174", "0af7651916cd43dd"},
+		},
+		{
+			name:    "raw",
+			traceID: "\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10",
+			spanID:  "\xa1\xa2\xa3\xa4\xa5\xa6\xa7\xa8",
+			parent:  nil,
+			want:    [3]string{"0102030405060708090a0b0c0d0e0f10", "a1a2a3a4a5a6a7a8", ""},
+		},
+		{
+			// Raw IDs whose bytes are all hex digits
+			name:    "raw hex digits",
+			traceID: "0123456789abcdef",
+			spanID:  "deadbeef",
+			parent:  "CAFEF00D",
+			want:    [3]string{"30313233343536373839616263646566", "6465616462656566", "4341464546303044"},
+		},
+	}
+	for i, span := range spans {
+		if _, err := db.Exec(`INSERT INTO traces (trace_id, span_id, parent_span_id, service_name, operation_name, start_time, duration_nanos, attributes, status_code)
+			VALUES (?, ?, ?, 'api', ?, ?, 1000, '{}', 'OK')`, span.traceID, span.spanID, span.parent, span.name, now.Add(-time.Duration(i)*time.Second).UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO logs (timestamp, service_name, level, message, attributes, trace_id, span_id)
+		VALUES (?, 'api', 'INFO', 'started', '{}', '0123456789ABCDEF', 'EEE19B7EC3C1B174')`, now.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := storage.NewSQLiteStorage(config.StorageConfig{Type: "sqlite", Path: path, RetentionDays: 30})
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+	defer s.Close()
+
+	traces, err := s.GetTraces(10, 0)
+	if err != nil {
+		t.Fatalf("GetTraces: %v", err)
+	}
+	if len(traces) != len(spans) {
+		t.Fatalf("GetTraces returned %d spans, want %d", len(traces), len(spans))
+	}
+	for i, span := range spans {
+		trace := traces[i]
+		var parent string
+		if trace.ParentSpanID != nil {
+			parent = *trace.ParentSpanID
+		}
+		if got := [3]string{trace.TraceID, trace.SpanID, parent}; trace.OperationName != span.name || got != span.want {
+			t.Errorf("%s span has IDs %q, want %q", trace.OperationName, got, span.want)
+		}
+	}
+
+	logs, err := s.GetLogs(10, 0)
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	if len(logs) != 1 || logs[0].TraceID == nil || logs[0].SpanID == nil {
+		t.Fatalf("GetLogs = %+v, want the stored log with its IDs", logs)
+	}
+	if *logs[0].TraceID != "30313233343536373839414243444546" || *logs[0].SpanID != "eee19b7ec3c1b174" {
+		t.Errorf("log has IDs %q, %q, want the raw trace ID and the hex span ID in lowercase hex", *logs[0].TraceID, *logs[0].SpanID)
+	}
+	if logs[0].ScopeAttributes != "{}" {
+		t.Errorf("log has scope attributes %q, want {}", logs[0].ScopeAttributes)
+	}
+}
+
+// TestConcurrentWriters stores batches from several goroutines at once,
+// which only succeeds if writers wait for each other's locks rather than
+// failing with SQLITE_BUSY
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telemorph.db")
+	s, err := storage.NewSQLiteStorage(config.StorageConfig{Type: "sqlite", Path: path, RetentionDays: 30})
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+	defer s.Close()
+
+	const writers, batches, batchSize = 8, 20, 10
+	now := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*batches*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				var metrics []*storage.Metric
+				var logs []*storage.Log
+				for i := 0; i < batchSize; i++ {
+					ts := now.Add(-time.Duration(b*batchSize+i) * time.Millisecond)
+					metrics = append(metrics, &storage.Metric{
+						Timestamp:   ts,
+						MetricName:  "requests",
+						Value:       float64(i),
+						Labels:      fmt.Sprintf(`{"writer":"%d"}`, w),
+						ServiceName: "api",
+					})
+					logs = append(logs, &storage.Log{Timestamp: ts, ServiceName: "api", Level: "INFO", Message: "ok"})
+				}
+				if err := s.InsertMetrics(metrics); err != nil {
+					errs <- fmt.Errorf("InsertMetrics: %w", err)
+				}
+				if err := s.InsertLogs(logs); err != nil {
+					errs <- fmt.Errorf("InsertLogs: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	logs, err := s.GetLogs(-1, 0)
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	if want := writers * batches * batchSize; len(logs) != want {
+		t.Errorf("stored %d logs, want %d", len(logs), want)
+	}
+
+	// The journal mode is a property of the database file
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal mode = %s, want wal", mode)
+	}
+}
+
+// TestCleanupConcurrentWriters runs retention cleanup while writers store
+// samples past the retention period into series they have stored before,
+// and checks that no chunk is left referencing a deleted series
+func TestCleanupConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telemorph.db")
+	s, err := storage.NewSQLiteStorage(config.StorageConfig{Type: "sqlite", Path: path, RetentionDays: 1})
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+	defer s.Close()
+
+	const writers, writes = 4, 200
+	expired := time.Now().AddDate(0, 0, -2)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes+1)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := s.InsertMetrics([]*storage.Metric{{
+					Timestamp:  expired.Add(time.Duration(i) * time.Millisecond),
+					MetricName: "requests",
+					Value:      float64(i),
+					Labels:     fmt.Sprintf(`{"writer":"%d"}`, w),
+				}}); err != nil {
+					errs <- fmt.Errorf("InsertMetrics: %w", err)
+				}
+			}
+		}(w)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := s.CleanupOldData(); err != nil {
+				errs <- fmt.Errorf("CleanupOldData: %w", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-stopped
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var orphans int
+	if err := db.QueryRow(`SELECT count(*) FROM chunks WHERE series_id NOT IN (SELECT id FROM series)`).Scan(&orphans); err != nil {
+		t.Fatal(err)
+	}
+	if orphans > 0 {
+		t.Errorf("%d chunks reference deleted series", orphans)
+	}
+}
@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// sqlStore reads series, samples and postings from a database/sql database.
+// The SQLite and PostgreSQL storages embed it; queries use ? placeholders,
+// which the dialect rewrites for the database.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// queryIDs returns the IDs a query selects
+func (s *sqlStore) queryIDs(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.bind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read postings: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// queryStrings returns the strings a query selects
+func (s *sqlStore) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.bind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read postings: %w", err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// forEachIn calls fn with conditions that a column holds one of values and
+// the arguments they bind, splitting values across as many queries as the
+// dialect needs. fn is not called without values.
+func (s *sqlStore) forEachIn(column string, values []interface{}, fn func(condition string, args []interface{}) error) error {
+	for len(values) > 0 {
+		// Capping the capacity lets fn append arguments to the batch
+		batch := values[:len(values):len(values)]
+		if s.dialect.maxIn > 0 && len(batch) > s.dialect.maxIn {
+			batch = batch[:s.dialect.maxIn:s.dialect.maxIn]
+		}
+		values = values[len(batch):]
+
+		condition, args := s.dialect.in(column, batch)
+		if err := fn(condition, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// idArgs returns series IDs as query arguments
+func idArgs(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// GetMetrics returns the most recent samples of all series, newest first
+func (s *sqlStore) GetMetrics(limit int, offset int) ([]*Metric, error) {
+	if limit+offset <= 0 {
+		return nil, nil
+	}
+
+	query := `SELECT sr.id, sr.metric_name, sr.labels, sr.service_name, sr.created_at, c.max_time, c.data,
+			  ` + resourceColumns + `
+			  FROM chunks c
+			  JOIN series sr ON sr.id = c.series_id
+			  LEFT JOIN resources r ON r.id = sr.resource_id
+			  ORDER BY c.max_time DESC`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Chunks are read newest first until none can hold a sample recent
+	// enough for the requested page
+	wanted := limit + offset
+	var metrics []*Metric
+	for rows.Next() {
+		var m Metric
+		var createdAt, maxTime int64
+		var data []byte
+		var resource resourceScanner
+
+		err := rows.Scan(append([]interface{}{&m.ID, &m.MetricName, &m.Labels, &m.ServiceName, &createdAt,
+			&maxTime, &data}, resource.targets()...)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(metrics) >= wanted && maxTime < metrics[wanted-1].Timestamp.UnixNano() {
+			break
+		}
+
+		samples, err := decodeChunk(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk of series %d: %w", m.ID, err)
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		m.Resource = resource.result()
+		for _, sample := range samples {
+			metric := m
+			metric.Timestamp = time.Unix(0, sample.Timestamp)
+			metric.Value = sample.Value
+			metrics = append(metrics, &metric)
+		}
+
+		sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Timestamp.After(metrics[j].Timestamp) })
+		if len(metrics) > wanted {
+			metrics = metrics[:wanted]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if offset >= len(metrics) {
+		return nil, nil
+	}
+	return metrics[offset:], nil
+}
+
+// SelectSeries returns the series whose labels satisfy every matcher that
+// have samples between start and end. The metric name is matched as the
+// __name__ label.
+func (s *sqlStore) SelectSeries(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]*Series, error) {
+	ids, err := s.seriesIDsBetween(ctx, matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []*Series
+	err = s.forEachIn(`sr.id`, idArgs(ids), func(condition string, args []interface{}) error {
+		rows, err := s.db.QueryContext(ctx, s.dialect.bind(`SELECT sr.id, sr.metric_name, sr.labels, sr.service_name, `+resourceColumns+`
+			FROM series sr
+			LEFT JOIN resources r ON r.id = sr.resource_id
+			WHERE `+condition+`
+			ORDER BY sr.id`), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sr Series
+			var resource resourceScanner
+			if err := rows.Scan(append([]interface{}{&sr.ID, &sr.MetricName, &sr.Labels, &sr.ServiceName},
+				resource.targets()...)...); err != nil {
+				return err
+			}
+			sr.Resource = resource.result()
+			series = append(series, &sr)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// GetSamples returns the samples of series between start and end, by series
+// ID, sorted by timestamp
+func (s *sqlStore) GetSamples(ctx context.Context, seriesIDs []int64, start, end time.Time) (map[int64][]Sample, error) {
+	from, to := start.UnixNano(), end.UnixNano()
+	result := make(map[int64][]Sample)
+
+	err := s.forEachIn(`series_id`, idArgs(seriesIDs), func(condition string, args []interface{}) error {
+		// The start time bounds use the primary key and prune partitions,
+		// the others skip chunks whose samples are all outside the range
+		rows, err := s.db.QueryContext(ctx, s.dialect.bind(`SELECT series_id, data FROM chunks
+			WHERE `+condition+`
+			AND start_time > ? AND start_time <= ? AND max_time >= ? AND min_time <= ?
+			ORDER BY series_id, start_time`), append(args, from-chunkWindow, to, from, to)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				return err
+			}
+			samples, err := decodeChunk(data)
+			if err != nil {
+				return fmt.Errorf("failed to decode chunk of series %d: %w", id, err)
+			}
+			for _, sample := range samples {
+				if sample.Timestamp >= from && sample.Timestamp <= to {
+					result[id] = append(result[id], sample)
+				}
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LabelNames returns the sorted names of the labels of the series
+// satisfying every matcher that have samples between start and end,
+// including __name__
+func (s *sqlStore) LabelNames(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]string, error) {
+	return s.labelStrings(ctx, `name`, ``, nil, matchers, start, end, func(labels map[string]string) []string {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		return names
+	})
+}
+
+// LabelValues returns the sorted values of a label across the series
+// satisfying every matcher that have samples between start and end. The
+// values of __name__ are the metric names.
+func (s *sqlStore) LabelValues(ctx context.Context, name string, matchers []*LabelMatcher, start, end time.Time) ([]string, error) {
+	return s.labelStrings(ctx, `value`, `name = ? AND `, []interface{}{name}, matchers, start, end, func(labels map[string]string) []string {
+		if value, ok := labels[name]; ok {
+			return []string{value}
+		}
+		return nil
+	})
+}
+
+// labelStrings returns the distinct values of a postings column for the
+// series satisfying the matchers that have samples between start and end,
+// restricted by an extra condition on the arguments args, merged with those
+// fn derives from the label sets of matching native histograms
+func (s *sqlStore) labelStrings(ctx context.Context, column, condition string, args []interface{},
+	matchers []*LabelMatcher, start, end time.Time, fn func(labels map[string]string) []string) ([]string, error) {
+	seen := make(map[string]bool)
+	add := func(values []string) {
+		for _, value := range values {
+			seen[value] = true
+		}
+	}
+
+	all, err := s.coversAllSamples(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if all && len(matchers) == 0 {
+		values, err := s.distinctPostings(ctx, column, condition, args...)
+		if err != nil {
+			return nil, err
+		}
+		add(values)
+	} else {
+		ids, err := s.seriesIDsBetween(ctx, matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		err = s.forEachIn(`series_id`, idArgs(ids), func(in string, inArgs []interface{}) error {
+			values, err := s.queryStrings(ctx, `SELECT DISTINCT `+column+` FROM postings WHERE `+condition+in,
+				append(append([]interface{}{}, args...), inArgs...)...)
+			add(values)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	histograms, err := s.histogramLabels(ctx, matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, labels := range histograms {
+		add(fn(labels))
+	}
+
+	result := make([]string, 0, len(seen))
+	for value := range seen {
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// coversAllSamples reports whether every stored chunk has samples between
+// start and end, so that every series does
+func (s *sqlStore) coversAllSamples(ctx context.Context, start, end time.Time) (bool, error) {
+	var first, last sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT MIN(max_time), MAX(max_time) FROM chunks`).Scan(&first, &last)
+	if err != nil {
+		return false, fmt.Errorf("failed to read chunk times: %w", err)
+	}
+	// A chunk's last sample is within the range if the range starts before
+	// the earliest last sample and ends after the latest one
+	return !first.Valid || (start.UnixNano() <= first.Int64 && end.UnixNano() >= last.Int64), nil
+}
+
+// seriesIDsBetween returns the IDs of the series satisfying every matcher
+// that have samples between start and end, sorted
+func (s *sqlStore) seriesIDsBetween(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]int64, error) {
+	ids, err := selectSeriesIDs(ctx, s, matchers)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.coversAllSamples(ctx, start, end)
+	if err != nil || all {
+		return ids, err
+	}
+	return s.seriesWithSamples(ctx, ids, start, end)
+}
+
+// seriesWithSamples returns the series of ids that have samples between
+// start and end
+func (s *sqlStore) seriesWithSamples(ctx context.Context, ids []int64, start, end time.Time) ([]int64, error) {
+	from, to := start.UnixNano(), end.UnixNano()
+	var result []int64
+	err := s.forEachIn(`series_id`, idArgs(ids), func(condition string, args []interface{}) error {
+		batchIDs, err := s.queryIDs(ctx, `SELECT DISTINCT series_id FROM chunks
+			WHERE `+condition+`
+			AND start_time > ? AND start_time <= ? AND max_time >= ? AND min_time <= ?
+			ORDER BY series_id`, append(args, from-chunkWindow, to, from, to)...)
+		result = append(result, batchIDs...)
+		return err
+	})
+	return result, err
+}
+
+// histogramLabels returns the label sets, including __name__, of the native
+// histograms between start and end that satisfy every matcher. Native
+// histograms are not indexed; each distinct label set is matched once.
+func (s *sqlStore) histogramLabels(ctx context.Context, matchers []*LabelMatcher, start, end time.Time) ([]map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.bind(`SELECT t.metric_name, t.labels, t.service_name, `+resourceColumns+`
+		FROM (
+			SELECT DISTINCT metric_name, COALESCE(labels, '{}') AS labels, COALESCE(service_name, '') AS service_name, resource_id
+			FROM exp_histograms
+			WHERE timestamp >= ? AND timestamp <= ?
+		) t
+		LEFT JOIN resources r ON r.id = t.resource_id`), start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []map[string]string
+	for rows.Next() {
+		var sr Series
+		var resource resourceScanner
+		if err := rows.Scan(append([]interface{}{&sr.MetricName, &sr.Labels, &sr.ServiceName},
+			resource.targets()...)...); err != nil {
+			return nil, err
+		}
+
+		labels := MetricLabels(sr.Labels, sr.ServiceName, resource.result())
+		labels[MetricNameLabel] = sr.MetricName
+		if matchesAll(matchers, labels) {
+			result = append(result, labels)
+		}
+	}
+	return result, rows.Err()
+}
+
+// allSeries returns the IDs of all series, sorted
+func (s *sqlStore) allSeries(ctx context.Context) ([]int64, error) {
+	return s.queryIDs(ctx, `SELECT id FROM series ORDER BY id`)
+}
+
+// labelValues returns the sorted values of a label
+func (s *sqlStore) labelValues(ctx context.Context, name string) ([]string, error) {
+	return s.distinctPostings(ctx, `value`, `name = ? AND `, name)
+}
+
+// distinctPostings returns the sorted distinct values of a postings column
+// among the postings satisfying condition, skipping from one value to the
+// next rather than reading every posting
+func (s *sqlStore) distinctPostings(ctx context.Context, column, condition string, args ...interface{}) ([]string, error) {
+	query := fmt.Sprintf(`WITH RECURSIVE v(x) AS (
+			SELECT MIN(%[1]s) FROM postings WHERE %[2]s 1 = 1
+			UNION ALL
+			SELECT (SELECT MIN(%[1]s) FROM postings WHERE %[2]s %[1]s > v.x) FROM v WHERE v.x IS NOT NULL
+		) SELECT x FROM v WHERE x IS NOT NULL`, column, condition)
+	return s.queryStrings(ctx, query, append(append([]interface{}{}, args...), args...)...)
+}
+
+// postings returns the IDs of the series whose label has one of the values,
+// sorted
+func (s *sqlStore) postings(ctx context.Context, name string, values []string) ([]int64, error) {
+	if len(values) == 1 {
+		return s.queryIDs(ctx, `SELECT series_id FROM postings WHERE name = ? AND value = ? ORDER BY series_id`,
+			name, values[0])
+	}
+
+	valueArgs := make([]interface{}, len(values))
+	for i, value := range values {
+		valueArgs[i] = value
+	}
+	var ids []int64
+	err := s.forEachIn(`value`, valueArgs, func(condition string, args []interface{}) error {
+		batchIDs, err := s.queryIDs(ctx, `SELECT DISTINCT series_id FROM postings
+			WHERE name = ? AND `+condition+`
+			ORDER BY series_id`, append([]interface{}{name}, args...)...)
+		ids = union(ids, batchIDs)
+		return err
+	})
+	return ids, err
+}
+
+// seriesLabelValues returns the values of a label by the ID of the series
+// among ids that have it
+func (s *sqlStore) seriesLabelValues(ctx context.Context, name string, ids []int64) (map[int64]string, error) {
+	values := make(map[int64]string, len(ids))
+	err := s.forEachIn(`series_id`, idArgs(ids), func(condition string, args []interface{}) error {
+		rows, err := s.db.QueryContext(ctx, s.dialect.bind(`SELECT series_id, value FROM postings
+			WHERE `+condition+` AND name = ?`), append(args, name)...)
+		if err != nil {
+			return fmt.Errorf("failed to read postings: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				return err
+			}
+			values[id] = value
+		}
+		return rows.Err()
+	})
+	return values, err
+}
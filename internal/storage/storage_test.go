@@ -0,0 +1,195 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/storage"
+	"open-telemorph-prime/internal/storage/storagetest"
+
+	"github.com/lib/pq"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, cfg config.StorageConfig) storage.Storage {
+		cfg.Type = "memory"
+		return storage.NewMemoryStorage(cfg)
+	})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, cfg config.StorageConfig) storage.Storage {
+		cfg.Type = "sqlite"
+		cfg.Path = filepath.Join(t.TempDir(), "telemorph.db")
+		s, err := storage.NewSQLiteStorage(cfg)
+		if err != nil {
+			t.Fatalf("NewSQLiteStorage: %v", err)
+		}
+		return s
+	})
+}
+
+// TestPostgresConformance runs the conformance suite against the database
+// named by TELEMORPH_TEST_POSTGRES_DSN
+func TestPostgresConformance(t *testing.T) {
+	if os.Getenv(postgresDSNEnv) == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	storagetest.Run(t, func(t *testing.T, cfg config.StorageConfig) storage.Storage {
+		return newPostgresStorage(t, cfg)
+	})
+}
+
+// postgresDSNEnv names the environment variable holding the connection
+// string of a PostgreSQL database to run the storage tests against
+const postgresDSNEnv = "TELEMORPH_TEST_POSTGRES_DSN"
+
+// postgresSchemas numbers the schemas the PostgreSQL tests create
+var postgresSchemas atomic.Int64
+
+// newPostgresStorage opens a PostgreSQL storage in a schema of its own,
+// dropped when the test ends. The test is skipped unless
+// TELEMORPH_TEST_POSTGRES_DSN names a database.
+func newPostgresStorage(t *testing.T, cfg config.StorageConfig) *storage.PostgresStorage {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema := fmt.Sprintf("storagetest_%d_%d", os.Getpid(), postgresSchemas.Add(1))
+	if _, err := db.Exec(`CREATE SCHEMA ` + pq.QuoteIdentifier(schema)); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + pq.QuoteIdentifier(schema) + ` CASCADE`); err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	cfg.Type = "postgres"
+	cfg.DSN = withSearchPath(dsn, schema)
+	s, err := storage.NewPostgresStorage(cfg)
+	if err != nil {
+		t.Fatalf("NewPostgresStorage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// withSearchPath sets the schema of a connection string, in URL or
+// key/value form
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		return dsn + separator + "search_path=" + schema
+	}
+	return dsn + " search_path=" + schema
+}
+
+// TestPostgresStorage writes samples, spans and logs to PostgreSQL and
+// reads them back
+func TestPostgresStorage(t *testing.T) {
+	s := newPostgresStorage(t, config.StorageConfig{RetentionDays: 30})
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+
+	metric := func(age time.Duration, method string, value float64) *storage.Metric {
+		return &storage.Metric{
+			Timestamp:   now.Add(-age),
+			MetricName:  "requests",
+			Value:       value,
+			Labels:      `{"method":"` + method + `"}`,
+			ServiceName: "api",
+		}
+	}
+	if err := s.InsertMetrics([]*storage.Metric{
+		metric(time.Minute, "get", 1),
+		metric(30*time.Second, "get", 2),
+		metric(30*time.Second, "put", 3),
+	}); err != nil {
+		t.Fatalf("InsertMetrics: %v", err)
+	}
+	// A sample written again replaces the stored one
+	if err := s.InsertMetrics([]*storage.Metric{metric(30*time.Second, "get", 4)}); err != nil {
+		t.Fatalf("InsertMetrics: %v", err)
+	}
+
+	nameMatcher, err := storage.NewLabelMatcher(storage.MatchEqual, storage.MetricNameLabel, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	methodMatcher, err := storage.NewLabelMatcher(storage.MatchEqual, "method", "get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := s.SelectSeries(ctx, []*storage.LabelMatcher{nameMatcher, methodMatcher}, now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("SelectSeries: %v", err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("SelectSeries returned %d series, want 1", len(series))
+	}
+	samples, err := s.GetSamples(ctx, []int64{series[0].ID}, now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("GetSamples: %v", err)
+	}
+	want := []storage.Sample{
+		{Timestamp: now.Add(-time.Minute).UnixNano(), Value: 1},
+		{Timestamp: now.Add(-30 * time.Second).UnixNano(), Value: 4},
+	}
+	if got := samples[series[0].ID]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetSamples = %v, want %v", got, want)
+	}
+
+	if err := s.InsertTraces([]*storage.Trace{{
+		TraceID:       "0af7651916cd43dd8448eb211c80319c",
+		SpanID:        "b7ad6b7169203331",
+		ServiceName:   "api",
+		OperationName: "GET /",
+		StartTime:     now,
+		DurationNanos: int64(time.Millisecond),
+	}}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+	traces, err := s.GetTraces(10, 0)
+	if err != nil {
+		t.Fatalf("GetTraces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].SpanID != "b7ad6b7169203331" {
+		t.Errorf("GetTraces = %+v, want the stored span", traces)
+	}
+
+	if err := s.InsertLogs([]*storage.Log{{
+		Timestamp:   now,
+		ServiceName: "api",
+		Level:       "INFO",
+		Message:     "started",
+	}}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+	logs, err := s.GetLogs(10, 0)
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	if len(logs) != 1 || logs[0].Message != "started" {
+		t.Errorf("GetLogs = %+v, want the stored log", logs)
+	}
+}
@@ -0,0 +1,1188 @@
+// Package storagetest is a conformance suite for storage backends. It pins
+// down the behaviour the rest of Open-Telemorph-Prime relies on: ordering
+// and paging of reads, nil handling of optional IDs, label matching and
+// retention. A backend's tests run it with an Opener for the backend:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T, cfg config.StorageConfig) storage.Storage {
+//			return storage.NewMemoryStorage(cfg)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"open-telemorph-prime/internal/config"
+	"open-telemorph-prime/internal/histogram"
+	"open-telemorph-prime/internal/storage"
+)
+
+// Opener opens an empty storage of the backend under test with the given
+// configuration. The suite closes it when the test ends.
+type Opener func(t *testing.T, cfg config.StorageConfig) storage.Storage
+
+// RetentionDays is the retention period of the storages the suite opens
+const RetentionDays = 30
+
+var (
+	// minTime and maxTime bound reads that cover all stored data
+	minTime = time.Unix(0, 0)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
+// Run runs the conformance suite, each test against a storage of its own
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage)
+	}{
+		{"Empty", testEmpty},
+		{"Resources", testResources},
+		{"Services", testServices},
+		{"Metrics", testMetrics},
+		{"Samples", testSamples},
+		{"SelectSeries", testSelectSeries},
+		{"Labels", testLabels},
+		{"Histograms", testHistograms},
+		{"HistogramBatchErrors", testHistogramBatchErrors},
+		{"Traces", testTraces},
+		{"FindTraces", testFindTraces},
+		{"Logs", testLogs},
+		{"SearchLogs", testSearchLogs},
+		{"Retention", testRetention},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := open(t, config.StorageConfig{RetentionDays: RetentionDays, MaxConnections: 4})
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			})
+			test.fn(t, s)
+		})
+	}
+}
+
+// base is the time the test data is timestamped around, recent enough to
+// be within retention
+func base() time.Time {
+	return time.Now().Add(-time.Hour).Truncate(time.Second)
+}
+
+func resource(service, environment, host string) *storage.Resource {
+	attributes := map[string]interface{}{"service.name": service}
+	if environment != "" {
+		attributes["deployment.environment"] = environment
+	}
+	if host != "" {
+		attributes["host.name"] = host
+	}
+	return storage.NewResource(attributes)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// matcher builds a label matcher from its PromQL operator
+func matcher(t *testing.T, name, op, value string) *storage.LabelMatcher {
+	t.Helper()
+	types := map[string]storage.MatchType{
+		"=":  storage.MatchEqual,
+		"!=": storage.MatchNotEqual,
+		"=~": storage.MatchRegexp,
+		"!~": storage.MatchNotRegexp,
+	}
+	m, err := storage.NewLabelMatcher(types[op], name, value)
+	if err != nil {
+		t.Fatalf("NewLabelMatcher(%s%s%q): %v", name, op, value, err)
+	}
+	return m
+}
+
+// sameJSON reports whether two JSON documents are equal. Backends may
+// store JSON in a normalized form.
+func sameJSON(a, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return a == b
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func mustInsertMetrics(t *testing.T, s storage.Storage, metrics ...*storage.Metric) {
+	t.Helper()
+	if err := s.InsertMetrics(metrics); err != nil {
+		t.Fatalf("InsertMetrics: %v", err)
+	}
+}
+
+func testEmpty(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	if err := s.InsertMetrics(nil); err != nil {
+		t.Errorf("InsertMetrics(nil) = %v", err)
+	}
+	if err := s.InsertExponentialHistograms(nil); err != nil {
+		t.Errorf("InsertExponentialHistograms(nil) = %v", err)
+	}
+	if err := s.InsertTraces(nil); err != nil {
+		t.Errorf("InsertTraces(nil) = %v", err)
+	}
+	if err := s.InsertLogs(nil); err != nil {
+		t.Errorf("InsertLogs(nil) = %v", err)
+	}
+
+	if metrics, err := s.GetMetrics(10, 0); err != nil || len(metrics) != 0 {
+		t.Errorf("GetMetrics = %v, %v; want none", metrics, err)
+	}
+	if traces, err := s.GetTraces(10, 0); err != nil || len(traces) != 0 {
+		t.Errorf("GetTraces = %v, %v; want none", traces, err)
+	}
+	if logs, err := s.GetLogs(10, 0); err != nil || len(logs) != 0 {
+		t.Errorf("GetLogs = %v, %v; want none", logs, err)
+	}
+	if services, err := s.GetServices(storage.ResourceFilter{}); err != nil || len(services) != 0 {
+		t.Errorf("GetServices = %v, %v; want none", services, err)
+	}
+	if resources, err := s.GetResources(storage.ResourceFilter{}); err != nil || len(resources) != 0 {
+		t.Errorf("GetResources = %v, %v; want none", resources, err)
+	}
+	if series, err := s.SelectSeries(ctx, nil, minTime, maxTime); err != nil || len(series) != 0 {
+		t.Errorf("SelectSeries = %v, %v; want none", series, err)
+	}
+	if names, err := s.LabelNames(ctx, nil, minTime, maxTime); err != nil || len(names) != 0 {
+		t.Errorf("LabelNames = %v, %v; want none", names, err)
+	}
+	if samples, err := s.GetSamples(ctx, []int64{1}, minTime, maxTime); err != nil || len(samples) != 0 {
+		t.Errorf("GetSamples = %v, %v; want none", samples, err)
+	}
+	if err := s.CleanupOldData(); err != nil {
+		t.Errorf("CleanupOldData = %v", err)
+	}
+}
+
+func testResources(t *testing.T, s storage.Storage) {
+	now := base()
+	api := resource("api", "prod", "host-1")
+	worker := resource("worker", "staging", "host-2")
+
+	// The same resource reported by spans and logs is stored once
+	if err := s.InsertTraces([]*storage.Trace{
+		{TraceID: "t1", SpanID: "s1", ServiceName: "api", OperationName: "GET /", StartTime: now, Resource: api},
+	}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+	if err := s.InsertLogs([]*storage.Log{
+		{Timestamp: now, ServiceName: "api", Message: "hello", Resource: resource("api", "prod", "host-1")},
+		{Timestamp: now, ServiceName: "worker", Message: "working", Resource: worker},
+	}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+
+	resources, err := s.GetResources(storage.ResourceFilter{})
+	if err != nil {
+		t.Fatalf("GetResources: %v", err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("GetResources returned %d resources, want 2", len(resources))
+	}
+	// Resources are ordered by namespace, then service name
+	if resources[0].ServiceName != "api" || resources[1].ServiceName != "worker" {
+		t.Errorf("GetResources returned services %q, %q; want api, worker", resources[0].ServiceName, resources[1].ServiceName)
+	}
+	r := resources[0]
+	if r.ID == 0 || r.DeploymentEnvironment != "prod" || r.HostName != "host-1" || !sameJSON(r.Attributes, api.Attributes) {
+		t.Errorf("GetResources()[0] = %+v, want the api resource", r)
+	}
+	if r.CreatedAt.IsZero() {
+		t.Errorf("resource has no creation time")
+	}
+
+	filtered, err := s.GetResources(storage.ResourceFilter{DeploymentEnvironment: "staging"})
+	if err != nil {
+		t.Fatalf("GetResources: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].ServiceName != "worker" {
+		t.Errorf("GetResources(staging) = %v, want the worker resource", filtered)
+	}
+
+	// Records read back reference their resource
+	traces, err := s.GetTraces(10, 0)
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("GetTraces = %v, %v", traces, err)
+	}
+	if traces[0].Resource == nil || traces[0].Resource.ID != r.ID {
+		t.Errorf("span resource = %+v, want resource %d", traces[0].Resource, r.ID)
+	}
+	logs, err := s.GetLogs(10, 0)
+	if err != nil || len(logs) != 2 {
+		t.Fatalf("GetLogs = %v, %v", logs, err)
+	}
+	for _, l := range logs {
+		if l.Resource == nil || l.Resource.ServiceName != l.ServiceName {
+			t.Errorf("log %q resource = %+v, want the %s resource", l.Message, l.Resource, l.ServiceName)
+		}
+		if l.ServiceName == "api" && l.Resource != nil && l.Resource.ID != r.ID {
+			t.Errorf("log %q references resource %d, want %d", l.Message, l.Resource.ID, r.ID)
+		}
+	}
+}
+
+func testServices(t *testing.T, s storage.Storage) {
+	now := base()
+	mustInsertMetrics(t, s, &storage.Metric{Timestamp: now, MetricName: "up", Value: 1, ServiceName: "metrics-svc",
+		Resource: resource("metrics-svc", "prod", "")})
+	if err := s.InsertExponentialHistograms([]*storage.ExponentialHistogram{
+		{Timestamp: now, MetricName: "latency", ServiceName: "histogram-svc", Histogram: &histogram.Exponential{Count: 1},
+			Resource: resource("histogram-svc", "prod", "")},
+	}); err != nil {
+		t.Fatalf("InsertExponentialHistograms: %v", err)
+	}
+	if err := s.InsertTraces([]*storage.Trace{
+		{TraceID: "t1", SpanID: "s1", ServiceName: "trace-svc", StartTime: now, Resource: resource("trace-svc", "staging", "")},
+	}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+	if err := s.InsertLogs([]*storage.Log{
+		{Timestamp: now, ServiceName: "log-svc", Resource: resource("log-svc", "prod", "")},
+		// Records without a resource or a service
+		{Timestamp: now, ServiceName: "legacy-svc"},
+		{Timestamp: now, ServiceName: ""},
+	}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+
+	services, err := s.GetServices(storage.ResourceFilter{})
+	if err != nil {
+		t.Fatalf("GetServices: %v", err)
+	}
+	want := []string{"histogram-svc", "legacy-svc", "log-svc", "metrics-svc", "trace-svc"}
+	if !reflect.DeepEqual(services, want) {
+		t.Errorf("GetServices = %q, want %q", services, want)
+	}
+
+	services, err = s.GetServices(storage.ResourceFilter{DeploymentEnvironment: "prod"})
+	if err != nil {
+		t.Fatalf("GetServices: %v", err)
+	}
+	want = []string{"histogram-svc", "log-svc", "metrics-svc"}
+	if !reflect.DeepEqual(services, want) {
+		t.Errorf("GetServices(prod) = %q, want %q", services, want)
+	}
+}
+
+func testMetrics(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+	api := resource("api", "prod", "")
+
+	mustInsertMetrics(t, s,
+		&storage.Metric{Timestamp: now.Add(-3 * time.Minute), MetricName: "requests", Value: 1, Labels: `{"code":"200"}`, ServiceName: "api", Resource: api},
+		&storage.Metric{Timestamp: now.Add(-2 * time.Minute), MetricName: "requests", Value: 2, Labels: `{"code":"200"}`, ServiceName: "api", Resource: api},
+		&storage.Metric{Timestamp: now.Add(-1 * time.Minute), MetricName: "errors", Value: 3, Labels: `{"code":"500"}`, ServiceName: "api", Resource: api},
+	)
+	mustInsertMetrics(t, s,
+		&storage.Metric{Timestamp: now, MetricName: "requests", Value: 4, Labels: `{"code":"200"}`, ServiceName: "api", Resource: api},
+		// A metric without labels or a resource
+		&storage.Metric{Timestamp: now.Add(-4 * time.Minute), MetricName: "up", Value: 5},
+	)
+
+	metrics, err := s.GetMetrics(10, 0)
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	var values []float64
+	for _, m := range metrics {
+		values = append(values, m.Value)
+	}
+	// Newest first
+	if want := []float64{4, 3, 2, 1, 5}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("GetMetrics values = %v, want %v", values, want)
+	}
+
+	first := metrics[0]
+	if first.MetricName != "requests" || first.ServiceName != "api" || !sameJSON(first.Labels, `{"code":"200"}`) ||
+		!first.Timestamp.Equal(now) {
+		t.Errorf("GetMetrics()[0] = %+v, want requests{code=200} at %v", first, now)
+	}
+	if first.Resource == nil || first.Resource.ServiceName != "api" {
+		t.Errorf("GetMetrics()[0].Resource = %+v, want the api resource", first.Resource)
+	}
+	if metrics[4].Resource != nil {
+		t.Errorf("metric without a resource has resource %+v", metrics[4].Resource)
+	}
+
+	// Metrics read back carry the ID of their series
+	series, err := s.SelectSeries(ctx, []*storage.LabelMatcher{matcher(t, storage.MetricNameLabel, "=", "requests")}, minTime, maxTime)
+	if err != nil || len(series) != 1 {
+		t.Fatalf("SelectSeries(requests) = %v, %v; want one series", series, err)
+	}
+	if first.ID != series[0].ID || metrics[2].ID != series[0].ID || metrics[1].ID == series[0].ID {
+		t.Errorf("metric IDs %d, %d, %d; want %d for the requests series", first.ID, metrics[1].ID, metrics[2].ID, series[0].ID)
+	}
+
+	pages := []struct {
+		limit, offset int
+		want          []float64
+	}{
+		{2, 0, []float64{4, 3}},
+		{2, 2, []float64{2, 1}},
+		{2, 4, []float64{5}},
+		{2, 5, nil},
+		{0, 0, nil},
+	}
+	for _, p := range pages {
+		metrics, err := s.GetMetrics(p.limit, p.offset)
+		if err != nil {
+			t.Fatalf("GetMetrics(%d, %d): %v", p.limit, p.offset, err)
+		}
+		var values []float64
+		for _, m := range metrics {
+			values = append(values, m.Value)
+		}
+		if !reflect.DeepEqual(values, p.want) {
+			t.Errorf("GetMetrics(%d, %d) values = %v, want %v", p.limit, p.offset, values, p.want)
+		}
+	}
+}
+
+func testSamples(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+
+	at := func(minutes int) time.Time { return now.Add(time.Duration(minutes) * time.Minute) }
+	sample := func(minutes int, value float64) *storage.Metric {
+		return &storage.Metric{Timestamp: at(minutes), MetricName: "temperature", Value: value, ServiceName: "sensor"}
+	}
+
+	// Out of order, across batches and across several hours
+	mustInsertMetrics(t, s, sample(-10, 1), sample(-30, 2), sample(-300, 3))
+	mustInsertMetrics(t, s, sample(-20, 4), sample(0, 5))
+	mustInsertMetrics(t, s, &storage.Metric{Timestamp: at(-15), MetricName: "other", Value: 6})
+	// A sample written again replaces the one with the same timestamp,
+	// across batches and within one
+	mustInsertMetrics(t, s, sample(-10, 7))
+	mustInsertMetrics(t, s, sample(-5, 8), sample(-5, 9))
+
+	series, err := s.SelectSeries(ctx, []*storage.LabelMatcher{matcher(t, storage.MetricNameLabel, "=", "temperature")}, minTime, maxTime)
+	if err != nil || len(series) != 1 {
+		t.Fatalf("SelectSeries(temperature) = %v, %v; want one series", series, err)
+	}
+	id := series[0].ID
+
+	result, err := s.GetSamples(ctx, []int64{id}, at(-400), at(10))
+	if err != nil {
+		t.Fatalf("GetSamples: %v", err)
+	}
+	want := []storage.Sample{
+		{Timestamp: at(-300).UnixNano(), Value: 3},
+		{Timestamp: at(-30).UnixNano(), Value: 2},
+		{Timestamp: at(-20).UnixNano(), Value: 4},
+		{Timestamp: at(-10).UnixNano(), Value: 7},
+		{Timestamp: at(-5).UnixNano(), Value: 9},
+		{Timestamp: at(0).UnixNano(), Value: 5},
+	}
+	if !reflect.DeepEqual(result[id], want) {
+		t.Errorf("GetSamples = %v, want %v", result[id], want)
+	}
+	if len(result) != 1 {
+		t.Errorf("GetSamples returned %d series, want 1", len(result))
+	}
+
+	// Both ends of the range are inclusive
+	result, err = s.GetSamples(ctx, []int64{id}, at(-30), at(-10))
+	if err != nil {
+		t.Fatalf("GetSamples: %v", err)
+	}
+	if !reflect.DeepEqual(result[id], want[1:4]) {
+		t.Errorf("GetSamples(-30m, -10m) = %v, want %v", result[id], want[1:4])
+	}
+
+	// Series without samples in the range are left out
+	result, err = s.GetSamples(ctx, []int64{id, id + 1000}, at(-200), at(-100))
+	if err != nil {
+		t.Fatalf("GetSamples: %v", err)
+	}
+	if len(result) != 0 {
+		t.Errorf("GetSamples(-200m, -100m) = %v, want no series", result)
+	}
+
+	// So are series selected over such a range
+	temperature := []*storage.LabelMatcher{matcher(t, storage.MetricNameLabel, "=", "temperature")}
+	if series, err := s.SelectSeries(ctx, temperature, at(-200), at(-100)); err != nil || len(series) != 0 {
+		t.Errorf("SelectSeries(temperature, -200m, -100m) = %v, %v; want none", series, err)
+	}
+	if series, err := s.SelectSeries(ctx, temperature, at(-300), at(-300)); err != nil || len(series) != 1 || series[0].ID != id {
+		t.Errorf("SelectSeries(temperature, -300m, -300m) = %v, %v; want series %d", series, err, id)
+	}
+}
+
+// seriesFixture stores the series the label tests select from
+func seriesFixture(t *testing.T, s storage.Storage, at time.Time) {
+	t.Helper()
+	mustInsertMetrics(t, s,
+		&storage.Metric{Timestamp: at, MetricName: "http_requests", Value: 1, Labels: `{"method":"GET","code":"200"}`, ServiceName: "api"},
+		&storage.Metric{Timestamp: at, MetricName: "http_requests", Value: 1, Labels: `{"method":"POST","code":"500"}`, ServiceName: "api"},
+		&storage.Metric{Timestamp: at, MetricName: "http_requests", Value: 1, Labels: `{"method":"GET"}`, ServiceName: "web"},
+		&storage.Metric{Timestamp: at, MetricName: "cpu_usage", Value: 1, ServiceName: "web", Resource: resource("web", "prod", "h1")},
+		// Numbers are labels in their literal form
+		&storage.Metric{Timestamp: at, MetricName: "queue_depth", Value: 1, Labels: `{"shard":3,"empty":""}`},
+	)
+}
+
+// seriesKey identifies a series in test failures
+func seriesKey(sr *storage.Series) string {
+	labels := storage.MetricLabels(sr.Labels, sr.ServiceName, sr.Resource)
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+labels[name])
+	}
+	return sr.MetricName + "{" + strings.Join(parts, ",") + "}"
+}
+
+func testSelectSeries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	seriesFixture(t, s, base())
+	// The same series again is not stored twice
+	seriesFixture(t, s, base().Add(time.Minute))
+
+	getOK := "http_requests{code=200,method=GET,service_name=api}"
+	post := "http_requests{code=500,method=POST,service_name=api}"
+	getWeb := "http_requests{method=GET,service_name=web}"
+	cpu := "cpu_usage{deployment_environment=prod,host_name=h1,service_name=web}"
+	queue := "queue_depth{shard=3}"
+
+	tests := []struct {
+		matchers [][3]string
+		want     []string
+	}{
+		{nil, []string{getOK, post, getWeb, cpu, queue}},
+		{[][3]string{{"__name__", "=", "http_requests"}}, []string{getOK, post, getWeb}},
+		{[][3]string{{"__name__", "=", "http_requests"}, {"method", "!=", "GET"}}, []string{post}},
+		{[][3]string{{"__name__", "=~", "http_.*"}, {"code", "=~", "2.."}}, []string{getOK}},
+		{[][3]string{{"code", "=", ""}}, []string{getWeb, cpu, queue}},
+		{[][3]string{{"code", "!=", ""}}, []string{getOK, post}},
+		{[][3]string{{"__name__", "!~", "http.*"}}, []string{cpu, queue}},
+		{[][3]string{{"__name__", "=~", "http"}}, nil},
+		{[][3]string{{"host_name", "=", "h1"}}, []string{cpu}},
+		{[][3]string{{"service_name", "=", "web"}}, []string{getWeb, cpu}},
+		{[][3]string{{"shard", "=", "3"}}, []string{queue}},
+		{[][3]string{{"empty", "!=", ""}}, nil},
+		{[][3]string{{"method", "=~", "GET|POST"}, {"service_name", "!=", "web"}}, []string{getOK, post}},
+		{[][3]string{{"__name__", "=", "missing"}}, nil},
+	}
+
+	for _, test := range tests {
+		var matchers []*storage.LabelMatcher
+		for _, m := range test.matchers {
+			matchers = append(matchers, matcher(t, m[0], m[1], m[2]))
+		}
+		series, err := s.SelectSeries(ctx, matchers, minTime, maxTime)
+		if err != nil {
+			t.Errorf("SelectSeries(%v): %v", test.matchers, err)
+			continue
+		}
+
+		var got []string
+		for i, sr := range series {
+			if i > 0 && sr.ID <= series[i-1].ID {
+				t.Errorf("SelectSeries(%v) is not sorted by ID", test.matchers)
+			}
+			got = append(got, seriesKey(sr))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SelectSeries(%v) = %q, want %q", test.matchers, got, test.want)
+		}
+	}
+}
+
+func testLabels(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+	seriesFixture(t, s, now)
+	mustInsertMetrics(t, s, &storage.Metric{Timestamp: now.Add(-10 * 24 * time.Hour), MetricName: "old_metric",
+		Value: 1, Labels: `{"era":"past"}`})
+	if err := s.InsertExponentialHistograms([]*storage.ExponentialHistogram{
+		{Timestamp: now, MetricName: "latency", Labels: `{"route":"/home"}`, ServiceName: "web",
+			Histogram: &histogram.Exponential{Count: 1}},
+	}); err != nil {
+		t.Fatalf("InsertExponentialHistograms: %v", err)
+	}
+
+	everything := [2]time.Time{now.Add(-30 * 24 * time.Hour), now.Add(time.Hour)}
+	recent := [2]time.Time{now.Add(-time.Hour), now.Add(time.Hour)}
+
+	tests := []struct {
+		name     string
+		label    string // empty for LabelNames
+		matchers [][3]string
+		window   [2]time.Time
+		want     []string
+	}{
+		{"all names", "", nil, everything, []string{"__name__", "code", "deployment_environment", "era", "host_name",
+			"method", "route", "service_name", "shard"}},
+		{"recent names", "", nil, recent, []string{"__name__", "code", "deployment_environment", "host_name",
+			"method", "route", "service_name", "shard"}},
+		{"names of matching series", "", [][3]string{{"service_name", "=", "web"}}, everything, []string{"__name__",
+			"deployment_environment", "host_name", "method", "route", "service_name"}},
+		{"metric names", "__name__", nil, everything, []string{"cpu_usage", "http_requests", "latency", "old_metric", "queue_depth"}},
+		{"recent metric names", "__name__", nil, recent, []string{"cpu_usage", "http_requests", "latency", "queue_depth"}},
+		{"values", "method", nil, everything, []string{"GET", "POST"}},
+		{"values of matching series", "method", [][3]string{{"service_name", "=", "web"}}, everything, []string{"GET"}},
+		{"histogram values", "route", nil, everything, []string{"/home"}},
+		{"no matching series", "method", [][3]string{{"__name__", "=", "missing"}}, everything, nil},
+		{"missing label", "missing", nil, everything, nil},
+	}
+
+	for _, test := range tests {
+		var matchers []*storage.LabelMatcher
+		for _, m := range test.matchers {
+			matchers = append(matchers, matcher(t, m[0], m[1], m[2]))
+		}
+
+		var got []string
+		var err error
+		if test.label == "" {
+			got, err = s.LabelNames(ctx, matchers, test.window[0], test.window[1])
+		} else {
+			got, err = s.LabelValues(ctx, test.label, matchers, test.window[0], test.window[1])
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(got) == 0 {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func testHistograms(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+
+	h := func(count float64) *histogram.Exponential {
+		return &histogram.Exponential{
+			Scale:         2,
+			ZeroThreshold: 0.001,
+			ZeroCount:     1,
+			Count:         count,
+			Sum:           count * 1.5,
+			Positive:      histogram.Buckets{Offset: -1, Counts: []float64{1, count - 2}},
+			Negative:      histogram.Buckets{Counts: []float64{}},
+		}
+	}
+
+	if err := s.InsertExponentialHistograms([]*storage.ExponentialHistogram{
+		{Timestamp: now, MetricName: "latency", Labels: `{"route":"/"}`, ServiceName: "api", Histogram: h(10),
+			Resource: resource("api", "", "")},
+		{Timestamp: now.Add(-time.Minute), MetricName: "latency", Labels: `{"route":"/"}`, ServiceName: "api", Histogram: h(5)},
+		{Timestamp: now.Add(-30 * time.Second), MetricName: "size", ServiceName: "api", Histogram: h(3)},
+	}); err != nil {
+		t.Fatalf("InsertExponentialHistograms: %v", err)
+	}
+	if err := s.InsertExponentialHistogram(&storage.ExponentialHistogram{Timestamp: now.Add(-2 * time.Hour),
+		MetricName: "latency", ServiceName: "api", Histogram: h(7)}); err != nil {
+		t.Fatalf("InsertExponentialHistogram: %v", err)
+	}
+
+	histograms, err := s.GetExponentialHistograms(ctx,
+		[]*storage.LabelMatcher{matcher(t, "__name__", "=", "latency")}, now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("GetExponentialHistograms: %v", err)
+	}
+	if len(histograms) != 2 {
+		t.Fatalf("GetExponentialHistograms(latency) returned %d histograms, want 2", len(histograms))
+	}
+	// Oldest first, both ends of the range inclusive
+	if got := histograms[0]; !got.Timestamp.Equal(now.Add(-time.Minute)) || !reflect.DeepEqual(got.Histogram, h(5)) {
+		t.Errorf("first histogram = %v %+v, want %v %+v", got.Timestamp, got.Histogram, now.Add(-time.Minute), h(5))
+	}
+	got := histograms[1]
+	if !got.Timestamp.Equal(now) || !reflect.DeepEqual(got.Histogram, h(10)) {
+		t.Errorf("second histogram = %v %+v, want %v %+v", got.Timestamp, got.Histogram, now, h(10))
+	}
+	if got.MetricName != "latency" || got.ServiceName != "api" || !sameJSON(got.Labels, `{"route":"/"}`) || got.ID == 0 {
+		t.Errorf("second histogram = %+v, want latency{route=/} of api", got)
+	}
+	if got.Resource == nil || got.Resource.ServiceName != "api" || histograms[0].Resource != nil {
+		t.Errorf("histogram resources = %+v, %+v; want none, then api", histograms[0].Resource, got.Resource)
+	}
+
+	// All metrics
+	histograms, err = s.GetExponentialHistograms(ctx, nil, now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("GetExponentialHistograms: %v", err)
+	}
+	var names []string
+	for _, h := range histograms {
+		names = append(names, h.MetricName)
+	}
+	if want := []string{"latency", "size", "latency"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("GetExponentialHistograms(nil) = %q, want %q", names, want)
+	}
+
+	// Matchers apply to every label, the metric name included
+	for _, test := range []struct {
+		matchers [][3]string
+		want     int
+	}{
+		{[][3]string{{"route", "=", "/"}}, 2},
+		{[][3]string{{"route", "=", ""}}, 1},
+		{[][3]string{{"__name__", "=~", "size|missing"}}, 1},
+		{[][3]string{{"__name__", "!=", "size"}, {"service_name", "=", "api"}}, 2},
+		{[][3]string{{"__name__", "=", "missing"}}, 0},
+		{[][3]string{{"service_name", "=", "web"}}, 0},
+	} {
+		var matchers []*storage.LabelMatcher
+		for _, m := range test.matchers {
+			matchers = append(matchers, matcher(t, m[0], m[1], m[2]))
+		}
+		histograms, err := s.GetExponentialHistograms(ctx, matchers, now.Add(-time.Hour), now)
+		if err != nil {
+			t.Fatalf("GetExponentialHistograms(%v): %v", test.matchers, err)
+		}
+		if len(histograms) != test.want {
+			t.Errorf("GetExponentialHistograms(%v) returned %d histograms, want %d", test.matchers, len(histograms), test.want)
+		}
+	}
+}
+
+func testHistogramBatchErrors(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+
+	// Histograms that cannot be encoded fail on their own
+	err := s.InsertExponentialHistograms([]*storage.ExponentialHistogram{
+		{Timestamp: now, MetricName: "good", Histogram: &histogram.Exponential{Count: 1}},
+		{Timestamp: now, MetricName: "bad", Histogram: &histogram.Exponential{Count: 1, Sum: math.NaN()}},
+		{Timestamp: now, MetricName: "good", Histogram: &histogram.Exponential{Count: 2}},
+	})
+	var batchErr *storage.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("InsertExponentialHistograms = %v, want a *BatchError", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+		t.Errorf("failed records = %v, want record 1", batchErr.Errors)
+	}
+	if errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("invalid record reported as storage unavailable: %v", err)
+	}
+	failures := storage.BatchFailures(err, 3)
+	if len(failures) != 1 || failures[1] == nil {
+		t.Errorf("BatchFailures = %v, want record 1", failures)
+	}
+
+	histograms, err := s.GetExponentialHistograms(ctx, nil, now, now)
+	if err != nil {
+		t.Fatalf("GetExponentialHistograms: %v", err)
+	}
+	if len(histograms) != 2 {
+		t.Errorf("stored %d histograms, want the 2 valid ones", len(histograms))
+	}
+
+	// A single failing record returns its own error
+	err = s.InsertExponentialHistogram(&storage.ExponentialHistogram{Timestamp: now, MetricName: "bad",
+		Histogram: &histogram.Exponential{Sum: math.Inf(1)}})
+	if err == nil || errors.As(err, &batchErr) {
+		t.Errorf("InsertExponentialHistogram(invalid) = %v, want the record's error", err)
+	}
+}
+
+func testTraces(t *testing.T, s storage.Storage) {
+	now := base()
+	root := &storage.Trace{
+		TraceID:       "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:        "00f067aa0ba902b7",
+		TraceState:    "vendor=value",
+		ServiceName:   "api",
+		OperationName: "GET /users",
+		Kind:          "SERVER",
+		StartTime:     now.Add(-time.Second),
+		DurationNanos: int64(250 * time.Millisecond),
+		Attributes:    `{"http.method":"GET","http.status_code":200}`,
+		Events:        `[{"name":"cache miss","timestamp":1}]`,
+		Links:         `[{"trace_id":"0af7651916cd43dd8448eb211c80319c","span_id":"b7ad6b7169203331"}]`,
+		StatusCode:    "OK",
+		StatusMessage: "fine",
+		ScopeName:     "net/http",
+		ScopeVersion:  "1.0",
+	}
+	child := &storage.Trace{
+		TraceID:       root.TraceID,
+		SpanID:        "a1b2c3d4e5f60708",
+		ParentSpanID:  stringPtr(root.SpanID),
+		ServiceName:   "api",
+		OperationName: "SELECT users",
+		Kind:          "CLIENT",
+		StartTime:     now.Add(-900 * time.Millisecond),
+		DurationNanos: int64(100 * time.Millisecond),
+		Attributes:    `{"db.system":"postgresql"}`,
+		StatusCode:    "UNSET",
+	}
+	older := &storage.Trace{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331",
+		ServiceName: "worker", OperationName: "job", StartTime: now.Add(-time.Minute), Attributes: `{}`}
+
+	if err := s.InsertTraces([]*storage.Trace{root, older}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+	if err := s.InsertTrace(child); err != nil {
+		t.Fatalf("InsertTrace: %v", err)
+	}
+
+	traces, err := s.GetTraces(10, 0)
+	if err != nil {
+		t.Fatalf("GetTraces: %v", err)
+	}
+	var spans []string
+	for _, trace := range traces {
+		spans = append(spans, trace.SpanID)
+	}
+	// Newest first
+	if want := []string{child.SpanID, root.SpanID, older.SpanID}; !reflect.DeepEqual(spans, want) {
+		t.Fatalf("GetTraces spans = %q, want %q", spans, want)
+	}
+
+	got := traces[1]
+	if got.ID == 0 || got.TraceID != root.TraceID || got.TraceState != root.TraceState || got.ServiceName != root.ServiceName ||
+		got.OperationName != root.OperationName || got.Kind != root.Kind || !got.StartTime.Equal(root.StartTime) ||
+		got.DurationNanos != root.DurationNanos || got.StatusCode != root.StatusCode ||
+		got.StatusMessage != root.StatusMessage || got.ScopeName != root.ScopeName || got.ScopeVersion != root.ScopeVersion {
+		t.Errorf("root span = %+v, want %+v", got, root)
+	}
+	if !sameJSON(got.Attributes, root.Attributes) || !sameJSON(got.Events, root.Events) || !sameJSON(got.Links, root.Links) {
+		t.Errorf("root span JSON = %s %s %s, want %s %s %s", got.Attributes, got.Events, got.Links,
+			root.Attributes, root.Events, root.Links)
+	}
+
+	// Root spans have no parent; spans without events or links have empty
+	// lists of them
+	if got.ParentSpanID != nil {
+		t.Errorf("root span parent = %q, want nil", *got.ParentSpanID)
+	}
+	if traces[0].ParentSpanID == nil || *traces[0].ParentSpanID != root.SpanID {
+		t.Errorf("child span parent = %v, want %q", traces[0].ParentSpanID, root.SpanID)
+	}
+	if !sameJSON(traces[0].Events, `[]`) || !sameJSON(traces[0].Links, `[]`) {
+		t.Errorf("child span events and links = %s %s, want [] []", traces[0].Events, traces[0].Links)
+	}
+	if traces[0].Resource != nil {
+		t.Errorf("span without a resource has resource %+v", traces[0].Resource)
+	}
+
+	// Records read back are not shared with those inserted or returned
+	*child.ParentSpanID = "changed"
+	again, err := s.GetTraces(1, 0)
+	if err != nil || len(again) != 1 || again[0].ParentSpanID == nil || *again[0].ParentSpanID != root.SpanID {
+		t.Errorf("child span parent after changing the inserted span = %v, %v", again, err)
+	}
+
+	pages := []struct {
+		limit, offset int
+		want          []string
+	}{
+		{1, 0, []string{child.SpanID}},
+		{2, 1, []string{root.SpanID, older.SpanID}},
+		{5, 3, nil},
+	}
+	for _, p := range pages {
+		traces, err := s.GetTraces(p.limit, p.offset)
+		if err != nil {
+			t.Fatalf("GetTraces(%d, %d): %v", p.limit, p.offset, err)
+		}
+		var spans []string
+		for _, trace := range traces {
+			spans = append(spans, trace.SpanID)
+		}
+		if !reflect.DeepEqual(spans, p.want) {
+			t.Errorf("GetTraces(%d, %d) = %q, want %q", p.limit, p.offset, spans, p.want)
+		}
+	}
+}
+
+func testFindTraces(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	api := resource("api", "prod", "")
+	worker := resource("worker", "staging", "")
+
+	if err := s.InsertTraces([]*storage.Trace{
+		{TraceID: traceID, SpanID: "a000000000000001", ServiceName: "api", OperationName: "GET /users", Kind: "SERVER",
+			StatusCode: "OK", StartTime: now.Add(-10 * time.Second), DurationNanos: int64(250 * time.Millisecond),
+			Attributes: `{"http.method":"GET","http.status_code":200,"cached":false}`, Resource: api},
+		{TraceID: traceID, SpanID: "b000000000000002", ParentSpanID: stringPtr("a000000000000001"), ServiceName: "api",
+			OperationName: "SELECT users", Kind: "CLIENT", StatusCode: "UNSET", StartTime: now.Add(-9 * time.Second),
+			DurationNanos: int64(100 * time.Millisecond), Attributes: `{"db.system":"postgresql"}`, Resource: api},
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "c000000000000003", ServiceName: "worker",
+			OperationName: "job", Kind: "INTERNAL", StatusCode: "ERROR", StartTime: now.Add(-5 * time.Second),
+			DurationNanos: int64(2 * time.Second), Attributes: `{"job.id":"42","retry":true}`, Resource: worker},
+		{TraceID: "1af7651916cd43dd8448eb211c80319c", SpanID: "d000000000000004", ServiceName: "legacy",
+			OperationName: "GET /users", Kind: "SERVER", StatusCode: "OK", StartTime: now.Add(-time.Minute),
+			DurationNanos: int64(50 * time.Millisecond)},
+		{TraceID: "2af7651916cd43dd8448eb211c80319c", SpanID: "e000000000000005", ServiceName: "api",
+			OperationName: "GET /users", Kind: "SERVER", StatusCode: "OK", StartTime: now.Add(-2 * time.Hour),
+			DurationNanos: int64(time.Second), Attributes: `{"http.method":"GET"}`, Resource: api},
+	}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query storage.TraceQuery
+		want  string // span IDs by their first letter, newest first
+	}{
+		{"everything", storage.TraceQuery{}, "cbade"},
+		{"trace ID in uppercase", storage.TraceQuery{TraceID: strings.ToUpper(traceID)}, "ba"},
+		{"service", storage.TraceQuery{ServiceName: "api"}, "bae"},
+		{"operation", storage.TraceQuery{OperationName: "GET /users"}, "ade"},
+		{"kind", storage.TraceQuery{Kind: "CLIENT"}, "b"},
+		{"status", storage.TraceQuery{StatusCode: "ERROR"}, "c"},
+		{"minimum duration", storage.TraceQuery{MinDuration: 200 * time.Millisecond}, "cae"},
+		{"maximum duration", storage.TraceQuery{MaxDuration: 100 * time.Millisecond}, "bd"},
+		{"duration range", storage.TraceQuery{MinDuration: 100 * time.Millisecond, MaxDuration: time.Second}, "bae"},
+		{"string attribute", storage.TraceQuery{Attributes: map[string]string{"http.method": "GET"}}, "ae"},
+		{"number attribute", storage.TraceQuery{Attributes: map[string]string{"http.status_code": "200"}}, "a"},
+		{"true attribute", storage.TraceQuery{Attributes: map[string]string{"retry": "true"}}, "c"},
+		{"false attribute", storage.TraceQuery{Attributes: map[string]string{"cached": "false"}}, "a"},
+		{"numeric string attribute", storage.TraceQuery{Attributes: map[string]string{"job.id": "42"}}, "c"},
+		{"all attributes", storage.TraceQuery{Attributes: map[string]string{"http.method": "GET", "http.status_code": "500"}}, ""},
+		{"empty attribute", storage.TraceQuery{Attributes: map[string]string{"http.method": ""}}, "cbade"},
+		{"missing attribute", storage.TraceQuery{Attributes: map[string]string{"missing": "x"}}, ""},
+		{"resource", storage.TraceQuery{Resource: storage.ResourceFilter{DeploymentEnvironment: "staging"}}, "c"},
+		{"inclusive time range", storage.TraceQuery{Start: now.Add(-time.Minute), End: now.Add(-9 * time.Second)}, "bad"},
+		{"open end", storage.TraceQuery{Start: now.Add(-30 * time.Second)}, "cba"},
+		{"open start", storage.TraceQuery{End: now.Add(-time.Hour)}, "e"},
+		{"limit", storage.TraceQuery{Limit: 2}, "cb"},
+		{"page", storage.TraceQuery{Limit: 2, Offset: 2}, "ad"},
+		{"past the end", storage.TraceQuery{Offset: 5}, ""},
+		{"combined", storage.TraceQuery{ServiceName: "api", OperationName: "GET /users", Start: now.Add(-time.Hour)}, "a"},
+	}
+
+	for _, test := range tests {
+		traces, err := s.FindTraces(ctx, test.query)
+		if err != nil {
+			t.Errorf("FindTraces(%s): %v", test.name, err)
+			continue
+		}
+		got := ""
+		for _, trace := range traces {
+			got += trace.SpanID[:1]
+		}
+		if got != test.want {
+			t.Errorf("FindTraces(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// Spans found are complete
+	traces, err := s.FindTraces(ctx, storage.TraceQuery{Kind: "CLIENT"})
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("FindTraces(CLIENT) = %v, %v", traces, err)
+	}
+	got := traces[0]
+	if got.ParentSpanID == nil || *got.ParentSpanID != "a000000000000001" || got.OperationName != "SELECT users" ||
+		!got.StartTime.Equal(now.Add(-9*time.Second)) || got.Resource == nil || got.Resource.ServiceName != "api" {
+		t.Errorf("FindTraces(CLIENT) = %s, want the SELECT users span", describe(got))
+	}
+}
+
+func testLogs(t *testing.T, s storage.Storage) {
+	now := base()
+	correlated := &storage.Log{
+		Timestamp:         now,
+		ObservedTimestamp: now.Add(time.Millisecond),
+		ServiceName:       "api",
+		Level:             "ERROR",
+		SeverityNumber:    17,
+		EventName:         "request.failed",
+		Message:           "request failed",
+		Body:              `{"error":"timeout","retries":3}`,
+		Attributes:        `{"user.id":"42"}`,
+		TraceID:           stringPtr("4bf92f3577b34da6a3ce929d0e0e4736"),
+		SpanID:            stringPtr("00f067aa0ba902b7"),
+		Flags:             1,
+		ScopeName:         "logger",
+		ScopeVersion:      "2.0",
+		ScopeAttributes:   `{"logger.kind":"structured"}`,
+	}
+	plain := &storage.Log{Timestamp: now.Add(-time.Minute), ServiceName: "api", Level: "INFO", SeverityNumber: 9,
+		Message: "started", Attributes: `{}`}
+	oldest := &storage.Log{Timestamp: now.Add(-2 * time.Minute), ServiceName: "worker", Level: "DEBUG",
+		SeverityNumber: 5, Message: "tick", Body: `"tick"`, Attributes: `{}`}
+
+	if err := s.InsertLogs([]*storage.Log{plain, correlated}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+	if err := s.InsertLog(oldest); err != nil {
+		t.Fatalf("InsertLog: %v", err)
+	}
+
+	logs, err := s.GetLogs(10, 0)
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	var messages []string
+	for _, l := range logs {
+		messages = append(messages, l.Message)
+	}
+	// Newest first
+	if want := []string{"request failed", "started", "tick"}; !reflect.DeepEqual(messages, want) {
+		t.Fatalf("GetLogs messages = %q, want %q", messages, want)
+	}
+
+	got := logs[0]
+	if got.ID == 0 || !got.Timestamp.Equal(correlated.Timestamp) || !got.ObservedTimestamp.Equal(correlated.ObservedTimestamp) ||
+		got.ServiceName != correlated.ServiceName || got.Level != correlated.Level ||
+		got.SeverityNumber != correlated.SeverityNumber || got.EventName != correlated.EventName ||
+		got.Flags != correlated.Flags || got.ScopeName != correlated.ScopeName || got.ScopeVersion != correlated.ScopeVersion {
+		t.Errorf("log = %+v, want %+v", got, correlated)
+	}
+	if !sameJSON(got.Body, correlated.Body) || !sameJSON(got.Attributes, correlated.Attributes) ||
+		!sameJSON(got.ScopeAttributes, correlated.ScopeAttributes) {
+		t.Errorf("log JSON = %s %s %s, want %s %s %s", got.Body, got.Attributes, got.ScopeAttributes,
+			correlated.Body, correlated.Attributes, correlated.ScopeAttributes)
+	}
+	if got.TraceID == nil || *got.TraceID != *correlated.TraceID || got.SpanID == nil || *got.SpanID != *correlated.SpanID {
+		t.Errorf("log trace context = %v %v, want %s %s", got.TraceID, got.SpanID, *correlated.TraceID, *correlated.SpanID)
+	}
+
+	// Logs outside of a trace have no trace or span ID, an unset observed
+	// time stays unset, and a log without a body has a null one
+	if logs[1].TraceID != nil || logs[1].SpanID != nil {
+		t.Errorf("uncorrelated log trace context = %v %v, want nil nil", logs[1].TraceID, logs[1].SpanID)
+	}
+	if !logs[1].ObservedTimestamp.IsZero() {
+		t.Errorf("unset observed timestamp read back as %v", logs[1].ObservedTimestamp)
+	}
+	if !sameJSON(logs[1].Body, `null`) {
+		t.Errorf("log without a body has body %s, want null", logs[1].Body)
+	}
+	if !sameJSON(logs[2].Body, `"tick"`) {
+		t.Errorf("log body = %s, want \"tick\"", logs[2].Body)
+	}
+
+	pages := []struct {
+		limit, offset int
+		want          []string
+	}{
+		{1, 1, []string{"started"}},
+		{10, 2, []string{"tick"}},
+		{10, 3, nil},
+	}
+	for _, p := range pages {
+		logs, err := s.GetLogs(p.limit, p.offset)
+		if err != nil {
+			t.Fatalf("GetLogs(%d, %d): %v", p.limit, p.offset, err)
+		}
+		var messages []string
+		for _, l := range logs {
+			messages = append(messages, l.Message)
+		}
+		if !reflect.DeepEqual(messages, p.want) {
+			t.Errorf("GetLogs(%d, %d) = %q, want %q", p.limit, p.offset, messages, p.want)
+		}
+	}
+}
+
+func testSearchLogs(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	api := resource("api", "prod", "")
+
+	if err := s.InsertLogs([]*storage.Log{
+		{Timestamp: now.Add(-10 * time.Second), ServiceName: "api", Level: "INFO", SeverityNumber: 9,
+			Message: "user 42 logged in", Attributes: `{"user.id":"42","attempt":1}`, TraceID: stringPtr(traceID),
+			SpanID: stringPtr("a000000000000001"), Resource: api},
+		{Timestamp: now.Add(-8 * time.Second), ServiceName: "api", Level: "ERROR", SeverityNumber: 17,
+			Message: "Payment failed: card declined", Attributes: `{"retryable":false}`, TraceID: stringPtr(traceID),
+			SpanID: stringPtr("b000000000000002"), Resource: api},
+		{Timestamp: now.Add(-5 * time.Second), ServiceName: "worker", Level: "WARN", SeverityNumber: 13,
+			Message: "queue is filling up", Attributes: `{"queue":"payments"}`, Resource: resource("worker", "staging", "")},
+		{Timestamp: now.Add(-time.Minute), ServiceName: "legacy", Level: "DEBUG", SeverityNumber: 5,
+			Message: "legacy payment check"},
+		{Timestamp: now.Add(-2 * time.Hour), ServiceName: "api", Level: "ERROR", SeverityNumber: 17,
+			Message: "payment failed", Attributes: `{}`, Resource: api},
+	}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query storage.LogQuery
+		want  []string // first words of the messages, newest first
+	}{
+		{"everything", storage.LogQuery{}, []string{"queue", "Payment", "user", "legacy", "payment"}},
+		{"service", storage.LogQuery{ServiceName: "api"}, []string{"Payment", "user", "payment"}},
+		{"severity", storage.LogQuery{MinSeverity: 13}, []string{"queue", "Payment", "payment"}},
+		{"text", storage.LogQuery{Contains: "payment"}, []string{"legacy", "payment"}},
+		{"more text", storage.LogQuery{Contains: "failed"}, []string{"Payment", "payment"}},
+		{"trace ID in uppercase", storage.LogQuery{TraceID: strings.ToUpper(traceID)}, []string{"Payment", "user"}},
+		{"span ID", storage.LogQuery{SpanID: "b000000000000002"}, []string{"Payment"}},
+		{"string attribute", storage.LogQuery{Attributes: map[string]string{"user.id": "42"}}, []string{"user"}},
+		{"number attribute", storage.LogQuery{Attributes: map[string]string{"attempt": "1"}}, []string{"user"}},
+		{"false attribute", storage.LogQuery{Attributes: map[string]string{"retryable": "false"}}, []string{"Payment"}},
+		{"resource", storage.LogQuery{Resource: storage.ResourceFilter{DeploymentEnvironment: "staging"}}, []string{"queue"}},
+		{"inclusive time range", storage.LogQuery{Start: now.Add(-10 * time.Second), End: now.Add(-5 * time.Second)},
+			[]string{"queue", "Payment", "user"}},
+		{"open start", storage.LogQuery{End: now.Add(-time.Hour)}, []string{"payment"}},
+		{"page", storage.LogQuery{Limit: 1, Offset: 1}, []string{"Payment"}},
+		{"past the end", storage.LogQuery{Offset: 10}, nil},
+		{"combined", storage.LogQuery{ServiceName: "api", MinSeverity: 17, Start: now.Add(-time.Hour)}, []string{"Payment"}},
+	}
+
+	for _, test := range tests {
+		logs, err := s.SearchLogs(ctx, test.query)
+		if err != nil {
+			t.Errorf("SearchLogs(%s): %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, l := range logs {
+			got = append(got, strings.Fields(l.Message)[0])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SearchLogs(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// Records found are complete
+	logs, err := s.SearchLogs(ctx, storage.LogQuery{SpanID: "a000000000000001"})
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("SearchLogs(span a) = %v, %v", logs, err)
+	}
+	got := logs[0]
+	if got.TraceID == nil || *got.TraceID != traceID || got.Level != "INFO" || !got.Timestamp.Equal(now.Add(-10*time.Second)) ||
+		!sameJSON(got.Attributes, `{"user.id":"42","attempt":1}`) || got.Resource == nil || got.Resource.ServiceName != "api" {
+		t.Errorf("SearchLogs(span a) = %s, want the login record", describe(got))
+	}
+}
+
+func testRetention(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	now := base()
+	expired := now.Add(-(RetentionDays + 10) * 24 * time.Hour)
+
+	mustInsertMetrics(t, s,
+		&storage.Metric{Timestamp: expired, MetricName: "expired_metric", Value: 1, ServiceName: "old"},
+		&storage.Metric{Timestamp: expired, MetricName: "mixed_metric", Value: 1, ServiceName: "api"},
+		&storage.Metric{Timestamp: now, MetricName: "mixed_metric", Value: 2, ServiceName: "api"},
+	)
+	if err := s.InsertExponentialHistograms([]*storage.ExponentialHistogram{
+		{Timestamp: expired, MetricName: "latency", ServiceName: "old", Histogram: &histogram.Exponential{Count: 1}},
+		{Timestamp: now, MetricName: "latency", ServiceName: "api", Histogram: &histogram.Exponential{Count: 2}},
+	}); err != nil {
+		t.Fatalf("InsertExponentialHistograms: %v", err)
+	}
+	if err := s.InsertTraces([]*storage.Trace{
+		{TraceID: "t1", SpanID: "expired", ServiceName: "old", StartTime: expired, Attributes: `{}`},
+		{TraceID: "t2", SpanID: "recent", ServiceName: "api", StartTime: now, Attributes: `{}`},
+	}); err != nil {
+		t.Fatalf("InsertTraces: %v", err)
+	}
+	if err := s.InsertLogs([]*storage.Log{
+		{Timestamp: expired, ServiceName: "old", Message: "expired", Attributes: `{}`},
+		{Timestamp: now, ServiceName: "api", Message: "recent", Attributes: `{}`},
+	}); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+
+	if err := s.CleanupOldData(); err != nil {
+		t.Fatalf("CleanupOldData: %v", err)
+	}
+
+	series, err := s.SelectSeries(ctx, nil, minTime, maxTime)
+	if err != nil {
+		t.Fatalf("SelectSeries: %v", err)
+	}
+	if len(series) != 1 || series[0].MetricName != "mixed_metric" {
+		var keys []string
+		for _, sr := range series {
+			keys = append(keys, seriesKey(sr))
+		}
+		t.Fatalf("series after cleanup = %q, want only mixed_metric", keys)
+	}
+	samples, err := s.GetSamples(ctx, []int64{series[0].ID}, expired.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("GetSamples: %v", err)
+	}
+	if want := []storage.Sample{{Timestamp: now.UnixNano(), Value: 2}}; !reflect.DeepEqual(samples[series[0].ID], want) {
+		t.Errorf("samples after cleanup = %v, want %v", samples[series[0].ID], want)
+	}
+	names, err := s.LabelValues(ctx, storage.MetricNameLabel, nil, expired.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("LabelValues: %v", err)
+	}
+	if want := []string{"latency", "mixed_metric"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("metric names after cleanup = %q, want %q", names, want)
+	}
+
+	histograms, err := s.GetExponentialHistograms(ctx, nil, expired.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("GetExponentialHistograms: %v", err)
+	}
+	if len(histograms) != 1 || histograms[0].ServiceName != "api" {
+		t.Errorf("histograms after cleanup = %s, want the recent one", describe(histograms))
+	}
+
+	traces, err := s.GetTraces(10, 0)
+	if err != nil {
+		t.Fatalf("GetTraces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].SpanID != "recent" {
+		t.Errorf("spans after cleanup = %v, want the recent one", describe(traces))
+	}
+	logs, err := s.GetLogs(10, 0)
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	if len(logs) != 1 || logs[0].Message != "recent" {
+		t.Errorf("logs after cleanup = %v, want the recent one", describe(logs))
+	}
+
+	services, err := s.GetServices(storage.ResourceFilter{})
+	if err != nil {
+		t.Fatalf("GetServices: %v", err)
+	}
+	if want := []string{"api"}; !reflect.DeepEqual(services, want) {
+		t.Errorf("services after cleanup = %q, want %q", services, want)
+	}
+
+	// Storage keeps working after a cleanup
+	mustInsertMetrics(t, s, &storage.Metric{Timestamp: now.Add(time.Second), MetricName: "expired_metric", Value: 3})
+	series, err = s.SelectSeries(ctx, []*storage.LabelMatcher{matcher(t, storage.MetricNameLabel, "=", "expired_metric")}, minTime, maxTime)
+	if err != nil || len(series) != 1 {
+		t.Errorf("SelectSeries(expired_metric) after storing it again = %v, %v", series, err)
+	}
+}
+
+// describe renders records in test failures
+func describe(records interface{}) string {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Sprint(records)
+	}
+	return string(data)
+}
@@ -85,15 +85,34 @@ func (s *Service) GetLogs(c *gin.Context) {
 	})
 }
 
+// GetServices lists the reporting services and the resources they reported
+// from. Both can be filtered by resource attribute, e.g.
+// ?deployment.environment=production.
 func (s *Service) GetServices(c *gin.Context) {
-	services, err := s.storage.GetServices()
+	filter := storage.ResourceFilter{
+		ServiceName:           c.Query("service.name"),
+		ServiceNamespace:      c.Query("service.namespace"),
+		ServiceVersion:        c.Query("service.version"),
+		DeploymentEnvironment: c.Query("deployment.environment"),
+		HostName:              c.Query("host.name"),
+		ServiceInstanceID:     c.Query("service.instance.id"),
+	}
+
+	services, err := s.storage.GetServices(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resources, err := s.storage.GetResources(filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"services": services,
+		"services":  services,
+		"resources": resources,
 	})
 }
 
@@ -23,36 +23,50 @@ import (
 
 var (
 	configPath = flag.String("config", "config.yaml", "Path to configuration file")
+	ephemeral  = flag.Bool("ephemeral", false, "Keep all data in memory and write nothing to disk")
 	version    = "0.2.1"
 )
 
 func main() {
 	flag.Parse()
 
-	// Load configuration
-	cfg, err := config.Load(*configPath)
-	if err != nil {
+	// Load configuration. Ephemeral runs do not write a default
+	// configuration file.
+	var cfg *config.Config
+	var err error
+	if _, statErr := os.Stat(*configPath); *ephemeral && os.IsNotExist(statErr) {
+		cfg = config.DefaultConfig()
+	} else if cfg, err = config.Load(*configPath); err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	if *ephemeral {
+		cfg.Storage.Type = "memory"
+		cfg.Ingestion.Spool.Enabled = false
+		log.Println("Running in ephemeral mode: data is kept in memory and lost on exit")
+	}
+
 	// Initialize storage
-	storage, err := storage.NewSQLiteStorage(cfg.Storage)
+	storage, err := storage.New(cfg.Storage)
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 	defer storage.Close()
 
 	// Initialize ingestion service
-	ingestionService := ingestion.NewService(storage, cfg.Ingestion)
+	ingestionService, err := ingestion.NewService(storage, cfg.Ingestion)
+	if err != nil {
+		log.Fatalf("Failed to initialize ingestion service: %v", err)
+	}
 
 	// Initialize web service
 	webService := web.NewService(storage, cfg.Web, version)
 
 	// Initialize dogfood service
-	dogfoodService := dogfood.NewService(cfg.Web, storage, cfg.Server.Port)
+	dogfoodService := dogfood.NewService(cfg.Web, storage)
 
 	// Initialize query service
-	queryService := query.NewService(storage.GetDB())
+	queryService := query.NewService(storage)
 
 	// Set up Gin router
 	if cfg.Server.Environment == "production" {
@@ -134,10 +148,19 @@ func registerRoutes(router *gin.Engine, ingestionService *ingestion.Service, web
 		api.GET("/traces", webService.GetTraces)
 		api.GET("/logs", webService.GetLogs)
 		api.GET("/services", webService.GetServices)
-		api.POST("/query", webService.Query)
+		// POST /query is shared by the web UI, which sends JSON, and
+		// Prometheus clients, which send form-encoded parameters
+		api.POST("/query", func(c *gin.Context) {
+			if c.ContentType() == "application/json" {
+				webService.Query(c)
+				return
+			}
+			queryService.HandleInstantQuery(c)
+		})
 
 		// Query service routes
 		queryService.RegisterRoutes(api)
+		queryService.RegisterPrometheusRoutes(api)
 	}
 
 	// Admin API routes
@@ -146,6 +169,7 @@ func registerRoutes(router *gin.Engine, ingestionService *ingestion.Service, web
 		admin.GET("/config", webService.GetConfig)
 		admin.POST("/config", webService.SaveConfig)
 		admin.GET("/status", webService.GetSystemStatus)
+		admin.GET("/spool", ingestionService.GetSpoolStats)
 		admin.GET("/dogfood", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"enabled": dogfoodService.IsEnabled()})
 		})